@@ -11,7 +11,7 @@ use sysinfo::{MemoryRefreshKind, RefreshKind, System};
 ///
 /// - **absolute:** just use a non-negative number to specify the absolute bytes, e.g. `1024`
 /// - **relative:** use percentage between 0 and 100 (both inclusive) to specify a relative amount of the totally
-///   available memory size, e.g. `50%`
+///   available memory size, e.g. `50%`. In a container, this is relative to the memory limit of its cgroup.
 #[derive(Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
 pub struct MemorySize(usize);
 
@@ -58,19 +58,45 @@ impl FromStr for MemorySize {
     }
 }
 
-/// Totally available memory size in bytes.
-pub fn total_mem_bytes() -> usize {
+/// Memory of the machine, and the memory limit of the cgroup of the process.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct MemoryLimits {
+    /// Memory of the machine in bytes.
+    pub system_bytes: usize,
+    /// Memory limit of the cgroup of the process in bytes, if it has one.
+    pub cgroup_bytes: Option<usize>,
+}
+
+impl MemoryLimits {
+    /// Memory available to the process in bytes.
+    pub fn available_bytes(&self) -> usize {
+        self.cgroup_bytes
+            .map_or(self.system_bytes, |cgroup| cgroup.min(self.system_bytes))
+    }
+}
+
+/// Memory of the machine and cgroup limit of the process.
+pub fn memory_limits() -> MemoryLimits {
     // Keep this in a global state so that we only need to inspect the system once during IOx startup.
-    static TOTAL_MEM_BYTES: OnceLock<usize> = OnceLock::new();
+    static MEMORY_LIMITS: OnceLock<MemoryLimits> = OnceLock::new();
 
-    *TOTAL_MEM_BYTES.get_or_init(|| {
+    *MEMORY_LIMITS.get_or_init(|| {
         let sys = System::new_with_specifics(
             RefreshKind::new().with_memory(MemoryRefreshKind::everything()),
         );
-        sys.total_memory() as usize
+        MemoryLimits {
+            system_bytes: sys.total_memory() as usize,
+            cgroup_bytes: sys.cgroup_limits().map(|l| l.total_memory as usize),
+        }
     })
 }
 
+/// Totally available memory size in bytes, which is the memory limit of the
+/// cgroup of the process if it is lower than the memory of the machine.
+pub fn total_mem_bytes() -> usize {
+    memory_limits().available_bytes()
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -93,6 +119,17 @@ mod tests {
         );
     }
 
+    #[test]
+    fn test_available_bytes() {
+        let limits = |cgroup_bytes| MemoryLimits {
+            system_bytes: 1024,
+            cgroup_bytes,
+        };
+        assert_eq!(limits(None).available_bytes(), 1024);
+        assert_eq!(limits(Some(512)).available_bytes(), 512);
+        assert_eq!(limits(Some(usize::MAX)).available_bytes(), 1024);
+    }
+
     #[track_caller]
     fn assert_ok(s: &'static str, expected: usize) {
         let parsed: MemorySize = s.parse().unwrap();
@@ -0,0 +1,258 @@
+//! Inspection and validation of the configuration of the server.
+//!
+//! The server is configured by its defaults, the `.env` file, the environment
+//! and the command line, in increasing order of precedence. Settings given in
+//! the environment are easy to get wrong: a misspelt variable name is simply
+//! ignored. These commands show the configuration the server would run with,
+//! and report variables that the server would not pick up.
+
+use crate::commands::serve;
+use clap::parser::ValueSource;
+use clap::{Arg, CommandFactory};
+use std::collections::BTreeMap;
+use std::ffi::OsStr;
+use std::path::PathBuf;
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("invalid serve arguments: {0}")]
+    Arguments(#[from] clap::Error),
+
+    #[error("cannot read {path}: {source}")]
+    EnvFile {
+        path: PathBuf,
+        source: dotenvy::Error,
+    },
+
+    #[error("found {0} configuration problem(s)")]
+    Invalid(usize),
+}
+
+pub type Result<T, E = Error> = std::result::Result<T, E>;
+
+/// Print the configuration `influxdb3 serve` would run with.
+#[derive(Debug, clap::Parser)]
+pub struct PrintConfig {
+    /// Arguments that would be passed to `influxdb3 serve`.
+    #[clap(trailing_var_arg = true, allow_hyphen_values = true, action)]
+    serve_args: Vec<String>,
+}
+
+/// Check the environment, or an environment file, for settings of
+/// `influxdb3 serve` that are misspelt or have invalid values.
+#[derive(Debug, clap::Parser)]
+pub struct ValidateConfig {
+    /// Environment file to check, in the format of `.env`.
+    ///
+    /// If not specified, the environment of this process is checked.
+    #[clap(action)]
+    file: Option<PathBuf>,
+}
+
+/// Print each setting in the format of an environment file, noting where its
+/// value came from. Secrets are redacted.
+pub fn print_config(config: PrintConfig) -> Result<()> {
+    let command = serve::Config::command();
+    let matches = command
+        .clone()
+        .try_get_matches_from(std::iter::once("serve".to_string()).chain(config.serve_args))?;
+
+    for arg in settings(&command) {
+        let id = arg.get_id().as_str();
+        let name = arg
+            .get_env()
+            .map(|env| env.to_string_lossy().to_string())
+            .unwrap_or_else(|| format!("--{}", arg.get_long().unwrap_or(id)));
+        let source = match matches.value_source(id) {
+            Some(ValueSource::DefaultValue) => "default",
+            Some(ValueSource::EnvVariable) => "environment",
+            Some(ValueSource::CommandLine) => "command line",
+            Some(_) => "unknown",
+            None => {
+                println!("# {name} is not set");
+                continue;
+            }
+        };
+        let value = if is_secret(arg) {
+            "<redacted>".to_string()
+        } else {
+            matches
+                .get_raw(id)
+                .into_iter()
+                .flatten()
+                .map(|v| v.to_string_lossy())
+                .collect::<Vec<_>>()
+                .join(",")
+        };
+        println!("{name}={value} # {source}");
+    }
+
+    Ok(())
+}
+
+/// Report variables that look like settings of the server but are not, and
+/// settings whose value would be rejected at startup.
+pub fn validate_config(config: ValidateConfig) -> Result<()> {
+    let vars: Vec<(String, String)> = match &config.file {
+        Some(path) => dotenvy::from_path_iter(path)
+            .and_then(|iter| iter.collect())
+            .map_err(|source| Error::EnvFile {
+                path: path.clone(),
+                source,
+            })?,
+        None => std::env::vars().collect(),
+    };
+
+    let problems = problems(&serve::Config::command(), vars);
+    for problem in &problems {
+        println!("{problem}");
+    }
+    if !problems.is_empty() {
+        return Err(Error::Invalid(problems.len()));
+    }
+    println!("configuration is valid");
+    Ok(())
+}
+
+/// The problems with the variables `vars` as settings of `command`, one per
+/// variable.
+fn problems(command: &clap::Command, vars: Vec<(String, String)>) -> Vec<String> {
+    let known: BTreeMap<String, &Arg> = settings(command)
+        .filter_map(|arg| Some((arg.get_env()?.to_string_lossy().to_string(), arg)))
+        .collect();
+
+    let mut problems = vec![];
+    for (name, value) in vars {
+        if let Some(arg) = known.get(&name) {
+            let parser = arg.get_value_parser();
+            if let Err(e) = parser.parse_ref(command, Some(arg), OsStr::new(&value)) {
+                problems.push(format!("{name}: {} '{value}'", e.kind()));
+            }
+            continue;
+        }
+
+        let closest = known
+            .keys()
+            .map(|known| (edit_distance(&name, known), known))
+            .min();
+        match closest {
+            Some((distance, known)) if distance <= 2 => {
+                problems.push(format!("{name}: unknown setting, did you mean {known}?"));
+            }
+            _ if name.starts_with("INFLUXDB") => {
+                problems.push(format!("{name}: unknown setting"));
+            }
+            _ => {}
+        }
+    }
+    problems
+}
+
+/// The arguments of `influxdb3 serve` that hold settings.
+fn settings(command: &clap::Command) -> impl Iterator<Item = &Arg> {
+    command
+        .get_arguments()
+        .filter(|arg| !matches!(arg.get_id().as_str(), "help" | "version"))
+}
+
+fn is_secret(arg: &Arg) -> bool {
+    let name = arg.get_long().unwrap_or_default();
+    ["token", "secret", "password", "access-key"]
+        .iter()
+        .any(|s| name.contains(s))
+}
+
+/// The number of single character edits needed to turn `a` into `b`.
+fn edit_distance(a: &str, b: &str) -> usize {
+    let b: Vec<char> = b.chars().collect();
+    let mut row: Vec<usize> = (0..=b.len()).collect();
+    for (i, ca) in a.chars().enumerate() {
+        let mut previous = row[0];
+        row[0] = i + 1;
+        for (j, cb) in b.iter().enumerate() {
+            let substitution = previous + usize::from(ca != *cb);
+            previous = row[j + 1];
+            row[j + 1] = substitution.min(row[j] + 1).min(previous + 1);
+        }
+    }
+    row[b.len()]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn secrets() {
+        let command = serve::Config::command();
+        for (long, secret) in [
+            ("bearer-token", true),
+            ("replication-token", true),
+            ("aws-secret-access-key", true),
+            ("aws-access-key-id", true),
+            ("aws-session-token", true),
+            ("azure-storage-access-key", true),
+            ("signed-write-keys-file", false),
+            ("write-idempotency-max-keys", false),
+            ("http-bind", false),
+        ] {
+            let arg = settings(&command)
+                .find(|arg| arg.get_long() == Some(long))
+                .unwrap_or_else(|| panic!("no setting --{long}"));
+            assert_eq!(is_secret(arg), secret, "--{long}");
+        }
+    }
+
+    #[test]
+    fn edit_distances() {
+        for (a, b, distance) in [
+            ("", "", 0),
+            ("", "abc", 3),
+            ("abc", "", 3),
+            ("abc", "abc", 0),
+            ("abc", "abd", 1),
+            ("abc", "ab", 1),
+            ("ab", "abc", 1),
+            ("abc", "bac", 2),
+            ("kitten", "sitting", 3),
+            ("INFLUXDB3_HTTP_BIND", "INFLUXDB3_HTTP_BIND_ADDR", 5),
+            ("INFLUXDB3_HTP_BIND_ADDR", "INFLUXDB3_HTTP_BIND_ADDR", 1),
+            ("ünïcode", "unicode", 2),
+        ] {
+            assert_eq!(edit_distance(a, b), distance, "{a} -> {b}");
+            assert_eq!(edit_distance(b, a), distance, "{b} -> {a}");
+        }
+    }
+
+    #[test]
+    fn validation() {
+        let command = serve::Config::command();
+        for (name, value, problem) in [
+            ("INFLUXDB3_HTTP_BIND_ADDR", "127.0.0.1:8181", None),
+            ("INFLUXDB3_MAX_HTTP_REQUEST_SIZE", "1024", None),
+            ("HOME", "/root", None),
+            (
+                "INFLUXDB3_MAX_HTTP_REQUEST_SIZE",
+                "lots",
+                Some("INFLUXDB3_MAX_HTTP_REQUEST_SIZE: invalid value for one of the arguments 'lots'"),
+            ),
+            (
+                "INFLUXDB3_HTP_BIND_ADDR",
+                "127.0.0.1:8181",
+                Some("INFLUXDB3_HTP_BIND_ADDR: unknown setting, did you mean INFLUXDB3_HTTP_BIND_ADDR?"),
+            ),
+            (
+                "INFLUXDB3_NOT_A_SETTING",
+                "1",
+                Some("INFLUXDB3_NOT_A_SETTING: unknown setting"),
+            ),
+        ] {
+            assert_eq!(
+                problems(&command, vec![(name.to_string(), value.to_string())]),
+                problem.into_iter().collect::<Vec<_>>(),
+                "{name}={value}"
+            );
+        }
+    }
+}
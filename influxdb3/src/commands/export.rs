@@ -0,0 +1,100 @@
+use std::path::PathBuf;
+
+use clap::Parser;
+use secrecy::ExposeSecret;
+use tokio::{
+    fs::File,
+    io::{self, AsyncWriteExt},
+};
+
+use super::common::InfluxDb3Config;
+
+#[derive(Debug, thiserror::Error)]
+pub(crate) enum Error {
+    #[error(transparent)]
+    Client(#[from] influxdb3_client::Error),
+
+    #[error("error writing {path}: {source}")]
+    Io { path: PathBuf, source: io::Error },
+}
+
+pub(crate) type Result<T> = std::result::Result<T, Error>;
+
+#[derive(Debug, Parser)]
+pub struct Config {
+    #[clap(subcommand)]
+    cmd: SubCommand,
+}
+
+#[derive(Debug, Parser)]
+enum SubCommand {
+    /// Export a table as a Parquet file
+    ///
+    /// The file keeps the measurement, tag and field structure of the table
+    /// in its schema, so it can be written back with
+    /// `influxdb3 write --format parquet`.
+    Parquet(ParquetConfig),
+}
+
+#[derive(Debug, Parser)]
+struct ParquetConfig {
+    /// Common InfluxDB 3.0 config
+    #[clap(flatten)]
+    influxdb3_config: InfluxDb3Config,
+
+    /// The table to export
+    #[clap(short = 't', long = "table")]
+    table: String,
+
+    /// File to write the export to
+    ///
+    /// If not specified, the export is written to `<table>.parquet`.
+    #[clap(short = 'o', long = "output")]
+    output_file_path: Option<PathBuf>,
+}
+
+pub(crate) async fn command(config: Config) -> Result<()> {
+    match config.cmd {
+        SubCommand::Parquet(config) => export_parquet(config).await,
+    }
+}
+
+async fn export_parquet(config: ParquetConfig) -> Result<()> {
+    let InfluxDb3Config {
+        host_url,
+        database_name,
+        auth_token,
+    } = config.influxdb3_config;
+    let mut client = influxdb3_client::Client::new(host_url)?;
+    if let Some(t) = auth_token {
+        client = client.with_auth_token(t.expose_secret());
+    }
+
+    let path = config
+        .output_file_path
+        .unwrap_or_else(|| PathBuf::from(format!("{}.parquet", config.table)));
+    let io_error = |source| Error::Io {
+        path: path.clone(),
+        source,
+    };
+
+    let mut export = client
+        .api_v3_export(database_name, &config.table)
+        .send()
+        .await?;
+    let mut f = File::create(&path).await.map_err(io_error)?;
+    let mut bytes = 0;
+    while let Some(chunk) = export.chunk().await? {
+        f.write_all(&chunk).await.map_err(io_error)?;
+        bytes += chunk.len();
+    }
+    f.flush().await.map_err(io_error)?;
+
+    println!(
+        "exported {} to {} ({bytes} bytes)",
+        config.table,
+        path.display()
+    );
+
+    Ok(())
+}
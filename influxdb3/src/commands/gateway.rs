@@ -0,0 +1,106 @@
+//! Entrypoint for the InfluxDB 3.0 write gateway
+
+use crate::process_info::setup_metric_registry;
+use clap_blocks::socket_addr::SocketAddr;
+use influxdb3_server::gateway::GatewayConfig;
+use observability_deps::tracing::info;
+use secrecy::ExposeSecret;
+use std::path::PathBuf;
+use tokio_util::sync::CancellationToken;
+use trogging::cli::LoggingConfig;
+
+/// The default bind address for the gateway HTTP API.
+pub const DEFAULT_HTTP_BIND_ADDR: &str = "127.0.0.1:8182";
+
+pub(crate) type Result<T, E = influxdb3_server::gateway::Error> = std::result::Result<T, E>;
+
+#[derive(Debug, clap::Parser)]
+pub struct Config {
+    /// The address on which the gateway will accept writes
+    #[clap(
+        long = "http-bind",
+        env = "INFLUXDB3_GATEWAY_HTTP_BIND_ADDR",
+        default_value = DEFAULT_HTTP_BIND_ADDR,
+        action,
+    )]
+    pub http_bind_address: SocketAddr,
+
+    /// The URL of the InfluxDB 3.0 server writes are forwarded to
+    #[clap(long = "upstream", env = "INFLUXDB3_GATEWAY_UPSTREAM", action)]
+    pub upstream: String,
+
+    /// The token for authentication with the upstream server
+    #[clap(
+        long = "upstream-token",
+        env = "INFLUXDB3_GATEWAY_UPSTREAM_TOKEN",
+        action
+    )]
+    pub upstream_token: Option<secrecy::Secret<String>>,
+
+    /// The hex encoded SHA-256 hash of the bearer token clients of the
+    /// gateway must authenticate with
+    ///
+    /// Required, since writes to the gateway are forwarded with the upstream
+    /// token.
+    #[clap(long = "bearer-token", env = "INFLUXDB3_GATEWAY_BEARER_TOKEN", action)]
+    pub bearer_token: String,
+
+    /// The directory writes are spooled in until they are forwarded
+    #[clap(long = "spool-dir", env = "INFLUXDB3_GATEWAY_SPOOL_DIR", action)]
+    pub spool_dir: PathBuf,
+
+    /// Number of bytes the spool may hold before writes are refused with
+    /// `507 Insufficient Storage`
+    ///
+    /// If not specified, the spool is only limited by the free disk space.
+    #[clap(
+        long = "max-spool-bytes",
+        env = "INFLUXDB3_GATEWAY_MAX_SPOOL_BYTES",
+        action
+    )]
+    pub max_spool_bytes: Option<u64>,
+
+    /// Maximum size of HTTP requests.
+    #[clap(
+        long = "max-http-request-size",
+        env = "INFLUXDB3_GATEWAY_MAX_HTTP_REQUEST_SIZE",
+        default_value = "10485760", // 10 MiB
+        action,
+    )]
+    pub max_http_request_size: usize,
+
+    /// logging options
+    #[clap(flatten)]
+    pub(crate) logging_config: LoggingConfig,
+}
+
+pub async fn command(config: Config) -> Result<()> {
+    info!(
+        upstream = %config.upstream,
+        spool_dir = %config.spool_dir.display(),
+        "InfluxDB3 Edge gateway starting",
+    );
+
+    let gateway_config = GatewayConfig {
+        bind_addr: *config.http_bind_address,
+        upstream: config.upstream,
+        upstream_token: config.upstream_token.map(|t| t.expose_secret().to_string()),
+        bearer_token: hex::decode(config.bearer_token)?,
+        spool_dir: config.spool_dir,
+        max_spool_bytes: config.max_spool_bytes,
+        max_request_bytes: config.max_http_request_size,
+    };
+
+    let shutdown = CancellationToken::new();
+    let signal = tokio::spawn({
+        let shutdown = shutdown.clone();
+        async move {
+            influxdb3_server::wait_for_signal().await;
+            shutdown.cancel();
+        }
+    });
+    let result =
+        influxdb3_server::gateway::serve(gateway_config, setup_metric_registry(), shutdown).await;
+    signal.abort();
+    result
+}
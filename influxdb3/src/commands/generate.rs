@@ -0,0 +1,285 @@
+//! Synthetic data written to a running server, to size hardware or
+//! reproduce performance issues.
+//!
+//! The data is a number of rounds of one point per series, the timestamps of
+//! successive rounds `--interval` apart. Field values are derived from
+//! `--seed`, so two runs with the same settings and `--start-time` write the
+//! same points.
+
+use std::sync::Arc;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use clap::Parser;
+use secrecy::ExposeSecret;
+use tokio::task::JoinSet;
+
+use super::common::InfluxDb3Config;
+
+#[derive(Debug, thiserror::Error)]
+pub(crate) enum Error {
+    #[error(transparent)]
+    Client(#[from] influxdb3_client::Error),
+
+    #[error("--interval must be greater than zero")]
+    ZeroInterval,
+}
+
+pub(crate) type Result<T> = std::result::Result<T, Error>;
+
+#[derive(Debug, Parser)]
+pub struct Config {
+    /// Common InfluxDB 3.0 config
+    #[clap(flatten)]
+    influxdb3_config: InfluxDb3Config,
+
+    /// Measurement the points are written to
+    #[clap(long = "measurement", default_value = "generated")]
+    measurement: String,
+
+    /// Number of series, each with its own value of the `series` tag
+    #[clap(long = "series", default_value = "100")]
+    series: usize,
+
+    /// Number of fields of each point, named `f0`, `f1` and so on
+    #[clap(long = "fields", default_value = "1")]
+    fields: usize,
+
+    /// Type of the fields
+    #[clap(long = "field-type", value_enum, default_value = "float")]
+    field_type: FieldType,
+
+    /// Time range covered by the data, from `--start-time`
+    #[clap(long = "duration", value_parser = humantime::parse_duration, default_value = "1m")]
+    duration: Duration,
+
+    /// Time between the points of a series
+    #[clap(long = "interval", value_parser = humantime::parse_duration, default_value = "1s")]
+    interval: Duration,
+
+    /// Timestamp of the first round of points, in nanoseconds since the
+    /// epoch
+    ///
+    /// If not specified, the data ends at the current time.
+    #[clap(long = "start-time")]
+    start_time: Option<i64>,
+
+    /// Seed of the field values
+    #[clap(long = "seed", default_value = "0")]
+    seed: u64,
+
+    /// Maximum number of points written per second
+    ///
+    /// If not specified, points are written as fast as the server accepts
+    /// them.
+    #[clap(long = "rate")]
+    rate: Option<u64>,
+
+    /// Maximum number of lines sent in a single write request
+    #[clap(long = "batch-size", default_value = "5000")]
+    batch_size: usize,
+
+    /// Number of write requests sent concurrently
+    #[clap(long = "concurrency", default_value = "4")]
+    concurrency: usize,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+enum FieldType {
+    Float,
+    Integer,
+    String,
+    Boolean,
+}
+
+pub(crate) async fn command(config: Config) -> Result<()> {
+    let InfluxDb3Config {
+        host_url,
+        database_name,
+        auth_token,
+    } = config.influxdb3_config;
+    let mut client = influxdb3_client::Client::new(host_url)?;
+    if let Some(t) = auth_token {
+        client = client.with_auth_token(t.expose_secret());
+    }
+    let client = Arc::new(client);
+
+    if config.interval.is_zero() {
+        return Err(Error::ZeroInterval);
+    }
+    let interval = config.interval.as_nanos() as i64;
+    let rounds = (config.duration.as_nanos() / config.interval.as_nanos()).max(1) as u64;
+    let start_time = config.start_time.unwrap_or_else(|| {
+        let now = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .expect("system time is after the epoch")
+            .as_nanos() as i64;
+        now - (rounds as i64 - 1) * interval
+    });
+    let generator = Generator {
+        measurement: config.measurement,
+        fields: config.fields.max(1),
+        field_type: config.field_type,
+        seed: config.seed,
+    };
+
+    let batch_size = config.batch_size.max(1);
+    let concurrency = config.concurrency.max(1);
+    let started = Instant::now();
+    let mut requests = JoinSet::new();
+    let mut batch = String::new();
+    let mut batch_lines = 0;
+    let mut points: u64 = 0;
+    for round in 0..rounds {
+        let timestamp = start_time + round as i64 * interval;
+        for series in 0..config.series {
+            generator.line(round, series, timestamp, &mut batch);
+            batch_lines += 1;
+            points += 1;
+            if batch_lines < batch_size {
+                continue;
+            }
+
+            while requests.len() >= concurrency {
+                requests
+                    .join_next()
+                    .await
+                    .expect("requests are running")
+                    .expect("write request panicked")?;
+            }
+            let client = Arc::clone(&client);
+            let db = database_name.clone();
+            let body = std::mem::take(&mut batch);
+            batch_lines = 0;
+            requests.spawn(async move { client.api_v3_write_lp(db).body(body).send().await });
+
+            if let Some(rate) = config.rate.filter(|r| *r > 0) {
+                let due = Duration::from_secs_f64(points as f64 / rate as f64);
+                tokio::time::sleep(due.saturating_sub(started.elapsed())).await;
+            }
+        }
+    }
+    if !batch.is_empty() {
+        client
+            .api_v3_write_lp(database_name.as_str())
+            .body(batch)
+            .send()
+            .await?;
+    }
+    while let Some(result) = requests.join_next().await {
+        result.expect("write request panicked")?;
+    }
+
+    let elapsed = started.elapsed();
+    println!(
+        "wrote {points} points of {} series in {:.2}s ({:.0} points/s)",
+        config.series,
+        elapsed.as_secs_f64(),
+        points as f64 / elapsed.as_secs_f64()
+    );
+    Ok(())
+}
+
+/// Generates the lines of the points.
+#[derive(Debug)]
+struct Generator {
+    measurement: String,
+    fields: usize,
+    field_type: FieldType,
+    seed: u64,
+}
+
+impl Generator {
+    /// Append the line of the point of `series` in `round` to `out`.
+    fn line(&self, round: u64, series: usize, timestamp: i64, out: &mut String) {
+        use std::fmt::Write;
+
+        write!(out, "{},series=s{series}", self.measurement).expect("writing to a string");
+        for field in 0..self.fields {
+            let separator = if field == 0 { ' ' } else { ',' };
+            let x = splitmix64(
+                self.seed ^ round.rotate_left(32) ^ ((series as u64) << 16) ^ field as u64,
+            );
+            match self.field_type {
+                FieldType::Float => write!(
+                    out,
+                    "{separator}f{field}={}",
+                    (x >> 11) as f64 / (1u64 << 53) as f64 * 100.0
+                ),
+                FieldType::Integer => write!(out, "{separator}f{field}={}i", x % 1000),
+                FieldType::String => write!(out, "{separator}f{field}=\"v{}\"", x % 100),
+                FieldType::Boolean => write!(out, "{separator}f{field}={}", x & 1 == 1),
+            }
+            .expect("writing to a string");
+        }
+        writeln!(out, " {timestamp}").expect("writing to a string");
+    }
+}
+
+/// A well-mixed function of `x`, from the SplitMix64 generator.
+fn splitmix64(x: u64) -> u64 {
+    let mut z = x.wrapping_add(0x9e37_79b9_7f4a_7c15);
+    z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+    z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+    z ^ (z >> 31)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn splitmix64_outputs() {
+        // the outputs of the reference generator seeded with 0
+        for (x, expected) in [
+            (0, 0xe220_a839_7b1d_cdaf),
+            (0x9e37_79b9_7f4a_7c15, 0x6e78_9e6a_a1b9_65f4),
+            (0x3c6e_f372_fe94_f82a, 0x06c4_5d18_8009_454f),
+        ] {
+            assert_eq!(splitmix64(x), expected, "{x:#x}");
+        }
+    }
+
+    #[test]
+    fn lines() {
+        for (field_type, fields) in [
+            (
+                FieldType::Float,
+                "f0=27.955341672324664,f1=72.73677241633045",
+            ),
+            (FieldType::Integer, "f0=447i,f1=309i"),
+            (FieldType::String, r#"f0="v47",f1="v9""#),
+            (FieldType::Boolean, "f0=true,f1=true"),
+        ] {
+            let generator = Generator {
+                measurement: "generated".to_string(),
+                fields: 2,
+                field_type,
+                seed: 0,
+            };
+            let mut out = String::new();
+            generator.line(1, 2, 1000, &mut out);
+            assert_eq!(out, format!("generated,series=s2 {fields} 1000\n"));
+        }
+    }
+
+    #[test]
+    fn lines_depend_on_the_seed_round_and_series() {
+        let generator = |seed| Generator {
+            measurement: "m".to_string(),
+            fields: 1,
+            field_type: FieldType::Integer,
+            seed,
+        };
+        let line = |generator: &Generator, round, series| {
+            let mut out = String::new();
+            generator.line(round, series, 0, &mut out);
+            out
+        };
+
+        let a = generator(1);
+        assert_eq!(line(&a, 3, 4), line(&generator(1), 3, 4));
+        assert_ne!(line(&a, 3, 4), line(&generator(2), 3, 4));
+        assert_ne!(line(&a, 3, 4), line(&a, 4, 4));
+        assert_ne!(line(&a, 3, 4), line(&a, 3, 5));
+    }
+}
@@ -1,3 +1,4 @@
+use std::num::NonZeroUsize;
 use std::str::Utf8Error;
 
 use clap::{Parser, ValueEnum};
@@ -28,6 +29,18 @@ pub(crate) enum Error {
         the output as `parquet`"
     )]
     NoOutputFileForParquet,
+
+    #[error(
+        "must specify a template with `--template` parameter when formatting \
+        the output as `template`"
+    )]
+    NoTemplate,
+
+    #[error("invalid JSON received from server: {0}")]
+    Json(#[from] serde_json::Error),
+
+    #[error("invalid template, unmatched '{0}'")]
+    InvalidTemplate(char),
 }
 
 pub type Result<T> = std::result::Result<T, Error>;
@@ -51,10 +64,27 @@ pub struct Config {
     /// The format in which to output the query
     ///
     /// If `--fmt` is set to `parquet`, then you must also specify an output
-    /// file path with `--output`.
-    #[clap(value_enum, long = "fmt", default_value = "pretty")]
+    /// file path with `--output`. If it is set to `template`, then you must
+    /// also specify the template with `--template`.
+    #[clap(value_enum, long = "fmt", alias = "format", default_value = "pretty")]
     output_format: Format,
 
+    /// Template each row of the result is printed with, for `--fmt template`
+    ///
+    /// `{column}` is replaced by the value of `column` in the row, or nothing
+    /// if the value is null. `{{` and `}}` print `{` and `}`. For example:
+    /// `--template '{host}: {usage_user}%'`
+    #[clap(long = "template")]
+    template: Option<String>,
+
+    /// Maximum number of partitions the server executes the query in
+    /// concurrently
+    ///
+    /// If not specified, or larger than the server's limit, the server's limit
+    /// is used.
+    #[clap(long = "parallelism")]
+    parallelism: Option<NonZeroUsize>,
+
     /// Put all query output into `output`
     #[clap(short = 'o', long = "output")]
     output_file_path: Option<String>,
@@ -66,10 +96,16 @@ pub struct Config {
 #[derive(Debug, ValueEnum, Clone)]
 #[clap(rename_all = "snake_case")]
 enum Format {
+    /// A table, for reading in a terminal
+    #[value(alias = "table")]
     Pretty,
+    /// A JSON array with an object per row, keyed by column name, with null
+    /// values omitted
     Json,
     Csv,
     Parquet,
+    /// Each row printed with the template given with `--template`
+    Template,
 }
 
 impl Format {
@@ -85,6 +121,8 @@ impl From<Format> for influxdb3_client::Format {
             Format::Json => Self::Json,
             Format::Csv => Self::Csv,
             Format::Parquet => Self::Parquet,
+            // rows are rendered from their JSON representation
+            Format::Template => Self::Json,
         }
     }
 }
@@ -106,18 +144,35 @@ pub(crate) async fn command(config: Config) -> Result<()> {
     }
 
     let query = parse_query(config.query)?;
+    let template = match (&config.output_format, config.template) {
+        (Format::Template, None) => return Err(Error::NoTemplate),
+        (Format::Template, Some(template)) => Some(Template::parse(&template)?),
+        _ => None,
+    };
 
     // make the query using the client
     let mut resp_bytes = match config.language {
         QueryLanguage::Sql => {
-            client
+            let mut req = client
                 .api_v3_query_sql(database_name, query)
-                .format(config.output_format.clone().into())
-                .send()
-                .await?
+                .format(config.output_format.clone().into());
+            if let Some(parallelism) = config.parallelism {
+                req = req.parallelism(parallelism);
+            }
+            req.send().await?
         }
     };
 
+    if let Some(template) = template {
+        let rows: Vec<serde_json::Map<String, serde_json::Value>> =
+            serde_json::from_slice(&resp_bytes)?;
+        resp_bytes = rows
+            .iter()
+            .map(|row| template.render(row))
+            .collect::<String>()
+            .into();
+    }
+
     // write to file if output path specified
     if let Some(path) = &config.output_file_path {
         let mut f = OpenOptions::new()
@@ -130,7 +185,10 @@ pub(crate) async fn command(config: Config) -> Result<()> {
         if config.output_format.is_parquet() {
             Err(Error::NoOutputFileForParquet)?
         }
-        println!("{}", std::str::from_utf8(&resp_bytes)?);
+        print!("{}", std::str::from_utf8(&resp_bytes)?);
+        if !resp_bytes.ends_with(b"\n") {
+            println!();
+        }
     }
 
     Ok(())
@@ -159,3 +217,63 @@ fn parse_query(mut input: Vec<String>) -> Result<String> {
         Ok(input.remove(0))
     }
 }
+
+/// A template for printing the rows of a query result.
+#[derive(Debug)]
+struct Template(Vec<Part>);
+
+#[derive(Debug)]
+enum Part {
+    Text(String),
+    Column(String),
+}
+
+impl Template {
+    fn parse(template: &str) -> Result<Self> {
+        let mut parts = Vec::new();
+        let mut text = String::new();
+        let mut chars = template.chars();
+        while let Some(c) = chars.next() {
+            match c {
+                '{' if chars.as_str().starts_with('{') => {
+                    chars.next();
+                    text.push('{');
+                }
+                '}' if chars.as_str().starts_with('}') => {
+                    chars.next();
+                    text.push('}');
+                }
+                '{' => {
+                    let (column, rest) = chars
+                        .as_str()
+                        .split_once('}')
+                        .ok_or(Error::InvalidTemplate('{'))?;
+                    parts.push(Part::Text(std::mem::take(&mut text)));
+                    parts.push(Part::Column(column.trim().to_string()));
+                    chars = rest.chars();
+                }
+                '}' => return Err(Error::InvalidTemplate('}')),
+                c => text.push(c),
+            }
+        }
+        parts.push(Part::Text(text));
+        Ok(Self(parts))
+    }
+
+    /// The row rendered with the template, followed by a newline.
+    fn render(&self, row: &serde_json::Map<String, serde_json::Value>) -> String {
+        let mut out = String::new();
+        for part in &self.0 {
+            match part {
+                Part::Text(text) => out.push_str(text),
+                Part::Column(column) => match row.get(column) {
+                    Some(serde_json::Value::String(s)) => out.push_str(s),
+                    Some(serde_json::Value::Null) | None => {}
+                    Some(value) => out.push_str(&value.to_string()),
+                },
+            }
+        }
+        out.push('\n');
+        out
+    }
+}
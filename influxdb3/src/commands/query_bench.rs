@@ -0,0 +1,250 @@
+//! A benchmark of a suite of queries against a running server.
+//!
+//! Each query of the suite is run a number of times, and the latencies of
+//! the runs are reported as JSON, so that the reports of two runs of the same
+//! suite, such as before and after an upgrade, can be compared.
+
+use std::num::NonZeroUsize;
+use std::path::PathBuf;
+use std::time::{Duration, Instant};
+
+use clap::Parser;
+use secrecy::ExposeSecret;
+use serde::Serialize;
+use tokio::io;
+
+use super::common::InfluxDb3Config;
+
+#[derive(Debug, thiserror::Error)]
+pub(crate) enum Error {
+    #[error(transparent)]
+    Client(#[from] influxdb3_client::Error),
+
+    #[error("error reading {path}: {source}")]
+    Read { path: PathBuf, source: io::Error },
+
+    #[error("error writing report: {0}")]
+    Write(#[from] io::Error),
+
+    #[error("no queries in {0}")]
+    NoQueries(PathBuf),
+
+    #[error("error encoding report: {0}")]
+    Json(#[from] serde_json::Error),
+}
+
+pub(crate) type Result<T> = std::result::Result<T, Error>;
+
+#[derive(Debug, Parser)]
+pub struct Config {
+    /// Common InfluxDB 3.0 config
+    #[clap(flatten)]
+    influxdb3_config: InfluxDb3Config,
+
+    /// File of the SQL queries run, one per line
+    ///
+    /// Blank lines and lines starting with `#` are ignored.
+    #[clap(short = 'f', long = "file")]
+    file_path: PathBuf,
+
+    /// Number of timed runs of each query
+    #[clap(long = "iterations", default_value = "10")]
+    iterations: NonZeroUsize,
+
+    /// Number of runs of each query before the timed runs
+    #[clap(long = "warmup", default_value = "1")]
+    warmup: usize,
+
+    /// Maximum number of partitions the server executes each query in
+    /// concurrently
+    #[clap(long = "parallelism")]
+    parallelism: Option<NonZeroUsize>,
+
+    /// File the report is written to
+    ///
+    /// If not specified, the report is printed.
+    #[clap(short = 'o', long = "output")]
+    output_file_path: Option<PathBuf>,
+}
+
+/// The results of a run of the suite.
+#[derive(Debug, Serialize)]
+struct Report {
+    queries: Vec<QueryReport>,
+}
+
+/// The results of the runs of a query.
+#[derive(Debug, Serialize)]
+struct QueryReport {
+    query: String,
+    /// Number of timed runs that succeeded
+    iterations: usize,
+    /// Number of rows in the result
+    #[serde(skip_serializing_if = "Option::is_none")]
+    rows: Option<usize>,
+    /// Size of the response, in bytes
+    #[serde(skip_serializing_if = "Option::is_none")]
+    response_bytes: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    latency_ms: Option<Latency>,
+    /// The error of the first run that failed, after which the query is not
+    /// run again
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
+}
+
+/// Latencies of the runs of a query, in milliseconds.
+#[derive(Debug, Serialize)]
+struct Latency {
+    min: f64,
+    mean: f64,
+    p50: f64,
+    p90: f64,
+    p99: f64,
+    max: f64,
+}
+
+pub(crate) async fn command(config: Config) -> Result<()> {
+    let InfluxDb3Config {
+        host_url,
+        database_name,
+        auth_token,
+    } = config.influxdb3_config;
+    let mut client = influxdb3_client::Client::new(host_url)?;
+    if let Some(t) = auth_token {
+        client = client.with_auth_token(t.expose_secret());
+    }
+
+    let contents = tokio::fs::read_to_string(&config.file_path)
+        .await
+        .map_err(|source| Error::Read {
+            path: config.file_path.clone(),
+            source,
+        })?;
+    let queries: Vec<&str> = contents
+        .lines()
+        .map(str::trim)
+        .filter(|l| !l.is_empty() && !l.starts_with('#'))
+        .collect();
+    if queries.is_empty() {
+        return Err(Error::NoQueries(config.file_path));
+    }
+
+    let mut report = Report { queries: vec![] };
+    for query in queries {
+        let run = || {
+            let mut req = client
+                .api_v3_query_sql(database_name.as_str(), query)
+                .format(influxdb3_client::Format::Json);
+            if let Some(parallelism) = config.parallelism {
+                req = req.parallelism(parallelism);
+            }
+            req.send()
+        };
+
+        let mut query_report = QueryReport {
+            query: query.to_string(),
+            iterations: 0,
+            rows: None,
+            response_bytes: None,
+            latency_ms: None,
+            error: None,
+        };
+        let mut latencies = Vec::with_capacity(config.iterations.get());
+        for i in 0..config.warmup + config.iterations.get() {
+            let started = Instant::now();
+            let response = match run().await {
+                Ok(response) => response,
+                Err(e) => {
+                    query_report.error = Some(e.to_string());
+                    break;
+                }
+            };
+            if i < config.warmup {
+                continue;
+            }
+            latencies.push(started.elapsed());
+            if query_report.response_bytes.is_none() {
+                query_report.response_bytes = Some(response.len());
+                query_report.rows = serde_json::from_slice::<Vec<serde_json::Value>>(&response)
+                    .ok()
+                    .map(|rows| rows.len());
+            }
+        }
+        query_report.iterations = latencies.len();
+        query_report.latency_ms = Latency::new(latencies);
+        eprintln!(
+            "{}: {}",
+            query,
+            match (&query_report.latency_ms, &query_report.error) {
+                (_, Some(e)) => format!("failed: {e}"),
+                (Some(latency), None) => format!("p50 {:.2}ms", latency.p50),
+                (None, None) => "no runs".to_string(),
+            }
+        );
+        report.queries.push(query_report);
+    }
+
+    let json = serde_json::to_string_pretty(&report)?;
+    match config.output_file_path {
+        Some(path) => tokio::fs::write(path, json).await?,
+        None => println!("{json}"),
+    }
+    Ok(())
+}
+
+impl Latency {
+    fn new(mut latencies: Vec<Duration>) -> Option<Self> {
+        if latencies.is_empty() {
+            return None;
+        }
+        latencies.sort();
+        let ms = |d: Duration| d.as_secs_f64() * 1000.0;
+        // nearest-rank percentile
+        let percentile = |p: f64| {
+            let rank = (p / 100.0 * latencies.len() as f64).ceil() as usize;
+            ms(latencies[rank.clamp(1, latencies.len()) - 1])
+        };
+        Some(Self {
+            min: ms(latencies[0]),
+            mean: ms(latencies.iter().sum::<Duration>()) / latencies.len() as f64,
+            p50: percentile(50.0),
+            p90: percentile(90.0),
+            p99: percentile(99.0),
+            max: ms(latencies[latencies.len() - 1]),
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn latency() {
+        let ms = |ms: &[u64]| -> Vec<Duration> {
+            ms.iter().map(|ms| Duration::from_millis(*ms)).collect()
+        };
+        for (latencies, expected) in [
+            (ms(&[]), None),
+            (ms(&[7]), Some([7.0, 7.0, 7.0, 7.0, 7.0, 7.0])),
+            (
+                ms(&[10, 2, 9, 4, 5, 6, 7, 8, 3, 1]),
+                Some([1.0, 5.5, 5.0, 9.0, 10.0, 10.0]),
+            ),
+            (ms(&[1, 100]), Some([1.0, 50.5, 1.0, 100.0, 100.0, 100.0])),
+        ] {
+            let actual =
+                Latency::new(latencies).map(|l| [l.min, l.mean, l.p50, l.p90, l.p99, l.max]);
+            match (actual, expected) {
+                (None, None) => {}
+                (Some(actual), Some(expected)) => {
+                    for (a, e) in actual.iter().zip(expected) {
+                        assert!((a - e).abs() < 1e-9, "{actual:?} != {expected:?}");
+                    }
+                }
+                (actual, expected) => panic!("{actual:?} != {expected:?}"),
+            }
+        }
+    }
+}
@@ -3,16 +3,37 @@
 use crate::process_info;
 use crate::process_info::setup_metric_registry;
 use clap_blocks::{
-    memory_size::MemorySize,
+    memory_size::{self, MemorySize},
     object_store::{make_object_store, ObjectStoreConfig},
     socket_addr::SocketAddr,
 };
-use influxdb3_server::{query_executor::QueryExecutorImpl, serve, CommonServerState, Server};
+use influxdb3_server::{
+    compression::ResponseCompression,
+    database_metrics::DatabaseMetricsConfig,
+    dead_letter::DeadLetterDatabase,
+    default_tags::{DefaultTag, DefaultTags},
+    health::HealthThresholds,
+    idempotency::IdempotencyCache,
+    load_shedding::LoadSheddingConfig,
+    precision::Precision,
+    query_executor::QueryExecutorImpl,
+    read_only::ReadOnly,
+    replication::{ReplicationMode, Replicator},
+    resources::Resources,
+    sampling::SamplingRules,
+    self_monitoring, serve,
+    signed_writes::SigningKeys,
+    time_bounds::TimeBounds,
+    udp::{UdpConfig, UdpListener},
+    write_rules::WriteRules,
+    CommonServerState, HttpServerConfig, Server,
+};
 use influxdb3_write::persister::PersisterImpl;
 use influxdb3_write::wal::WalImpl;
 use influxdb3_write::write_buffer::WriteBufferImpl;
 use influxdb3_write::SegmentId;
 use iox_query::exec::{Executor, ExecutorConfig};
+use iox_time::SystemProvider;
 use ioxd_common::reexport::trace_http::ctx::TraceHeaderParser;
 use object_store::DynObjectStore;
 use observability_deps::tracing::*;
@@ -23,11 +44,13 @@ use std::{
     num::NonZeroUsize,
     path::{Path, PathBuf},
     sync::Arc,
+    time::Duration,
 };
 use thiserror::Error;
 use tokio_util::sync::CancellationToken;
 use trace_exporters::TracingConfig;
 use trogging::cli::LoggingConfig;
+use trogging::LogFilterHandle;
 
 /// The default name of the influxdb_iox data directory
 #[allow(dead_code)]
@@ -36,6 +59,10 @@ pub const DEFAULT_DATA_DIRECTORY_NAME: &str = ".influxdb3";
 /// The default bind address for the HTTP API.
 pub const DEFAULT_HTTP_BIND_ADDR: &str = "127.0.0.1:8181";
 
+/// The largest default size of the query execution memory pool, which is
+/// otherwise half of the available memory.
+const DEFAULT_MAX_EXEC_MEM_POOL_BYTES: usize = 8 * 1024 * 1024 * 1024;
+
 #[derive(Debug, Error)]
 pub enum Error {
     #[error("Cannot parse object store config: {0}")]
@@ -52,6 +79,21 @@ pub enum Error {
 
     #[error("Write buffer error: {0}")]
     WriteBuffer(#[from] influxdb3_write::write_buffer::Error),
+
+    #[error("Replication error: {0}")]
+    Replication(#[from] influxdb3_server::replication::Error),
+
+    #[error("UDP listener error: {0}")]
+    Udp(#[from] influxdb3_server::udp::Error),
+
+    #[error("Write rules error: {0}")]
+    WriteRules(#[from] influxdb3_server::write_rules::Error),
+
+    #[error("Sampling rules error: {0}")]
+    SamplingRules(#[from] influxdb3_server::sampling::Error),
+
+    #[error("Signing keys error: {0}")]
+    SigningKeys(#[from] influxdb3_server::signed_writes::Error),
 }
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
@@ -85,6 +127,304 @@ pub struct Config {
     )]
     pub http_bind_address: SocketAddr,
 
+    /// Maximum number of connections the HTTP server serves at once.
+    ///
+    /// Connections beyond the limit are answered with `503 Service Unavailable`
+    /// and closed. If not specified, the number of connections is unlimited.
+    #[clap(
+        long = "http-max-connections",
+        env = "INFLUXDB3_HTTP_MAX_CONNECTIONS",
+        action
+    )]
+    pub http_max_connections: Option<usize>,
+
+    /// Time allowed for a client to send the headers of a request.
+    #[clap(
+        long = "http-header-read-timeout",
+        env = "INFLUXDB3_HTTP_HEADER_READ_TIMEOUT",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub http_header_read_timeout: Option<Duration>,
+
+    /// Time after which an idle connection is closed.
+    ///
+    /// A connection is idle while no request is being handled on it and
+    /// nothing is received or sent. If not specified, idle connections are
+    /// kept open until the client closes them.
+    #[clap(
+        long = "http-idle-timeout",
+        env = "INFLUXDB3_HTTP_IDLE_TIMEOUT",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub http_idle_timeout: Option<Duration>,
+
+    /// Time allowed for the server to handle a request.
+    ///
+    /// Applies to every endpoint unless overridden with
+    /// `--http-write-timeout` or `--http-query-timeout`.
+    #[clap(
+        long = "http-request-timeout",
+        env = "INFLUXDB3_HTTP_REQUEST_TIMEOUT",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub http_request_timeout: Option<Duration>,
+
+    /// Time allowed for the server to handle a write request.
+    #[clap(
+        long = "http-write-timeout",
+        env = "INFLUXDB3_HTTP_WRITE_TIMEOUT",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub http_write_timeout: Option<Duration>,
+
+    /// Time allowed for the server to handle a query request.
+    #[clap(
+        long = "http-query-timeout",
+        env = "INFLUXDB3_HTTP_QUERY_TIMEOUT",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub http_query_timeout: Option<Duration>,
+
+    /// Keep HTTP/1 connections open between requests.
+    #[clap(
+        long = "http-enable-keepalive",
+        env = "INFLUXDB3_HTTP_ENABLE_KEEPALIVE",
+        default_value = "true",
+        action
+    )]
+    pub http_enable_keepalive: bool,
+
+    /// Interval of the TCP keepalive probes sent on idle connections.
+    ///
+    /// If not specified, TCP keepalive is disabled.
+    #[clap(
+        long = "http-tcp-keepalive",
+        env = "INFLUXDB3_HTTP_TCP_KEEPALIVE",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub http_tcp_keepalive: Option<Duration>,
+
+    /// Maximum size of the headers of a request, in bytes.
+    ///
+    /// Values below 8192 are raised to 8192.
+    #[clap(
+        long = "http-max-header-size",
+        env = "INFLUXDB3_HTTP_MAX_HEADER_SIZE",
+        action
+    )]
+    pub http_max_header_size: Option<usize>,
+
+    /// Allow clients to use HTTP/2.
+    #[clap(
+        long = "http-enable-http2",
+        env = "INFLUXDB3_HTTP_ENABLE_HTTP2",
+        default_value = "true",
+        action
+    )]
+    pub http_enable_http2: bool,
+
+    /// Start the server in read-only mode, in which writes are refused while
+    /// queries are served.
+    ///
+    /// Read-only mode can be switched at runtime with
+    /// `PUT /api/v3/config/read_only`.
+    #[clap(long = "read-only", env = "INFLUXDB3_READ_ONLY", action)]
+    pub read_only: bool,
+
+    /// Path of a unix socket on which to additionally serve the HTTP API.
+    ///
+    /// Lets co-located clients reach the server without TCP. Access to the
+    /// socket is governed by its file permissions, see
+    /// `--http-unix-socket-permissions`.
+    #[clap(
+        long = "http-unix-socket-path",
+        env = "INFLUXDB3_HTTP_UNIX_SOCKET_PATH",
+        action
+    )]
+    pub http_unix_socket_path: Option<PathBuf>,
+
+    /// File permissions of the unix socket, in octal.
+    #[clap(
+        long = "http-unix-socket-permissions",
+        env = "INFLUXDB3_HTTP_UNIX_SOCKET_PERMISSIONS",
+        default_value = "660",
+        value_parser = parse_file_permissions,
+        action
+    )]
+    pub http_unix_socket_permissions: u32,
+
+    /// Bind the HTTP address with `SO_REUSEPORT`, so that a new server process
+    /// can bind it before this one exits, for an upgrade without downtime.
+    ///
+    /// When the server is started by systemd socket activation, the socket
+    /// passed by systemd is used instead.
+    #[clap(long = "http-reuse-port", env = "INFLUXDB3_HTTP_REUSE_PORT", action)]
+    pub http_reuse_port: bool,
+
+    /// Time the requests in flight when the server receives SIGTERM or
+    /// SIGINT have to complete before they are abandoned.
+    ///
+    /// New connections are refused as soon as the signal is received.
+    #[clap(
+        long = "shutdown-timeout",
+        env = "INFLUXDB3_SHUTDOWN_TIMEOUT",
+        default_value = "30s",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub shutdown_timeout: Duration,
+
+    /// Fraction of the write queue, between 0 and 1, that may be in use before
+    /// `/ready` reports that the server is not ready.
+    #[clap(
+        long = "health-write-queue-fail-ratio",
+        env = "INFLUXDB3_HEALTH_WRITE_QUEUE_FAIL_RATIO",
+        default_value = "0.9",
+        value_parser = parse_ratio,
+        action
+    )]
+    pub health_write_queue_fail_ratio: f64,
+
+    /// Number of rows the open buffer segment may hold before `/ready` reports
+    /// that the server is not ready.
+    #[clap(
+        long = "health-open-segment-max-rows",
+        env = "INFLUXDB3_HEALTH_OPEN_SEGMENT_MAX_ROWS",
+        action
+    )]
+    pub health_open_segment_max_rows: Option<usize>,
+
+    /// File of settings to apply when the server receives `SIGHUP` or a
+    /// request to `/api/v3/config/reload`.
+    ///
+    /// Each line sets one of `LOG_FILTER`, `INFLUXDB3_HTTP_REQUEST_TIMEOUT`,
+    /// `INFLUXDB3_HTTP_WRITE_TIMEOUT`, `INFLUXDB3_HTTP_QUERY_TIMEOUT`,
+    /// `INFLUXDB3_HEALTH_WRITE_QUEUE_FAIL_RATIO` or
+    /// `INFLUXDB3_HEALTH_OPEN_SEGMENT_MAX_ROWS` as `NAME=VALUE`, overriding the
+    /// value the server was started with.
+    #[clap(
+        long = "config-reload-file",
+        env = "INFLUXDB3_CONFIG_RELOAD_FILE",
+        action
+    )]
+    pub config_reload_file: Option<PathBuf>,
+
+    /// How far in the future the timestamp of a written line may be.
+    ///
+    /// Writes with lines beyond it are rejected, or with `accept_partial=true`
+    /// written without those lines. If not specified, there is no limit.
+    #[clap(
+        long = "write-max-future",
+        env = "INFLUXDB3_WRITE_MAX_FUTURE",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub write_max_future: Option<Duration>,
+
+    /// How far in the past the timestamp of a written line may be.
+    ///
+    /// Writes with lines beyond it are rejected, or with `accept_partial=true`
+    /// written without those lines. If not specified, there is no limit.
+    #[clap(
+        long = "write-max-past",
+        env = "INFLUXDB3_WRITE_MAX_PAST",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub write_max_past: Option<Duration>,
+
+    /// Tags added to every point written to a database, as
+    /// `<database>:<tag>=<value>`.
+    ///
+    /// A point that sets one of the tags itself has its value replaced. May be
+    /// given several times, or as a comma separated list.
+    #[clap(
+        long = "default-tag",
+        env = "INFLUXDB3_DEFAULT_TAGS",
+        value_delimiter = ',',
+        action
+    )]
+    pub default_tags: Vec<DefaultTag>,
+
+    /// JSON file of the transformations applied to the lines written to each
+    /// database: renaming tags, dropping fields, scaling fields and extracting
+    /// tags from string fields.
+    ///
+    /// Rules are applied before the default tags are added.
+    #[clap(long = "write-rules-file", env = "INFLUXDB3_WRITE_RULES_FILE", action)]
+    pub write_rules_file: Option<PathBuf>,
+
+    /// JSON file of the rules dropping some of the points written to each
+    /// database: keeping one in every N points of a measurement, or a point
+    /// of each series every interval.
+    ///
+    /// Dropped points are counted in the `influxdb3_sampling_dropped_points`
+    /// metric.
+    #[clap(
+        long = "sampling-rules-file",
+        env = "INFLUXDB3_SAMPLING_RULES_FILE",
+        action
+    )]
+    pub sampling_rules_file: Option<PathBuf>,
+
+    /// Database the lines dropped from writes made with `accept_partial=true`
+    /// are written to, along with the reason they were dropped.
+    ///
+    /// If not specified, dropped lines are only listed in the write response.
+    #[clap(
+        long = "dead-letter-database",
+        env = "INFLUXDB3_DEAD_LETTER_DATABASE",
+        action
+    )]
+    pub dead_letter_database: Option<DeadLetterDatabase>,
+
+    /// Report the points, bytes and dropped points written to each measurement
+    /// on `/metrics`, for up to this many measurements.
+    ///
+    /// The measurements with the most points written recently, chosen every
+    /// minute, are reported on their own and the others together, as
+    /// `_other`. If not specified, ingest metrics by measurement are not
+    /// reported.
+    #[clap(
+        long = "ingest-metrics-max-measurements",
+        env = "INFLUXDB3_INGEST_METRICS_MAX_MEASUREMENTS",
+        action
+    )]
+    pub ingest_metrics_max_measurements: Option<usize>,
+
+    /// Report the write requests and bytes, and the queries and their
+    /// duration, of each database on `/metrics`, for up to this many
+    /// databases, those with the most requests recently.
+    ///
+    /// The other databases, or those not in
+    /// `--database-metrics-allow-list`, are reported together, as `_other`.
+    /// If not specified, metrics by database are not reported.
+    #[clap(
+        long = "database-metrics-max-databases",
+        env = "INFLUXDB3_DATABASE_METRICS_MAX_DATABASES",
+        action
+    )]
+    pub database_metrics_max_databases: Option<usize>,
+
+    /// The databases reported on their own in the metrics by database.
+    ///
+    /// If not specified, any database may be, up to
+    /// `--database-metrics-max-databases`.
+    #[clap(
+        long = "database-metrics-allow-list",
+        env = "INFLUXDB3_DATABASE_METRICS_ALLOW_LIST",
+        value_delimiter = ',',
+        requires = "database_metrics_max_databases",
+        action
+    )]
+    pub database_metrics_allow_list: Option<Vec<String>>,
+
     /// Size of the RAM cache used to store data in bytes.
     ///
     /// Can be given as absolute value or in percentage of the total available memory (e.g. `10%`).
@@ -99,13 +439,93 @@ pub struct Config {
     /// Size of memory pool used during query exec, in bytes.
     ///
     /// Can be given as absolute value or in percentage of the total available memory (e.g. `10%`).
+    /// If not specified, half of the available memory is used, up to 8GB.
     #[clap(
-    long = "exec-mem-pool-bytes",
-    env = "INFLUXDB3_EXEC_MEM_POOL_BYTES",
-    default_value = "8589934592",  // 8GB
-    action
+        long = "exec-mem-pool-bytes",
+        env = "INFLUXDB3_EXEC_MEM_POOL_BYTES",
+        action
+    )]
+    pub exec_mem_pool_bytes: Option<MemorySize>,
+
+    /// Number of threads executing queries.
+    ///
+    /// If not specified, one thread per CPU is used.
+    #[clap(
+        long = "num-query-threads",
+        env = "INFLUXDB3_NUM_QUERY_THREADS",
+        action
+    )]
+    pub num_query_threads: Option<NonZeroUsize>,
+
+    /// Maximum number of partitions a single query is executed in
+    /// concurrently, and so the number of query threads it may keep busy.
+    ///
+    /// Queries may ask for fewer with the `parallelism` parameter. If not
+    /// specified, or larger, the number of query threads is used.
+    #[clap(
+        long = "query-max-parallelism",
+        env = "INFLUXDB3_QUERY_MAX_PARALLELISM",
+        action
+    )]
+    pub query_max_parallelism: Option<NonZeroUsize>,
+
+    /// Total size, in bytes, of the rows of query results made with
+    /// `page_size` that are kept for their following pages.
+    ///
+    /// A paged query fails as soon as its remaining rows no longer fit.
+    #[clap(
+        long = "query-cursor-max-bytes",
+        env = "INFLUXDB3_QUERY_CURSOR_MAX_BYTES",
+        default_value = "1073741824",  // 1GB
+        action
+    )]
+    pub query_cursor_max_bytes: usize,
+
+    /// Time the rest of a paged query result is kept without its next page
+    /// being fetched.
+    #[clap(
+        long = "query-cursor-ttl",
+        env = "INFLUXDB3_QUERY_CURSOR_TTL",
+        default_value = "5m",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub query_cursor_ttl: Duration,
+
+    /// Number of queries in flight at which queries are refused, lowest
+    /// priority first.
+    ///
+    /// Low priority queries are refused from 80% of the limit, and normal
+    /// priority queries from the limit; high priority queries are never
+    /// refused. Queries are given a priority with the `priority` parameter.
+    #[clap(
+        long = "query-shedding-max-queries",
+        env = "INFLUXDB3_QUERY_SHEDDING_MAX_QUERIES",
+        action
+    )]
+    pub query_shedding_max_queries: Option<usize>,
+
+    /// Resident memory of the server, in bytes, at which queries are refused,
+    /// lowest priority first, as with `--query-shedding-max-queries`.
+    ///
+    /// Can be given as absolute value or in percentage of the total available memory (e.g. `90%`).
+    #[clap(
+        long = "query-shedding-max-memory",
+        env = "INFLUXDB3_QUERY_SHEDDING_MAX_MEMORY",
+        action
     )]
-    pub exec_mem_pool_bytes: MemorySize,
+    pub query_shedding_max_memory: Option<MemorySize>,
+
+    /// Time clients are told, with `Retry-After`, to wait before retrying a
+    /// query refused because the server is overloaded.
+    #[clap(
+        long = "query-shedding-retry-after",
+        env = "INFLUXDB3_QUERY_SHEDDING_RETRY_AFTER",
+        default_value = "5s",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub query_shedding_retry_after: Duration,
 
     /// logging options
     #[clap(flatten)]
@@ -128,6 +548,189 @@ pub struct Config {
     /// bearer token to be set for requests
     #[clap(long = "bearer-token", env = "INFLUXDB3_BEARER_TOKEN", action)]
     pub bearer_token: Option<String>,
+
+    /// JSON file mapping key ids to the secrets writes may be signed with
+    /// instead of sending the bearer token, such as by IoT devices.
+    ///
+    /// A signed write has the header `Authorization: HMAC-SHA256 <key
+    /// id>:<timestamp>:<signature>`, the signature being the hex encoded
+    /// HMAC-SHA256 of the timestamp, method, path and query, and body of the
+    /// request, each followed by a newline but the body.
+    #[clap(
+        long = "signed-write-keys-file",
+        env = "INFLUXDB3_SIGNED_WRITE_KEYS_FILE",
+        action
+    )]
+    pub signed_write_keys_file: Option<PathBuf>,
+
+    /// How far the timestamp of a signed write may be from the time of the
+    /// server.
+    ///
+    /// Signatures are remembered for this long, and a write with a signature
+    /// already used is refused.
+    #[clap(
+        long = "signed-write-max-skew",
+        env = "INFLUXDB3_SIGNED_WRITE_MAX_SKEW",
+        default_value = "5m",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub signed_write_max_skew: Duration,
+
+    /// How long the `Idempotency-Key` of a completed write is remembered.
+    ///
+    /// A retried write carrying a remembered key is acknowledged without being
+    /// applied a second time.
+    #[clap(
+    long = "write-idempotency-ttl",
+    env = "INFLUXDB3_WRITE_IDEMPOTENCY_TTL",
+    default_value = "5m",
+    value_parser = humantime::parse_duration,
+    action
+    )]
+    pub write_idempotency_ttl: Duration,
+
+    /// Maximum number of write idempotency keys remembered at once.
+    ///
+    /// The keys of completed writes are forgotten, oldest first, to make room
+    /// for new ones. Keyed writes are refused with `503 Service Unavailable`
+    /// while all the keys remembered are of writes still in progress.
+    #[clap(
+        long = "write-idempotency-max-keys",
+        env = "INFLUXDB3_WRITE_IDEMPOTENCY_MAX_KEYS",
+        default_value = "100000",
+        action
+    )]
+    pub write_idempotency_max_keys: usize,
+
+    /// Minimum size, in bytes, of a query response before it is compressed.
+    ///
+    /// Responses are only compressed for clients that send an
+    /// `Accept-Encoding` header listing `gzip` or `zstd`.
+    #[clap(
+        long = "query-response-compression-min-bytes",
+        env = "INFLUXDB3_QUERY_RESPONSE_COMPRESSION_MIN_BYTES",
+        default_value = "1024",
+        action
+    )]
+    pub query_response_compression_min_bytes: usize,
+
+    /// Interval at which the server writes its own metrics to the
+    /// `_monitoring` database.
+    ///
+    /// If not specified, the metrics are only served on `/metrics`.
+    #[clap(
+        long = "self-monitoring-interval",
+        env = "INFLUXDB3_SELF_MONITORING_INTERVAL",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub self_monitoring_interval: Option<Duration>,
+
+    /// Address on which to listen for line protocol sent over UDP, as with
+    /// the `[[udp]]` service of InfluxDB 1.x.
+    ///
+    /// The lines are written to the database given with `--udp-database`.
+    #[clap(
+        long = "udp-bind",
+        env = "INFLUXDB3_UDP_BIND_ADDR",
+        requires = "udp_database",
+        action
+    )]
+    pub udp_bind_address: Option<SocketAddr>,
+
+    /// Database the lines received over UDP are written to.
+    #[clap(long = "udp-database", env = "INFLUXDB3_UDP_DATABASE", action)]
+    pub udp_database: Option<String>,
+
+    /// Precision of the timestamps of the lines received over UDP.
+    #[clap(
+        long = "udp-precision",
+        env = "INFLUXDB3_UDP_PRECISION",
+        default_value = "ns",
+        action
+    )]
+    pub udp_precision: Precision,
+
+    /// Size of the receive buffer of the UDP socket, in bytes.
+    ///
+    /// If not specified, the system default is used.
+    #[clap(long = "udp-read-buffer", env = "INFLUXDB3_UDP_READ_BUFFER", action)]
+    pub udp_read_buffer: Option<usize>,
+
+    /// Number of lines received over UDP that are written together.
+    #[clap(
+        long = "udp-batch-size",
+        env = "INFLUXDB3_UDP_BATCH_SIZE",
+        default_value = "5000",
+        action
+    )]
+    pub udp_batch_size: usize,
+
+    /// Time after which the lines received over UDP are written, even if
+    /// there are fewer than `--udp-batch-size`.
+    #[clap(
+        long = "udp-batch-timeout",
+        env = "INFLUXDB3_UDP_BATCH_TIMEOUT",
+        default_value = "1s",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub udp_batch_timeout: Duration,
+
+    /// URL of a peer server that accepted writes are replicated to.
+    ///
+    /// Writes replicated from the peer are not sent back to it, so two
+    /// servers may replicate to each other, each with the other's
+    /// `--replication-token` as its `--replication-peer-token`.
+    #[clap(long = "replication-peer", env = "INFLUXDB3_REPLICATION_PEER", action)]
+    pub replication_peer: Option<String>,
+
+    /// Token used to authenticate with the replication peer.
+    #[clap(
+        long = "replication-token",
+        env = "INFLUXDB3_REPLICATION_TOKEN",
+        action
+    )]
+    pub replication_token: Option<String>,
+
+    /// Token the replication peer authenticates with, in the format of
+    /// `--bearer-token`: the hex encoded SHA-256 of the peer's
+    /// `--replication-token`.
+    ///
+    /// Writes replicated from the peer are not sent back to it, so they are
+    /// only accepted when authenticated with this token, and refused with
+    /// `403 Forbidden` otherwise. It only authenticates replicated writes.
+    #[clap(
+        long = "replication-peer-token",
+        env = "INFLUXDB3_REPLICATION_PEER_TOKEN",
+        action
+    )]
+    pub replication_peer_token: Option<String>,
+
+    /// When writes are acknowledged, relative to being replicated.
+    ///
+    /// With `sync`, a write is acknowledged once the peer has accepted it and
+    /// fails if the peer does not. With `async`, a write is acknowledged at
+    /// once and queued for the peer, which is retried until it is reachable.
+    #[clap(
+        long = "replication-mode",
+        env = "INFLUXDB3_REPLICATION_MODE",
+        default_value = "async",
+        action
+    )]
+    pub replication_mode: ReplicationMode,
+
+    /// Number of writes queued for the peer in `async` replication mode.
+    ///
+    /// Writes accepted while the queue is full are not replicated.
+    #[clap(
+        long = "replication-queue-size",
+        env = "INFLUXDB3_REPLICATION_QUEUE_SIZE",
+        default_value = "10000",
+        action
+    )]
+    pub replication_queue_size: usize,
 }
 
 #[cfg(all(not(feature = "heappy"), not(feature = "jemalloc_replacing_malloc")))]
@@ -177,7 +780,11 @@ fn ensure_directory_exists(p: &Path) {
     }
 }
 
-pub async fn command(config: Config) -> Result<()> {
+pub async fn command(
+    config: Config,
+    log_filter: LogFilterHandle,
+    systemd_listener: Option<std::net::TcpListener>,
+) -> Result<()> {
     let num_cpus = num_cpus::get();
     let build_malloc_conf = build_malloc_conf();
     info!(
@@ -208,22 +815,42 @@ pub async fn command(config: Config) -> Result<()> {
 
     let trace_exporter = config.tracing_config.build()?;
 
-    // TODO: make this a parameter
-    let num_threads =
-        NonZeroUsize::new(num_cpus::get()).unwrap_or_else(|| NonZeroUsize::new(1).unwrap());
+    // num_cpus and the memory limits account for the limits of the cgroup
+    // of the process, so the defaults suit a container as well as a machine
+    let memory_limits = memory_size::memory_limits();
+    let num_threads = config.num_query_threads.unwrap_or_else(|| {
+        NonZeroUsize::new(num_cpus).unwrap_or_else(|| NonZeroUsize::new(1).unwrap())
+    });
+    let max_parallelism = config
+        .query_max_parallelism
+        .map_or(num_threads, |p| p.min(num_threads));
+    let exec_mem_pool_bytes = config.exec_mem_pool_bytes.map_or_else(
+        || (memory_limits.available_bytes() / 2).min(DEFAULT_MAX_EXEC_MEM_POOL_BYTES),
+        |size| size.bytes(),
+    );
+    let resources = Resources {
+        cpus: num_cpus,
+        system_memory_bytes: memory_limits.system_bytes,
+        cgroup_memory_limit_bytes: memory_limits.cgroup_bytes,
+        available_memory_bytes: memory_limits.available_bytes(),
+        num_query_threads: num_threads.get(),
+        query_max_parallelism: max_parallelism.get(),
+        exec_mem_pool_bytes,
+    };
+    info!(?resources, "Detected resources");
 
-    info!(%num_threads, "Creating shared query executor");
+    info!(%num_threads, %max_parallelism, "Creating shared query executor");
     let parquet_store =
         ParquetStorage::new(Arc::clone(&object_store), StorageId::from("influxdb3"));
     let exec = Arc::new(Executor::new_with_config(ExecutorConfig {
         num_threads,
-        target_query_partitions: num_threads,
+        target_query_partitions: max_parallelism,
         object_stores: [&parquet_store]
             .into_iter()
             .map(|store| (store.id(), Arc::clone(store.object_store())))
             .collect(),
         metric_registry: Arc::clone(&metrics),
-        mem_pool_size: config.exec_mem_pool_bytes.bytes(),
+        mem_pool_size: exec_mem_pool_bytes,
     }));
 
     let trace_header_parser = TraceHeaderParser::new()
@@ -232,7 +859,8 @@ pub async fn command(config: Config) -> Result<()> {
                 .tracing_config
                 .traces_jaeger_trace_context_header_name,
         )
-        .with_jaeger_debug_name(config.tracing_config.traces_jaeger_debug_name);
+        .with_jaeger_debug_name(config.tracing_config.traces_jaeger_debug_name)
+        .with_sampling_ratio(config.tracing_config.traces_sampling_ratio);
 
     let common_state = CommonServerState::new(
         Arc::clone(&metrics),
@@ -240,8 +868,10 @@ pub async fn command(config: Config) -> Result<()> {
         trace_header_parser,
         *config.http_bind_address,
         config.bearer_token,
-    )?;
+    )?
+    .with_log_filter(log_filter);
     let catalog = Arc::new(influxdb3_write::catalog::Catalog::new());
+    let read_only = ReadOnly::new(config.read_only);
     let wal: Option<Arc<WalImpl>> = config
         .wal_directory
         .map(|dir| WalImpl::new(dir).map(Arc::new))
@@ -252,6 +882,26 @@ pub async fn command(config: Config) -> Result<()> {
         wal,
         SegmentId::new(0),
     )?);
+    if let Some(interval) = config.self_monitoring_interval {
+        tokio::spawn(self_monitoring::run(
+            Arc::clone(&write_buffer),
+            Arc::clone(&metrics),
+            interval,
+            read_only.clone(),
+            frontend_shutdown.clone(),
+        ));
+    }
+    let mut udp_listener = None;
+    if let (Some(bind_addr), Some(db)) = (config.udp_bind_address, config.udp_database) {
+        udp_listener = Some(UdpListener::bind(UdpConfig {
+            bind_addr: *bind_addr,
+            db,
+            precision: config.udp_precision,
+            read_buffer_bytes: config.udp_read_buffer,
+            batch_size: config.udp_batch_size,
+            batch_timeout: config.udp_batch_timeout,
+        })?);
+    }
     let query_executor = QueryExecutorImpl::new(
         catalog,
         Arc::clone(&write_buffer),
@@ -259,17 +909,136 @@ pub async fn command(config: Config) -> Result<()> {
         Arc::clone(&metrics),
         Arc::new(config.datafusion_config),
         10,
+        max_parallelism,
+    );
+
+    let idempotency_cache = IdempotencyCache::new(
+        config.write_idempotency_ttl,
+        config.write_idempotency_max_keys,
+        Arc::new(SystemProvider::new()),
+        &metrics,
     );
 
+    let replicator = config
+        .replication_peer
+        .map(|peer| {
+            Replicator::new(
+                &peer,
+                config.replication_token.as_deref(),
+                config.replication_mode,
+                config.replication_queue_size,
+                &metrics,
+            )
+        })
+        .transpose()?;
+
+    let write_rules = config
+        .write_rules_file
+        .as_deref()
+        .map(WriteRules::load)
+        .transpose()?
+        .unwrap_or_default();
+    let sampling_rules = config
+        .sampling_rules_file
+        .as_deref()
+        .map(SamplingRules::load)
+        .transpose()?
+        .unwrap_or_default();
+    let signing_keys = config
+        .signed_write_keys_file
+        .as_deref()
+        .map(SigningKeys::load)
+        .transpose()?
+        .unwrap_or_default();
+    let load_shedding = (config.query_shedding_max_queries.is_some()
+        || config.query_shedding_max_memory.is_some())
+    .then(|| LoadSheddingConfig {
+        max_queries: config.query_shedding_max_queries,
+        max_memory_bytes: config.query_shedding_max_memory.map(|size| size.bytes()),
+        retry_after: config.query_shedding_retry_after,
+    });
+
     let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
     let server = Server::new(
         common_state,
         persister,
         Arc::clone(&write_buffer),
         Arc::new(query_executor),
-        config.max_http_request_size,
+        HttpServerConfig {
+            max_request_bytes: config.max_http_request_size,
+            max_connections: config.http_max_connections,
+            header_read_timeout: config.http_header_read_timeout,
+            idle_timeout: config.http_idle_timeout,
+            request_timeout: config.http_request_timeout,
+            write_timeout: config.http_write_timeout,
+            query_timeout: config.http_query_timeout,
+            http1_keepalive: config.http_enable_keepalive,
+            tcp_keepalive: config.http_tcp_keepalive,
+            max_header_bytes: config.http_max_header_size,
+            http2: config.http_enable_http2,
+            unix_socket_path: config.http_unix_socket_path,
+            unix_socket_permissions: config.http_unix_socket_permissions,
+            reuse_port: config.http_reuse_port,
+            shutdown_timeout: config.shutdown_timeout,
+            health: HealthThresholds {
+                write_queue_fail_ratio: config.health_write_queue_fail_ratio,
+                max_open_segment_rows: config.health_open_segment_max_rows,
+            },
+            reload_file: config.config_reload_file,
+            default_tags: DefaultTags::new(config.default_tags),
+            time_bounds: TimeBounds {
+                max_future: config.write_max_future,
+                max_past: config.write_max_past,
+            },
+            write_rules,
+            sampling_rules,
+            signing_keys,
+            signed_write_max_skew: config.signed_write_max_skew,
+            replication_peer_token: config
+                .replication_peer_token
+                .map(hex::decode)
+                .transpose()
+                .map_err(influxdb3_server::Error::FromHex)?,
+            dead_letter_database: config.dead_letter_database,
+            ingest_metrics_max_measurements: config.ingest_metrics_max_measurements,
+            database_metrics: config.database_metrics_max_databases.map(|max_databases| {
+                DatabaseMetricsConfig {
+                    max_databases,
+                    allow_list: config
+                        .database_metrics_allow_list
+                        .map(|dbs| dbs.into_iter().collect()),
+                }
+            }),
+            load_shedding,
+            read_only,
+            resources,
+            query_cursor_max_bytes: config.query_cursor_max_bytes,
+            query_cursor_ttl: config.query_cursor_ttl,
+        },
+        idempotency_cache,
+        ResponseCompression::new(config.query_response_compression_min_bytes, &metrics),
+        replicator,
     );
-    serve(server, frontend_shutdown).await?;
+    let server = match udp_listener {
+        Some(listener) => server.with_udp_listener(listener),
+        None => server,
+    };
+    let server = match systemd_listener {
+        Some(listener) => server.with_tcp_listener(listener),
+        None => server,
+    };
+    let signal = tokio::spawn({
+        let shutdown = frontend_shutdown.clone();
+        async move {
+            influxdb3_server::wait_for_signal().await;
+            info!("Shutting down");
+            shutdown.cancel();
+        }
+    });
+    let result = serve(server, frontend_shutdown).await;
+    signal.abort();
+    result?;
+    info!("Shutdown complete");
 
     Ok(())
 }
@@ -304,3 +1073,17 @@ fn parse_datafusion_config(
 
     Ok(out)
 }
+
+fn parse_file_permissions(s: &str) -> Result<u32, String> {
+    u32::from_str_radix(s.trim_start_matches("0o"), 8)
+        .ok()
+        .filter(|mode| *mode <= 0o777)
+        .ok_or_else(|| format!("invalid file permissions '{s}', expected octal such as 660"))
+}
+
+fn parse_ratio(s: &str) -> Result<f64, String> {
+    s.parse::<f64>()
+        .ok()
+        .filter(|r| (0.0..=1.0).contains(r))
+        .ok_or_else(|| format!("invalid ratio '{s}', expected a number between 0 and 1"))
+}
@@ -0,0 +1,209 @@
+//! An interactive shell for querying a running server.
+
+use std::path::PathBuf;
+
+use clap::Parser;
+use secrecy::ExposeSecret;
+use tokio::io::{self, AsyncBufReadExt, AsyncWriteExt, BufReader};
+use url::Url;
+
+#[derive(Debug, thiserror::Error)]
+pub(crate) enum Error {
+    #[error(transparent)]
+    Client(#[from] influxdb3_client::Error),
+
+    #[error("io error: {0}")]
+    Io(#[from] io::Error),
+}
+
+pub(crate) type Result<T> = std::result::Result<T, Error>;
+
+#[derive(Debug, Parser)]
+pub struct Config {
+    /// The host URL of the running InfluxDB 3.0 server
+    #[clap(
+        short = 'h',
+        long = "host",
+        env = "INFLUXDB3_HOST_URL",
+        default_value = "http://127.0.0.1:8181"
+    )]
+    host_url: Url,
+
+    /// The database to query, which can be changed with `\use`
+    #[clap(short = 'd', long = "dbname", env = "INFLUXDB3_DATABASE_NAME")]
+    database_name: Option<String>,
+
+    /// The token for authentication with the InfluxDB 3.0 server
+    #[clap(long = "token", env = "INFLUXDB3_AUTH_TOKEN")]
+    auth_token: Option<secrecy::Secret<String>>,
+
+    /// File the statements entered are appended to
+    ///
+    /// If not specified, `.influxdb3_history` in the home directory is used.
+    #[clap(long = "history-file", env = "INFLUXDB3_HISTORY_FILE")]
+    history_file: Option<PathBuf>,
+}
+
+const HELP: &str = r#"Statements are SQL, ended with ';', and may span several lines.
+
+Commands:
+    \use <database>      query <database>
+    \tables              list the tables of the database
+    \describe <table>    list the columns of <table> and their types
+    \format <format>     print results as pretty (the default), csv or json
+    \history             print the statements entered
+    \help                print this help
+    \quit                leave the shell
+"#;
+
+#[derive(Debug)]
+struct Shell {
+    client: influxdb3_client::Client,
+    database_name: Option<String>,
+    format: influxdb3_client::Format,
+    history: Vec<String>,
+    history_file: Option<PathBuf>,
+}
+
+pub(crate) async fn command(config: Config) -> Result<()> {
+    let mut client = influxdb3_client::Client::new(config.host_url)?;
+    if let Some(t) = config.auth_token {
+        client = client.with_auth_token(t.expose_secret());
+    }
+    let history_file = config.history_file.or_else(|| {
+        std::env::var_os("HOME").map(|home| PathBuf::from(home).join(".influxdb3_history"))
+    });
+    let history = match &history_file {
+        Some(path) => std::fs::read_to_string(path)
+            .map(|h| h.lines().map(ToString::to_string).collect())
+            .unwrap_or_default(),
+        None => Vec::new(),
+    };
+
+    let mut shell = Shell {
+        client,
+        database_name: config.database_name,
+        format: influxdb3_client::Format::Pretty,
+        history,
+        history_file,
+    };
+
+    println!("InfluxDB 3.0 shell, enter \\help for help");
+    let mut lines = BufReader::new(io::stdin()).lines();
+    let mut statement = String::new();
+    loop {
+        shell.prompt(!statement.is_empty()).await?;
+        let Some(line) = lines.next_line().await? else {
+            println!();
+            return Ok(());
+        };
+        let line = line.trim();
+
+        if statement.is_empty() && line.starts_with('\\') {
+            if !shell.command(line).await {
+                return Ok(());
+            }
+            continue;
+        }
+
+        if !line.is_empty() {
+            if !statement.is_empty() {
+                statement.push(' ');
+            }
+            statement.push_str(line);
+        }
+        if let Some(query) = statement.strip_suffix(';') {
+            let query = query.trim().to_string();
+            statement.clear();
+            shell.remember(&query);
+            shell.query(&query).await;
+        }
+    }
+}
+
+impl Shell {
+    async fn prompt(&self, continuation: bool) -> Result<()> {
+        let prompt = match (&self.database_name, continuation) {
+            (_, true) => "...> ".to_string(),
+            (Some(db), false) => format!("{db}> "),
+            (None, false) => "> ".to_string(),
+        };
+        let mut stdout = io::stdout();
+        stdout.write_all(prompt.as_bytes()).await?;
+        stdout.flush().await?;
+        Ok(())
+    }
+
+    /// Run a `\` command, returning `false` if the shell should exit.
+    async fn command(&mut self, line: &str) -> bool {
+        let (command, argument) = line
+            .split_once(char::is_whitespace)
+            .map(|(c, a)| (c, a.trim()))
+            .unwrap_or((line, ""));
+        match (command, argument) {
+            ("\\q" | "\\quit" | "\\exit", _) => return false,
+            ("\\h" | "\\help", _) => print!("{HELP}"),
+            ("\\use", db) if !db.is_empty() => self.database_name = Some(db.to_string()),
+            ("\\tables", _) => {
+                self.query(
+                    "SELECT table_name FROM information_schema.tables \
+                     WHERE table_schema = 'iox' ORDER BY table_name",
+                )
+                .await
+            }
+            ("\\describe", table) if !table.is_empty() => {
+                self.query(&format!(
+                    "SELECT column_name, data_type, is_nullable \
+                     FROM information_schema.columns \
+                     WHERE table_schema = 'iox' AND table_name = '{}' \
+                     ORDER BY ordinal_position",
+                    table.replace('\'', "''")
+                ))
+                .await
+            }
+            ("\\format", "pretty") => self.format = influxdb3_client::Format::Pretty,
+            ("\\format", "csv") => self.format = influxdb3_client::Format::Csv,
+            ("\\format", "json") => self.format = influxdb3_client::Format::Json,
+            ("\\history", _) => {
+                for (i, statement) in self.history.iter().enumerate() {
+                    println!("{:>5}  {statement}", i + 1);
+                }
+            }
+            _ => println!("invalid command '{line}', enter \\help for help"),
+        }
+        true
+    }
+
+    async fn query(&self, query: &str) {
+        let Some(db) = &self.database_name else {
+            println!("no database selected, enter \\use <database>");
+            return;
+        };
+        let result = self
+            .client
+            .api_v3_query_sql(db, query)
+            .format(self.format)
+            .send()
+            .await;
+        match result {
+            Ok(bytes) => println!("{}", String::from_utf8_lossy(&bytes)),
+            Err(e) => println!("error: {e}"),
+        }
+    }
+
+    fn remember(&mut self, statement: &str) {
+        self.history.push(statement.to_string());
+        if let Some(path) = &self.history_file {
+            let appended = std::fs::OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(path)
+                .and_then(|mut f| {
+                    std::io::Write::write_all(&mut f, format!("{statement}\n").as_bytes())
+                });
+            if let Err(e) = appended {
+                eprintln!("cannot write history to {}: {e}", path.display());
+            }
+        }
+    }
+}
@@ -1,11 +1,22 @@
+use std::collections::{BTreeMap, VecDeque};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
 use clap::Parser;
+use parking_lot::Mutex;
 use secrecy::ExposeSecret;
 use tokio::{
     fs::File,
-    io::{self, AsyncReadExt},
+    io::{self, AsyncBufReadExt, BufReader},
+    task::JoinSet,
 };
 
 use super::common::InfluxDb3Config;
+use mapping::{CsvArgs, CsvLines, CsvMapping};
+use parquet_lines::ParquetLines;
+
+mod mapping;
+mod parquet_lines;
 
 #[derive(Debug, thiserror::Error)]
 pub(crate) enum Error {
@@ -14,6 +25,24 @@ pub(crate) enum Error {
 
     #[error("error reading file: {0}")]
     Io(#[from] io::Error),
+
+    #[error("error writing {path}: {source}")]
+    File { path: PathBuf, source: Box<Error> },
+
+    #[error("invalid import state file {path}, line {line}")]
+    StateFile { path: PathBuf, line: usize },
+
+    #[error("{0} is a directory, use --recursive to import the files it contains")]
+    Directory(PathBuf),
+
+    #[error(transparent)]
+    Csv(#[from] mapping::Error),
+
+    #[error(transparent)]
+    Parquet(#[from] parquet_lines::Error),
+
+    #[error("{failed} of {total} files could not be written")]
+    Incomplete { failed: usize, total: usize },
 }
 
 pub(crate) type Result<T> = std::result::Result<T, Error>;
@@ -26,16 +55,60 @@ pub struct Config {
     influxdb3_config: InfluxDb3Config,
 
     /// File path to load the write data from
-    ///
-    /// Currently, only files containing line protocol are supported.
     #[clap(short = 'f', long = "file")]
-    file_path: String,
+    file_path: PathBuf,
+
+    /// Format of the files to write
+    #[clap(long = "format", value_enum, default_value = "lp")]
+    format: Format,
+
+    /// How the columns of CSV files map to points, for `--format csv`
+    #[clap(flatten)]
+    csv: CsvArgs,
 
     /// Flag to request the server accept partial writes
     ///
     /// Invalid lines in the input data will be ignored by the server.
     #[clap(long = "accept-partial")]
     accept_partial_writes: bool,
+
+    /// Write every file in the directory given with `--file`, and in its
+    /// subdirectories
+    #[clap(short = 'r', long = "recursive")]
+    recursive: bool,
+
+    /// Number of files written concurrently
+    #[clap(long = "workers", default_value = "4")]
+    workers: usize,
+
+    /// Maximum number of lines sent in a single write request
+    ///
+    /// Blank lines and lines starting with `#` are not sent, and do not count
+    /// towards the batch size.
+    #[clap(long = "batch-size", default_value = "10000")]
+    batch_size: usize,
+
+    /// File recording the progress of the import
+    ///
+    /// When given, files that were completely written by a previous run with
+    /// the same state file are skipped, and partially written files resume
+    /// from the first line that was not written.
+    ///
+    /// The progress is recorded after each batch is written, so the batch
+    /// being written when an import is interrupted is written again when it
+    /// is resumed.
+    #[clap(long = "state-file")]
+    state_file: Option<PathBuf>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, clap::ValueEnum)]
+enum Format {
+    /// Line protocol
+    Lp,
+    /// CSV without annotations, see the `--csv-*` flags
+    Csv,
+    /// Parquet, such as files exported with `influxdb3 export parquet`
+    Parquet,
 }
 
 pub(crate) async fn command(config: Config) -> Result<()> {
@@ -49,17 +122,406 @@ pub(crate) async fn command(config: Config) -> Result<()> {
         client = client.with_auth_token(t.expose_secret());
     }
 
-    let mut f = File::open(config.file_path).await?;
-    let mut writes = Vec::new();
-    f.read_to_end(&mut writes).await?;
+    let files = if config.recursive {
+        list_files(&config.file_path)?
+    } else if config.file_path.is_dir() {
+        return Err(Error::Directory(config.file_path));
+    } else {
+        vec![config.file_path]
+    };
+    let state = Arc::new(match config.state_file {
+        Some(path) => ImportState::load(path)?,
+        None => ImportState::default(),
+    });
+    let total = files.len();
+    let queue = Arc::new(Mutex::new(files.into_iter().collect::<VecDeque<_>>()));
+
+    let csv_mapping = match config.format {
+        Format::Lp | Format::Parquet => None,
+        Format::Csv => Some(config.csv.mapping()?),
+    };
+    let writer = Arc::new(FileWriter {
+        client,
+        format: config.format,
+        csv_mapping,
+        database_name,
+        accept_partial_writes: config.accept_partial_writes,
+        batch_size: config.batch_size.max(1),
+        state,
+    });
+    let mut workers = JoinSet::new();
+    for _ in 0..config.workers.max(1) {
+        let queue = Arc::clone(&queue);
+        let writer = Arc::clone(&writer);
+        workers.spawn(async move {
+            let mut failed = 0;
+            loop {
+                let Some(path) = queue.lock().pop_front() else {
+                    return failed;
+                };
+                if let Err(e) = writer.write_file(&path).await {
+                    eprintln!("{e}");
+                    failed += 1;
+                }
+            }
+        });
+    }
 
-    let mut req = client.api_v3_write_lp(database_name);
-    if config.accept_partial_writes {
-        req = req.accept_partial(true);
+    let mut failed = 0;
+    while let Some(result) = workers.join_next().await {
+        failed += result.expect("write worker panicked");
+    }
+    if failed > 0 {
+        return Err(Error::Incomplete { failed, total });
     }
-    req.body(writes).send().await?;
 
     println!("success");
 
     Ok(())
 }
+
+/// All files under `dir`, in a stable order so that progress is predictable.
+fn list_files(dir: &Path) -> Result<Vec<PathBuf>> {
+    let mut files = Vec::new();
+    let mut dirs = vec![dir.to_path_buf()];
+    while let Some(dir) = dirs.pop() {
+        for entry in std::fs::read_dir(&dir)? {
+            let path = entry?.path();
+            if path.is_dir() {
+                dirs.push(path);
+            } else {
+                files.push(path);
+            }
+        }
+    }
+    files.sort();
+    Ok(files)
+}
+
+#[derive(Debug)]
+struct FileWriter {
+    client: influxdb3_client::Client,
+    format: Format,
+    csv_mapping: Option<CsvMapping>,
+    database_name: String,
+    accept_partial_writes: bool,
+    batch_size: usize,
+    state: Arc<ImportState>,
+}
+
+impl FileWriter {
+    async fn write_file(&self, path: &Path) -> Result<()> {
+        self.write_batches(path).await.map_err(|e| Error::File {
+            path: path.to_path_buf(),
+            source: Box::new(e),
+        })
+    }
+
+    /// Send the lines of `path` in batches, recording the progress after each
+    /// batch is accepted.
+    async fn write_batches(&self, path: &Path) -> Result<()> {
+        let progress = self.state.get(path);
+        if progress.complete {
+            println!("{}: already written, skipping", path.display());
+            return Ok(());
+        }
+
+        let mut lines = match (self.format, &self.csv_mapping) {
+            (Format::Csv, Some(mapping)) => {
+                Lines::Csv(CsvLines::new(mapping, std::fs::File::open(path)?)?)
+            }
+            (Format::Parquet, _) => Lines::Parquet(Box::new(ParquetLines::open(path)?)),
+            _ => Lines::LineProtocol(BufReader::new(File::open(path).await?).lines()),
+        };
+        let mut written = lines.skip(progress.lines).await?;
+
+        loop {
+            let batch = Batch::read(&mut lines, self.batch_size).await?;
+            if !batch.body.is_empty() {
+                self.client
+                    .api_v3_write_lp(&self.database_name)
+                    .accept_partial(self.accept_partial_writes)
+                    .body(batch.body)
+                    .send()
+                    .await?;
+            }
+            written += batch.read;
+            self.state
+                .set(
+                    path,
+                    Progress {
+                        lines: written,
+                        complete: batch.eof,
+                    },
+                )
+                .await?;
+
+            if batch.eof {
+                println!("{}: wrote {written} lines", path.display());
+                return Ok(());
+            }
+        }
+    }
+}
+
+/// The lines of a file sent in one write request.
+#[derive(Debug, Default, PartialEq, Eq)]
+struct Batch {
+    /// The lines to send
+    body: String,
+    /// Number of lines of the file read for the batch, including the blank
+    /// lines and comments, which are not sent
+    read: usize,
+    /// Whether the end of the file was reached
+    eof: bool,
+}
+
+impl Batch {
+    /// Read up to `max_lines` lines to send from `lines`.
+    async fn read(lines: &mut Lines, max_lines: usize) -> Result<Self> {
+        let mut batch = Self::default();
+        let mut batch_lines = 0;
+        while batch_lines < max_lines {
+            let Some(line) = lines.next_line().await? else {
+                batch.eof = true;
+                break;
+            };
+            batch.read += 1;
+            if line.trim().is_empty() || line.starts_with('#') {
+                continue;
+            }
+            batch.body.push_str(&line);
+            batch.body.push('\n');
+            batch_lines += 1;
+        }
+        Ok(batch)
+    }
+}
+
+/// The lines of line protocol read from a file, counting one per line of a
+/// line protocol file, per record of a CSV file or per row of a Parquet file.
+#[derive(Debug)]
+enum Lines {
+    LineProtocol(io::Lines<BufReader<File>>),
+    Csv(CsvLines<std::fs::File>),
+    Parquet(Box<ParquetLines>),
+}
+
+impl Lines {
+    async fn next_line(&mut self) -> Result<Option<String>> {
+        match self {
+            Self::LineProtocol(lines) => Ok(lines.next_line().await?),
+            Self::Csv(lines) => Ok(lines.next_line()?),
+            Self::Parquet(lines) => Ok(lines.next_line()?),
+        }
+    }
+
+    /// Skip the first `n` lines, returning the number skipped, which is fewer
+    /// if there are fewer lines.
+    async fn skip(&mut self, n: usize) -> Result<usize> {
+        let mut skipped = 0;
+        while skipped < n && self.next_line().await?.is_some() {
+            skipped += 1;
+        }
+        Ok(skipped)
+    }
+}
+
+/// How much of a file has been written.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+struct Progress {
+    /// Number of lines of the file that were written, from its start
+    lines: usize,
+    /// Whether the whole file was written
+    complete: bool,
+}
+
+/// The progress of each file of an import, optionally persisted so that an
+/// interrupted import can be resumed.
+///
+/// The state file holds a line per file: the number of lines written, whether
+/// the file is `complete` or `partial`, and its path, separated by tabs.
+#[derive(Debug, Default)]
+struct ImportState {
+    path: Option<PathBuf>,
+    files: Mutex<BTreeMap<PathBuf, Progress>>,
+    /// Held while the state file is replaced, so that the workers replace it
+    /// one at a time
+    saving: tokio::sync::Mutex<()>,
+}
+
+impl ImportState {
+    fn load(path: PathBuf) -> Result<Self> {
+        let contents = match std::fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+            Err(e) => return Err(e.into()),
+        };
+
+        let mut files = BTreeMap::new();
+        for (i, line) in contents.lines().enumerate() {
+            let invalid = || Error::StateFile {
+                path: path.clone(),
+                line: i + 1,
+            };
+            let mut parts = line.splitn(3, '\t');
+            let (Some(lines), Some(status), Some(file)) =
+                (parts.next(), parts.next(), parts.next())
+            else {
+                return Err(invalid());
+            };
+            let progress = Progress {
+                lines: lines.parse().map_err(|_| invalid())?,
+                complete: match status {
+                    "complete" => true,
+                    "partial" => false,
+                    _ => return Err(invalid()),
+                },
+            };
+            files.insert(PathBuf::from(file), progress);
+        }
+
+        Ok(Self {
+            path: Some(path),
+            files: Mutex::new(files),
+            saving: Default::default(),
+        })
+    }
+
+    fn get(&self, file: &Path) -> Progress {
+        self.files.lock().get(file).copied().unwrap_or_default()
+    }
+
+    /// Record the progress of `file`, and save the progress of all files to
+    /// the state file, if any.
+    async fn set(&self, file: &Path, progress: Progress) -> Result<()> {
+        self.files.lock().insert(file.to_path_buf(), progress);
+
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        let _saving = self.saving.lock().await;
+        let contents: String = self
+            .files
+            .lock()
+            .iter()
+            .map(|(file, progress)| {
+                let status = if progress.complete {
+                    "complete"
+                } else {
+                    "partial"
+                };
+                format!("{}\t{status}\t{}\n", progress.lines, file.display())
+            })
+            .collect();
+        // Replace the file atomically, so that an interrupted import never
+        // leaves a truncated state file behind
+        let tmp = path.with_extension("tmp");
+        tokio::fs::write(&tmp, contents).await?;
+        tokio::fs::rename(tmp, path).await?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    async fn open_lines(dir: &Path, contents: &str) -> Lines {
+        let path = dir.join("lines.lp");
+        std::fs::write(&path, contents).unwrap();
+        Lines::LineProtocol(BufReader::new(File::open(path).await.unwrap()).lines())
+    }
+
+    #[tokio::test]
+    async fn batches_skip_blank_lines_and_comments() {
+        let dir = test_helpers::tmp_dir().unwrap();
+        let mut lines = open_lines(dir.path(), "a v=1\n\n# comment\nb v=2\nc v=3\n").await;
+
+        assert_eq!(
+            Batch::read(&mut lines, 2).await.unwrap(),
+            Batch {
+                body: "a v=1\nb v=2\n".to_string(),
+                read: 4,
+                eof: false,
+            }
+        );
+        assert_eq!(
+            Batch::read(&mut lines, 2).await.unwrap(),
+            Batch {
+                body: "c v=3\n".to_string(),
+                read: 1,
+                eof: true,
+            }
+        );
+    }
+
+    #[tokio::test]
+    async fn partially_written_file_resumes() {
+        let dir = test_helpers::tmp_dir().unwrap();
+        let mut lines = open_lines(dir.path(), "a v=1\n# comment\nb v=2\nc v=3\n").await;
+
+        // the comment counts as a line written
+        assert_eq!(lines.skip(3).await.unwrap(), 3);
+        assert_eq!(
+            Batch::read(&mut lines, 10).await.unwrap(),
+            Batch {
+                body: "c v=3\n".to_string(),
+                read: 1,
+                eof: true,
+            }
+        );
+
+        let mut lines = open_lines(dir.path(), "a v=1\n").await;
+        assert_eq!(lines.skip(3).await.unwrap(), 1);
+    }
+
+    #[tokio::test]
+    async fn state_is_saved_and_loaded() {
+        let dir = test_helpers::tmp_dir().unwrap();
+        let path = dir.path().join("import.state");
+
+        let state = ImportState::load(path.clone()).unwrap();
+        assert_eq!(state.get(Path::new("a.lp")), Progress::default());
+
+        let a = Progress {
+            lines: 20000,
+            complete: false,
+        };
+        let b = Progress {
+            lines: 3,
+            complete: true,
+        };
+        state.set(Path::new("a.lp"), a).await.unwrap();
+        state.set(Path::new("dir/b.lp"), b).await.unwrap();
+        assert_eq!(
+            std::fs::read_to_string(&path).unwrap(),
+            "20000\tpartial\ta.lp\n3\tcomplete\tdir/b.lp\n"
+        );
+
+        let state = ImportState::load(path).unwrap();
+        assert_eq!(state.get(Path::new("a.lp")), a);
+        assert_eq!(state.get(Path::new("dir/b.lp")), b);
+        assert_eq!(state.get(Path::new("c.lp")), Progress::default());
+    }
+
+    #[test]
+    fn invalid_state_file() {
+        let dir = test_helpers::tmp_dir().unwrap();
+        let path = dir.path().join("import.state");
+        for contents in [
+            "1\tcomplete\ta.lp\nmany\tpartial\tb.lp\n",
+            "1\tcomplete\ta.lp\n1\tdone\tb.lp\n",
+            "1\tcomplete\ta.lp\n1\tpartial\n",
+        ] {
+            std::fs::write(&path, contents).unwrap();
+            assert!(
+                matches!(
+                    ImportState::load(path.clone()),
+                    Err(Error::StateFile { line: 2, .. })
+                ),
+                "{contents:?}"
+            );
+        }
+    }
+}
@@ -0,0 +1,642 @@
+//! Conversion of ordinary CSV files to line protocol.
+//!
+//! A [`CsvMapping`] describes which columns of a CSV file hold the time, tags
+//! and fields of each point, so that files exported by other systems can be
+//! written without first adding annotation headers. It is read from a JSON
+//! file with `--csv-mapping`, for example:
+//!
+//! ```json
+//! {
+//!   "measurement": "weather",
+//!   "time": { "column": "observed", "format": "%d/%m/%Y %H:%M", "timezone": "Europe/Berlin" },
+//!   "tags": ["station"],
+//!   "fields": { "temperature": "float", "humidity": "integer" }
+//! }
+//! ```
+//!
+//! and can be amended with the `--csv-*` flags of `influxdb3 write`.
+//!
+//! Without `fields`, every other column is a field whose type is inferred
+//! from its values in the first [`INFER_TYPES_FROM`] records: `integer` if
+//! they are all integers, `float` if they are all numbers, `boolean` if they
+//! are all booleans, and `string` otherwise. A later value that does not have
+//! the inferred type is an error, rather than a field of a different type.
+
+use std::collections::{BTreeMap, VecDeque};
+use std::fmt::Write;
+use std::path::{Path, PathBuf};
+
+use chrono::{DateTime, NaiveDateTime, TimeZone};
+use chrono_tz::Tz;
+use serde::Deserialize;
+
+/// The number of records from which the types of the fields are inferred.
+pub(crate) const INFER_TYPES_FROM: usize = 100;
+
+#[derive(Debug, thiserror::Error)]
+pub(crate) enum Error {
+    #[error("cannot read CSV mapping {path}: {source}")]
+    ReadMapping {
+        path: PathBuf,
+        source: std::io::Error,
+    },
+
+    #[error("invalid CSV mapping {path}: {source}")]
+    ParseMapping {
+        path: PathBuf,
+        source: serde_json::Error,
+    },
+
+    #[error("the CSV mapping does not name a measurement, see --csv-measurement")]
+    NoMeasurement,
+
+    #[error("the CSV mapping does not name the time column, see --csv-time-column")]
+    NoTimeColumn,
+
+    #[error("invalid CSV field type '{0}', expected float, integer, unsigned, boolean or string")]
+    FieldType(String),
+
+    #[error("invalid CSV delimiter '{0}', expected an ASCII character")]
+    Delimiter(char),
+
+    #[error("unknown timezone '{0}'")]
+    Timezone(String),
+
+    #[error("column '{0}' is not in the CSV header")]
+    MissingColumn(String),
+
+    #[error("CSV error: {0}")]
+    Csv(#[from] csv::Error),
+
+    #[error("record {record}: {message}")]
+    Record { record: u64, message: String },
+}
+
+pub(crate) type Result<T, E = Error> = std::result::Result<T, E>;
+
+/// How the columns of a CSV file map to points.
+#[derive(Debug, Default, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub(crate) struct CsvMapping {
+    /// The measurement of every point
+    #[serde(default)]
+    pub(crate) measurement: Option<String>,
+    /// The column holding the time of each point
+    #[serde(default)]
+    pub(crate) time: TimeMapping,
+    /// The columns holding tags
+    #[serde(default)]
+    pub(crate) tags: Vec<String>,
+    /// The columns holding fields, and their types
+    ///
+    /// If empty, every column that is neither the time nor a tag is a field,
+    /// with its type inferred from its values.
+    #[serde(default)]
+    pub(crate) fields: BTreeMap<String, FieldType>,
+    /// The character separating columns
+    #[serde(default = "default_delimiter")]
+    pub(crate) delimiter: char,
+}
+
+fn default_delimiter() -> char {
+    ','
+}
+
+#[derive(Debug, Default, Clone, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub(crate) struct TimeMapping {
+    #[serde(default)]
+    pub(crate) column: Option<String>,
+    /// `rfc3339` (the default), `unix`, `unix_ms`, `unix_us`, `unix_ns`, or a
+    /// `strftime` format such as `%Y-%m-%d %H:%M:%S`
+    #[serde(default)]
+    pub(crate) format: Option<String>,
+    /// The timezone of times without an offset, `UTC` by default
+    #[serde(default)]
+    pub(crate) timezone: Option<String>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum FieldType {
+    Float,
+    Integer,
+    Unsigned,
+    Boolean,
+    String,
+}
+
+impl std::str::FromStr for FieldType {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        Ok(match s {
+            "float" => Self::Float,
+            "integer" => Self::Integer,
+            "unsigned" => Self::Unsigned,
+            "boolean" => Self::Boolean,
+            "string" => Self::String,
+            _ => return Err(Error::FieldType(s.to_string())),
+        })
+    }
+}
+
+/// Flags describing the mapping of CSV columns, which override those of the
+/// `--csv-mapping` file.
+#[derive(Debug, Default, clap::Parser)]
+pub(crate) struct CsvArgs {
+    /// JSON file describing how the columns of CSV files map to points
+    #[clap(long = "csv-mapping")]
+    mapping: Option<PathBuf>,
+
+    /// The measurement of the points written from CSV files
+    #[clap(long = "csv-measurement")]
+    measurement: Option<String>,
+
+    /// The CSV column holding the time of each point
+    #[clap(long = "csv-time-column")]
+    time_column: Option<String>,
+
+    /// The format of the time column: `rfc3339`, `unix`, `unix_ms`, `unix_us`,
+    /// `unix_ns`, or a `strftime` format such as `%Y-%m-%d %H:%M:%S`
+    #[clap(long = "csv-time-format")]
+    time_format: Option<String>,
+
+    /// The timezone of times without an offset, e.g. `Europe/Berlin`
+    #[clap(long = "csv-timezone")]
+    timezone: Option<String>,
+
+    /// Comma separated CSV columns holding tags
+    #[clap(long = "csv-tags", value_delimiter = ',')]
+    tags: Vec<String>,
+
+    /// Comma separated CSV columns holding fields, each optionally followed by
+    /// its type, e.g. `temperature,humidity:integer`; the type is `float` when
+    /// not given
+    ///
+    /// If not specified, every column that is neither the time nor a tag is a
+    /// field, with its type inferred from its values in the first 100
+    /// records.
+    #[clap(long = "csv-fields", value_delimiter = ',')]
+    fields: Vec<String>,
+
+    /// The character separating CSV columns, which must be ASCII
+    #[clap(long = "csv-delimiter")]
+    delimiter: Option<char>,
+}
+
+impl CsvArgs {
+    /// The mapping of the `--csv-mapping` file, if any, with the flags applied.
+    pub(crate) fn mapping(&self) -> Result<CsvMapping> {
+        let mut mapping = match &self.mapping {
+            Some(path) => CsvMapping::load(path)?,
+            None => CsvMapping {
+                delimiter: default_delimiter(),
+                ..Default::default()
+            },
+        };
+        if let Some(measurement) = &self.measurement {
+            mapping.measurement = Some(measurement.clone());
+        }
+        if let Some(column) = &self.time_column {
+            mapping.time.column = Some(column.clone());
+        }
+        if let Some(format) = &self.time_format {
+            mapping.time.format = Some(format.clone());
+        }
+        if let Some(timezone) = &self.timezone {
+            mapping.time.timezone = Some(timezone.clone());
+        }
+        if !self.tags.is_empty() {
+            mapping.tags = self.tags.clone();
+        }
+        if !self.fields.is_empty() {
+            mapping.fields = self
+                .fields
+                .iter()
+                .map(|field| match field.split_once(':') {
+                    Some((name, field_type)) => Ok((name.to_string(), field_type.parse()?)),
+                    None => Ok((field.to_string(), FieldType::Float)),
+                })
+                .collect::<Result<_>>()?;
+        }
+        if let Some(delimiter) = self.delimiter {
+            mapping.delimiter = delimiter;
+        }
+        Ok(mapping)
+    }
+}
+
+impl CsvMapping {
+    pub(crate) fn load(path: &Path) -> Result<Self> {
+        let contents = std::fs::read(path).map_err(|source| Error::ReadMapping {
+            path: path.to_path_buf(),
+            source,
+        })?;
+        serde_json::from_slice(&contents).map_err(|source| Error::ParseMapping {
+            path: path.to_path_buf(),
+            source,
+        })
+    }
+}
+
+/// Reads the records of a CSV file as lines of line protocol.
+pub(crate) struct CsvLines<R> {
+    reader: csv::Reader<R>,
+    record: csv::StringRecord,
+    /// The records read to infer the types of the fields, not yet returned
+    sample: VecDeque<csv::StringRecord>,
+    measurement: String,
+    time: (usize, TimeFormat, Tz),
+    tags: Vec<(String, usize)>,
+    /// The name, column and type of each field, the type being `None` until
+    /// it is inferred from a value
+    fields: Vec<(String, usize, Option<FieldType>)>,
+}
+
+impl<R> std::fmt::Debug for CsvLines<R> {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("CsvLines")
+            .field("measurement", &self.measurement)
+            .field("tags", &self.tags)
+            .field("fields", &self.fields)
+            .finish_non_exhaustive()
+    }
+}
+
+#[derive(Debug, Clone)]
+enum TimeFormat {
+    Rfc3339,
+    Unix(i64),
+    Strftime(String),
+}
+
+impl<R: std::io::Read> CsvLines<R> {
+    pub(crate) fn new(mapping: &CsvMapping, reader: R) -> Result<Self> {
+        if !mapping.delimiter.is_ascii() {
+            return Err(Error::Delimiter(mapping.delimiter));
+        }
+        let mut reader = csv::ReaderBuilder::new()
+            .delimiter(mapping.delimiter as u8)
+            .trim(csv::Trim::All)
+            .from_reader(reader);
+        let header = reader.headers()?.clone();
+        let column = |name: &str| {
+            header
+                .iter()
+                .position(|h| h == name)
+                .ok_or_else(|| Error::MissingColumn(name.to_string()))
+        };
+
+        let measurement = mapping.measurement.clone().ok_or(Error::NoMeasurement)?;
+        let time_column = mapping.time.column.as_deref().ok_or(Error::NoTimeColumn)?;
+        let time_format = match mapping.time.format.as_deref().unwrap_or("rfc3339") {
+            "rfc3339" => TimeFormat::Rfc3339,
+            "unix" => TimeFormat::Unix(1_000_000_000),
+            "unix_ms" => TimeFormat::Unix(1_000_000),
+            "unix_us" => TimeFormat::Unix(1_000),
+            "unix_ns" => TimeFormat::Unix(1),
+            format => TimeFormat::Strftime(format.to_string()),
+        };
+        let timezone = match mapping.time.timezone.as_deref() {
+            None => Tz::UTC,
+            Some(tz) => tz.parse().map_err(|_| Error::Timezone(tz.to_string()))?,
+        };
+        let time = (column(time_column)?, time_format, timezone);
+
+        let tags = mapping
+            .tags
+            .iter()
+            .map(|tag| Ok((tag.clone(), column(tag)?)))
+            .collect::<Result<_>>()?;
+        let mut fields: Vec<(String, usize, Option<FieldType>)> = if mapping.fields.is_empty() {
+            header
+                .iter()
+                .enumerate()
+                .filter(|(_, name)| *name != time_column && !mapping.tags.iter().any(|t| t == name))
+                .map(|(i, name)| (name.to_string(), i, None))
+                .collect()
+        } else {
+            mapping
+                .fields
+                .iter()
+                .map(|(field, field_type)| Ok((field.clone(), column(field)?, Some(*field_type))))
+                .collect::<Result<_>>()?
+        };
+
+        let mut sample = VecDeque::new();
+        if fields.iter().any(|(_, _, field_type)| field_type.is_none()) {
+            let mut record = csv::StringRecord::new();
+            while sample.len() < INFER_TYPES_FROM && reader.read_record(&mut record)? {
+                sample.push_back(record.clone());
+            }
+            for (_, i, field_type) in &mut fields {
+                *field_type = infer_type(sample.iter().map(|r| r.get(*i).unwrap_or_default()));
+            }
+        }
+
+        Ok(Self {
+            reader,
+            record: csv::StringRecord::new(),
+            sample,
+            measurement,
+            time,
+            tags,
+            fields,
+        })
+    }
+
+    /// The next record of the file as line protocol, or `None` at the end of
+    /// the file.
+    pub(crate) fn next_line(&mut self) -> Result<Option<String>> {
+        if let Some(record) = self.sample.pop_front() {
+            self.record = record;
+        } else if !self.reader.read_record(&mut self.record)? {
+            return Ok(None);
+        }
+        let record_number = self.record.position().map(|p| p.record()).unwrap_or(0);
+        let invalid = |message: String| Error::Record {
+            record: record_number,
+            message,
+        };
+        let record = &self.record;
+        let value = |i: usize| record.get(i).unwrap_or_default();
+
+        let mut line = escape(&self.measurement, &[',', ' ']);
+        for (tag, i) in &self.tags {
+            let tag_value = value(*i);
+            if !tag_value.is_empty() {
+                write!(
+                    line,
+                    ",{}={}",
+                    escape(tag, &[',', '=', ' ']),
+                    escape(tag_value, &[',', '=', ' '])
+                )
+                .unwrap();
+            }
+        }
+
+        let mut separator = ' ';
+        for (field, i, field_type) in &mut self.fields {
+            let field_value = value(*i);
+            if field_value.is_empty() {
+                continue;
+            }
+            // the column was empty in all the records the type was inferred
+            // from
+            let field_type = *field_type
+                .get_or_insert_with(|| infer_type([field_value]).expect("the value is not empty"));
+            let field_value = format_field(field_value, field_type)
+                .ok_or_else(|| invalid(format!("invalid value '{field_value}' for {field}")))?;
+            write!(
+                line,
+                "{separator}{}={field_value}",
+                escape(field, &[',', '=', ' '])
+            )
+            .unwrap();
+            separator = ',';
+        }
+        if separator == ' ' {
+            return Err(invalid("no field has a value".to_string()));
+        }
+
+        let (column, format, timezone) = &self.time;
+        let time = value(*column);
+        let nanos = parse_time(time, format, timezone)
+            .ok_or_else(|| invalid(format!("invalid time '{time}'")))?;
+        write!(line, " {nanos}").unwrap();
+
+        Ok(Some(line))
+    }
+}
+
+fn parse_time(time: &str, format: &TimeFormat, timezone: &Tz) -> Option<i64> {
+    match format {
+        TimeFormat::Unix(multiplier) => return time.parse::<i64>().ok()?.checked_mul(*multiplier),
+        TimeFormat::Rfc3339 => match DateTime::parse_from_rfc3339(time) {
+            Ok(time) => time.timestamp_nanos_opt(),
+            Err(_) => {
+                let naive = NaiveDateTime::parse_from_str(time, "%Y-%m-%dT%H:%M:%S%.f").ok()?;
+                timezone
+                    .from_local_datetime(&naive)
+                    .earliest()?
+                    .timestamp_nanos_opt()
+            }
+        },
+        TimeFormat::Strftime(format) => match DateTime::parse_from_str(time, format) {
+            Ok(time) => time.timestamp_nanos_opt(),
+            Err(_) => {
+                let naive = NaiveDateTime::parse_from_str(time, format).ok()?;
+                timezone
+                    .from_local_datetime(&naive)
+                    .earliest()?
+                    .timestamp_nanos_opt()
+            }
+        },
+    }
+}
+
+/// The narrowest type of all the non-empty `values`, or `None` if they are all
+/// empty.
+///
+/// Integers are widened to floats when there are both, and values of any
+/// other mix of types are strings.
+fn infer_type<'a>(values: impl IntoIterator<Item = &'a str>) -> Option<FieldType> {
+    let mut inferred = None;
+    for value in values.into_iter().filter(|v| !v.is_empty()) {
+        let value_type = if value.parse::<i64>().is_ok() {
+            FieldType::Integer
+        } else if value.parse::<f64>().is_ok() {
+            FieldType::Float
+        } else if parse_bool(value).is_some() {
+            FieldType::Boolean
+        } else {
+            FieldType::String
+        };
+        inferred = Some(match (inferred, value_type) {
+            (None, value_type) => value_type,
+            (Some(inferred), value_type) if inferred == value_type => inferred,
+            (
+                Some(FieldType::Integer | FieldType::Float),
+                FieldType::Integer | FieldType::Float,
+            ) => FieldType::Float,
+            _ => return Some(FieldType::String),
+        });
+    }
+    inferred
+}
+
+/// `value` as a line protocol field value of `field_type`, or `None` if it
+/// is not a value of that type.
+///
+/// Line protocol cannot represent NaN or infinite floats, so those are not
+/// values of any float field.
+fn format_field(value: &str, field_type: FieldType) -> Option<String> {
+    Some(match field_type {
+        FieldType::Float => value
+            .parse::<f64>()
+            .ok()
+            .filter(|f| f.is_finite())?
+            .to_string(),
+        FieldType::Integer => format!("{}i", value.parse::<i64>().ok()?),
+        FieldType::Unsigned => format!("{}u", value.parse::<u64>().ok()?),
+        FieldType::Boolean => parse_bool(value)?.to_string(),
+        FieldType::String => format!("\"{}\"", escape(value, &['"', '\\'])),
+    })
+}
+
+fn parse_bool(value: &str) -> Option<bool> {
+    match value.to_ascii_lowercase().as_str() {
+        "true" | "t" | "yes" => Some(true),
+        "false" | "f" | "no" => Some(false),
+        _ => None,
+    }
+}
+
+pub(super) fn escape(s: &str, special: &[char]) -> String {
+    let mut escaped = String::with_capacity(s.len());
+    for c in s.chars() {
+        if special.contains(&c) {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn mapping() -> CsvMapping {
+        CsvMapping {
+            measurement: Some("m".to_string()),
+            time: TimeMapping {
+                column: Some("time".to_string()),
+                format: Some("unix".to_string()),
+                timezone: None,
+            },
+            delimiter: default_delimiter(),
+            ..Default::default()
+        }
+    }
+
+    fn lines(mapping: &CsvMapping, csv: &str) -> Vec<Result<String>> {
+        let mut lines = CsvLines::new(mapping, csv.as_bytes()).unwrap();
+        std::iter::from_fn(|| lines.next_line().transpose()).collect()
+    }
+
+    #[test]
+    fn field_types_are_inferred_per_column() {
+        let csv = "\
+time,host,count,ratio,up,name,late
+1,a,1,2,true,x,
+2,b,2,2.5,false,3,
+3,c,3,3,t,y,4
+";
+        let mut mapping = mapping();
+        mapping.tags = vec!["host".to_string()];
+        let lines: Vec<_> = lines(&mapping, csv)
+            .into_iter()
+            .map(Result::unwrap)
+            .collect();
+        assert_eq!(
+            lines,
+            [
+                r#"m,host=a count=1i,ratio=2,up=true,name="x" 1000000000"#,
+                r#"m,host=b count=2i,ratio=2.5,up=false,name="3" 2000000000"#,
+                r#"m,host=c count=3i,ratio=3,up=true,name="y",late=4i 3000000000"#,
+            ]
+        );
+    }
+
+    #[test]
+    fn values_not_of_the_inferred_type_are_errors() {
+        let mut csv = "time,count\n".to_string();
+        for i in 0..INFER_TYPES_FROM {
+            csv.push_str(&format!("{i},{i}\n"));
+        }
+        csv.push_str("100,1.5\n");
+
+        let lines = lines(&mapping(), &csv);
+        assert_eq!(lines.len(), INFER_TYPES_FROM + 1);
+        assert!(lines[..INFER_TYPES_FROM].iter().all(Result::is_ok));
+        assert!(matches!(lines[INFER_TYPES_FROM], Err(Error::Record { .. })));
+    }
+
+    #[test]
+    fn non_finite_floats_are_errors() {
+        let mut explicit = mapping();
+        explicit.fields = [("value".to_string(), FieldType::Float)].into();
+        for mapping in [mapping(), explicit] {
+            let lines = lines(&mapping, "time,value\n1,1.5\n2,NaN\n3,inf\n4,-inf\n");
+            assert_eq!(lines[0].as_ref().unwrap(), "m value=1.5 1000000000");
+            for line in &lines[1..] {
+                assert!(matches!(line, Err(Error::Record { .. })), "{line:?}");
+            }
+        }
+    }
+
+    #[test]
+    fn delimiters() {
+        let mut mapping = mapping();
+        mapping.tags = vec!["host".to_string()];
+        mapping.delimiter = ';';
+        assert_eq!(
+            lines(&mapping, "time;host;value\n1;a;2\n")[0]
+                .as_ref()
+                .unwrap(),
+            "m,host=a value=2i 1000000000"
+        );
+
+        // would be truncated to a different byte
+        mapping.delimiter = 'Ĭ';
+        assert!(matches!(
+            CsvLines::new(&mapping, "time".as_bytes()),
+            Err(Error::Delimiter('Ĭ'))
+        ));
+    }
+
+    #[test]
+    fn infer_types() {
+        use FieldType::*;
+        for (values, expected) in [
+            (vec![], None),
+            (vec!["", ""], None),
+            (vec!["1", "", "-2"], Some(Integer)),
+            (vec!["1", "2.5"], Some(Float)),
+            (vec!["1e3", "2"], Some(Float)),
+            (vec!["true", "F", "no"], Some(Boolean)),
+            (vec!["1", "true"], Some(String)),
+            (vec!["1.5", "x", "2"], Some(String)),
+        ] {
+            assert_eq!(infer_type(values.iter().copied()), expected, "{values:?}");
+        }
+    }
+
+    #[test]
+    fn format_fields() {
+        use FieldType::*;
+        for (value, field_type, expected) in [
+            ("1.5", Float, Some("1.5")),
+            ("2", Float, Some("2")),
+            ("NaN", Float, None),
+            ("inf", Float, None),
+            ("x", Float, None),
+            ("-3", Integer, Some("-3i")),
+            ("1.5", Integer, None),
+            ("3", Unsigned, Some("3u")),
+            ("-3", Unsigned, None),
+            ("Yes", Boolean, Some("true")),
+            ("f", Boolean, Some("false")),
+            ("maybe", Boolean, None),
+            (r#"say "hi" \o/"#, String, Some(r#""say \"hi\" \\o/""#)),
+        ] {
+            assert_eq!(
+                format_field(value, field_type).as_deref(),
+                expected,
+                "{value} as {field_type:?}"
+            );
+        }
+    }
+}
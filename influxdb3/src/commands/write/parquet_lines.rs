@@ -0,0 +1,387 @@
+//! Conversion of Parquet files to line protocol.
+//!
+//! Files exported with `influxdb3 export parquet` record the measurement and
+//! the tag, field or time type of each column in their schema, which is used
+//! to write them back. Other files are written to the measurement named after
+//! the file, with the `time` column as the time of each point, string columns
+//! as tags and every other column as a field.
+
+use std::collections::VecDeque;
+use std::fmt::Write;
+use std::path::Path;
+
+use arrow::array::{Array, ArrayRef, AsArray};
+use arrow::compute::cast;
+use arrow::datatypes::{DataType, Float64Type, Int64Type, TimeUnit, UInt64Type};
+use arrow::record_batch::RecordBatch;
+use parquet::arrow::arrow_reader::{ParquetRecordBatchReader, ParquetRecordBatchReaderBuilder};
+use schema::{InfluxColumnType, Schema, TIME_COLUMN_NAME};
+
+use super::mapping::escape;
+
+#[derive(Debug, thiserror::Error)]
+pub(crate) enum Error {
+    #[error("error reading file: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("parquet error: {0}")]
+    Parquet(#[from] parquet::errors::ParquetError),
+
+    #[error("arrow error: {0}")]
+    Arrow(#[from] arrow::error::ArrowError),
+
+    #[error("the file has no '{TIME_COLUMN_NAME}' column")]
+    NoTimeColumn,
+
+    #[error("column '{name}' has unsupported type {data_type}")]
+    UnsupportedType { name: String, data_type: DataType },
+
+    #[error("row {row}: no field has a value")]
+    NoFields { row: usize },
+
+    #[error("row {row}: the time is null")]
+    NullTime { row: usize },
+
+    #[error("row {row}: field {name} is {value}, which line protocol cannot represent")]
+    NonFiniteFloat {
+        row: usize,
+        name: String,
+        value: f64,
+    },
+}
+
+pub(crate) type Result<T, E = Error> = std::result::Result<T, E>;
+
+#[derive(Debug, Clone, Copy)]
+enum Role {
+    Tag,
+    Field,
+    Time,
+}
+
+/// Reads the rows of a Parquet file as lines of line protocol.
+pub(crate) struct ParquetLines {
+    reader: ParquetRecordBatchReader,
+    measurement: String,
+    roles: Vec<(String, Role)>,
+    lines: VecDeque<String>,
+    row: usize,
+}
+
+impl std::fmt::Debug for ParquetLines {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ParquetLines")
+            .field("measurement", &self.measurement)
+            .field("roles", &self.roles)
+            .field("row", &self.row)
+            .finish_non_exhaustive()
+    }
+}
+
+impl ParquetLines {
+    pub(crate) fn open(path: &Path) -> Result<Self> {
+        let builder = ParquetRecordBatchReaderBuilder::try_new(std::fs::File::open(path)?)?;
+        let arrow_schema = builder.schema();
+
+        let (measurement, roles) = match Schema::try_from(std::sync::Arc::clone(arrow_schema)) {
+            Ok(schema) if schema.measurement().is_some() => {
+                let roles = schema
+                    .iter()
+                    .map(|(column_type, field)| {
+                        let role = match column_type {
+                            InfluxColumnType::Tag => Role::Tag,
+                            InfluxColumnType::Field(_) => Role::Field,
+                            InfluxColumnType::Timestamp => Role::Time,
+                        };
+                        (field.name().to_string(), role)
+                    })
+                    .collect();
+                (schema.measurement().cloned().unwrap_or_default(), roles)
+            }
+            _ => {
+                let roles = arrow_schema
+                    .fields()
+                    .iter()
+                    .map(|field| {
+                        let role = if field.name() == TIME_COLUMN_NAME {
+                            Role::Time
+                        } else if is_string(field.data_type()) {
+                            Role::Tag
+                        } else {
+                            Role::Field
+                        };
+                        (field.name().to_string(), role)
+                    })
+                    .collect();
+                let stem = path.file_stem().unwrap_or_default().to_string_lossy();
+                (stem.to_string(), roles)
+            }
+        };
+        if !roles.iter().any(|(_, role)| matches!(role, Role::Time)) {
+            return Err(Error::NoTimeColumn);
+        }
+
+        Ok(Self {
+            reader: builder.build()?,
+            measurement,
+            roles,
+            lines: VecDeque::new(),
+            row: 0,
+        })
+    }
+
+    /// The next row of the file as line protocol, or `None` at the end of the
+    /// file.
+    pub(crate) fn next_line(&mut self) -> Result<Option<String>> {
+        while self.lines.is_empty() {
+            let Some(batch) = self.reader.next().transpose()? else {
+                return Ok(None);
+            };
+            self.convert(&batch)?;
+        }
+        Ok(self.lines.pop_front())
+    }
+
+    fn convert(&mut self, batch: &RecordBatch) -> Result<()> {
+        let mut tags = Vec::new();
+        let mut fields = Vec::new();
+        let mut time = None;
+        for (name, role) in &self.roles {
+            let Some(column) = batch.column_by_name(name) else {
+                continue;
+            };
+            match role {
+                Role::Tag => tags.push((
+                    escape(name, &[',', '=', ' ']),
+                    cast(column, &DataType::Utf8)?,
+                )),
+                Role::Field => {
+                    fields.push((escape(name, &[',', '=', ' ']), field_column(name, column)?))
+                }
+                Role::Time => time = Some(time_column(column)?),
+            }
+        }
+        let time = time.ok_or(Error::NoTimeColumn)?;
+        let time = time.as_primitive::<Int64Type>();
+
+        let measurement = escape(&self.measurement, &[',', ' ']);
+        for i in 0..batch.num_rows() {
+            self.row += 1;
+            let mut line = measurement.clone();
+            for (name, column) in &tags {
+                // line protocol has no empty tag values, so they are left out
+                // as nulls are
+                let value = column
+                    .is_valid(i)
+                    .then(|| column.as_string::<i32>().value(i))
+                    .filter(|value| !value.is_empty());
+                if let Some(value) = value {
+                    write!(line, ",{name}={}", escape(value, &[',', '=', ' '])).unwrap();
+                }
+            }
+
+            let mut separator = ' ';
+            for (name, column) in &fields {
+                if let Some(value) = format_field(column, i, self.row, name)? {
+                    write!(line, "{separator}{name}={value}").unwrap();
+                    separator = ',';
+                }
+            }
+            if separator == ' ' {
+                return Err(Error::NoFields { row: self.row });
+            }
+
+            if time.is_null(i) {
+                return Err(Error::NullTime { row: self.row });
+            }
+            write!(line, " {}", time.value(i)).unwrap();
+            self.lines.push_back(line);
+        }
+        Ok(())
+    }
+}
+
+fn is_string(data_type: &DataType) -> bool {
+    match data_type {
+        DataType::Utf8 | DataType::LargeUtf8 => true,
+        DataType::Dictionary(_, value) => is_string(value),
+        _ => false,
+    }
+}
+
+/// The times of `column` in nanoseconds since the epoch.
+///
+/// Timestamps and dates are converted from their unit, and integers are taken
+/// to be nanoseconds already.
+fn time_column(column: &ArrayRef) -> Result<ArrayRef> {
+    let nanos = match column.data_type() {
+        // keeping the timezone, as removing it would shift the times to
+        // local time rather than only change their unit
+        DataType::Timestamp(_, timezone) => cast(
+            column,
+            &DataType::Timestamp(TimeUnit::Nanosecond, timezone.clone()),
+        )?,
+        DataType::Date32 | DataType::Date64 => {
+            cast(column, &DataType::Timestamp(TimeUnit::Nanosecond, None))?
+        }
+        _ => std::sync::Arc::clone(column),
+    };
+    Ok(cast(&nanos, &DataType::Int64)?)
+}
+
+/// Cast `column` to the arrow type of the line protocol field type it maps to.
+fn field_column(name: &str, column: &ArrayRef) -> Result<ArrayRef> {
+    let target = match column.data_type() {
+        DataType::Float16 | DataType::Float32 | DataType::Float64 => DataType::Float64,
+        DataType::Int8 | DataType::Int16 | DataType::Int32 | DataType::Int64 => DataType::Int64,
+        DataType::UInt8 | DataType::UInt16 | DataType::UInt32 | DataType::UInt64 => {
+            DataType::UInt64
+        }
+        DataType::Boolean => DataType::Boolean,
+        data_type if is_string(data_type) => DataType::Utf8,
+        data_type => {
+            return Err(Error::UnsupportedType {
+                name: name.to_string(),
+                data_type: data_type.clone(),
+            })
+        }
+    };
+    Ok(cast(column, &target)?)
+}
+
+/// The value of field `name` in row `i` of `column`, the `row`th of the file,
+/// or `None` if it is null.
+///
+/// Line protocol cannot represent NaN or infinite floats, so those are errors.
+fn format_field(column: &ArrayRef, i: usize, row: usize, name: &str) -> Result<Option<String>> {
+    if column.is_null(i) {
+        return Ok(None);
+    }
+    Ok(Some(match column.data_type() {
+        DataType::Float64 => {
+            let value = column.as_primitive::<Float64Type>().value(i);
+            if !value.is_finite() {
+                return Err(Error::NonFiniteFloat {
+                    row,
+                    name: name.to_string(),
+                    value,
+                });
+            }
+            value.to_string()
+        }
+        DataType::Int64 => format!("{}i", column.as_primitive::<Int64Type>().value(i)),
+        DataType::UInt64 => format!("{}u", column.as_primitive::<UInt64Type>().value(i)),
+        DataType::Boolean => column.as_boolean().value(i).to_string(),
+        _ => format!(
+            "\"{}\"",
+            escape(column.as_string::<i32>().value(i), &['"', '\\'])
+        ),
+    }))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use arrow::array::{
+        Float64Array, Int64Array, StringArray, TimestampMillisecondArray, TimestampSecondArray,
+    };
+    use parquet::arrow::ArrowWriter;
+    use std::sync::Arc;
+
+    fn lines(time: ArrayRef) -> Vec<String> {
+        let dir = test_helpers::tmp_dir().unwrap();
+        let mut lines = open(
+            dir.path(),
+            [
+                ("time", time),
+                (
+                    "usage",
+                    Arc::new(Float64Array::from(vec![0.5, 1.5])) as ArrayRef,
+                ),
+            ],
+        );
+        std::iter::from_fn(|| lines.next_line().unwrap()).collect()
+    }
+
+    /// Write `columns` to `cpu.parquet` in `dir` and open it.
+    fn open<const N: usize>(dir: &Path, columns: [(&str, ArrayRef); N]) -> ParquetLines {
+        let path = dir.join("cpu.parquet");
+        let batch = RecordBatch::try_from_iter(columns).unwrap();
+        let mut writer =
+            ArrowWriter::try_new(std::fs::File::create(&path).unwrap(), batch.schema(), None)
+                .unwrap();
+        writer.write(&batch).unwrap();
+        writer.close().unwrap();
+
+        ParquetLines::open(&path).unwrap()
+    }
+
+    #[test]
+    fn empty_tags_are_left_out() {
+        let dir = test_helpers::tmp_dir().unwrap();
+        let mut lines = open(
+            dir.path(),
+            [
+                ("time", Arc::new(Int64Array::from(vec![1, 2])) as ArrayRef),
+                (
+                    "host",
+                    Arc::new(StringArray::from(vec!["", "a"])) as ArrayRef,
+                ),
+                (
+                    "usage",
+                    Arc::new(Float64Array::from(vec![0.5, 1.5])) as ArrayRef,
+                ),
+            ],
+        );
+        let lines: Vec<_> = std::iter::from_fn(|| lines.next_line().unwrap()).collect();
+        assert_eq!(lines, ["cpu usage=0.5 1", "cpu,host=a usage=1.5 2"]);
+    }
+
+    #[test]
+    fn non_finite_floats_are_errors() {
+        let dir = test_helpers::tmp_dir().unwrap();
+        let mut lines = open(
+            dir.path(),
+            [
+                ("time", Arc::new(Int64Array::from(vec![1, 2])) as ArrayRef),
+                (
+                    "usage",
+                    Arc::new(Float64Array::from(vec![0.5, f64::INFINITY])) as ArrayRef,
+                ),
+            ],
+        );
+        assert!(matches!(
+            lines.next_line(),
+            Err(Error::NonFiniteFloat { row: 2, .. })
+        ));
+    }
+
+    #[test]
+    fn times_are_converted_to_nanoseconds() {
+        let expected = [
+            "cpu usage=0.5 1700000000000000000",
+            "cpu usage=1.5 1700000001000000000",
+        ];
+        assert_eq!(
+            lines(Arc::new(TimestampMillisecondArray::from(vec![
+                1_700_000_000_000,
+                1_700_000_001_000
+            ]))),
+            expected
+        );
+        assert_eq!(
+            lines(Arc::new(
+                TimestampSecondArray::from(vec![1_700_000_000, 1_700_000_001])
+                    .with_timezone("+02:00")
+            )),
+            expected
+        );
+        assert_eq!(
+            lines(Arc::new(Int64Array::from(vec![
+                1_700_000_000_000_000_000,
+                1_700_000_001_000_000_000
+            ]))),
+            expected
+        );
+    }
+}
@@ -21,14 +21,20 @@ use tokio::runtime::Runtime;
 use trogging::{
     cli::LoggingConfigBuilderExt,
     tracing_subscriber::{prelude::*, Registry},
-    TroggingGuard,
+    LogFilterHandle, TroggingGuard,
 };
 
 mod commands {
     pub(crate) mod common;
+    pub mod config;
     pub mod create;
+    pub mod export;
+    pub mod gateway;
+    pub mod generate;
     pub mod query;
+    pub mod query_bench;
     pub mod serve;
+    pub mod shell;
     pub mod write;
 }
 
@@ -91,14 +97,35 @@ enum Command {
     /// Run the InfluxDB 3.0 server
     Serve(commands::serve::Config),
 
+    /// Accept writes, spool them on local disk and forward them to an InfluxDB 3.0 server
+    Gateway(commands::gateway::Config),
+
     /// Perform a query against a running InfluxDB 3.0 server
     Query(commands::query::Config),
 
+    /// Time a suite of queries against a running InfluxDB 3.0 server
+    QueryBench(commands::query_bench::Config),
+
+    /// Run queries interactively against a running InfluxDB 3.0 server
+    Shell(commands::shell::Config),
+
     /// Perform a set of writes to a running InfluxDB 3.0 server
     Write(commands::write::Config),
 
     /// Create new resources
     Create(commands::create::Config),
+
+    /// Export data from a running InfluxDB 3.0 server
+    Export(commands::export::Config),
+
+    /// Write synthetic data to a running InfluxDB 3.0 server
+    Generate(commands::generate::Config),
+
+    /// Print the configuration the server would run with, secrets redacted
+    PrintConfig(commands::config::PrintConfig),
+
+    /// Check the server configuration in the environment or an env file
+    ValidateConfig(commands::config::ValidateConfig),
 }
 
 fn main() -> Result<(), std::io::Error> {
@@ -109,11 +136,17 @@ fn main() -> Result<(), std::io::Error> {
 
     let config: Config = clap::Parser::parse();
 
+    // this changes the environment, so it must run before the runtime starts
+    // any thread
+    let systemd_listener = influxdb3_server::listener::take_systemd_listener();
+
     let tokio_runtime = get_runtime(None)?;
     tokio_runtime.block_on(async move {
-        fn handle_init_logs(r: Result<TroggingGuard, trogging::Error>) -> TroggingGuard {
+        fn handle_init_logs(
+            r: Result<(TroggingGuard, LogFilterHandle), trogging::Error>,
+        ) -> (TroggingGuard, LogFilterHandle) {
             match r {
-                Ok(guard) => guard,
+                Ok(r) => r,
                 Err(e) => {
                     eprintln!("Initializing logs failed: {e}");
                     std::process::exit(ReturnCode::Failure as _);
@@ -124,19 +157,34 @@ fn main() -> Result<(), std::io::Error> {
         match config.command {
             None => println!("command required, --help for help"),
             Some(Command::Serve(config)) => {
-                let _tracing_guard =
+                let (_tracing_guard, log_filter) =
                     handle_init_logs(init_logs_and_tracing(&config.logging_config));
-                if let Err(e) = commands::serve::command(config).await {
+                if let Err(e) = commands::serve::command(config, log_filter, systemd_listener).await
+                {
                     eprintln!("Serve command failed: {e}");
                     std::process::exit(ReturnCode::Failure as _)
                 }
             }
+            Some(Command::Gateway(config)) => {
+                let (_tracing_guard, _log_filter) =
+                    handle_init_logs(init_logs_and_tracing(&config.logging_config));
+                if let Err(e) = commands::gateway::command(config).await {
+                    eprintln!("Gateway command failed: {e}");
+                    std::process::exit(ReturnCode::Failure as _)
+                }
+            }
             Some(Command::Query(config)) => {
                 if let Err(e) = commands::query::command(config).await {
                     eprintln!("Query command failed: {e}");
                     std::process::exit(ReturnCode::Failure as _)
                 }
             }
+            Some(Command::QueryBench(config)) => {
+                if let Err(e) = commands::query_bench::command(config).await {
+                    eprintln!("Query bench command failed: {e}");
+                    std::process::exit(ReturnCode::Failure as _)
+                }
+            }
             Some(Command::Write(config)) => {
                 if let Err(e) = commands::write::command(config).await {
                     eprintln!("Write command failed: {e}");
@@ -149,6 +197,36 @@ fn main() -> Result<(), std::io::Error> {
                     std::process::exit(ReturnCode::Failure as _)
                 }
             }
+            Some(Command::Shell(config)) => {
+                if let Err(e) = commands::shell::command(config).await {
+                    eprintln!("Shell command failed: {e}");
+                    std::process::exit(ReturnCode::Failure as _)
+                }
+            }
+            Some(Command::Export(config)) => {
+                if let Err(e) = commands::export::command(config).await {
+                    eprintln!("Export command failed: {e}");
+                    std::process::exit(ReturnCode::Failure as _)
+                }
+            }
+            Some(Command::Generate(config)) => {
+                if let Err(e) = commands::generate::command(config).await {
+                    eprintln!("Generate command failed: {e}");
+                    std::process::exit(ReturnCode::Failure as _)
+                }
+            }
+            Some(Command::PrintConfig(config)) => {
+                if let Err(e) = commands::config::print_config(config) {
+                    eprintln!("Print config command failed: {e}");
+                    std::process::exit(ReturnCode::Failure as _)
+                }
+            }
+            Some(Command::ValidateConfig(config)) => {
+                if let Err(e) = commands::config::validate_config(config) {
+                    eprintln!("Validate config command failed: {e}");
+                    std::process::exit(ReturnCode::Failure as _)
+                }
+            }
         }
     });
 
@@ -260,10 +338,10 @@ unsafe fn set_signal_handler(signal: libc::c_int, handler: unsafe extern "C" fn(
 
 fn init_logs_and_tracing(
     config: &trogging::cli::LoggingConfig,
-) -> Result<TroggingGuard, trogging::Error> {
-    let log_layer = trogging::Builder::new()
+) -> Result<(TroggingGuard, LogFilterHandle), trogging::Error> {
+    let (log_layer, log_filter) = trogging::Builder::new()
         .with_logging_config(config)
-        .build()?;
+        .build_reloadable()?;
 
     let layers = log_layer;
 
@@ -279,5 +357,5 @@ fn init_logs_and_tracing(
     };
 
     let subscriber = Registry::default().with(layers);
-    trogging::install_global(subscriber)
+    Ok((trogging::install_global(subscriber)?, log_filter))
 }
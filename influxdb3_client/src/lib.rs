@@ -1,3 +1,4 @@
+use std::num::NonZeroUsize;
 use std::string::FromUtf8Error;
 
 use bytes::Bytes;
@@ -24,6 +25,9 @@ pub enum Error {
     #[error("failed to send /api/v3/query_sql request: {0}")]
     QuerySqlSend(#[source] reqwest::Error),
 
+    #[error("failed to send /api/v3/export request: {0}")]
+    ExportSend(#[source] reqwest::Error),
+
     #[error("invalid UTF8 in response: {0}")]
     InvalidUtf8(#[from] FromUtf8Error),
 
@@ -33,6 +37,10 @@ pub enum Error {
 
 pub type Result<T> = std::result::Result<T, Error>;
 
+/// The header marking a write to `/api/v3/write_lp` as replicated from
+/// another server
+pub const REPLICATED_HEADER: &str = "x-influxdb3-replicated";
+
 /// The InfluxDB 3.0 Client
 ///
 /// For programmatic access to the HTTP API of InfluxDB 3.0
@@ -101,6 +109,7 @@ impl Client {
             db: db.into(),
             precision: None,
             accept_partial: None,
+            replicated: false,
             body: NoBody,
         }
     }
@@ -131,6 +140,39 @@ impl Client {
             db: db.into(),
             query: query.into(),
             format: None,
+            parallelism: None,
+        }
+    }
+
+    /// Compose a request to the `/api/v3/export` API, which streams the
+    /// contents of a table as a Parquet file
+    ///
+    /// # Example
+    /// ```no_run
+    /// # use influxdb3_client::Client;
+    /// # #[tokio::main]
+    /// # async fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+    /// let client = Client::new("http://localhost:8181")?;
+    /// let mut export = client
+    ///     .api_v3_export("db_name", "cpu")
+    ///     .send()
+    ///     .await
+    ///     .expect("send export request");
+    /// while let Some(chunk) = export.chunk().await? {
+    ///     // write the chunk to a file
+    /// }
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn api_v3_export<D: Into<String>, T: Into<String>>(
+        &self,
+        db: D,
+        table: T,
+    ) -> ExportRequestBuilder<'_> {
+        ExportRequestBuilder {
+            client: self,
+            db: db.into(),
+            table: table.into(),
         }
     }
 }
@@ -176,6 +218,7 @@ pub struct WriteRequestBuilder<'c, B> {
     db: String,
     precision: Option<Precision>,
     accept_partial: Option<bool>,
+    replicated: bool,
     body: B,
 }
 
@@ -191,6 +234,13 @@ impl<'c, B> WriteRequestBuilder<'c, B> {
         self.accept_partial = Some(set_to);
         self
     }
+
+    /// Mark the write as replicated from another server, so that the server
+    /// receiving it does not replicate it in turn
+    pub fn replicated(mut self, set_to: bool) -> Self {
+        self.replicated = set_to;
+        self
+    }
 }
 
 impl<'c> WriteRequestBuilder<'c, NoBody> {
@@ -204,6 +254,7 @@ impl<'c> WriteRequestBuilder<'c, NoBody> {
             db: self.db,
             precision: self.precision,
             accept_partial: self.accept_partial,
+            replicated: self.replicated,
             body: body.into(),
         }
     }
@@ -218,6 +269,9 @@ impl<'c> WriteRequestBuilder<'c, Body> {
         if let Some(token) = &self.client.auth_token {
             req = req.bearer_auth(token.expose_secret());
         }
+        if self.replicated {
+            req = req.header(REPLICATED_HEADER, "true");
+        }
         let resp = req
             .body(self.body)
             .send()
@@ -250,6 +304,7 @@ pub struct QueryRequestBuilder<'c> {
     db: String,
     query: String,
     format: Option<Format>,
+    parallelism: Option<NonZeroUsize>,
 }
 
 // TODO - for now the send method just returns the bytes from the response.
@@ -262,6 +317,12 @@ impl<'c> QueryRequestBuilder<'c> {
         self
     }
 
+    /// Limit the number of partitions the query is executed in concurrently
+    pub fn parallelism(mut self, parallelism: NonZeroUsize) -> Self {
+        self.parallelism = Some(parallelism);
+        self
+    }
+
     /// Send the request to `/api/v3/query_sql`
     pub async fn send(self) -> Result<Bytes> {
         let url = self.client.base_url.join("/api/v3/query_sql")?;
@@ -284,6 +345,57 @@ impl<'c> QueryRequestBuilder<'c> {
     }
 }
 
+/// Used to compose a request to the `/api/v3/export` API
+///
+/// Produced by [`Client::api_v3_export`] method.
+#[derive(Debug)]
+pub struct ExportRequestBuilder<'c> {
+    client: &'c Client,
+    db: String,
+    table: String,
+}
+
+impl<'c> ExportRequestBuilder<'c> {
+    /// Send the request to `/api/v3/export`
+    pub async fn send(self) -> Result<ExportResponse> {
+        let url = self.client.base_url.join("/api/v3/export")?;
+        let mut req = self
+            .client
+            .http_client
+            .get(url)
+            .query(&[("db", &self.db), ("table", &self.table)]);
+        if let Some(token) = &self.client.auth_token {
+            req = req.bearer_auth(token.expose_secret());
+        }
+        let resp = req.send().await.map_err(Error::ExportSend)?;
+
+        match resp.status() {
+            StatusCode::OK => Ok(ExportResponse { resp }),
+            code => {
+                let content = resp.bytes().await.map_err(Error::Bytes)?;
+                Err(Error::ApiError {
+                    code,
+                    message: String::from_utf8(content.to_vec()).map_err(Error::InvalidUtf8)?,
+                })
+            }
+        }
+    }
+}
+
+/// The body of a response from the `/api/v3/export` API, which is read as it
+/// arrives so that large tables need not be held in memory
+#[derive(Debug)]
+pub struct ExportResponse {
+    resp: reqwest::Response,
+}
+
+impl ExportResponse {
+    /// The next chunk of the exported file, or `None` once it is complete
+    pub async fn chunk(&mut self) -> Result<Option<Bytes>> {
+        self.resp.chunk().await.map_err(Error::Bytes)
+    }
+}
+
 /// Query parameters for the `/api/v3/query_sql` API
 #[derive(Debug, Serialize)]
 pub struct QueryParams<'a> {
@@ -291,6 +403,7 @@ pub struct QueryParams<'a> {
     #[serde(rename = "q")]
     query: &'a str,
     format: Option<Format>,
+    parallelism: Option<NonZeroUsize>,
 }
 
 impl<'a> From<&'a QueryRequestBuilder<'a>> for QueryParams<'a> {
@@ -299,6 +412,7 @@ impl<'a> From<&'a QueryRequestBuilder<'a>> for QueryParams<'a> {
             db: &builder.db,
             query: &builder.query,
             format: builder.format,
+            parallelism: builder.parallelism,
         }
     }
 }
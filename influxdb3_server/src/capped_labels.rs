@@ -0,0 +1,143 @@
+//! Capping of the number of series of a metric label.
+//!
+//! A label taking a value per database or measurement could create a series
+//! for every one of them, so only the heaviest keys have a label value of
+//! their own, and the others are counted together under [`OTHER`].
+//!
+//! Each key is weighed by what is recorded for it, such as the points written
+//! to a measurement. Until the limit is reached keys get a label of their own
+//! as they are first seen. Every [`CHOOSE_INTERVAL`] after that, the heaviest
+//! keys are chosen anew and the weights are halved, so that a key that became
+//! heavy is not hidden for good by those seen before it. A key that loses its
+//! label keeps the series it had, which stops increasing.
+
+use parking_lot::Mutex;
+use std::collections::{HashMap, HashSet};
+use std::hash::Hash;
+use std::time::{Duration, Instant};
+
+/// The label value the keys without one of their own are counted under.
+pub(crate) const OTHER: &str = "_other";
+
+/// How often the keys with a label of their own are chosen.
+pub(crate) const CHOOSE_INTERVAL: Duration = Duration::from_secs(60);
+
+/// How many keys are weighed for each label value of their own.
+const CANDIDATES_PER_LABEL: usize = 10;
+
+/// The keys that have a label value of their own.
+#[derive(Debug)]
+pub(crate) struct CappedLabels<K> {
+    max: usize,
+    interval: Duration,
+    state: Mutex<State<K>>,
+}
+
+#[derive(Debug)]
+struct State<K> {
+    tracked: HashSet<K>,
+    weights: HashMap<K, u64>,
+    chosen_at: Instant,
+}
+
+impl<K: Hash + Eq + Clone> CappedLabels<K> {
+    /// Give at most `max` keys a label of their own, choosing them every
+    /// `interval`.
+    pub(crate) fn new(max: usize, interval: Duration) -> Self {
+        Self {
+            max,
+            interval,
+            state: Mutex::new(State {
+                tracked: HashSet::new(),
+                weights: HashMap::new(),
+                chosen_at: Instant::now(),
+            }),
+        }
+    }
+
+    /// Add the weight of each key, and return whether each has a label of its
+    /// own.
+    pub(crate) fn record(&self, weighed: &[(K, u64)]) -> Vec<bool> {
+        let mut state = self.state.lock();
+        if state.chosen_at.elapsed() >= self.interval {
+            self.choose(&mut state);
+        }
+
+        let max_candidates = self.max.saturating_mul(CANDIDATES_PER_LABEL);
+        weighed
+            .iter()
+            .map(|(key, weight)| {
+                match state.weights.get_mut(key) {
+                    Some(w) => *w += weight,
+                    None if state.weights.len() < max_candidates => {
+                        state.weights.insert(key.clone(), *weight);
+                    }
+                    None => {}
+                }
+                if state.tracked.contains(key) {
+                    return true;
+                }
+                if state.tracked.len() < self.max {
+                    state.tracked.insert(key.clone());
+                    return true;
+                }
+                false
+            })
+            .collect()
+    }
+
+    /// Whether `key` has a label of its own.
+    pub(crate) fn is_tracked(&self, key: &K) -> bool {
+        self.state.lock().tracked.contains(key)
+    }
+
+    /// Give the heaviest keys a label of their own.
+    fn choose(&self, state: &mut State<K>) {
+        let mut weights: Vec<_> = state.weights.iter().collect();
+        weights.sort_unstable_by(|(_, a), (_, b)| b.cmp(a));
+        state.tracked = weights
+            .into_iter()
+            .take(self.max)
+            .map(|(key, _)| key.clone())
+            .collect();
+        state.weights.retain(|_, weight| {
+            *weight /= 2;
+            *weight > 0
+        });
+        state.chosen_at = Instant::now();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn first_keys_until_chosen() {
+        let labels = CappedLabels::new(2, CHOOSE_INTERVAL);
+        assert_eq!(labels.record(&[("a", 1), ("b", 1)]), [true, true]);
+        assert_eq!(labels.record(&[("c", 100), ("a", 1)]), [false, true]);
+        assert!(labels.is_tracked(&"b"));
+        assert!(!labels.is_tracked(&"c"));
+    }
+
+    #[test]
+    fn heaviest_keys_are_chosen() {
+        let labels = CappedLabels::new(2, Duration::ZERO);
+        labels.record(&[("a", 1), ("b", 2)]);
+        // "c" is heavier than "a", so it takes its label once they are chosen
+        assert_eq!(labels.record(&[("c", 10)]), [false]);
+        assert_eq!(
+            labels.record(&[("a", 1), ("b", 1), ("c", 1)]),
+            [false, true, true]
+        );
+
+        // weights decay, so that keys that are no longer written lose their
+        // labels
+        for _ in 0..8 {
+            labels.record(&[("a", 4)]);
+        }
+        assert!(labels.is_tracked(&"a"));
+        assert!(!labels.is_tracked(&"c"));
+    }
+}
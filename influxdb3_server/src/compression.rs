@@ -0,0 +1,277 @@
+//! Content-encoding negotiation for HTTP responses.
+//!
+//! Large query results, CSV in particular, compress very well. When a client
+//! advertises support for it through the `Accept-Encoding` header, response
+//! bodies above a configurable size are compressed with `zstd` or `gzip`.
+
+use bytes::Bytes;
+use flate2::write::GzEncoder;
+use hyper::header::{HeaderValue, ToStrError, ACCEPT_ENCODING, CONTENT_ENCODING, VARY};
+use hyper::{Body, HeaderMap, Response};
+use metric::{Metric, U64Counter};
+use std::io::Write;
+
+/// The default minimum size of a response body, in bytes, before it is
+/// compressed.
+pub const DEFAULT_COMPRESSION_MIN_BYTES: usize = 1024;
+
+/// The zstd compression level used for responses; this favours speed over
+/// ratio, as results are compressed on the request path.
+const ZSTD_LEVEL: i32 = 3;
+
+/// A content coding supported for response bodies.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum Encoding {
+    Zstd,
+    Gzip,
+}
+
+impl Encoding {
+    pub(crate) fn as_str(&self) -> &'static str {
+        match self {
+            Self::Zstd => "zstd",
+            Self::Gzip => "gzip",
+        }
+    }
+
+    /// Pick the encoding to use for a response from the value of a request's
+    /// `Accept-Encoding` header.
+    ///
+    /// The coding with the highest quality value wins; ties are broken in
+    /// favour of zstd. Codings with a quality of zero are refused. `*` stands
+    /// for gzip, or zstd if gzip is listed itself, and for neither if both are.
+    pub(crate) fn negotiate(accept_encoding: &str) -> Option<Self> {
+        let codings: Vec<_> = accept_encoding
+            .split(',')
+            .filter_map(|coding| {
+                let mut parts = coding.split(';').map(str::trim);
+                let name = parts.next().unwrap_or_default();
+                let q = parts
+                    .find_map(|p| p.strip_prefix("q="))
+                    .map(|q| q.parse::<f32>().unwrap_or(0.0))
+                    .unwrap_or(1.0);
+                let encoding = match name.to_ascii_lowercase().as_str() {
+                    "zstd" => Some(Self::Zstd),
+                    "gzip" | "x-gzip" => Some(Self::Gzip),
+                    "*" => None,
+                    _ => return None,
+                };
+                Some((encoding, q))
+            })
+            .collect();
+        let unlisted = [Self::Gzip, Self::Zstd]
+            .into_iter()
+            .find(|e| !codings.iter().any(|(listed, _)| *listed == Some(*e)));
+
+        let mut best: Option<(Self, f32)> = None;
+        for (encoding, q) in codings {
+            let Some(encoding) = encoding.or(unlisted) else {
+                continue;
+            };
+            if q <= 0.0 {
+                continue;
+            }
+            match best {
+                Some((b, bq)) if bq > q || (bq == q && b == Self::Zstd) => {}
+                _ => best = Some((encoding, q)),
+            }
+        }
+        best.map(|(e, _)| e)
+    }
+
+    fn encode(&self, body: &[u8]) -> std::io::Result<Vec<u8>> {
+        match self {
+            Self::Zstd => zstd::bulk::compress(body, ZSTD_LEVEL),
+            Self::Gzip => {
+                let mut encoder = GzEncoder::new(Vec::new(), flate2::Compression::fast());
+                encoder.write_all(body)?;
+                encoder.finish()
+            }
+        }
+    }
+}
+
+/// Compresses a response body that is sent in chunks as it is produced.
+pub(crate) enum StreamEncoder {
+    Zstd(zstd::stream::write::Encoder<'static, Vec<u8>>),
+    Gzip(GzEncoder<Vec<u8>>),
+}
+
+impl StreamEncoder {
+    pub(crate) fn new(encoding: Encoding) -> std::io::Result<Self> {
+        Ok(match encoding {
+            Encoding::Zstd => {
+                Self::Zstd(zstd::stream::write::Encoder::new(Vec::new(), ZSTD_LEVEL)?)
+            }
+            Encoding::Gzip => Self::Gzip(GzEncoder::new(Vec::new(), flate2::Compression::fast())),
+        })
+    }
+
+    /// Compress the next chunk of the body, returning the compressed bytes
+    /// that are ready to be sent, which may be none.
+    pub(crate) fn encode(&mut self, chunk: &[u8]) -> std::io::Result<Vec<u8>> {
+        match self {
+            Self::Zstd(encoder) => {
+                encoder.write_all(chunk)?;
+                Ok(std::mem::take(encoder.get_mut()))
+            }
+            Self::Gzip(encoder) => {
+                encoder.write_all(chunk)?;
+                Ok(std::mem::take(encoder.get_mut()))
+            }
+        }
+    }
+
+    /// The remaining compressed bytes, once the whole body has been encoded.
+    pub(crate) fn finish(self) -> std::io::Result<Vec<u8>> {
+        match self {
+            Self::Zstd(encoder) => encoder.finish(),
+            Self::Gzip(encoder) => encoder.finish(),
+        }
+    }
+}
+
+impl std::fmt::Debug for StreamEncoder {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let encoding = match self {
+            Self::Zstd(_) => Encoding::Zstd,
+            Self::Gzip(_) => Encoding::Gzip,
+        };
+        f.debug_tuple("StreamEncoder").field(&encoding).finish()
+    }
+}
+
+/// Compresses response bodies for clients that accept it, recording how much
+/// was saved.
+#[derive(Debug)]
+pub struct ResponseCompression {
+    min_bytes: usize,
+    uncompressed_bytes: Metric<U64Counter>,
+    compressed_bytes: Metric<U64Counter>,
+}
+
+impl ResponseCompression {
+    pub fn new(min_bytes: usize, metrics: &metric::Registry) -> Self {
+        Self {
+            min_bytes,
+            uncompressed_bytes: metrics.register_metric(
+                "http_response_compression_input_bytes",
+                "Size of HTTP response bodies before compression",
+            ),
+            compressed_bytes: metrics.register_metric(
+                "http_response_compression_output_bytes",
+                "Size of HTTP response bodies after compression",
+            ),
+        }
+    }
+
+    /// Build a response with `body`, compressing it with an encoding accepted
+    /// by the client if it is large enough to be worthwhile.
+    pub(crate) fn respond(
+        &self,
+        request_headers: &HeaderMap,
+        builder: hyper::http::response::Builder,
+        body: Bytes,
+    ) -> Result<Response<Body>, Error> {
+        let builder = builder.header(VARY, ACCEPT_ENCODING.as_str());
+
+        let encoding = request_headers
+            .get(ACCEPT_ENCODING)
+            .map(HeaderValue::to_str)
+            .transpose()?
+            .and_then(Encoding::negotiate);
+        let encoding = match encoding {
+            Some(e) if body.len() >= self.min_bytes => e,
+            _ => return Ok(builder.body(Body::from(body))?),
+        };
+
+        let compressed = encoding.encode(&body).map_err(Error::Encode)?;
+        let attributes = [("encoding", encoding.as_str())];
+        self.uncompressed_bytes
+            .recorder(&attributes)
+            .inc(body.len() as u64);
+        self.compressed_bytes
+            .recorder(&attributes)
+            .inc(compressed.len() as u64);
+
+        Ok(builder
+            .header(CONTENT_ENCODING, encoding.as_str())
+            .body(Body::from(compressed))?)
+    }
+}
+
+#[derive(Debug, thiserror::Error)]
+pub enum Error {
+    #[error("invalid accept-encoding header: {0}")]
+    InvalidAcceptEncoding(#[from] ToStrError),
+
+    #[error("failed to compress response: {0}")]
+    Encode(std::io::Error),
+
+    #[error("failed to build response: {0}")]
+    Http(#[from] hyper::http::Error),
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Read;
+
+    #[test]
+    fn negotiate() {
+        assert_eq!(Encoding::negotiate("gzip"), Some(Encoding::Gzip));
+        assert_eq!(Encoding::negotiate("gzip, zstd"), Some(Encoding::Zstd));
+        assert_eq!(
+            Encoding::negotiate("zstd;q=0.5, gzip"),
+            Some(Encoding::Gzip)
+        );
+        assert_eq!(Encoding::negotiate("zstd;q=0, gzip;q=0"), None);
+        assert_eq!(Encoding::negotiate("*"), Some(Encoding::Gzip));
+        // `*` does not stand for a coding that is listed, even refused
+        assert_eq!(Encoding::negotiate("gzip;q=0, *"), Some(Encoding::Zstd));
+        assert_eq!(Encoding::negotiate("gzip;q=0, zstd;q=0, *"), None);
+        assert_eq!(Encoding::negotiate("br, identity"), None);
+        assert_eq!(Encoding::negotiate(""), None);
+    }
+
+    #[tokio::test]
+    async fn compresses_large_bodies() {
+        let metrics = metric::Registry::new();
+        let compression = ResponseCompression::new(16, &metrics);
+        let body = Bytes::from("host,time,val\n".repeat(100));
+
+        let mut headers = HeaderMap::new();
+        headers.insert(ACCEPT_ENCODING, HeaderValue::from_static("gzip"));
+        let res = compression
+            .respond(&headers, Response::builder(), body.clone())
+            .unwrap();
+        assert_eq!(res.headers()[CONTENT_ENCODING], "gzip");
+
+        let compressed = hyper::body::to_bytes(res.into_body()).await.unwrap();
+        let mut decoded = Vec::new();
+        flate2::read::GzDecoder::new(&compressed[..])
+            .read_to_end(&mut decoded)
+            .unwrap();
+        assert_eq!(decoded, body);
+
+        let input = metrics
+            .get_instrument::<Metric<U64Counter>>("http_response_compression_input_bytes")
+            .unwrap()
+            .get_observer(&metric::Attributes::from(&[("encoding", "gzip")]))
+            .unwrap()
+            .fetch();
+        assert_eq!(input, body.len() as u64);
+    }
+
+    #[tokio::test]
+    async fn small_bodies_are_not_compressed() {
+        let compression = ResponseCompression::new(1024, &metric::Registry::new());
+
+        let mut headers = HeaderMap::new();
+        headers.insert(ACCEPT_ENCODING, HeaderValue::from_static("zstd"));
+        let res = compression
+            .respond(&headers, Response::builder(), Bytes::from("{}"))
+            .unwrap();
+        assert!(res.headers().get(CONTENT_ENCODING).is_none());
+    }
+}
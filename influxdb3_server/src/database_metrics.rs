@@ -0,0 +1,141 @@
+//! Load by database.
+//!
+//! Counts the writes and queries made to each database, so that operators can
+//! attribute the load of a server shared by several tenants from their
+//! monitoring.
+//!
+//! Only writes that succeed are counted, so that the names of databases that
+//! do not exist do not take series.
+//!
+//! A database is a label of the metrics, so the number of series is capped:
+//! only the databases of the allow-list, if one is configured, and at most
+//! the configured number of them, those with the most requests recently,
+//! have series of their own. The others are counted together under `_other`.
+
+use crate::capped_labels::{self, CappedLabels};
+use metric::{Attributes, DurationHistogram, Metric, U64Counter};
+use std::borrow::Cow;
+use std::collections::HashSet;
+use std::time::Duration;
+
+/// Which databases have series of their own.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct DatabaseMetricsConfig {
+    /// The most databases with series of their own
+    pub max_databases: usize,
+    /// The databases that may have series of their own, or all if `None`
+    pub allow_list: Option<HashSet<String>>,
+}
+
+#[derive(Debug)]
+pub(crate) struct DatabaseMetrics {
+    write_requests: Metric<U64Counter>,
+    write_bytes: Metric<U64Counter>,
+    queries: Metric<U64Counter>,
+    query_duration: Metric<DurationHistogram>,
+    /// The databases that may have series of their own
+    allow_list: Option<HashSet<String>>,
+    /// The databases with series of their own, weighed by their requests
+    labels: CappedLabels<String>,
+}
+
+impl DatabaseMetrics {
+    pub(crate) fn new(config: DatabaseMetricsConfig, metrics: &metric::Registry) -> Self {
+        Self {
+            write_requests: metrics.register_metric(
+                "influxdb3_database_write_requests",
+                "Number of write requests, by database",
+            ),
+            write_bytes: metrics.register_metric(
+                "influxdb3_database_write_bytes",
+                "Bytes of line protocol in write requests, by database",
+            ),
+            queries: metrics.register_metric(
+                "influxdb3_database_queries",
+                "Number of queries, by database",
+            ),
+            query_duration: metrics.register_metric(
+                "influxdb3_database_query_duration",
+                "Time taken to execute queries, by database",
+            ),
+            allow_list: config.allow_list,
+            labels: CappedLabels::new(config.max_databases, capped_labels::CHOOSE_INTERVAL),
+        }
+    }
+
+    /// Count a write request of `bytes` bytes to `db`.
+    pub(crate) fn record_write(&self, db: &str, bytes: usize) {
+        let attributes = self.attributes(db);
+        self.write_requests.recorder(attributes.clone()).inc(1);
+        self.write_bytes.recorder(attributes).inc(bytes as u64);
+    }
+
+    /// Count a query to `db` that took `duration`.
+    pub(crate) fn record_query(&self, db: &str, duration: Duration) {
+        let attributes = self.attributes(db);
+        self.queries.recorder(attributes.clone()).inc(1);
+        self.query_duration.recorder(attributes).record(duration);
+    }
+
+    fn attributes(&self, db: &str) -> Attributes {
+        Attributes::from([("db", Cow::Owned(self.label(db)))])
+    }
+
+    /// The label `db` is counted under.
+    fn label(&self, db: &str) -> String {
+        let allowed = self
+            .allow_list
+            .as_ref()
+            .map_or(true, |allowed| allowed.contains(db));
+        if allowed && self.labels.record(&[(db.to_string(), 1)])[0] {
+            db.to_string()
+        } else {
+            capped_labels::OTHER.to_string()
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn writes(metrics: &DatabaseMetrics, db: &str) -> u64 {
+        metrics
+            .write_requests
+            .get_observer(&Attributes::from([("db", Cow::Owned(db.to_string()))]))
+            .map(|c| c.fetch())
+            .unwrap_or_default()
+    }
+
+    #[test]
+    fn databases_are_capped() {
+        let registry = metric::Registry::new();
+        let metrics = DatabaseMetrics::new(
+            DatabaseMetricsConfig {
+                max_databases: 2,
+                allow_list: Some(["a", "b", "c"].map(String::from).into()),
+            },
+            &registry,
+        );
+
+        for db in ["a", "x", "b", "c", "a"] {
+            metrics.record_write(db, 10);
+        }
+        metrics.record_query("b", Duration::from_millis(5));
+        assert_eq!(writes(&metrics, "a"), 2);
+        assert_eq!(writes(&metrics, "b"), 1);
+        assert_eq!(writes(&metrics, "c"), 0);
+        assert_eq!(writes(&metrics, "x"), 0);
+        // "x" is not allowed, and "c" is beyond the limit
+        assert_eq!(writes(&metrics, capped_labels::OTHER), 2);
+        assert_eq!(
+            metrics
+                .query_duration
+                .get_observer(&Attributes::from(&[("db", "b")]))
+                .unwrap()
+                .fetch()
+                .sample_count(),
+            1
+        );
+    }
+}
@@ -0,0 +1,95 @@
+//! Retention of the lines dropped from writes.
+//!
+//! A write made with `accept_partial=true` buffers its valid lines and
+//! drops the others, whether they were rejected before the write was buffered
+//! or by the write buffer, as lines that conflict with the column types of
+//! their table are. With a [`DeadLetterDatabase`] configured, the dropped
+//! lines are also written to that database, to the [`DEAD_LETTER_TABLE`]
+//! table, so that the producers of the data can query what they lost and why.
+//!
+//! Each point has the database of the write as its `db` tag, the
+//! [`RejectionCode`](crate::rejection::RejectionCode) as its `code` tag, the
+//! number of the line in the write as its `line_number` tag, the dropped line
+//! as its `line` field, the reason it was dropped as its `reason` field, and
+//! the time of the write as its timestamp. The line number keeps the points of
+//! the lines dropped from one write apart, as they share the time.
+
+use crate::rejection::RejectedLine;
+use data_types::{NamespaceName, NamespaceNameError};
+use influxdb_line_protocol::LineProtocolBuilder;
+use std::str::FromStr;
+
+/// The table the dropped lines are written to.
+pub const DEAD_LETTER_TABLE: &str = "rejected_lines";
+
+/// The database the lines dropped from writes are written to.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DeadLetterDatabase(NamespaceName<'static>);
+
+impl DeadLetterDatabase {
+    pub fn name(&self) -> &NamespaceName<'static> {
+        &self.0
+    }
+
+    /// The line protocol recording the lines of a write to `db`, at `time`,
+    /// that were dropped.
+    pub(crate) fn line_protocol(&self, db: &str, rejected: &[RejectedLine], time: i64) -> String {
+        let mut builder = LineProtocolBuilder::new();
+        for line in rejected {
+            builder = builder
+                .measurement(DEAD_LETTER_TABLE)
+                .tag("db", db)
+                .tag("code", line.code.as_str())
+                .tag("line_number", &line.line_number.to_string())
+                .field("line", line.line.as_str())
+                .field("reason", line.reason.as_str())
+                .timestamp(time)
+                .close_line();
+        }
+        String::from_utf8(builder.build()).expect("line protocol is valid UTF-8")
+    }
+}
+
+impl FromStr for DeadLetterDatabase {
+    type Err = NamespaceNameError;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        NamespaceName::new(s.to_string()).map(Self)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rejection::RejectionCode;
+
+    #[test]
+    fn rejected_lines_as_line_protocol() {
+        let dead_letter: DeadLetterDatabase = "dead_letter".parse().unwrap();
+        let rejected = [
+            RejectedLine {
+                line_number: 1,
+                line: "cpu,host=a usage=1 123".to_string(),
+                code: RejectionCode::TimestampTooFarInPast,
+                reason: "timestamp is more than 1h in the past".to_string(),
+                timestamp: Some(123),
+            },
+            RejectedLine {
+                line_number: 3,
+                line: "cpu,host=b usage=2 124".to_string(),
+                code: RejectionCode::TimestampTooFarInPast,
+                reason: "timestamp is more than 1h in the past".to_string(),
+                timestamp: Some(124),
+            },
+        ];
+        // lines dropped for the same reason are distinct points
+        assert_eq!(
+            dead_letter.line_protocol("sensors", &rejected, 456),
+            "rejected_lines,db=sensors,code=timestamp_too_far_in_past,line_number=1 \
+             line=\"cpu,host=a usage=1 123\",reason=\"timestamp is more than 1h in the past\" 456\n\
+             rejected_lines,db=sensors,code=timestamp_too_far_in_past,line_number=3 \
+             line=\"cpu,host=b usage=2 124\",reason=\"timestamp is more than 1h in the past\" 456\n"
+        );
+        assert!("".parse::<DeadLetterDatabase>().is_err());
+    }
+}
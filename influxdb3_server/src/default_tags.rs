@@ -0,0 +1,164 @@
+//! Tags added by the server to every point written to a database.
+//!
+//! A default tag such as `site=factory-7` for database `sensors` is added to
+//! each line written to `sensors` before it is buffered, so that identical
+//! devices can share a configuration and still be told apart. Default tags
+//! are enforced: a line that sets the tag itself has its value replaced.
+
+use crate::write_rules::{push_line, Value};
+use influxdb_line_protocol::builder::AfterMeasurement;
+use influxdb_line_protocol::{parse_lines, split_lines, LineProtocolBuilder, ParsedLine};
+use std::borrow::Cow;
+use std::collections::HashMap;
+use std::str::FromStr;
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+#[error("invalid default tag '{0}', expected '<database>:<tag>=<value>'")]
+pub struct ParseError(String);
+
+/// A tag added to every point written to a database.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DefaultTag {
+    pub db: String,
+    pub key: String,
+    pub value: String,
+}
+
+impl FromStr for DefaultTag {
+    type Err = ParseError;
+
+    /// Parse a tag given as `<database>:<tag>=<value>`.
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let invalid = || ParseError(s.to_string());
+        let (db, tag) = s.split_once(':').ok_or_else(invalid)?;
+        let (key, value) = tag.split_once('=').ok_or_else(invalid)?;
+        if db.is_empty() || key.is_empty() || value.is_empty() {
+            return Err(invalid());
+        }
+        Ok(Self {
+            db: db.to_string(),
+            key: key.to_string(),
+            value: value.to_string(),
+        })
+    }
+}
+
+/// The default tags of each database.
+#[derive(Debug, Clone, Default)]
+pub struct DefaultTags {
+    by_db: HashMap<String, Vec<(String, String)>>,
+}
+
+impl DefaultTags {
+    pub fn new(tags: impl IntoIterator<Item = DefaultTag>) -> Self {
+        let mut by_db: HashMap<String, Vec<(String, String)>> = HashMap::new();
+        for tag in tags {
+            let db_tags = by_db.entry(tag.db).or_default();
+            // the last value given for a tag wins
+            db_tags.retain(|(key, _)| *key != tag.key);
+            db_tags.push((tag.key, tag.value));
+        }
+        Self { by_db }
+    }
+
+    /// Add the default tags of `db` to the lines of `lp`.
+    ///
+    /// Lines that do not parse are left unchanged, for the write buffer to
+    /// reject.
+    pub(crate) fn apply<'a>(&self, db: &str, lp: &'a str) -> Cow<'a, str> {
+        let Some(tags) = self.by_db.get(db) else {
+            return Cow::Borrowed(lp);
+        };
+
+        let mut tagged = String::with_capacity(lp.len());
+        for original in split_lines(lp) {
+            let line = match parse_lines(original).next() {
+                // blank lines and comments, and invalid lines, which are left
+                // to be rejected by the write buffer
+                None | Some(Err(_)) => {
+                    push_line(&mut tagged, original, original);
+                    continue;
+                }
+                Some(Ok(line)) => line,
+            };
+            let builder = LineProtocolBuilder::new().measurement(line.series.measurement.as_str());
+            let built = tagged_line(builder, &line, tags).build();
+            let built = String::from_utf8(built).expect("line protocol is valid UTF-8");
+            push_line(&mut tagged, original, &built);
+        }
+        Cow::Owned(tagged)
+    }
+}
+
+/// Write `line` with `tags` in place of any tags of the same name.
+fn tagged_line(
+    mut builder: LineProtocolBuilder<Vec<u8>, AfterMeasurement>,
+    line: &ParsedLine<'_>,
+    tags: &[(String, String)],
+) -> LineProtocolBuilder<Vec<u8>> {
+    for (key, value) in line.series.tag_set.iter().flatten() {
+        if !tags.iter().any(|(k, _)| k == key.as_str()) {
+            builder = builder.tag(key.as_str(), value.as_str());
+        }
+    }
+    for (key, value) in tags {
+        builder = builder.tag(key, value);
+    }
+
+    let mut fields = line.field_set.iter();
+    let (key, value) = fields.next().expect("parsed lines have a field");
+    let mut builder = Value::from(value).first(builder, key.as_str());
+    for (key, value) in fields {
+        builder = Value::from(value).next(builder, key.as_str());
+    }
+
+    match line.timestamp {
+        Some(timestamp) => builder.timestamp(timestamp).close_line(),
+        None => builder.close_line(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_default_tag() {
+        assert_eq!(
+            "sensors:site=factory-7".parse::<DefaultTag>().unwrap(),
+            DefaultTag {
+                db: "sensors".to_string(),
+                key: "site".to_string(),
+                value: "factory-7".to_string(),
+            }
+        );
+        assert!("site=factory-7".parse::<DefaultTag>().is_err());
+        assert!("sensors:site".parse::<DefaultTag>().is_err());
+        assert!("sensors:=factory-7".parse::<DefaultTag>().is_err());
+    }
+
+    #[test]
+    fn tags_are_added_and_enforced() {
+        let tags = DefaultTags::new(
+            ["sensors:site=factory-7", "sensors:line=a b"]
+                .into_iter()
+                .map(|t| t.parse().unwrap()),
+        );
+
+        let lp =
+            "cpu,host=a,site=home usage=0.5,count=3i,name=\"x y\" 123\n# comment\n\nmem free=1u";
+        assert_eq!(
+            tags.apply("sensors", lp),
+            "cpu,host=a,site=factory-7,line=a\\ b usage=0.5,count=3i,name=\"x y\" 123\n\
+             # comment\n\
+             \n\
+             mem,site=factory-7,line=a\\ b free=1u\n"
+        );
+        assert!(matches!(tags.apply("other", lp), Cow::Borrowed(_)));
+        assert_eq!(
+            tags.apply("sensors", "cpu\nmem free=1u"),
+            "cpu\nmem,site=factory-7,line=a\\ b free=1u\n"
+        );
+    }
+}
@@ -0,0 +1,570 @@
+//! Streaming export of the contents of a table.
+//!
+//! Tables can be exported as Parquet, line protocol or CSV, optionally
+//! restricted to a time range and to rows with given tag values.
+//!
+//! Exported Parquet files carry the InfluxDB schema of the table: the
+//! measurement name in the file metadata and the tag, field or time type of
+//! each column in its field metadata, so that a file can be written back with
+//! `influxdb3 write --format parquet` and still be read by other Parquet
+//! tooling.
+
+use crate::compression::{Encoding, StreamEncoder};
+use arrow::array::{Array, ArrayRef, AsArray};
+use arrow::compute::cast;
+use arrow::datatypes::{
+    DataType, Float64Type, Int64Type, SchemaRef, TimestampNanosecondType, UInt64Type,
+};
+use arrow::record_batch::RecordBatch;
+use bytes::Bytes;
+use chrono::{DateTime, SecondsFormat, TimeZone, Utc};
+use datafusion::execution::SendableRecordBatchStream;
+use futures::StreamExt;
+use hyper::Body;
+use influxdb_line_protocol::builder::{AfterField, AfterMeasurement};
+use influxdb_line_protocol::LineProtocolBuilder;
+use observability_deps::tracing::error;
+use parking_lot::Mutex;
+use parquet::arrow::ArrowWriter;
+use schema::{InfluxColumnType, Schema, TIME_COLUMN_NAME};
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::io::Write;
+use std::sync::Arc;
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("query error: {0}")]
+    Query(#[from] datafusion::error::DataFusionError),
+
+    #[error("arrow error: {0}")]
+    Arrow(#[from] arrow::error::ArrowError),
+
+    #[error("parquet error: {0}")]
+    Parquet(#[from] parquet::errors::ParquetError),
+
+    #[error("compression error: {0}")]
+    Compression(#[from] std::io::Error),
+
+    #[error("the query result has no column '{0}'")]
+    MissingColumn(String),
+
+    #[error("client disconnected")]
+    ClientHangup,
+}
+
+pub type Result<T, E = Error> = std::result::Result<T, E>;
+
+/// An invalid filter in an export request.
+#[derive(Debug, Error)]
+pub enum FilterError {
+    #[error("invalid time '{0}', expected an RFC 3339 timestamp or nanoseconds since the epoch")]
+    InvalidTime(String),
+
+    #[error("invalid tag filter '{0}', expected 'key=value'")]
+    InvalidTagFilter(String),
+
+    #[error("'{0}' is not a tag of the table")]
+    NotATag(String),
+}
+
+/// The format of an export.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Format {
+    #[default]
+    Parquet,
+    Lp,
+    Csv,
+}
+
+impl Format {
+    pub(crate) fn content_type(&self) -> &'static str {
+        match self {
+            Self::Parquet => "application/vnd.apache.parquet",
+            Self::Lp => "text/plain; charset=utf-8",
+            Self::Csv => "text/csv",
+        }
+    }
+
+    pub(crate) fn extension(&self) -> &'static str {
+        match self {
+            Self::Parquet => "parquet",
+            Self::Lp => "lp",
+            Self::Csv => "csv",
+        }
+    }
+}
+
+/// The rows of a table to export.
+#[derive(Debug, Default)]
+pub(crate) struct Filter {
+    /// Inclusive start of the time range, in nanoseconds since the epoch
+    start: Option<i64>,
+    /// Exclusive end of the time range, in nanoseconds since the epoch
+    end: Option<i64>,
+    /// Accepted values of each tag
+    tags: BTreeMap<String, Vec<String>>,
+}
+
+impl Filter {
+    /// Parse the filter of an export request of the table with `schema`.
+    ///
+    /// `tags` is a comma separated list of `key=value` pairs. Rows must match
+    /// one of the values given for each key.
+    pub(crate) fn parse(
+        schema: &Schema,
+        start: Option<&str>,
+        end: Option<&str>,
+        tags: Option<&str>,
+    ) -> Result<Self, FilterError> {
+        let mut filter = Self {
+            start: start.map(parse_time).transpose()?,
+            end: end.map(parse_time).transpose()?,
+            tags: BTreeMap::new(),
+        };
+        for pair in tags
+            .unwrap_or_default()
+            .split(',')
+            .filter(|p| !p.is_empty())
+        {
+            let (key, value) = pair
+                .split_once('=')
+                .ok_or_else(|| FilterError::InvalidTagFilter(pair.to_string()))?;
+            if schema.field_type_by_name(key) != Some(InfluxColumnType::Tag) {
+                return Err(FilterError::NotATag(key.to_string()));
+            }
+            filter
+                .tags
+                .entry(key.to_string())
+                .or_default()
+                .push(value.to_string());
+        }
+        Ok(filter)
+    }
+
+    /// The query selecting the rows of `table` matching the filter.
+    pub(crate) fn query(&self, table: &str) -> String {
+        let mut conditions = Vec::new();
+        if let Some(start) = self.start {
+            conditions.push(format!("\"{TIME_COLUMN_NAME}\" >= '{}'", rfc3339(start)));
+        }
+        if let Some(end) = self.end {
+            conditions.push(format!("\"{TIME_COLUMN_NAME}\" < '{}'", rfc3339(end)));
+        }
+        for (key, values) in &self.tags {
+            let values = values
+                .iter()
+                .map(|v| format!("'{}'", v.replace('\'', "''")))
+                .collect::<Vec<_>>()
+                .join(", ");
+            conditions.push(format!("{} IN ({values})", quote_ident(key)));
+        }
+
+        let mut sql = format!("SELECT * FROM {}", quote_ident(table));
+        if !conditions.is_empty() {
+            sql.push_str(" WHERE ");
+            sql.push_str(&conditions.join(" AND "));
+        }
+        sql
+    }
+}
+
+fn parse_time(s: &str) -> Result<i64, FilterError> {
+    let invalid = || FilterError::InvalidTime(s.to_string());
+    if let Ok(ns) = s.parse() {
+        return Ok(ns);
+    }
+    DateTime::parse_from_rfc3339(s)
+        .map_err(|_| invalid())?
+        .timestamp_nanos_opt()
+        .ok_or_else(invalid)
+}
+
+fn rfc3339(ns: i64) -> String {
+    Utc.timestamp_nanos(ns)
+        .to_rfc3339_opts(SecondsFormat::Nanos, true)
+}
+
+fn quote_ident(name: &str) -> String {
+    format!("\"{}\"", name.replace('"', "\"\""))
+}
+
+/// Encode the rows of `stream`, which are from the table described by
+/// `schema`, in `format`, as a body that is sent as it is produced, one row
+/// group or chunk per record batch, compressed with `encoding` if given.
+///
+/// Errors after the response has started can only be reported by aborting
+/// it, which the client sees as a truncated body.
+pub(crate) fn export_body(
+    schema: &Schema,
+    stream: SendableRecordBatchStream,
+    format: Format,
+    encoding: Option<Encoding>,
+) -> Body {
+    let (sender, body) = Body::channel();
+    let schema = schema.clone();
+    tokio::spawn(async move {
+        let mut sender = ChunkSender {
+            sender,
+            encoder: None,
+        };
+        let result: Result<()> = async {
+            sender.encoder = encoding.map(StreamEncoder::new).transpose()?;
+            match format {
+                Format::Parquet => write_parquet(schema.as_arrow(), stream, &mut sender).await?,
+                Format::Lp => write_line_protocol(&schema, stream, &mut sender).await?,
+                Format::Csv => write_csv(schema.as_arrow(), stream, &mut sender).await?,
+            }
+            sender.finish().await
+        }
+        .await;
+        if let Err(e) = result {
+            error!(%e, ?format, "error exporting table");
+            sender.sender.abort();
+        }
+    });
+    body
+}
+
+async fn write_parquet(
+    schema: SchemaRef,
+    mut stream: SendableRecordBatchStream,
+    sender: &mut ChunkSender,
+) -> Result<()> {
+    let buffer = SharedBuffer::default();
+    let mut writer = ArrowWriter::try_new(buffer.clone(), Arc::clone(&schema), None)?;
+
+    while let Some(batch) = stream.next().await {
+        let batch = with_schema(&schema, batch?)?;
+        writer.write(&batch)?;
+        writer.flush()?;
+        sender.send(buffer.take()).await?;
+    }
+    writer.close()?;
+    sender.send(buffer.take()).await
+}
+
+async fn write_csv(
+    schema: SchemaRef,
+    mut stream: SendableRecordBatchStream,
+    sender: &mut ChunkSender,
+) -> Result<()> {
+    let buffer = SharedBuffer::default();
+    // the writer writes the header with the first batch only
+    let mut writer = arrow_csv::writer::Writer::new(buffer.clone());
+
+    while let Some(batch) = stream.next().await {
+        writer.write(&with_schema(&schema, batch?)?)?;
+        sender.send(buffer.take()).await?;
+    }
+    Ok(())
+}
+
+async fn write_line_protocol(
+    schema: &Schema,
+    mut stream: SendableRecordBatchStream,
+    sender: &mut ChunkSender,
+) -> Result<()> {
+    let arrow_schema = schema.as_arrow();
+    while let Some(batch) = stream.next().await {
+        let batch = with_schema(&arrow_schema, batch?)?;
+        sender.send(line_protocol(schema, &batch)?).await?;
+    }
+    Ok(())
+}
+
+/// The rows of `batch`, whose columns are those of `schema`, as line protocol.
+///
+/// Null tags and fields are left out, as are rows with no field.
+fn line_protocol(schema: &Schema, batch: &RecordBatch) -> Result<Vec<u8>> {
+    let measurement = schema.measurement().map(String::as_str).unwrap_or_default();
+    let mut tags = Vec::new();
+    let mut fields = Vec::new();
+    let mut time = None;
+    for ((column_type, field), column) in schema.iter().zip(batch.columns()) {
+        match column_type {
+            InfluxColumnType::Tag => tags.push((field.name(), cast(column, &DataType::Utf8)?)),
+            InfluxColumnType::Field(_) => fields.push((field.name(), column)),
+            InfluxColumnType::Timestamp => time = Some(column),
+        }
+    }
+    let time = time
+        .ok_or_else(|| Error::MissingColumn(TIME_COLUMN_NAME.to_string()))?
+        .as_primitive::<TimestampNanosecondType>();
+
+    let mut builder = LineProtocolBuilder::new();
+    for row in 0..batch.num_rows() {
+        let mut values = fields
+            .iter()
+            .filter_map(|(name, column)| Some((name.as_str(), FieldValue::of(column, row)?)));
+        let Some((name, value)) = values.next() else {
+            continue;
+        };
+
+        let mut line = builder.measurement(measurement);
+        for (name, column) in &tags {
+            let column = column.as_string::<i32>();
+            if column.is_valid(row) && !column.value(row).is_empty() {
+                line = line.tag(name, column.value(row));
+            }
+        }
+        let mut line = value.first(line, name);
+        for (name, value) in values {
+            line = value.next(line, name);
+        }
+        builder = line.timestamp(time.value(row)).close_line();
+    }
+    Ok(builder.build())
+}
+
+/// The value of a field in a row, of one of the line protocol field types.
+#[derive(Debug, Clone, Copy)]
+enum FieldValue<'a> {
+    Float(f64),
+    Integer(i64),
+    UInteger(u64),
+    Boolean(bool),
+    String(&'a str),
+}
+
+impl<'a> FieldValue<'a> {
+    fn of(column: &'a ArrayRef, row: usize) -> Option<Self> {
+        if column.is_null(row) {
+            return None;
+        }
+        Some(match column.data_type() {
+            DataType::Float64 => Self::Float(column.as_primitive::<Float64Type>().value(row)),
+            DataType::Int64 => Self::Integer(column.as_primitive::<Int64Type>().value(row)),
+            DataType::UInt64 => Self::UInteger(column.as_primitive::<UInt64Type>().value(row)),
+            DataType::Boolean => Self::Boolean(column.as_boolean().value(row)),
+            DataType::Utf8 => Self::String(column.as_string::<i32>().value(row)),
+            _ => return None,
+        })
+    }
+
+    fn first(
+        self,
+        line: LineProtocolBuilder<Vec<u8>, AfterMeasurement>,
+        name: &str,
+    ) -> LineProtocolBuilder<Vec<u8>, AfterField> {
+        match self {
+            Self::Float(v) => line.field(name, v),
+            Self::Integer(v) => line.field(name, v),
+            Self::UInteger(v) => line.field(name, v),
+            Self::Boolean(v) => line.field(name, v),
+            Self::String(v) => line.field(name, v),
+        }
+    }
+
+    fn next(
+        self,
+        line: LineProtocolBuilder<Vec<u8>, AfterField>,
+        name: &str,
+    ) -> LineProtocolBuilder<Vec<u8>, AfterField> {
+        match self {
+            Self::Float(v) => line.field(name, v),
+            Self::Integer(v) => line.field(name, v),
+            Self::UInteger(v) => line.field(name, v),
+            Self::Boolean(v) => line.field(name, v),
+            Self::String(v) => line.field(name, v),
+        }
+    }
+}
+
+/// Sends the chunks of an export body, compressing them if requested.
+#[derive(Debug)]
+struct ChunkSender {
+    sender: hyper::body::Sender,
+    encoder: Option<StreamEncoder>,
+}
+
+impl ChunkSender {
+    async fn send(&mut self, bytes: Vec<u8>) -> Result<()> {
+        let bytes = match &mut self.encoder {
+            Some(encoder) => encoder.encode(&bytes)?,
+            None => bytes,
+        };
+        if bytes.is_empty() {
+            return Ok(());
+        }
+        self.sender
+            .send_data(Bytes::from(bytes))
+            .await
+            .map_err(|_| Error::ClientHangup)
+    }
+
+    /// Send what remains of the compressed body, if it is compressed.
+    async fn finish(&mut self) -> Result<()> {
+        match self.encoder.take() {
+            Some(encoder) => self.send(encoder.finish()?).await,
+            None => Ok(()),
+        }
+    }
+}
+
+/// Put the columns of `batch` in the order and types of `schema`, so that they
+/// carry its metadata.
+fn with_schema(schema: &SchemaRef, batch: RecordBatch) -> Result<RecordBatch> {
+    let columns = schema
+        .fields()
+        .iter()
+        .map(|field| {
+            let column = batch
+                .column_by_name(field.name())
+                .ok_or_else(|| Error::MissingColumn(field.name().to_string()))?;
+            Ok(cast(column, field.data_type())?)
+        })
+        .collect::<Result<_>>()?;
+    Ok(RecordBatch::try_new(Arc::clone(schema), columns)?)
+}
+
+/// A buffer the Parquet writer writes into, which is drained each time a row
+/// group has been written.
+#[derive(Debug, Default, Clone)]
+struct SharedBuffer(Arc<Mutex<Vec<u8>>>);
+
+impl SharedBuffer {
+    fn take(&self) -> Vec<u8> {
+        std::mem::take(&mut self.0.lock())
+    }
+}
+
+impl Write for SharedBuffer {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.lock().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use arrow::array::{Float64Array, StringArray, TimestampNanosecondArray};
+    use datafusion::physical_plan::stream::RecordBatchStreamAdapter;
+    use parquet::arrow::arrow_reader::ParquetRecordBatchReaderBuilder;
+    use schema::{InfluxColumnType, InfluxFieldType, SchemaBuilder};
+
+    fn cpu_schema() -> Schema {
+        SchemaBuilder::new()
+            .measurement("cpu")
+            .tag("host")
+            .influx_field("usage", InfluxFieldType::Float)
+            .timestamp()
+            .build()
+            .unwrap()
+    }
+
+    #[tokio::test]
+    async fn parquet_preserves_influx_schema() {
+        let schema = cpu_schema();
+
+        // the query result orders the columns differently from the table
+        let batch = RecordBatch::try_from_iter([
+            (
+                "time",
+                Arc::new(TimestampNanosecondArray::from(vec![1, 2])) as _,
+            ),
+            ("usage", Arc::new(Float64Array::from(vec![0.5, 0.7])) as _),
+            ("host", Arc::new(StringArray::from(vec!["a", "b"])) as _),
+        ])
+        .unwrap();
+        let stream = Box::pin(RecordBatchStreamAdapter::new(
+            batch.schema(),
+            futures::stream::iter([Ok(batch)]),
+        ));
+
+        let body = export_body(&schema, stream, Format::Parquet, None);
+        let bytes = hyper::body::to_bytes(body).await.unwrap();
+
+        let reader = ParquetRecordBatchReaderBuilder::try_new(bytes)
+            .unwrap()
+            .build()
+            .unwrap();
+        let batches = reader.collect::<Result<Vec<_>, _>>().unwrap();
+        let exported = Schema::try_from(batches[0].schema()).unwrap();
+        assert_eq!(exported.measurement().unwrap(), "cpu");
+        assert_eq!(
+            exported.field_type_by_name("host"),
+            Some(InfluxColumnType::Tag)
+        );
+        assert_eq!(
+            exported.field_type_by_name("usage"),
+            Some(InfluxColumnType::Field(InfluxFieldType::Float))
+        );
+        assert_eq!(batches[0].num_rows(), 2);
+    }
+
+    #[tokio::test]
+    async fn line_protocol_skips_nulls() {
+        let schema = SchemaBuilder::new()
+            .measurement("cpu")
+            .tag("host")
+            .influx_field("usage", InfluxFieldType::Float)
+            .influx_field("state", InfluxFieldType::String)
+            .timestamp()
+            .build()
+            .unwrap();
+        let batch = RecordBatch::try_from_iter([
+            (
+                "host",
+                Arc::new(StringArray::from(vec![Some("a b"), None, Some("c")])) as _,
+            ),
+            (
+                "usage",
+                Arc::new(Float64Array::from(vec![Some(0.5), Some(1.0), None])) as _,
+            ),
+            (
+                "state",
+                Arc::new(StringArray::from(vec![Some("ok \"1\""), None, None])) as _,
+            ),
+            (
+                "time",
+                Arc::new(TimestampNanosecondArray::from(vec![1, 2, 3])) as _,
+            ),
+        ])
+        .unwrap();
+        let stream = Box::pin(RecordBatchStreamAdapter::new(
+            batch.schema(),
+            futures::stream::iter([Ok(batch)]),
+        ));
+
+        let body = export_body(&schema, stream, Format::Lp, None);
+        let bytes = hyper::body::to_bytes(body).await.unwrap();
+        assert_eq!(
+            std::str::from_utf8(&bytes).unwrap(),
+            "cpu,host=a\\ b usage=0.5,state=\"ok \\\"1\\\"\" 1\ncpu usage=1 2\n"
+        );
+    }
+
+    #[test]
+    fn filter_query() {
+        let schema = cpu_schema();
+        let filter = Filter::parse(
+            &schema,
+            Some("2024-01-01T00:00:00Z"),
+            Some("1704070800000000000"),
+            Some("host=a,host=b'c"),
+        )
+        .unwrap();
+        assert_eq!(
+            filter.query("cpu"),
+            "SELECT * FROM \"cpu\" WHERE \"time\" >= '2024-01-01T00:00:00.000000000Z' \
+             AND \"time\" < '2024-01-01T01:00:00.000000000Z' AND \"host\" IN ('a', 'b''c')"
+        );
+
+        assert!(matches!(
+            Filter::parse(&schema, None, None, Some("usage=1")),
+            Err(FilterError::NotATag(_))
+        ));
+        assert!(matches!(
+            Filter::parse(&schema, Some("yesterday"), None, None),
+            Err(FilterError::InvalidTime(_))
+        ));
+    }
+}
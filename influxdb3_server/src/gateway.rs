@@ -0,0 +1,601 @@
+//! A write gateway for sites with an unreliable connection to the server.
+//!
+//! The gateway accepts writes on `/api/v3/write_lp` like a server does, but
+//! instead of buffering them it appends each one to a spool directory on
+//! local disk, and acknowledges it once it is durable there. A background task
+//! forwards the spooled writes, oldest first, to the upstream server, retrying
+//! for as long as it is unreachable, and removes each one once it has been
+//! accepted. Writes survive restarts of the gateway. Writes refused because
+//! of the token or a rate limit are retried too.
+//!
+//! Clients authenticate with a bearer token of the gateway's own, since the
+//! writes they make are forwarded with the token of the upstream server.
+//!
+//! Each spooled write is a file named after its sequence number, holding the
+//! parameters the write is forwarded with, URL encoded, on its first line
+//! followed by the line protocol. Writes that
+//! the upstream server rejects as invalid are moved to the `rejected`
+//! subdirectory rather than retried.
+
+use crate::http::WriteParams;
+use crate::precision;
+use crate::replication::is_invalid_write;
+use bytes::Bytes;
+use hyper::header::AUTHORIZATION;
+use hyper::server::conn::AddrStream;
+use hyper::{Body, Method, Request, Response, StatusCode};
+use metric::U64Counter;
+use observability_deps::tracing::{error, info, warn};
+use parking_lot::Mutex;
+use serde::{Deserialize, Serialize};
+use serde_json::json;
+use sha2::{Digest, Sha256};
+use std::collections::BTreeSet;
+use std::convert::Infallible;
+use std::fs::{self, File};
+use std::io::Write;
+use std::net::SocketAddr;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+use thiserror::Error;
+use tokio::sync::Notify;
+use tokio_util::sync::CancellationToken;
+
+/// The subdirectory of the spool that rejected writes are moved to.
+pub const REJECTED_DIR: &str = "rejected";
+
+const SPOOL_FILE_EXTENSION: &str = "lp";
+
+/// The longest wait between two attempts to forward a write.
+const MAX_RETRY_INTERVAL: Duration = Duration::from_secs(30);
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("spool io error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("invalid upstream server: {0}")]
+    Upstream(#[source] influxdb3_client::Error),
+
+    #[error("http server error: {0}")]
+    Http(#[from] hyper::Error),
+
+    #[error("the spool is full, {bytes} bytes are waiting to be forwarded")]
+    SpoolFull { bytes: u64 },
+
+    #[error("invalid spool file {0}")]
+    InvalidSpoolFile(PathBuf),
+
+    #[error("from hex error: {0}")]
+    FromHex(#[from] hex::FromHexError),
+}
+
+pub type Result<T, E = Error> = std::result::Result<T, E>;
+
+/// The configuration of a gateway.
+#[derive(Debug, Clone)]
+pub struct GatewayConfig {
+    /// Address the HTTP API is served on
+    pub bind_addr: SocketAddr,
+    /// URL of the server writes are forwarded to
+    pub upstream: String,
+    /// Token used to authenticate with the upstream server
+    pub upstream_token: Option<String>,
+    /// SHA-256 hash of the bearer token clients authenticate with
+    pub bearer_token: Vec<u8>,
+    /// Directory writes are spooled in
+    pub spool_dir: PathBuf,
+    /// Number of bytes the spool may hold before writes are refused
+    pub max_spool_bytes: Option<u64>,
+    /// Maximum size of a write request, in bytes
+    pub max_request_bytes: usize,
+}
+
+/// Serve the gateway until `shutdown` is cancelled.
+pub async fn serve(
+    config: GatewayConfig,
+    metrics: Arc<metric::Registry>,
+    shutdown: CancellationToken,
+) -> Result<()> {
+    let spool = Arc::new(Spool::open(&config.spool_dir, config.max_spool_bytes)?);
+    info!(
+        spool_dir = %config.spool_dir.display(),
+        spooled_writes = spool.len(),
+        spooled_bytes = spool.bytes(),
+        upstream = %config.upstream,
+        "opened gateway spool"
+    );
+
+    let mut client =
+        influxdb3_client::Client::new(config.upstream.as_str()).map_err(Error::Upstream)?;
+    if let Some(token) = &config.upstream_token {
+        client = client.with_auth_token(token);
+    }
+    let forwarded = metrics.register_metric::<U64Counter>(
+        "influxdb3_gateway_forwarded_writes",
+        "Number of spooled writes forwarded to the upstream server, by result",
+    );
+    let forwarder = tokio::spawn(forward(
+        Arc::clone(&spool),
+        client,
+        forwarded,
+        shutdown.clone(),
+    ));
+
+    let max_request_bytes = config.max_request_bytes;
+    let bearer_token: Arc<[u8]> = config.bearer_token.into();
+    let make_service = hyper::service::make_service_fn(|_conn: &AddrStream| {
+        let spool = Arc::clone(&spool);
+        let metrics = Arc::clone(&metrics);
+        let bearer_token = Arc::clone(&bearer_token);
+        futures::future::ready(Ok::<_, Infallible>(hyper::service::service_fn(
+            move |req| {
+                let spool = Arc::clone(&spool);
+                let metrics = Arc::clone(&metrics);
+                let bearer_token = Arc::clone(&bearer_token);
+                async move {
+                    let response = match authorize(&req, &bearer_token) {
+                        Ok(()) => route(&spool, &metrics, req, max_request_bytes).await,
+                        Err(e) => Err(e),
+                    };
+                    let response = match response {
+                        Ok(response) => response,
+                        Err(e) => e.response(),
+                    };
+                    Ok::<_, Infallible>(response)
+                }
+            },
+        )))
+    });
+    let server = hyper::Server::try_bind(&config.bind_addr)?.serve(make_service);
+    info!(bind_addr = %server.local_addr(), "bound gateway HTTP listener");
+    server.with_graceful_shutdown(shutdown.cancelled()).await?;
+
+    shutdown.cancel();
+    forwarder.await.expect("gateway forwarder panicked");
+    Ok(())
+}
+
+/// An error answering a request to the gateway.
+#[derive(Debug)]
+struct RequestError {
+    status: StatusCode,
+    message: String,
+}
+
+impl RequestError {
+    fn new(status: StatusCode, message: impl Into<String>) -> Self {
+        Self {
+            status,
+            message: message.into(),
+        }
+    }
+
+    fn response(self) -> Response<Body> {
+        Response::builder()
+            .status(self.status)
+            .body(Body::from(self.message))
+            .unwrap()
+    }
+}
+
+impl From<Error> for RequestError {
+    fn from(e: Error) -> Self {
+        let status = match e {
+            Error::SpoolFull { .. } => StatusCode::INSUFFICIENT_STORAGE,
+            _ => StatusCode::INTERNAL_SERVER_ERROR,
+        };
+        Self::new(status, e.to_string())
+    }
+}
+
+/// Check that a request carries the bearer token hashing to `bearer_token`.
+fn authorize(req: &Request<Body>, bearer_token: &[u8]) -> Result<(), RequestError> {
+    let token = req
+        .headers()
+        .get(AUTHORIZATION)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.strip_prefix("Bearer "));
+    match token {
+        Some(token) if &Sha256::digest(token.trim())[..] == bearer_token => Ok(()),
+        _ => Err(RequestError::new(StatusCode::UNAUTHORIZED, "unauthorized")),
+    }
+}
+
+async fn route(
+    spool: &Arc<Spool>,
+    metrics: &metric::Registry,
+    req: Request<Body>,
+    max_request_bytes: usize,
+) -> Result<Response<Body>, RequestError> {
+    match (req.method(), req.uri().path()) {
+        (&Method::POST, "/api/v3/write_lp") => {
+            let params: WriteParams =
+                serde_urlencoded::from_str(req.uri().query().unwrap_or_default())
+                    .map_err(|e| RequestError::new(StatusCode::BAD_REQUEST, e.to_string()))?;
+            let body = read_body(req.into_body(), max_request_bytes).await?;
+            // the spool holds nanosecond timestamps, which is what the
+            // upstream server is sent
+            let body = std::str::from_utf8(&body)
+                .map_err(|e| RequestError::new(StatusCode::BAD_REQUEST, e.to_string()))?;
+            let body = precision::to_nanoseconds(body, params.precision)
+                .map_err(|e| RequestError::new(StatusCode::BAD_REQUEST, e.to_string()))?
+                .into_owned();
+            let params = SpoolParams {
+                db: params.db,
+                accept_partial: params.accept_partial,
+            };
+            // appending syncs the spool to disk
+            let spool = Arc::clone(spool);
+            tokio::task::spawn_blocking(move || spool.append(&params, body.as_bytes()))
+                .await
+                .expect("spooling a write panicked")?;
+            Ok(Response::new(Body::from("{}")))
+        }
+        (&Method::GET, "/health") => {
+            let body = json!({
+                "status": "pass",
+                "spooled_writes": spool.len(),
+                "spooled_bytes": spool.bytes(),
+            });
+            Ok(Response::builder()
+                .header("Content-Type", "application/json")
+                .body(Body::from(body.to_string()))
+                .unwrap())
+        }
+        (&Method::GET, "/metrics") => {
+            let mut body: Vec<u8> = Default::default();
+            let mut reporter = metric_exporters::PrometheusTextEncoder::new(&mut body);
+            metrics.report(&mut reporter);
+            Ok(Response::new(Body::from(body)))
+        }
+        _ => Err(RequestError::new(StatusCode::NOT_FOUND, "not found")),
+    }
+}
+
+async fn read_body(mut body: Body, max_bytes: usize) -> Result<Bytes, RequestError> {
+    use futures::StreamExt;
+
+    let mut bytes = Vec::new();
+    while let Some(chunk) = body.next().await {
+        let chunk = chunk.map_err(|e| RequestError::new(StatusCode::BAD_REQUEST, e.to_string()))?;
+        if bytes.len() + chunk.len() > max_bytes {
+            return Err(RequestError::new(
+                StatusCode::PAYLOAD_TOO_LARGE,
+                format!("max request size ({max_bytes} bytes) exceeded"),
+            ));
+        }
+        bytes.extend_from_slice(&chunk);
+    }
+    Ok(bytes.into())
+}
+
+/// Forward the spooled writes, oldest first, until `shutdown` is cancelled.
+async fn forward(
+    spool: Arc<Spool>,
+    client: influxdb3_client::Client,
+    forwarded: metric::Metric<U64Counter>,
+    shutdown: CancellationToken,
+) {
+    let mut retry_interval = Duration::from_millis(100);
+    loop {
+        // register interest before looking, so that a write appended in
+        // between is not missed
+        let appended = spool.appended.notified();
+        let write = match spool.oldest() {
+            Ok(Some(write)) => write,
+            Ok(None) => {
+                tokio::select! {
+                    _ = appended => continue,
+                    _ = shutdown.cancelled() => return,
+                }
+            }
+            Err(e) => {
+                error!(%e, "unable to read spooled write");
+                tokio::select! {
+                    _ = tokio::time::sleep(MAX_RETRY_INTERVAL) => continue,
+                    _ = shutdown.cancelled() => return,
+                }
+            }
+        };
+
+        let result = client
+            .api_v3_write_lp(&write.params.db)
+            .accept_partial(write.params.accept_partial)
+            .body(write.lp)
+            .send()
+            .await;
+        let outcome = match result {
+            Ok(()) => spool.remove(write.id).map(|_| "ok"),
+            // a write the upstream server rejects as invalid will never succeed
+            Err(influxdb3_client::Error::ApiError { code, message })
+                if is_invalid_write(code.as_u16()) =>
+            {
+                error!(
+                    db = %write.params.db,
+                    %code,
+                    %message,
+                    "upstream server rejected spooled write, moving it to the rejected directory"
+                );
+                spool.reject(write.id).map(|_| "rejected")
+            }
+            Err(e) => {
+                match &e {
+                    // the token is wrong until it is fixed, which needs an
+                    // operator, but the spooled writes are kept for when it is
+                    influxdb3_client::Error::ApiError { code, .. }
+                        if matches!(code.as_u16(), 401 | 403) =>
+                    {
+                        error!(
+                            %e,
+                            ?retry_interval,
+                            "upstream server refused the gateway's token, check \
+                             --upstream-token; retrying"
+                        )
+                    }
+                    _ => warn!(%e, ?retry_interval, "unable to forward spooled write, retrying"),
+                }
+                forwarded.recorder(&[("result", "error")]).inc(1);
+                tokio::select! {
+                    _ = tokio::time::sleep(retry_interval) => {}
+                    _ = shutdown.cancelled() => return,
+                }
+                retry_interval = (retry_interval * 2).min(MAX_RETRY_INTERVAL);
+                continue;
+            }
+        };
+        match outcome {
+            Ok(outcome) => forwarded.recorder(&[("result", outcome)]).inc(1),
+            Err(e) => error!(%e, id = write.id, "unable to remove forwarded write from the spool"),
+        }
+        retry_interval = Duration::from_millis(100);
+    }
+}
+
+/// The parameters a spooled write is forwarded with.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+struct SpoolParams {
+    db: String,
+    #[serde(default)]
+    accept_partial: bool,
+}
+
+/// A write read back from the spool.
+#[derive(Debug)]
+struct SpooledWrite {
+    id: u64,
+    params: SpoolParams,
+    lp: Bytes,
+}
+
+/// The writes waiting to be forwarded, each in a file of the spool directory.
+#[derive(Debug)]
+struct Spool {
+    dir: PathBuf,
+    max_bytes: Option<u64>,
+    ids: Mutex<BTreeSet<u64>>,
+    next_id: AtomicU64,
+    bytes: AtomicU64,
+    appended: Notify,
+}
+
+impl Spool {
+    /// Open the spool in `dir`, picking up the writes left by a previous run.
+    fn open(dir: &Path, max_bytes: Option<u64>) -> Result<Self> {
+        fs::create_dir_all(dir.join(REJECTED_DIR))?;
+
+        let mut ids = BTreeSet::new();
+        let mut bytes = 0;
+        for entry in fs::read_dir(dir)? {
+            let path = entry?.path();
+            if !path.is_file() {
+                continue;
+            }
+            match path.extension().and_then(|e| e.to_str()) {
+                Some(SPOOL_FILE_EXTENSION) => {}
+                // a write that was not acknowledged before the gateway stopped
+                Some("tmp") => {
+                    fs::remove_file(&path)?;
+                    continue;
+                }
+                _ => continue,
+            }
+            let id = path
+                .file_stem()
+                .and_then(|s| s.to_str())
+                .and_then(|s| s.parse().ok())
+                .ok_or_else(|| Error::InvalidSpoolFile(path.clone()))?;
+            bytes += path.metadata()?.len();
+            ids.insert(id);
+        }
+
+        let next_id = ids.last().map_or(0, |id| id + 1);
+        Ok(Self {
+            dir: dir.to_path_buf(),
+            max_bytes,
+            ids: Mutex::new(ids),
+            next_id: AtomicU64::new(next_id),
+            bytes: AtomicU64::new(bytes),
+            appended: Notify::new(),
+        })
+    }
+
+    fn len(&self) -> usize {
+        self.ids.lock().len()
+    }
+
+    fn bytes(&self) -> u64 {
+        self.bytes.load(Ordering::Relaxed)
+    }
+
+    fn path(&self, id: u64) -> PathBuf {
+        self.dir
+            .join(format!("{id:020}"))
+            .with_extension(SPOOL_FILE_EXTENSION)
+    }
+
+    /// Durably add a write of `lp`, blocking until it is synced to disk.
+    fn append(&self, params: &SpoolParams, lp: &[u8]) -> Result<()> {
+        let params =
+            serde_urlencoded::to_string(params).expect("write parameters are URL encodable");
+        let size = (params.len() + 1 + lp.len()) as u64;
+        if let Some(max_bytes) = self.max_bytes {
+            let bytes = self.bytes();
+            if bytes + size > max_bytes {
+                return Err(Error::SpoolFull { bytes });
+            }
+        }
+
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+        let path = self.path(id);
+        let tmp = path.with_extension("tmp");
+        let mut f = File::create(&tmp)?;
+        f.write_all(params.as_bytes())?;
+        f.write_all(b"\n")?;
+        f.write_all(lp)?;
+        f.sync_all()?;
+        fs::rename(&tmp, &path)?;
+        File::open(&self.dir)?.sync_all()?;
+
+        self.bytes.fetch_add(size, Ordering::Relaxed);
+        self.ids.lock().insert(id);
+        self.appended.notify_one();
+        Ok(())
+    }
+
+    /// The oldest write in the spool.
+    fn oldest(&self) -> Result<Option<SpooledWrite>> {
+        let Some(id) = self.ids.lock().first().copied() else {
+            return Ok(None);
+        };
+        let path = self.path(id);
+        let contents = fs::read(&path)?;
+        let newline = contents
+            .iter()
+            .position(|b| *b == b'\n')
+            .ok_or_else(|| Error::InvalidSpoolFile(path.clone()))?;
+        let params = serde_urlencoded::from_bytes(&contents[..newline])
+            .map_err(|_| Error::InvalidSpoolFile(path.clone()))?;
+        let lp = Bytes::from(contents).slice(newline + 1..);
+        Ok(Some(SpooledWrite { id, params, lp }))
+    }
+
+    /// Remove a write that was forwarded.
+    fn remove(&self, id: u64) -> Result<()> {
+        let path = self.path(id);
+        let size = path.metadata()?.len();
+        fs::remove_file(path)?;
+        self.forget(id, size);
+        Ok(())
+    }
+
+    /// Set aside a write that the upstream server will not accept.
+    fn reject(&self, id: u64) -> Result<()> {
+        let path = self.path(id);
+        let size = path.metadata()?.len();
+        let rejected = self
+            .dir
+            .join(REJECTED_DIR)
+            .join(path.file_name().expect("spool files have a name"));
+        fs::rename(path, rejected)?;
+        self.forget(id, size);
+        Ok(())
+    }
+
+    fn forget(&self, id: u64, size: u64) {
+        self.ids.lock().remove(&id);
+        self.bytes.fetch_sub(size, Ordering::Relaxed);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn params(db: &str, accept_partial: bool) -> SpoolParams {
+        SpoolParams {
+            db: db.to_string(),
+            accept_partial,
+        }
+    }
+
+    #[test]
+    fn spool_survives_reopen() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+
+        {
+            let spool = Spool::open(&dir, None).unwrap();
+            spool
+                .append(&params("foo", true), b"cpu usage=1 1")
+                .unwrap();
+            spool
+                .append(&params("bar", false), b"mem used=2 2")
+                .unwrap();
+            assert_eq!(spool.len(), 2);
+        }
+        // a write interrupted before it was acknowledged
+        fs::write(dir.join("00000000000000000002.tmp"), b"db=foo\ncpu").unwrap();
+
+        let spool = Spool::open(&dir, None).unwrap();
+        assert_eq!(spool.len(), 2);
+        assert!(!dir.join("00000000000000000002.tmp").exists());
+
+        let write = spool.oldest().unwrap().unwrap();
+        assert_eq!(write.params, params("foo", true));
+        assert_eq!(write.lp, Bytes::from("cpu usage=1 1"));
+        spool.remove(write.id).unwrap();
+
+        let write = spool.oldest().unwrap().unwrap();
+        assert_eq!(write.params, params("bar", false));
+        spool.reject(write.id).unwrap();
+        assert!(spool.oldest().unwrap().is_none());
+        assert_eq!(spool.bytes(), 0);
+        assert_eq!(fs::read_dir(dir.join(REJECTED_DIR)).unwrap().count(), 1);
+
+        // ids keep increasing after a restart
+        spool
+            .append(&params("foo", false), b"cpu usage=3 3")
+            .unwrap();
+        assert_eq!(spool.oldest().unwrap().unwrap().id, 2);
+    }
+
+    #[test]
+    fn spool_limit() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let spool = Spool::open(&dir, Some(60)).unwrap();
+
+        // `db=foo&accept_partial=false`, a newline and the line
+        spool
+            .append(&params("foo", false), b"cpu usage=1 1")
+            .unwrap();
+        assert!(matches!(
+            spool.append(&params("foo", false), b"cpu usage=1 1"),
+            Err(Error::SpoolFull { bytes: 41 })
+        ));
+    }
+
+    #[test]
+    fn authorization() {
+        let token = Sha256::digest("secret").to_vec();
+        let request = |auth: Option<&str>| {
+            let mut builder = Request::post("/api/v3/write_lp?db=foo");
+            if let Some(auth) = auth {
+                builder = builder.header(AUTHORIZATION, auth);
+            }
+            builder.body(Body::empty()).unwrap()
+        };
+
+        assert!(authorize(&request(Some("Bearer secret")), &token).is_ok());
+        for auth in [
+            None,
+            Some("Bearer wrong"),
+            Some("secret"),
+            Some("Token secret"),
+        ] {
+            let e = authorize(&request(auth), &token).unwrap_err();
+            assert_eq!(e.status, StatusCode::UNAUTHORIZED, "{auth:?}");
+        }
+    }
+}
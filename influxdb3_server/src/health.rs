@@ -0,0 +1,230 @@
+//! Component level health reporting for the `/health` and `/ready` endpoints.
+//!
+//! `/health` reports whether the process is alive and able to serve requests,
+//! and always succeeds while it is. `/ready` runs the same checks, but fails
+//! with `503 Service Unavailable` when any component is over its configured
+//! thresholds, so that load balancers can route writes elsewhere until the
+//! server catches up.
+
+use influxdb3_write::{BufferStatus, Wal};
+use serde::Serialize;
+use serde_json::json;
+
+/// The default fraction of the write queue that may be in use before the
+/// server reports that it is not ready.
+pub const DEFAULT_WRITE_QUEUE_FAIL_RATIO: f64 = 0.9;
+
+/// Thresholds beyond which a component is reported as failing.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct HealthThresholds {
+    /// Fraction, between 0 and 1, of the write queue that may be in use.
+    pub write_queue_fail_ratio: f64,
+    /// Number of rows the open buffer segment may hold.
+    pub max_open_segment_rows: Option<usize>,
+}
+
+impl Default for HealthThresholds {
+    fn default() -> Self {
+        Self {
+            write_queue_fail_ratio: DEFAULT_WRITE_QUEUE_FAIL_RATIO,
+            max_open_segment_rows: None,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum Status {
+    Pass,
+    Fail,
+}
+
+/// The health of a single component of the server.
+#[derive(Debug, Serialize)]
+pub(crate) struct Check {
+    name: &'static str,
+    status: Status,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    message: Option<String>,
+    details: serde_json::Value,
+}
+
+/// The health of the server, made up of the health of its components.
+#[derive(Debug, Serialize)]
+pub(crate) struct HealthReport {
+    name: &'static str,
+    status: Status,
+    checks: Vec<Check>,
+}
+
+impl HealthReport {
+    pub(crate) fn new<W: Wal>(
+        thresholds: &HealthThresholds,
+        buffer: BufferStatus,
+        wal: Option<&W>,
+    ) -> Self {
+        let checks = vec![check_write_buffer(thresholds, buffer), check_wal(wal)];
+        let status = checks
+            .iter()
+            .map(|c| c.status)
+            .max()
+            .unwrap_or(Status::Pass);
+
+        Self {
+            name: "influxdb3",
+            status,
+            checks,
+        }
+    }
+
+    pub(crate) fn is_pass(&self) -> bool {
+        self.status == Status::Pass
+    }
+}
+
+fn check_write_buffer(thresholds: &HealthThresholds, buffer: BufferStatus) -> Check {
+    let details = json!({
+        "open_segment_id": buffer.open_segment_id,
+        "open_segment_rows": buffer.open_segment_rows,
+        "queued_writes": buffer.queued_writes,
+        "queue_capacity": buffer.queue_capacity,
+    });
+
+    let queue_limit = (buffer.queue_capacity as f64 * thresholds.write_queue_fail_ratio) as usize;
+    let message = if buffer.queued_writes >= queue_limit {
+        Some(format!(
+            "{} writes queued, the limit is {queue_limit}",
+            buffer.queued_writes
+        ))
+    } else {
+        match thresholds.max_open_segment_rows {
+            Some(max) if buffer.open_segment_rows > max => Some(format!(
+                "{} rows buffered in the open segment, the limit is {max}",
+                buffer.open_segment_rows
+            )),
+            _ => None,
+        }
+    };
+
+    Check {
+        name: "write_buffer",
+        status: if message.is_some() {
+            Status::Fail
+        } else {
+            Status::Pass
+        },
+        message,
+        details,
+    }
+}
+
+fn check_wal<W: Wal>(wal: Option<&W>) -> Check {
+    let Some(wal) = wal else {
+        return Check {
+            name: "wal",
+            status: Status::Pass,
+            message: Some("wal is not configured".to_string()),
+            details: json!({}),
+        };
+    };
+
+    // damage found at startup has been dealt with, so it is reported without
+    // failing the check
+    let recovery = wal.recovery_report();
+    let message = recovery.filter(|r| !r.is_clean()).map(|r| {
+        format!(
+            "{} damaged wal segment files were repaired and {} quarantined at startup",
+            r.repaired.len(),
+            r.quarantined.len()
+        )
+    });
+
+    match wal.segment_files() {
+        Ok(files) => Check {
+            name: "wal",
+            status: Status::Pass,
+            message,
+            details: json!({ "segment_files": files.len(), "recovery": recovery }),
+        },
+        Err(e) => Check {
+            name: "wal",
+            status: Status::Fail,
+            message: Some(format!("unable to list wal segment files: {e}")),
+            details: json!({}),
+        },
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use influxdb3_write::wal::WalImpl;
+    use influxdb3_write::SegmentId;
+
+    fn buffer(queued_writes: usize, open_segment_rows: usize) -> BufferStatus {
+        BufferStatus {
+            open_segment_id: SegmentId::new(1),
+            open_segment_rows,
+            queued_writes,
+            queue_capacity: 100,
+        }
+    }
+
+    #[test]
+    fn write_queue_threshold() {
+        let thresholds = HealthThresholds {
+            write_queue_fail_ratio: 0.5,
+            max_open_segment_rows: None,
+        };
+
+        let report = HealthReport::new::<WalImpl>(&thresholds, buffer(49, 1_000_000), None);
+        assert!(report.is_pass());
+
+        let report = HealthReport::new::<WalImpl>(&thresholds, buffer(50, 0), None);
+        assert!(!report.is_pass());
+        assert_eq!(report.checks[0].status, Status::Fail);
+        assert_eq!(report.checks[1].status, Status::Pass);
+    }
+
+    #[test]
+    fn open_segment_rows_threshold() {
+        let thresholds = HealthThresholds {
+            max_open_segment_rows: Some(10),
+            ..Default::default()
+        };
+
+        assert!(HealthReport::new::<WalImpl>(&thresholds, buffer(0, 10), None).is_pass());
+        assert!(!HealthReport::new::<WalImpl>(&thresholds, buffer(0, 11), None).is_pass());
+    }
+
+    #[test]
+    fn wal_segment_files_are_reported() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal = WalImpl::new(dir).unwrap();
+
+        let report = HealthReport::new(&HealthThresholds::default(), buffer(0, 0), Some(&wal));
+        assert!(report.is_pass());
+
+        let json = serde_json::to_value(&report).unwrap();
+        assert_eq!(json["checks"][1]["name"], "wal");
+        assert_eq!(json["checks"][1]["details"]["segment_files"], 0);
+        assert_eq!(
+            json["checks"][1]["details"]["recovery"]["segments_checked"],
+            0
+        );
+    }
+
+    #[test]
+    fn wal_recovery_is_reported() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        std::fs::write(dir.join("0000000001.wal"), b"garbage").unwrap();
+        let wal = WalImpl::new(dir).unwrap();
+
+        let report = HealthReport::new(&HealthThresholds::default(), buffer(0, 0), Some(&wal));
+        assert!(report.is_pass());
+        assert_eq!(
+            report.checks[1].message.as_deref(),
+            Some("0 damaged wal segment files were repaired and 1 quarantined at startup")
+        );
+    }
+}
@@ -1,6 +1,24 @@
 //! HTTP API service implementations for `server`
 
-use crate::{CommonServerState, QueryExecutor};
+use crate::compression::{Encoding, ResponseCompression};
+use crate::database_metrics::DatabaseMetrics;
+use crate::export;
+use crate::health::HealthReport;
+use crate::idempotency::{IdempotencyCache, InFlightWrite, Registration, IDEMPOTENCY_KEY};
+use crate::idle_timeout::{IdleTimeout, Requests};
+use crate::ingest_metrics::{IngestMetrics, WriteCounts};
+use crate::listener;
+use crate::load_shedding::{LoadShedder, Overloaded, Priority};
+use crate::precision;
+use crate::profile_bundle::{self, ProfileBundle};
+use crate::query_cursor::{Page, QueryCursors, CURSOR_HEADER};
+use crate::read_only::ReadOnlyState;
+use crate::rejection::{self, RejectedLine, RejectedLines};
+use crate::reload::{reload_on_sighup, ConfigReloader};
+use crate::replication::{Replicator, REPLICATED_HEADER};
+use crate::sampling::Sampler;
+use crate::signed_writes::{self, Signature, SignatureVerifier};
+use crate::{CommonServerState, HttpServerConfig, QueryExecutor};
 use arrow::record_batch::RecordBatch;
 use arrow::util::pretty;
 use authz::http::AuthorizationHeaderExtension;
@@ -9,26 +27,43 @@ use data_types::NamespaceName;
 use datafusion::execution::memory_pool::UnboundedMemoryPool;
 use futures::StreamExt;
 use hyper::header::ACCEPT;
+use hyper::header::ACCEPT_ENCODING;
 use hyper::header::AUTHORIZATION;
+use hyper::header::CONNECTION;
 use hyper::header::CONTENT_ENCODING;
+use hyper::header::RETRY_AFTER;
+use hyper::header::VARY;
 use hyper::http::HeaderValue;
+use hyper::server::accept::Accept;
 use hyper::server::conn::{AddrIncoming, AddrStream};
 use hyper::{Body, Method, Request, Response, StatusCode};
 use influxdb3_write::persister::TrackedMemoryArrowWriter;
-use influxdb3_write::WriteBuffer;
+use influxdb3_write::{Bufferer, WriteBuffer};
+use influxdb_line_protocol::parse_lines;
 use iox_time::{SystemProvider, TimeProvider};
-use observability_deps::tracing::{debug, error, info};
-use serde::Deserialize;
+use metric::{U64Counter, U64Gauge};
+use observability_deps::tracing::{debug, error, info, warn};
+use serde::{Deserialize, Serialize};
+use sha2::digest::Output;
 use sha2::Digest;
 use sha2::Sha256;
+use std::borrow::Cow;
 use std::convert::Infallible;
 use std::fmt::Debug;
-use std::num::NonZeroI32;
+use std::future::Future;
+use std::num::{NonZeroI32, NonZeroUsize};
+use std::path::PathBuf;
+use std::pin::Pin;
 use std::str::Utf8Error;
+use std::sync::atomic::{AtomicUsize, Ordering};
 use std::sync::Arc;
+use std::time::{Duration, Instant};
 use thiserror::Error;
 use tokio_util::sync::CancellationToken;
 use tower::Layer;
+use trace::ctx::SpanContext;
+use trace::span::{SpanExt, SpanRecorder};
+use trace_http::ctx::RequestLogContext;
 use trace_http::metrics::MetricFamily;
 use trace_http::metrics::RequestMetrics;
 use trace_http::tower::TraceLayer;
@@ -135,6 +170,122 @@ pub enum Error {
     // Influxdb3 Write
     #[error("serde json error: {0}")]
     Influxdb3Write(#[from] influxdb3_write::Error),
+
+    /// The `Idempotency-Key` header is invalid and cannot be read.
+    #[error("invalid idempotency-key header: {0}")]
+    InvalidIdempotencyKey(hyper::header::ToStrError),
+
+    /// A write with the same idempotency key is still being processed.
+    #[error("a write with idempotency key '{0}' is already in progress")]
+    IdempotentWriteInProgress(String),
+
+    /// The idempotency key was already used for a write with a different body.
+    #[error("idempotency key '{0}' was already used for a different write")]
+    IdempotencyKeyReused(String),
+
+    /// Too many keyed writes are in flight for another to be deduplicated.
+    #[error("too many writes with an idempotency key are in progress")]
+    IdempotencyCacheFull,
+
+    /// Compressing the response body failed.
+    #[error("response compression error: {0}")]
+    Compression(#[from] crate::compression::Error),
+
+    /// The request was not handled within the configured timeout.
+    ///
+    /// The client sent its request in time, so this is reported as the server
+    /// failing to answer in time rather than as `408 Request Timeout`.
+    #[error("request timed out after {0:?}")]
+    RequestTimeout(Duration),
+
+    /// Binding the TCP listener failed.
+    #[error("error binding HTTP listener: {0}")]
+    TcpListener(std::io::Error),
+
+    /// Binding the unix socket listener failed.
+    #[error("error binding unix socket: {0}")]
+    UnixSocket(std::io::Error),
+
+    /// The unix socket path is occupied by a file that is not a socket.
+    #[error("cannot bind unix socket: {0} exists and is not a socket")]
+    UnixSocketPathInUse(PathBuf),
+
+    /// Writing the profile bundle archive failed.
+    #[error("error writing profile bundle: {0}")]
+    ProfileBundle(std::io::Error),
+
+    /// The period requested for a profile bundle is too long.
+    #[error("profile bundles are captured over at most {max} seconds, not {seconds}")]
+    ProfileBundleTooLong { seconds: u64, max: u64 },
+
+    /// The log filter cannot be changed because the server was not started
+    /// with a reloadable one.
+    #[error("the log filter cannot be changed at runtime")]
+    LogFilterUnavailable,
+
+    /// Reading or changing the log filter failed.
+    #[error("log filter error: {0}")]
+    LogFilter(#[from] trogging::Error),
+
+    /// The database or table to export does not exist.
+    #[error("table '{table}' not found in database '{db}'")]
+    TableNotFound { db: String, table: String },
+
+    /// The filter of an export request is invalid.
+    #[error("invalid export filter: {0}")]
+    ExportFilter(#[from] export::FilterError),
+
+    /// Querying the table to export failed.
+    #[error("error querying table: {0}")]
+    Query(#[from] crate::Error),
+
+    /// The write was applied, but the replication peer did not accept it.
+    #[error("replication error: {0}")]
+    Replication(#[from] crate::replication::Error),
+
+    /// A write marked as replicated was not authenticated as coming from the
+    /// replication peer.
+    #[error("replicated writes are only accepted from the replication peer")]
+    NotReplicationPeer,
+
+    /// The timestamp precision of a write is invalid.
+    #[error("{0}")]
+    Precision(#[from] precision::Error),
+
+    /// Lines of a write are invalid or have timestamps too far from the
+    /// present.
+    #[error("{lines}")]
+    LinesRejected {
+        lines: RejectedLines,
+        /// Whether the client accepts the rejected lines as JSON
+        json: bool,
+    },
+
+    /// Paging a query result failed.
+    #[error("{0}")]
+    QueryCursor(#[from] crate::query_cursor::Error),
+
+    /// The server is in read-only mode.
+    #[error("writes are refused: {0}")]
+    ReadOnly(String),
+
+    /// The query was refused because the server is overloaded, see
+    /// [`load_shedding`](crate::load_shedding).
+    #[error("the server is overloaded, retry later")]
+    Overloaded(Overloaded),
+
+    /// The signature of a signed write is not accepted, see
+    /// [`signed_writes`].
+    #[error("signed write refused: {0}")]
+    Signature(#[from] signed_writes::SignatureError),
+
+    /// Reloading the configuration failed.
+    #[error("config reload error: {0}")]
+    Reload(#[from] crate::reload::Error),
+
+    /// Unix sockets are not available on this platform.
+    #[error("cannot bind unix socket {0}: unix sockets are not supported on this platform")]
+    UnixSocketUnsupported(PathBuf),
 }
 
 #[derive(Debug, Error)]
@@ -149,11 +300,52 @@ pub enum AuthorizationError {
 
 impl Error {
     fn response(&self) -> Response<Body> {
+        let status = match self {
+            Self::IdempotentWriteInProgress(_) => StatusCode::CONFLICT,
+            Self::IdempotencyKeyReused(_) => StatusCode::UNPROCESSABLE_ENTITY,
+            Self::RequestLimit
+            | Self::ReadOnly(_)
+            | Self::Overloaded(_)
+            | Self::IdempotencyCacheFull => StatusCode::SERVICE_UNAVAILABLE,
+            Self::RequestTimeout(_) => StatusCode::GATEWAY_TIMEOUT,
+            Self::Signature(_) => StatusCode::UNAUTHORIZED,
+            Self::NotReplicationPeer => StatusCode::FORBIDDEN,
+            Self::LogFilter(trogging::Error::InvalidLogFilter(_)) => StatusCode::BAD_REQUEST,
+            Self::LogFilterUnavailable => StatusCode::NOT_IMPLEMENTED,
+            Self::TableNotFound { .. } => StatusCode::NOT_FOUND,
+            Self::ExportFilter(_)
+            | Self::Precision(_)
+            | Self::LinesRejected { .. }
+            | Self::ProfileBundleTooLong { .. } => StatusCode::BAD_REQUEST,
+            Self::Replication(_) => StatusCode::BAD_GATEWAY,
+            Self::QueryCursor(crate::query_cursor::Error::NotFound(_)) => StatusCode::NOT_FOUND,
+            Self::QueryCursor(crate::query_cursor::Error::Full { .. }) => {
+                StatusCode::SERVICE_UNAVAILABLE
+            }
+            Self::Reload(crate::reload::Error::NoReloadFile) => StatusCode::NOT_IMPLEMENTED,
+            Self::Reload(
+                crate::reload::Error::Syntax { .. }
+                | crate::reload::Error::UnknownSetting { .. }
+                | crate::reload::Error::InvalidSetting { .. }
+                | crate::reload::Error::LogFilter(_),
+            ) => StatusCode::BAD_REQUEST,
+            _ => StatusCode::INTERNAL_SERVER_ERROR,
+        };
+        if let Self::LinesRejected { lines, json: true } = self {
+            if let Ok(body) = serde_json::to_string(lines) {
+                return Response::builder()
+                    .status(status)
+                    .header("Content-Type", "application/json")
+                    .body(Body::from(body))
+                    .unwrap();
+            }
+        }
+        let mut response = Response::builder().status(status);
+        if let Self::Overloaded(overloaded) = self {
+            response = response.header(RETRY_AFTER, overloaded.retry_after.as_secs().max(1));
+        }
         let body = Body::from(self.to_string());
-        Response::builder()
-            .status(StatusCode::INTERNAL_SERVER_ERROR)
-            .body(body)
-            .unwrap()
+        response.body(body).unwrap()
     }
 }
 
@@ -166,7 +358,17 @@ pub(crate) struct HttpApi<W, Q> {
     common_state: CommonServerState,
     write_buffer: Arc<W>,
     query_executor: Arc<Q>,
-    max_request_bytes: usize,
+    http_config: HttpServerConfig,
+    idempotency_cache: IdempotencyCache,
+    response_compression: ResponseCompression,
+    config_reloader: Arc<ConfigReloader>,
+    replicator: Option<Replicator>,
+    ingest_metrics: Option<IngestMetrics>,
+    database_metrics: Option<DatabaseMetrics>,
+    load_shedder: Option<LoadShedder>,
+    signature_verifier: SignatureVerifier,
+    sampler: Sampler,
+    query_cursors: QueryCursors,
 }
 
 impl<W, Q> HttpApi<W, Q> {
@@ -174,13 +376,50 @@ impl<W, Q> HttpApi<W, Q> {
         common_state: CommonServerState,
         write_buffer: Arc<W>,
         query_executor: Arc<Q>,
-        max_request_bytes: usize,
+        http_config: HttpServerConfig,
+        idempotency_cache: IdempotencyCache,
+        response_compression: ResponseCompression,
+        replicator: Option<Replicator>,
     ) -> Self {
+        let config_reloader = Arc::new(ConfigReloader::new(
+            http_config.clone(),
+            common_state.log_filter().cloned(),
+        ));
+        let ingest_metrics = http_config
+            .ingest_metrics_max_measurements
+            .map(|max| IngestMetrics::new(max, &common_state.metrics));
+        let database_metrics = http_config
+            .database_metrics
+            .clone()
+            .map(|config| DatabaseMetrics::new(config, &common_state.metrics));
+        let load_shedder = http_config
+            .load_shedding
+            .clone()
+            .map(|config| LoadShedder::new(config, &common_state.metrics));
+        let signature_verifier = SignatureVerifier::new(
+            http_config.signing_keys.clone(),
+            http_config.signed_write_max_skew,
+        );
+        let sampler = Sampler::new(http_config.sampling_rules.clone(), &common_state.metrics);
+        let query_cursors = QueryCursors::new(
+            http_config.query_cursor_max_bytes,
+            http_config.query_cursor_ttl,
+        );
         Self {
             common_state,
             write_buffer,
             query_executor,
-            max_request_bytes,
+            http_config,
+            idempotency_cache,
+            response_compression,
+            config_reloader,
+            replicator,
+            ingest_metrics,
+            database_metrics,
+            load_shedder,
+            signature_verifier,
+            sampler,
+            query_cursors,
         }
     }
 }
@@ -194,20 +433,297 @@ where
         let query = req.uri().query().ok_or(Error::MissingWriteParams)?;
         let params: WriteParams = serde_urlencoded::from_str(query)?;
         info!("write_lp to {}", params.db);
+        if let Some(reason) = self.http_config.read_only.reason() {
+            return Err(Error::ReadOnly(reason));
+        }
 
+        let idempotency_key = req
+            .headers()
+            .get(IDEMPOTENCY_KEY)
+            .map(|v| v.to_str().map(ToString::to_string))
+            .transpose()
+            .map_err(Error::InvalidIdempotencyKey)?;
+        // a write replicated from the peer is not sent back to it, which
+        // only the peer may ask for
+        let replicate = !req.headers().contains_key(REPLICATED_HEADER);
+        if !replicate && req.extensions().get::<ReplicationPeer>().is_none() {
+            return Err(Error::NotReplicationPeer);
+        }
+        let json_errors = req
+            .headers()
+            .get(ACCEPT)
+            .and_then(|v| v.to_str().ok())
+            .is_some_and(|v| v.contains("application/json"));
+
+        let span_ctx = req.extensions().get::<SpanContext>().cloned();
+        let signature = req.extensions().get::<Signature>().cloned();
+        let method = req.method().clone();
+        let uri = req.uri().clone();
+
+        let mut span = SpanRecorder::new(span_ctx.child_span("read body"));
         let body = self.read_body(req).await?;
-        let body = std::str::from_utf8(&body).map_err(Error::NonUtf8Body)?;
+        span.set_metadata("bytes", body.len() as i64);
+        drop(span);
+        if let Some(signature) = signature {
+            let path_and_query = uri.path_and_query().map_or("", |p| p.as_str());
+            let now = SystemProvider::new().now().timestamp();
+            self.signature_verifier.verify(
+                &signature,
+                method.as_str(),
+                path_and_query,
+                &body,
+                now,
+            )?;
+        }
+
+        let rejected = self
+            .write_lines(LineWrite {
+                db: params.db,
+                lp: &body,
+                precision: params.precision,
+                accept_partial: params.accept_partial,
+                replicate,
+                idempotency_key,
+                json_errors,
+                span_ctx,
+            })
+            .await?;
+        if rejected.is_empty() {
+            return Ok(Response::new(Body::from("{}")));
+        }
+        let body = serde_json::to_string(&RejectedLines::new(&rejected))?;
+        Ok(Response::new(Body::from(body)))
+    }
+
+    /// Whether writes are refused, and why.
+    pub(crate) fn read_only_reason(&self) -> Option<String> {
+        self.http_config.read_only.reason()
+    }
+
+    /// Write lines through the write path shared by `/api/v3/write_lp` and
+    /// the UDP listener, returning the lines dropped from a write made with
+    /// `accept_partial`.
+    pub(crate) async fn write_lines(&self, mut write: LineWrite<'_>) -> Result<Vec<RejectedLine>> {
+        // A retry of a write that was already applied is acknowledged without
+        // buffering its lines a second time, with the lines the write rejected.
+        // The key is forgotten if the write fails, or is dropped because the
+        // client disconnected or it timed out, so that it can be retried. A
+        // write that was buffered but not replicated is not retried, so that
+        // its lines are not buffered twice.
+        let entry = match write.idempotency_key.take() {
+            None => None,
+            Some(key) => {
+                match self
+                    .idempotency_cache
+                    .register(&write.db, &key, write.request_hash())
+                {
+                    Registration::New(entry) => Some(entry),
+                    Registration::Duplicate(rejected) => {
+                        debug!(db = %write.db, %key, "skipping duplicate idempotent write");
+                        return Ok(rejected);
+                    }
+                    Registration::InFlight => return Err(Error::IdempotentWriteInProgress(key)),
+                    Registration::Conflict => return Err(Error::IdempotencyKeyReused(key)),
+                    Registration::Full => return Err(Error::IdempotencyCacheFull),
+                }
+            }
+        };
+
+        let body = std::str::from_utf8(write.lp).map_err(Error::NonUtf8Body)?;
+        let body = precision::to_nanoseconds(body, write.precision)?;
+        // lines are checked before they are transformed, so that rejected
+        // lines are reported as written. Without time bounds or metrics to
+        // count the lines for, invalid lines are left to the write buffer,
+        // which rejects them the same way, rather than parsed twice.
+        let (checked, rejected, counts) =
+            if self.http_config.time_bounds.is_unbounded() && self.ingest_metrics.is_none() {
+                (Cow::Borrowed(&*body), vec![], WriteCounts::default())
+            } else {
+                let now = SystemProvider::new().now().timestamp_nanos();
+                rejection::check(&body, &self.http_config.time_bounds, now)
+            };
+        if let Some(metrics) = self
+            .ingest_metrics
+            .as_ref()
+            .filter(|_| !rejected.is_empty())
+        {
+            metrics.record_dropped(&write.db, &counts);
+        }
+        if !rejected.is_empty() && !write.accept_partial {
+            return Err(Error::LinesRejected {
+                lines: RejectedLines::new(&rejected),
+                json: write.json_errors,
+            });
+        }
+        // writes replicated from the peer were already transformed by it, and
+        // rules such as scaling a field must not be applied twice. The
+        // transformed lines keep their numbers, so that lines rejected by the
+        // write buffer are reported as checked.
+        let (ruled, tagged);
+        let body: &str = if write.replicate {
+            ruled = self.http_config.write_rules.apply(&write.db, &checked);
+            tagged = self.http_config.default_tags.apply(&write.db, &ruled);
+            &tagged
+        } else {
+            &checked
+        };
 
-        let database = NamespaceName::new(params.db)?;
+        let database = NamespaceName::new(write.db.clone())?;
+        let checked = Checked {
+            lp: &checked,
+            rejected,
+            counts,
+        };
 
+        self.write_lp_inner(&write, database, body, checked, entry)
+            .await
+    }
+
+    /// Buffer and replicate `body`, the transformed lines of `write`,
+    /// completing the `entry` of a write with an idempotency key once it is
+    /// buffered.
+    async fn write_lp_inner(
+        &self,
+        write: &LineWrite<'_>,
+        database: NamespaceName<'static>,
+        body: &str,
+        checked: Checked<'_>,
+        entry: Option<InFlightWrite<'_>>,
+    ) -> Result<Vec<RejectedLine>> {
+        let Checked {
+            lp: checked,
+            rejected: mut rejected_lines,
+            mut counts,
+        } = checked;
         // TODO: use the time provider
         let default_time = SystemProvider::new().now().timestamp_nanos();
+        let db = database.to_string();
+        // writes replicated from the peer were already sampled by it
+        let body = if write.replicate {
+            self.sampler.apply(&db, body, default_time)
+        } else {
+            Cow::Borrowed(body)
+        };
+        let body = &*body;
 
-        self.write_buffer
-            .write_lp(database, body, default_time)
-            .await?;
+        let mut span = SpanRecorder::new(write.span_ctx.child_span("buffer write"));
+        span.set_metadata("db", db.clone());
+        let invalid_lines = match self
+            .write_buffer
+            .write_lp(database, body, default_time, write.accept_partial)
+            .await
+        {
+            Ok(result) => {
+                span.set_metadata("lines", result.line_count as i64);
+                span.set_metadata("invalid_lines", result.invalid_lines.len() as i64);
+                span.ok("buffered");
+                result.invalid_lines
+            }
+            Err(influxdb3_write::write_buffer::Error::InvalidLines(invalid_lines)) => {
+                span.error(format!("{} invalid lines", invalid_lines.len()));
+                let buffer_rejected = rejection::buffer_rejections(checked, &invalid_lines);
+                self.record_buffer_rejections(&db, &buffer_rejected, &mut counts);
+                rejected_lines.extend(buffer_rejected);
+                rejected_lines.sort_by_key(|line| line.line_number);
+                return Err(Error::LinesRejected {
+                    lines: RejectedLines::new(&rejected_lines),
+                    json: write.json_errors,
+                });
+            }
+            Err(e) => {
+                span.error(e.to_string());
+                return Err(e.into());
+            }
+        };
+        drop(span);
+
+        let buffer_rejected = rejection::buffer_rejections(checked, &invalid_lines);
+        self.record_buffer_rejections(&db, &buffer_rejected, &mut counts);
+        if let Some(metrics) = &self.ingest_metrics {
+            metrics.record_write(&db, &counts);
+        }
+        // only databases written to take the series of the load by
+        // database, not the names of failed writes
+        if let Some(metrics) = &self.database_metrics {
+            metrics.record_write(&db, write.lp.len());
+        }
+        rejected_lines.extend(buffer_rejected);
+        rejected_lines.sort_by_key(|line| line.line_number);
+        if let Some(entry) = entry {
+            entry.complete(rejected_lines.clone());
+        }
+
+        if let Some(replicator) = self.replicator.as_ref().filter(|_| write.replicate) {
+            let mut span = SpanRecorder::new(write.span_ctx.child_span("replicate write"));
+            let lp = Bytes::copy_from_slice(body.as_bytes());
+            if let Err(e) = replicator.replicate(&db, lp).await {
+                span.error(e.to_string());
+                return Err(e.into());
+            }
+            span.ok("replicated");
+        }
+
+        if !rejected_lines.is_empty() {
+            self.write_dead_letters(&db, &rejected_lines, default_time)
+                .await;
+        }
+        Ok(rejected_lines)
+    }
+
+    /// Count the lines of a write to `db` rejected by the write buffer as
+    /// dropped rather than written.
+    fn record_buffer_rejections(
+        &self,
+        db: &str,
+        buffer_rejected: &[RejectedLine],
+        counts: &mut WriteCounts,
+    ) {
+        let Some(metrics) = self.ingest_metrics.as_ref() else {
+            return;
+        };
+        if buffer_rejected.is_empty() {
+            return;
+        }
+        let mut dropped = WriteCounts::default();
+        for rejected in buffer_rejected {
+            match parse_lines(&rejected.line).next() {
+                Some(Ok(line)) => {
+                    let measurement = line.series.measurement.as_str();
+                    counts.unwritten(measurement, rejected.line.len() + 1);
+                    dropped.dropped(Some(measurement));
+                }
+                _ => dropped.dropped(None),
+            }
+        }
+        metrics.record_dropped(db, &dropped);
+    }
 
-        Ok(Response::new(Body::from("{}")))
+    /// Write the lines dropped from a write to `db` to the dead letter
+    /// database, if one is configured.
+    ///
+    /// The write itself has succeeded, so a failure is only logged.
+    async fn write_dead_letters(&self, db: &str, rejected_lines: &[RejectedLine], time: i64) {
+        let Some(dead_letter) = &self.http_config.dead_letter_database else {
+            return;
+        };
+        // lines dropped from the dead letter database itself are not
+        // written back to it
+        if dead_letter.name().as_str() == db {
+            return;
+        }
+        let lp = dead_letter.line_protocol(db, rejected_lines, time);
+        if let Err(e) = self
+            .write_buffer
+            .write_lp(dead_letter.name().clone(), &lp, time, true)
+            .await
+        {
+            warn!(
+                %e,
+                db,
+                lines = rejected_lines.len(),
+                "unable to write dropped lines to the dead letter database"
+            );
+        }
     }
 
     async fn query_sql(&self, req: Request<Body>) -> Result<Response<Body>> {
@@ -216,18 +732,82 @@ where
 
         println!("query_sql {:?}", params);
 
-        let result = self
+        let span_ctx = req.extensions().get::<SpanContext>().cloned();
+        let external_span_ctx = req.extensions().get::<RequestLogContext>().cloned();
+
+        // the query is in flight until it is answered
+        let _permit = self
+            .load_shedder
+            .as_ref()
+            .map(|shedder| shedder.admit(params.priority))
+            .transpose()
+            .map_err(Error::Overloaded)?;
+        let started = Instant::now();
+        let mut result = self
             .query_executor
-            .query(&params.db, &params.q, None, None)
+            .query(
+                &params.db,
+                &params.q,
+                params.parallelism,
+                span_ctx.clone(),
+                external_span_ctx,
+            )
             .await
             .unwrap();
 
-        let batches: Vec<RecordBatch> = result
-            .collect::<Vec<datafusion::common::Result<RecordBatch>>>()
-            .await
-            .into_iter()
-            .map(|b| b.unwrap())
-            .collect();
+        let mut span = SpanRecorder::new(span_ctx.child_span("collect results"));
+        let mut rows = 0;
+        let page = match params.page_size {
+            // the rows beyond the first page are accounted for as they are
+            // read, so that a result too large to keep fails early
+            Some(page_size) => {
+                let mut pager = self.query_cursors.pager(page_size);
+                while let Some(batch) = result.next().await {
+                    let batch = batch.unwrap();
+                    rows += batch.num_rows();
+                    pager.push(batch)?;
+                }
+                pager.finish()
+            }
+            None => {
+                let batches: Vec<RecordBatch> = result
+                    .collect::<Vec<datafusion::common::Result<RecordBatch>>>()
+                    .await
+                    .into_iter()
+                    .map(|b| b.unwrap())
+                    .collect();
+                rows = batches.iter().map(|b| b.num_rows()).sum();
+                Page::all(batches)
+            }
+        };
+        span.set_metadata("rows", rows as i64);
+        drop(span);
+        if let Some(metrics) = &self.database_metrics {
+            metrics.record_query(&params.db, started.elapsed());
+        }
+
+        let _span = SpanRecorder::new(span_ctx.child_span("encode response"));
+        self.query_response(&req, params.format.as_deref(), page)
+    }
+
+    /// Fetch the page of a query result following a cursor, see
+    /// [`query_cursor`](crate::query_cursor).
+    async fn query_sql_page(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let query = req.uri().query().ok_or(Error::MissingQueryParams)?;
+        let params: QueryPageParams = serde_urlencoded::from_str(query)?;
+        let page = self.query_cursors.next_page(&params.cursor)?;
+        self.query_response(&req, params.format.as_deref(), page)
+    }
+
+    /// Encode a page of a query result in `format`, or in the format accepted
+    /// by the client.
+    fn query_response(
+        &self,
+        req: &Request<Body>,
+        format: Option<&str>,
+        page: Page,
+    ) -> Result<Response<Body>> {
+        let batches = page.batches;
 
         fn to_json(batches: Vec<RecordBatch>) -> Result<Bytes> {
             let batches: Vec<&RecordBatch> = batches.iter().collect();
@@ -272,7 +852,7 @@ where
             Error,
         }
 
-        let (body, format) = match params.format {
+        let (body, format) = match format {
             None => match req
                 .headers()
                 .get(ACCEPT)
@@ -293,7 +873,7 @@ where
                 Some("*/*") | None => (to_json(batches)?, Format::Json),
                 Some(_) => (Bytes::from("{ \"error\": \"Available mime types are: application/vnd.apache.parquet, text/csv, text/plain, and application/json\" }"), Format::Error),
             },
-            Some(format) => match format.as_str() {
+            Some(format) => match format {
                 "parquet" => (to_parquet(batches)?, Format::Parquet),
                 "csv" => (to_csv(batches)?, Format::Csv),
                 "pretty" => (to_pretty(batches)?, Format::Pretty),
@@ -302,41 +882,239 @@ where
             },
         };
 
-        match format {
-            Format::Parquet => Ok(Response::builder()
-                .status(StatusCode::OK)
-                .header("Content-Type", "application/vnd.apache.parquet")
-                .body(Body::from(body))?),
-            Format::Csv => Ok(Response::builder()
-                .status(StatusCode::OK)
-                .header("Content-Type", "text/csv")
-                .body(Body::from(body))?),
-            Format::Pretty => Ok(Response::builder()
-                .status(StatusCode::OK)
-                .header("Content-Type", "text/plain; charset=utf-8")
-                .body(Body::from(body))?),
-            Format::Json => Ok(Response::builder()
-                .status(StatusCode::OK)
-                .header("Content-Type", "application/json")
-                .body(Body::from(body))?),
-            Format::Error => Ok(Response::builder()
-                .status(StatusCode::BAD_REQUEST)
-                .header("Content-Type", "application/json")
-                .body(Body::from(body))?),
+        let (status, content_type) = match format {
+            Format::Parquet => (StatusCode::OK, "application/vnd.apache.parquet"),
+            Format::Csv => (StatusCode::OK, "text/csv"),
+            Format::Pretty => (StatusCode::OK, "text/plain; charset=utf-8"),
+            Format::Json => (StatusCode::OK, "application/json"),
+            Format::Error => (StatusCode::BAD_REQUEST, "application/json"),
+        };
+        let mut builder = Response::builder()
+            .status(status)
+            .header("Content-Type", content_type);
+        if let Some(cursor) = page.cursor {
+            builder = builder.header(CURSOR_HEADER, cursor);
         }
+
+        Ok(self
+            .response_compression
+            .respond(req.headers(), builder, body)?)
+    }
+
+    fn health_report(&self) -> HealthReport {
+        let wal = self.write_buffer.wal();
+        HealthReport::new(
+            &self.config_reloader.current().health,
+            self.write_buffer.status(),
+            wal.as_deref(),
+        )
     }
 
+    /// Liveness check: succeeds whenever the server is able to respond,
+    /// reporting the health of each component in the body.
     fn health(&self) -> Result<Response<Body>> {
-        let response_body = "OK";
-        Ok(Response::new(Body::from(response_body.to_string())))
+        let body = serde_json::to_vec(&self.health_report())?;
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header("Content-Type", "application/json")
+            .body(Body::from(body))?)
+    }
+
+    /// Readiness check: fails with `503 Service Unavailable` when any
+    /// component is over its configured thresholds.
+    fn ready(&self) -> Result<Response<Body>> {
+        let report = self.health_report();
+        let status = if report.is_pass() {
+            StatusCode::OK
+        } else {
+            StatusCode::SERVICE_UNAVAILABLE
+        };
+        let body = serde_json::to_vec(&report)?;
+        Ok(Response::builder()
+            .status(status)
+            .header("Content-Type", "application/json")
+            .body(Body::from(body))?)
+    }
+
+    fn resources(&self) -> Result<Response<Body>> {
+        let body = serde_json::to_vec(&self.http_config.resources)?;
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header("Content-Type", "application/json")
+            .body(Body::from(body))?)
     }
 
     fn handle_metrics(&self) -> Result<Response<Body>> {
+        Ok(Response::new(Body::from(self.encode_metrics())))
+    }
+
+    fn encode_metrics(&self) -> Vec<u8> {
         let mut body: Vec<u8> = Default::default();
         let mut reporter = metric_exporters::PrometheusTextEncoder::new(&mut body);
         self.common_state.metrics.report(&mut reporter);
+        body
+    }
 
-        Ok(Response::new(Body::from(body)))
+    /// Report the log filter of the running server.
+    fn get_log_level(&self) -> Result<Response<Body>> {
+        let log_filter = self
+            .common_state
+            .log_filter()
+            .ok_or(Error::LogFilterUnavailable)?;
+        log_level_response(log_filter.current()?)
+    }
+
+    /// Replace the log filter of the running server, e.g. with
+    /// `{"filter": "info,influxdb3_write=debug"}` to raise the level of a
+    /// single component.
+    async fn set_log_level(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let log_filter = self
+            .common_state
+            .log_filter()
+            .ok_or(Error::LogFilterUnavailable)?
+            .clone();
+        let body = self.read_body(req).await?;
+        let LogLevel { filter } = serde_json::from_slice(&body)?;
+        log_filter.set(&filter)?;
+        info!(%filter, "log filter changed");
+        log_level_response(log_filter.current()?)
+    }
+
+    fn get_read_only(&self) -> Result<Response<Body>> {
+        read_only_response(self.http_config.read_only.state())
+    }
+
+    /// Switch read-only mode, e.g. with
+    /// `{"read_only": true, "reason": "restore in progress"}`.
+    async fn set_read_only(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let body = self.read_body(req).await?;
+        let state: ReadOnlyState = serde_json::from_slice(&body)?;
+        self.http_config.read_only.set_state(state);
+        let state = self.http_config.read_only.state();
+        match &state.reason {
+            Some(reason) => warn!(%reason, "read-only mode enabled, writes are refused"),
+            None => info!("read-only mode disabled"),
+        }
+        read_only_response(state)
+    }
+
+    /// Stream the rows of a table, optionally restricted to a time range and
+    /// to rows with given tag values, as Parquet, line protocol or CSV.
+    ///
+    /// The body is compressed if the client accepts it, whatever its size,
+    /// as exports are expected to be large.
+    async fn export(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let query = req.uri().query().ok_or(Error::MissingQueryParams)?;
+        let params: ExportParams = serde_urlencoded::from_str(query)?;
+        info!(db = %params.db, table = %params.table, format = ?params.format, "export");
+
+        let schema = self
+            .write_buffer
+            .catalog()
+            .db_schema(&params.db)
+            .and_then(|db| db.get_table_schema(&params.table).cloned())
+            .ok_or_else(|| Error::TableNotFound {
+                db: params.db.clone(),
+                table: params.table.clone(),
+            })?;
+        let filter = export::Filter::parse(
+            &schema,
+            params.start.as_deref(),
+            params.end.as_deref(),
+            params.tags.as_deref(),
+        )?;
+        let encoding = req
+            .headers()
+            .get(ACCEPT_ENCODING)
+            .map(HeaderValue::to_str)
+            .transpose()?
+            .and_then(Encoding::negotiate);
+
+        let span_ctx = req.extensions().get::<SpanContext>().cloned();
+        let external_span_ctx = req.extensions().get::<RequestLogContext>().cloned();
+        let stream = self
+            .query_executor
+            .query(
+                &params.db,
+                &filter.query(&params.table),
+                None,
+                span_ctx,
+                external_span_ctx,
+            )
+            .await?;
+
+        let mut builder = Response::builder()
+            .status(StatusCode::OK)
+            .header("Content-Type", params.format.content_type())
+            .header(
+                "Content-Disposition",
+                format!(
+                    "attachment; filename=\"{}.{}\"",
+                    params.table,
+                    params.format.extension()
+                ),
+            )
+            .header(VARY, ACCEPT_ENCODING.as_str());
+        if let Some(encoding) = encoding {
+            builder = builder.header(CONTENT_ENCODING, encoding.as_str());
+        }
+        Ok(builder.body(export::export_body(
+            &schema,
+            stream,
+            params.format,
+            encoding,
+        ))?)
+    }
+
+    /// Re-read the config reload file and report the settings now in effect.
+    fn reload_config(&self) -> Result<Response<Body>> {
+        self.config_reloader.reload()?;
+        let body = serde_json::to_vec(&self.config_reloader.describe())?;
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header("Content-Type", "application/json")
+            .body(Body::from(body))?)
+    }
+
+    /// Capture CPU and heap profiles over the requested period, along with the
+    /// metrics and health of the server, into a single downloadable archive.
+    async fn flush_profile_bundle(&self, req: Request<Body>) -> Result<Response<Body>> {
+        let query_string = req.uri().query().unwrap_or_default();
+        let args: ProfileBundleArgs = serde_urlencoded::from_str(query_string)?;
+        if args.seconds > profile_bundle::MAX_SECONDS {
+            return Err(Error::ProfileBundleTooLong {
+                seconds: args.seconds,
+                max: profile_bundle::MAX_SECONDS,
+            });
+        }
+
+        let (cpu, heap) = futures::join!(cpu_profile(args.seconds), heap_profile(args.seconds));
+
+        let now = SystemProvider::new().now();
+        let mut bundle = ProfileBundle::new(now.timestamp() as u64);
+        let health = serde_json::to_vec_pretty(&self.health_report());
+        bundle.add("cpu.pb", cpu).map_err(Error::ProfileBundle)?;
+        bundle.add("heap.pb", heap).map_err(Error::ProfileBundle)?;
+        bundle
+            .add_captured("metrics.txt", &self.encode_metrics())
+            .map_err(Error::ProfileBundle)?;
+        bundle
+            .add("health.json", health)
+            .map_err(Error::ProfileBundle)?;
+        let body = bundle.finish().map_err(Error::ProfileBundle)?;
+
+        let filename = format!(
+            "influxdb3-profile-{}.tar.gz",
+            now.date_time().format("%Y%m%dT%H%M%SZ")
+        );
+        Ok(Response::builder()
+            .status(StatusCode::OK)
+            .header("Content-Type", "application/gzip")
+            .header(
+                "Content-Disposition",
+                format!("attachment; filename=\"{filename}\""),
+            )
+            .body(Body::from(body))?)
     }
 
     /// Parse the request's body into raw bytes, applying the configured size
@@ -359,8 +1137,10 @@ where
         while let Some(chunk) = payload.next().await {
             let chunk = chunk.map_err(Error::ClientHangup)?;
             // limit max size of in-memory payload
-            if (body.len() + chunk.len()) > self.max_request_bytes {
-                return Err(Error::RequestSizeExceeded(self.max_request_bytes));
+            if (body.len() + chunk.len()) > self.http_config.max_request_bytes {
+                return Err(Error::RequestSizeExceeded(
+                    self.http_config.max_request_bytes,
+                ));
             }
             body.extend_from_slice(&chunk);
         }
@@ -381,7 +1161,7 @@ where
         // In order to detect if the entire stream ahs been read, or truncated,
         // read an extra byte beyond the limit and check the resulting data
         // length - see the max_request_size_truncation test.
-        let mut decoder = decoder.take(self.max_request_bytes as u64 + 1);
+        let mut decoder = decoder.take(self.http_config.max_request_bytes as u64 + 1);
         let mut decoded_data = Vec::new();
         decoder
             .read_to_end(&mut decoded_data)
@@ -389,8 +1169,10 @@ where
 
         // If the length is max_size+1, the body is at least max_size+1 bytes in
         // length, and possibly longer, but truncated.
-        if decoded_data.len() > self.max_request_bytes {
-            return Err(Error::RequestSizeExceeded(self.max_request_bytes));
+        if decoded_data.len() > self.http_config.max_request_bytes {
+            return Err(Error::RequestSizeExceeded(
+                self.http_config.max_request_bytes,
+            ));
         }
 
         Ok(decoded_data.into())
@@ -401,6 +1183,49 @@ where
         // Take it out so we can use it and not log it later by accident.
         let auth = req.headers_mut().remove(AUTHORIZATION);
 
+        // signed writes are authenticated by their signature instead of the
+        // token, and the signature is verified once the body is read
+        if let Some(credentials) = auth
+            .as_ref()
+            .and_then(|v| v.to_str().ok())
+            .and_then(|v| v.strip_prefix(signed_writes::SCHEME)?.strip_prefix(' '))
+            .filter(|_| self.signature_verifier.is_enabled())
+        {
+            if (req.method(), req.uri().path()) != (&Method::POST, "/api/v3/write_lp") {
+                return Err(AuthorizationError::Unauthorized);
+            }
+            let signature =
+                Signature::parse(credentials.trim()).ok_or(AuthorizationError::MalformedRequest)?;
+            req.extensions_mut().insert(signature);
+            req.extensions_mut()
+                .insert(AuthorizationHeaderExtension::new(None));
+            return Ok(());
+        }
+
+        // the replication peer authenticates the writes it replicates with a
+        // token of its own
+        let replicated_write = (req.method(), req.uri().path())
+            == (&Method::POST, "/api/v3/write_lp")
+            && req.headers().contains_key(REPLICATED_HEADER);
+        if let Some(peer_token) = self
+            .http_config
+            .replication_peer_token
+            .as_ref()
+            .filter(|_| replicated_write)
+        {
+            let from_peer = auth
+                .as_ref()
+                .and_then(|v| v.to_str().ok())
+                .and_then(|v| v.strip_prefix("Bearer "))
+                .is_some_and(|token| &Sha256::digest(token)[..] == peer_token);
+            if from_peer {
+                req.extensions_mut().insert(ReplicationPeer);
+                req.extensions_mut()
+                    .insert(AuthorizationHeaderExtension::new(auth));
+                return Ok(());
+            }
+        }
+
         if let Some(bearer_token) = self.common_state.bearer_token() {
             let Some(header) = &auth else {
                 return Err(AuthorizationError::Unauthorized);
@@ -437,25 +1262,116 @@ where
     }
 }
 
+/// Marks a request authenticated as coming from the replication peer.
+#[derive(Debug, Clone, Copy)]
+struct ReplicationPeer;
+
 #[derive(Debug, Deserialize)]
 pub(crate) struct QuerySqlParams {
     pub(crate) db: String,
     pub(crate) q: String,
     pub(crate) format: Option<String>,
+    /// Number of partitions the query may be executed in concurrently.
+    pub(crate) parallelism: Option<NonZeroUsize>,
+    /// Number of rows of the result in each page, see
+    /// [`query_cursor`](crate::query_cursor).
+    pub(crate) page_size: Option<NonZeroUsize>,
+    /// Priority of the query when the server is overloaded, see
+    /// [`load_shedding`](crate::load_shedding).
+    #[serde(default)]
+    pub(crate) priority: Priority,
+}
+
+#[derive(Debug, Deserialize)]
+pub(crate) struct QueryPageParams {
+    pub(crate) cursor: String,
+    pub(crate) format: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub(crate) struct ExportParams {
+    pub(crate) db: String,
+    pub(crate) table: String,
+    #[serde(default)]
+    pub(crate) format: export::Format,
+    pub(crate) start: Option<String>,
+    pub(crate) end: Option<String>,
+    pub(crate) tags: Option<String>,
+}
+
+/// A write of line protocol, made to `/api/v3/write_lp` or received over
+/// UDP.
+#[derive(Debug)]
+pub(crate) struct LineWrite<'a> {
+    pub(crate) db: String,
+    pub(crate) lp: &'a [u8],
+    pub(crate) precision: Precision,
+    /// Whether the valid lines are written when others are rejected
+    pub(crate) accept_partial: bool,
+    /// Whether the write is replicated to the peer, which it is unless it
+    /// was replicated from the peer
+    pub(crate) replicate: bool,
+    pub(crate) idempotency_key: Option<String>,
+    /// Whether rejected lines are reported as JSON
+    pub(crate) json_errors: bool,
+    pub(crate) span_ctx: Option<SpanContext>,
+}
+
+impl LineWrite<'_> {
+    /// The hash of the request the write was made with, which a retry of the
+    /// write must match.
+    fn request_hash(&self) -> Output<Sha256> {
+        Sha256::new()
+            .chain_update(self.db.as_bytes())
+            .chain_update([0, self.precision as u8, self.accept_partial as u8])
+            .chain_update(self.lp)
+            .finalize()
+    }
+}
+
+/// The lines of a write as checked, before they are transformed.
+#[derive(Debug)]
+struct Checked<'a> {
+    /// The lines accepted, with those rejected left blank
+    lp: &'a str,
+    rejected: Vec<RejectedLine>,
+    counts: WriteCounts,
 }
 
 #[derive(Debug, Deserialize)]
 pub(crate) struct WriteParams {
     pub(crate) db: String,
+    #[serde(default)]
+    pub(crate) precision: Precision,
+    /// Whether the lines of the write that are valid are written when others
+    /// are rejected.
+    #[serde(default)]
+    pub(crate) accept_partial: bool,
 }
 
 pub(crate) async fn serve<W: WriteBuffer, Q: QueryExecutor>(
     http_server: Arc<HttpApi<W, Q>>,
+    tcp_listener: Option<std::net::TcpListener>,
     shutdown: CancellationToken,
 ) -> Result<()> {
-    let listener = AddrIncoming::bind(&http_server.common_state.http_addr)?;
+    let config = &http_server.http_config;
+    let listener = listener::bind(
+        http_server.common_state.http_addr,
+        config.reuse_port,
+        tcp_listener,
+    )
+    .and_then(tokio::net::TcpListener::from_std)
+    .map_err(Error::TcpListener)?;
+    let mut listener = AddrIncoming::from_listener(listener)?;
+    listener.set_keepalive(config.tcp_keepalive);
     println!("binding listener");
     info!(bind_addr=%listener.local_addr(), "bound HTTP listener");
+    let idle_timeout = config.idle_timeout;
+    let incoming = hyper::server::accept::from_stream(futures::stream::poll_fn(move |cx| {
+        Pin::new(&mut listener)
+            .poll_accept(cx)
+            .map(|r| r.map(|r| r.map(|stream| IdleTimeout::new(stream, idle_timeout))))
+    }));
 
     let req_metrics = RequestMetrics::new(
         Arc::clone(&http_server.common_state.metrics),
@@ -467,23 +1383,258 @@ pub(crate) async fn serve<W: WriteBuffer, Q: QueryExecutor>(
         http_server.common_state.trace_collector().clone(),
         TRACE_SERVER_NAME,
     );
-
-    hyper::Server::builder(listener)
-        .serve(hyper::service::make_service_fn(|_conn: &AddrStream| {
+    let connections =
+        ConnectionTracker::new(config.max_connections, &http_server.common_state.metrics);
+    tokio::spawn(reload_on_sighup(
+        Arc::clone(&http_server.config_reloader),
+        shutdown.clone(),
+    ));
+
+    // Builds the service that handles the requests received on one connection.
+    let new_service = |requests: Arc<Requests>| {
+        let http_server = Arc::clone(&http_server);
+        let connection = connections.open();
+        let service = hyper::service::service_fn(move |request: Request<_>| {
             let http_server = Arc::clone(&http_server);
-            let service = hyper::service::service_fn(move |request: Request<_>| {
-                route_request(Arc::clone(&http_server), request)
-            });
+            let admitted = connection.is_some();
+            let request_guard = requests.start();
+            async move {
+                if !admitted {
+                    let mut response = Error::RequestLimit.response();
+                    response
+                        .headers_mut()
+                        .insert(CONNECTION, HeaderValue::from_static("close"));
+                    return Ok(response);
+                }
+                let response = route_request(http_server, request).await;
+                drop(request_guard);
+                response
+            }
+        });
+
+        let service = trace_layer.layer(service);
+        futures::future::ready(Ok::<_, Infallible>(service))
+    };
+
+    let tcp = configure_server(hyper::Server::builder(incoming), config)
+        .serve(hyper::service::make_service_fn(
+            |conn: &IdleTimeout<AddrStream>| new_service(conn.requests()),
+        ))
+        .with_graceful_shutdown(shutdown.cancelled());
+
+    let Some(socket_path) = &config.unix_socket_path else {
+        return drain(tcp, &shutdown, config.shutdown_timeout, &connections).await;
+    };
+
+    #[cfg(unix)]
+    {
+        let listener = bind_unix_socket(socket_path, config.unix_socket_permissions)?;
+        info!(socket_path=%socket_path.display(), "bound HTTP unix socket listener");
+
+        let incoming = hyper::server::accept::from_stream(futures::stream::poll_fn(move |cx| {
+            listener
+                .poll_accept(cx)
+                .map(|r| Some(r.map(|(stream, _)| IdleTimeout::new(stream, idle_timeout))))
+        }));
+        let unix = configure_server(hyper::Server::builder(incoming), config)
+            .serve(hyper::service::make_service_fn(
+                |conn: &IdleTimeout<tokio::net::UnixStream>| new_service(conn.requests()),
+            ))
+            .with_graceful_shutdown(shutdown.cancelled());
+
+        let both = async { futures::future::try_join(tcp, unix).await.map(|_| ()) };
+        let result = drain(both, &shutdown, config.shutdown_timeout, &connections).await;
+        if let Err(e) = std::fs::remove_file(socket_path) {
+            error!(%e, socket_path=%socket_path.display(), "failed to remove unix socket");
+        }
+        result
+    }
+
+    #[cfg(not(unix))]
+    {
+        drop(tcp);
+        Err(Error::UnixSocketUnsupported(socket_path.clone()))
+    }
+}
+
+/// Apply the configured protocol options to a server builder.
+fn configure_server<I>(
+    builder: hyper::server::Builder<I>,
+    config: &HttpServerConfig,
+) -> hyper::server::Builder<I> {
+    let mut builder = builder
+        .http1_keepalive(config.http1_keepalive)
+        .http1_only(!config.http2);
+    if let Some(timeout) = config.header_read_timeout {
+        builder = builder.http1_header_read_timeout(timeout);
+    }
+    if let Some(max_header_bytes) = config.max_header_bytes {
+        // hyper panics if the buffer cannot hold at least 8 KiB
+        builder = builder.http1_max_buf_size(max_header_bytes.max(8 * 1024));
+    }
+    builder
+}
+
+/// Bind a listener to the unix socket at `path`, restricting access to it with
+/// the file `permissions`.
+///
+/// A socket left behind by a previous server process is replaced; any other
+/// kind of file at `path` is an error.
+///
+/// Clients could connect to a socket bound at `path` before its permissions
+/// are restricted, so the socket is bound in a directory only the server can
+/// enter, next to `path`, and only moved to `path` once restricted.
+#[cfg(unix)]
+fn bind_unix_socket(path: &std::path::Path, permissions: u32) -> Result<tokio::net::UnixListener> {
+    use std::os::unix::fs::{DirBuilderExt, FileTypeExt, PermissionsExt};
+
+    match std::fs::symlink_metadata(path) {
+        Ok(m) if m.file_type().is_socket() => {
+            std::fs::remove_file(path).map_err(Error::UnixSocket)?
+        }
+        Ok(_) => return Err(Error::UnixSocketPathInUse(path.to_path_buf())),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => {}
+        Err(e) => return Err(Error::UnixSocket(e)),
+    }
 
-            let service = trace_layer.layer(service);
-            futures::future::ready(Ok::<_, Infallible>(service))
-        }))
-        .with_graceful_shutdown(shutdown.cancelled())
-        .await?;
+    let file_name = path
+        .file_name()
+        .ok_or_else(|| Error::UnixSocketPathInUse(path.to_path_buf()))?;
+    let mut private_dir_name = std::ffi::OsString::from(".");
+    private_dir_name.push(file_name);
+    private_dir_name.push(format!(".{}", std::process::id()));
+    let private_dir = path.with_file_name(private_dir_name);
+    // left behind by a server that crashed while binding, with the same pid
+    // as is common in containers
+    match std::fs::remove_dir_all(&private_dir) {
+        Err(e) if e.kind() != std::io::ErrorKind::NotFound => return Err(Error::UnixSocket(e)),
+        _ => {}
+    }
+    std::fs::DirBuilder::new()
+        .mode(0o700)
+        .create(&private_dir)
+        .map_err(Error::UnixSocket)?;
+
+    let private_path = private_dir.join(file_name);
+    let bound = tokio::net::UnixListener::bind(&private_path).and_then(|listener| {
+        std::fs::set_permissions(&private_path, std::fs::Permissions::from_mode(permissions))?;
+        std::fs::rename(&private_path, path)?;
+        Ok(listener)
+    });
+    let removed = std::fs::remove_dir_all(&private_dir);
+    let listener = bound.map_err(Error::UnixSocket)?;
+    removed.map_err(Error::UnixSocket)?;
+
+    Ok(listener)
+}
 
+/// Run `server` until it has shut down, or until `timeout` after `shutdown`
+/// is cancelled.
+///
+/// Once `shutdown` is cancelled, the server stops accepting connections and
+/// closes its idle ones, and the requests in flight have up to `timeout` to
+/// complete. Connections still open after that are abandoned.
+async fn drain(
+    server: impl Future<Output = Result<(), hyper::Error>>,
+    shutdown: &CancellationToken,
+    timeout: Duration,
+    connections: &ConnectionTracker,
+) -> Result<()> {
+    let deadline = async {
+        shutdown.cancelled().await;
+        info!(
+            open_connections = connections.active(),
+            ?timeout,
+            "draining HTTP connections"
+        );
+        tokio::time::sleep(timeout).await;
+    };
+
+    tokio::select! {
+        result = server => {
+            result?;
+            if shutdown.is_cancelled() {
+                info!("all HTTP connections drained");
+            }
+        }
+        _ = deadline => warn!(
+            abandoned_connections = connections.active(),
+            "shutdown timeout elapsed before all HTTP connections drained, abandoning them"
+        ),
+    }
     Ok(())
 }
 
+/// Counts the connections open to the HTTP server, refusing to serve any
+/// beyond the configured maximum.
+#[derive(Debug)]
+struct ConnectionTracker {
+    max_connections: Option<usize>,
+    active: Arc<AtomicUsize>,
+    active_gauge: U64Gauge,
+    accepted: U64Counter,
+    rejected: U64Counter,
+}
+
+impl ConnectionTracker {
+    fn new(max_connections: Option<usize>, metrics: &metric::Registry) -> Self {
+        let active_gauge = metrics
+            .register_metric::<U64Gauge>(
+                "http_server_connections_active",
+                "Number of connections currently open to the HTTP server",
+            )
+            .recorder(&[]);
+        let connections = metrics.register_metric::<U64Counter>(
+            "http_server_connections",
+            "Number of connections opened to the HTTP server",
+        );
+
+        Self {
+            max_connections,
+            active: Default::default(),
+            active_gauge,
+            accepted: connections.recorder(&[("result", "accepted")]),
+            rejected: connections.recorder(&[("result", "rejected")]),
+        }
+    }
+
+    /// Number of connections currently open.
+    fn active(&self) -> usize {
+        self.active.load(Ordering::SeqCst)
+    }
+
+    /// Account for a newly accepted connection, returning a guard that must be
+    /// held for its lifetime, or `None` if it must not be served.
+    fn open(&self) -> Option<ConnectionGuard> {
+        let active = self.active.fetch_add(1, Ordering::SeqCst);
+        if self.max_connections.is_some_and(|max| active >= max) {
+            self.active.fetch_sub(1, Ordering::SeqCst);
+            self.rejected.inc(1);
+            return None;
+        }
+
+        self.accepted.inc(1);
+        self.active_gauge.inc(1);
+        Some(ConnectionGuard {
+            active: Arc::clone(&self.active),
+            active_gauge: self.active_gauge.clone(),
+        })
+    }
+}
+
+#[derive(Debug)]
+struct ConnectionGuard {
+    active: Arc<AtomicUsize>,
+    active_gauge: U64Gauge,
+}
+
+impl Drop for ConnectionGuard {
+    fn drop(&mut self) {
+        self.active.fetch_sub(1, Ordering::SeqCst);
+        self.active_gauge.dec(1);
+    }
+}
+
 async fn route_request<W: WriteBuffer, Q: QueryExecutor>(
     http_server: Arc<HttpApi<W, Q>>,
     mut req: Request<Body>,
@@ -520,22 +1671,46 @@ async fn route_request<W: WriteBuffer, Q: QueryExecutor>(
     let uri = req.uri().clone();
     let content_length = req.headers().get("content-length").cloned();
 
-    let response = match (method.clone(), uri.path()) {
-        (Method::POST, "/api/v3/write_lp") => http_server.write_lp(req).await,
-        (Method::GET | Method::POST, "/api/v3/query_sql") => http_server.query_sql(req).await,
-        (Method::GET, "/health") => http_server.health(),
-        (Method::GET, "/metrics") => http_server.handle_metrics(),
-        (Method::GET, "/debug/pprof") => pprof_home(req).await,
-        (Method::GET, "/debug/pprof/profile") => pprof_profile(req).await,
-        (Method::GET, "/debug/pprof/allocs") => pprof_heappy_profile(req).await,
-        _ => {
-            let body = Body::from("not found");
-            Ok(Response::builder()
-                .status(StatusCode::NOT_FOUND)
-                .body(body)
-                .unwrap())
+    let timeout = http_server
+        .config_reloader
+        .current()
+        .request_timeout_for(uri.path());
+    let handle_request = async {
+        match (method.clone(), uri.path()) {
+            (Method::POST, "/api/v3/write_lp") => http_server.write_lp(req).await,
+            (Method::GET | Method::POST, "/api/v3/query_sql") => http_server.query_sql(req).await,
+            (Method::GET, "/api/v3/query_sql/page") => http_server.query_sql_page(req).await,
+            (Method::GET, "/api/v3/export") => http_server.export(req).await,
+            (Method::GET, "/health") => http_server.health(),
+            (Method::GET, "/ready") => http_server.ready(),
+            (Method::GET, "/metrics") => http_server.handle_metrics(),
+            (Method::GET, "/api/v3/config/log_level") => http_server.get_log_level(),
+            (Method::PUT, "/api/v3/config/log_level") => http_server.set_log_level(req).await,
+            (Method::GET, "/api/v3/config/read_only") => http_server.get_read_only(),
+            (Method::PUT, "/api/v3/config/read_only") => http_server.set_read_only(req).await,
+            (Method::POST, "/api/v3/config/reload") => http_server.reload_config(),
+            (Method::GET, "/debug/resources") => http_server.resources(),
+            (Method::GET, "/debug/pprof") => pprof_home(req).await,
+            (Method::GET, "/debug/pprof/profile") => pprof_profile(req).await,
+            (Method::GET, "/debug/pprof/allocs") => pprof_heappy_profile(req).await,
+            (Method::POST, "/debug/flush-profile-bundle") => {
+                http_server.flush_profile_bundle(req).await
+            }
+            _ => {
+                let body = Body::from("not found");
+                Ok(Response::builder()
+                    .status(StatusCode::NOT_FOUND)
+                    .body(body)
+                    .unwrap())
+            }
         }
     };
+    let response = match timeout {
+        Some(timeout) => tokio::time::timeout(timeout, handle_request)
+            .await
+            .unwrap_or(Err(Error::RequestTimeout(timeout))),
+        None => handle_request.await,
+    };
 
     // TODO: Move logging to TraceLayer
     match response {
@@ -550,6 +1725,28 @@ async fn route_request<W: WriteBuffer, Q: QueryExecutor>(
     }
 }
 
+/// The body of the log level endpoints.
+#[derive(Debug, Deserialize, Serialize)]
+struct LogLevel {
+    filter: String,
+}
+
+fn log_level_response(filter: String) -> Result<Response<Body>> {
+    let body = serde_json::to_vec(&LogLevel { filter })?;
+    Ok(Response::builder()
+        .status(StatusCode::OK)
+        .header("Content-Type", "application/json")
+        .body(Body::from(body))?)
+}
+
+fn read_only_response(state: ReadOnlyState) -> Result<Response<Body>> {
+    let body = serde_json::to_vec(&state)?;
+    Ok(Response::builder()
+        .status(StatusCode::OK)
+        .header("Content-Type", "application/json")
+        .body(Body::from(body))?)
+}
+
 async fn pprof_home(req: Request<Body>) -> Result<Response<Body>> {
     let default_host = HeaderValue::from_static("localhost");
     let host = req
@@ -618,6 +1815,51 @@ impl PProfAllocsArgs {
     }
 }
 
+#[derive(Debug, Deserialize)]
+struct ProfileBundleArgs {
+    #[serde(default = "PProfArgs::default_seconds")]
+    seconds: u64,
+}
+
+/// Capture a CPU profile in pprof format for the profile bundle.
+#[cfg(feature = "pprof")]
+async fn cpu_profile(seconds: u64) -> Result<Vec<u8>, String> {
+    use ::pprof::protos::Message;
+
+    let report = self::pprof::dump_rsprof(seconds, PProfArgs::default_frequency().get())
+        .await
+        .map_err(|e| e.to_string())?;
+    let mut body = Vec::new();
+    report
+        .pprof()
+        .map_err(|e| e.to_string())?
+        .encode(&mut body)
+        .map_err(|e| e.to_string())?;
+    Ok(body)
+}
+
+#[cfg(not(feature = "pprof"))]
+async fn cpu_profile(_seconds: u64) -> Result<Vec<u8>, String> {
+    Err(Error::PProfIsNotCompiled.to_string())
+}
+
+/// Capture a heap allocation profile in pprof format for the profile bundle.
+#[cfg(feature = "heappy")]
+async fn heap_profile(seconds: u64) -> Result<Vec<u8>, String> {
+    let report =
+        self::heappy::dump_heappy_rsprof(seconds, PProfAllocsArgs::default_interval().get())
+            .await
+            .map_err(|e| e.to_string())?;
+    let mut body = Vec::new();
+    report.write_pprof(&mut body).map_err(|e| e.to_string())?;
+    Ok(body)
+}
+
+#[cfg(not(feature = "heappy"))]
+async fn heap_profile(_seconds: u64) -> Result<Vec<u8>, String> {
+    Err(Error::HeappyIsNotCompiled.to_string())
+}
+
 #[cfg(feature = "pprof")]
 async fn pprof_profile(req: Request<Body>) -> Result<Response<Body>, ApplicationError> {
     use ::pprof::protos::Message;
@@ -0,0 +1,354 @@
+//! Deduplication of retried write requests.
+//!
+//! A client that loses its connection while a write is in flight cannot tell
+//! whether the server applied it. By sending an `Idempotency-Key` header with
+//! the write, the client can safely retry: the server remembers the keys it has
+//! seen for a short period and acknowledges a repeated request without writing
+//! its points a second time, with the response the write was first given.
+
+use crate::rejection::RejectedLine;
+use iox_time::{Time, TimeProvider};
+use metric::U64Counter;
+use parking_lot::Mutex;
+use sha2::digest::Output;
+use sha2::Sha256;
+use std::collections::{HashMap, VecDeque};
+use std::sync::Arc;
+use std::time::Duration;
+
+/// The request header used by clients to identify a write that may be retried.
+pub(crate) const IDEMPOTENCY_KEY: &str = "idempotency-key";
+
+/// The default amount of time a key is remembered after its write completes.
+pub const DEFAULT_IDEMPOTENCY_KEY_TTL: Duration = Duration::from_secs(5 * 60);
+
+/// The default maximum number of keys held in the cache.
+pub const DEFAULT_IDEMPOTENCY_MAX_KEYS: usize = 100_000;
+
+/// The outcome of registering a keyed write with the [`IdempotencyCache`].
+#[derive(Debug)]
+pub(crate) enum Registration<'a> {
+    /// The key has not been seen; the write should be performed and then
+    /// [`InFlightWrite::complete`] called.
+    New(InFlightWrite<'a>),
+    /// A write with the same key and payload already completed; it must not be
+    /// applied again, and is answered with the lines it rejected.
+    Duplicate(Vec<RejectedLine>),
+    /// A write with the same key is still being processed.
+    InFlight,
+    /// The key was already used for a write with a different payload.
+    Conflict,
+    /// The cache holds as many keys as it may, all of writes still in flight.
+    Full,
+}
+
+/// A keyed write being processed.
+///
+/// The key is forgotten when this is dropped without the write being
+/// completed, such as when the write fails or the client disconnects, so
+/// that a retry of the write is applied rather than refused as in flight.
+#[derive(Debug)]
+pub(crate) struct InFlightWrite<'a> {
+    cache: &'a IdempotencyCache,
+    id: (String, String),
+    completed: bool,
+}
+
+impl InFlightWrite<'_> {
+    /// Record that the write was applied, rejecting `rejected`, so that
+    /// retries of it are recognised as duplicates until the TTL elapses.
+    pub(crate) fn complete(mut self, rejected: Vec<RejectedLine>) {
+        self.cache.complete(&self.id, rejected);
+        self.completed = true;
+    }
+}
+
+impl Drop for InFlightWrite<'_> {
+    fn drop(&mut self) {
+        if !self.completed {
+            self.cache.abort(&self.id);
+        }
+    }
+}
+
+#[derive(Debug)]
+enum EntryState {
+    InFlight,
+    Completed {
+        expires_at: Time,
+        rejected: Vec<RejectedLine>,
+    },
+}
+
+#[derive(Debug)]
+struct Entry {
+    payload_hash: Output<Sha256>,
+    state: EntryState,
+}
+
+#[derive(Debug, Default)]
+struct Entries {
+    by_id: HashMap<(String, String), Entry>,
+    /// The completed keys, in the order they expire, which is the order they
+    /// were completed in as the TTL is the same for all of them
+    expiry: VecDeque<(Time, (String, String))>,
+}
+
+impl Entries {
+    /// Forget the completed keys that expired by `now`.
+    fn expire(&mut self, now: Time) {
+        while self
+            .expiry
+            .front()
+            .is_some_and(|(expires_at, _)| *expires_at <= now)
+        {
+            let (expires_at, id) = self.expiry.pop_front().expect("front exists");
+            self.remove_completed(&id, expires_at);
+        }
+    }
+
+    /// Forget the completed key closest to expiring, returning whether there
+    /// was one.
+    fn evict(&mut self) -> bool {
+        while let Some((expires_at, id)) = self.expiry.pop_front() {
+            if self.remove_completed(&id, expires_at) {
+                return true;
+            }
+        }
+        false
+    }
+
+    fn remove_completed(&mut self, id: &(String, String), expires_at: Time) -> bool {
+        // the key may have been forgotten and registered again since
+        let current = matches!(
+            self.by_id.get(id),
+            Some(Entry { state: EntryState::Completed { expires_at: e, .. }, .. }) if *e == expires_at
+        );
+        if current {
+            self.by_id.remove(id);
+        }
+        current
+    }
+}
+
+/// A short-lived, in-memory record of the idempotency keys of recent writes.
+///
+/// Keys are scoped to a database, so the same key may be used independently
+/// against different databases.
+#[derive(Debug)]
+pub struct IdempotencyCache {
+    ttl: Duration,
+    max_keys: usize,
+    time_provider: Arc<dyn TimeProvider>,
+    entries: Mutex<Entries>,
+    duplicates: U64Counter,
+}
+
+impl IdempotencyCache {
+    pub fn new(
+        ttl: Duration,
+        max_keys: usize,
+        time_provider: Arc<dyn TimeProvider>,
+        metrics: &metric::Registry,
+    ) -> Self {
+        let duplicates = metrics
+            .register_metric::<U64Counter>(
+                "influxdb3_write_idempotent_duplicates",
+                "Number of retried writes that were acknowledged without being applied again",
+            )
+            .recorder(&[]);
+
+        Self {
+            ttl,
+            max_keys,
+            time_provider,
+            entries: Default::default(),
+            duplicates,
+        }
+    }
+
+    /// Register a write to `db` carrying the idempotency `key`, of a request
+    /// with the hash `payload_hash`.
+    pub(crate) fn register(
+        &self,
+        db: &str,
+        key: &str,
+        payload_hash: Output<Sha256>,
+    ) -> Registration<'_> {
+        let id = (db.to_string(), key.to_string());
+
+        let mut entries = self.entries.lock();
+        entries.expire(self.time_provider.now());
+
+        if let Some(entry) = entries.by_id.get(&id) {
+            if entry.payload_hash != payload_hash {
+                return Registration::Conflict;
+            }
+            return match &entry.state {
+                EntryState::InFlight => Registration::InFlight,
+                EntryState::Completed { rejected, .. } => {
+                    self.duplicates.inc(1);
+                    Registration::Duplicate(rejected.clone())
+                }
+            };
+        }
+
+        if entries.by_id.len() >= self.max_keys && !entries.evict() {
+            return Registration::Full;
+        }
+        entries.by_id.insert(
+            id.clone(),
+            Entry {
+                payload_hash,
+                state: EntryState::InFlight,
+            },
+        );
+
+        Registration::New(InFlightWrite {
+            cache: self,
+            id,
+            completed: false,
+        })
+    }
+
+    fn complete(&self, id: &(String, String), rejected: Vec<RejectedLine>) {
+        let expires_at = self.time_provider.now() + self.ttl;
+        let mut entries = self.entries.lock();
+        if let Some(entry) = entries.by_id.get_mut(id) {
+            entry.state = EntryState::Completed {
+                expires_at,
+                rejected,
+            };
+            entries.expiry.push_back((expires_at, id.clone()));
+        }
+    }
+
+    fn abort(&self, id: &(String, String)) {
+        self.entries.lock().by_id.remove(id);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rejection::RejectionCode;
+    use iox_time::MockProvider;
+    use sha2::Digest;
+
+    fn cache(max_keys: usize) -> (IdempotencyCache, Arc<MockProvider>) {
+        let time_provider = Arc::new(MockProvider::new(Time::from_timestamp_nanos(0)));
+        let cache = IdempotencyCache::new(
+            Duration::from_secs(60),
+            max_keys,
+            Arc::<MockProvider>::clone(&time_provider),
+            &metric::Registry::new(),
+        );
+        (cache, time_provider)
+    }
+
+    /// Register a write and apply it if it is new, returning whether it was.
+    fn write(cache: &IdempotencyCache, db: &str, key: &str, payload: &[u8]) -> bool {
+        match cache.register(db, key, Sha256::digest(payload)) {
+            Registration::New(write) => {
+                write.complete(vec![]);
+                true
+            }
+            _ => false,
+        }
+    }
+
+    #[test]
+    fn retried_write_is_deduplicated() {
+        let (cache, _) = cache(10);
+        let lp = b"cpu,host=a val=1i 123\ncpu,host=b val=";
+        let rejected = RejectedLine {
+            line_number: 2,
+            line: "cpu,host=b val=".to_string(),
+            code: RejectionCode::InvalidLineProtocol,
+            reason: "invalid".to_string(),
+            timestamp: None,
+        };
+
+        let Registration::New(write) = cache.register("foo", "k1", Sha256::digest(lp)) else {
+            panic!("first write is new");
+        };
+        assert!(matches!(
+            cache.register("foo", "k1", Sha256::digest(lp)),
+            Registration::InFlight
+        ));
+        write.complete(vec![rejected.clone()]);
+        // the retry is answered as the write was
+        assert!(matches!(
+            cache.register("foo", "k1", Sha256::digest(lp)),
+            Registration::Duplicate(lines) if lines == [rejected]
+        ));
+
+        // keys are scoped to the database
+        assert!(write(&cache, "bar", "k1", lp));
+    }
+
+    #[test]
+    fn reused_key_with_different_payload_conflicts() {
+        let (cache, _) = cache(10);
+
+        assert!(write(&cache, "foo", "k1", b"cpu val=1"));
+        assert!(matches!(
+            cache.register("foo", "k1", Sha256::digest(b"cpu val=2")),
+            Registration::Conflict
+        ));
+    }
+
+    #[test]
+    fn dropped_write_can_be_retried() {
+        let (cache, _) = cache(10);
+
+        // a failed write, or one whose client disconnected, is not completed
+        let registration = cache.register("foo", "k1", Sha256::digest(b"cpu val=1"));
+        assert!(matches!(registration, Registration::New(_)));
+        drop(registration);
+        assert!(write(&cache, "foo", "k1", b"cpu val=1"));
+    }
+
+    #[test]
+    fn keys_expire() {
+        let (cache, time_provider) = cache(10);
+
+        assert!(write(&cache, "foo", "k1", b"cpu val=1"));
+        time_provider.inc(Duration::from_secs(61));
+        assert!(write(&cache, "foo", "k1", b"cpu val=1"));
+        assert_eq!(cache.entries.lock().expiry.len(), 1);
+    }
+
+    #[test]
+    fn oldest_key_is_evicted_when_full() {
+        let (cache, time_provider) = cache(2);
+
+        for key in ["k1", "k2"] {
+            assert!(write(&cache, "foo", key, b"cpu val=1"));
+            time_provider.inc(Duration::from_secs(1));
+        }
+        assert!(write(&cache, "foo", "k3", b"cpu val=1"));
+
+        assert!(write(&cache, "foo", "k1", b"cpu val=1"));
+        assert!(matches!(
+            cache.register("foo", "k3", Sha256::digest(b"cpu val=1")),
+            Registration::Duplicate(_)
+        ));
+    }
+
+    #[test]
+    fn writes_in_flight_are_not_evicted() {
+        let (cache, _) = cache(2);
+
+        let first = cache.register("foo", "k1", Sha256::digest(b"cpu val=1"));
+        let second = cache.register("foo", "k2", Sha256::digest(b"cpu val=1"));
+        assert!(matches!(
+            cache.register("foo", "k3", Sha256::digest(b"cpu val=1")),
+            Registration::Full
+        ));
+        assert_eq!(cache.entries.lock().by_id.len(), 2);
+
+        drop((first, second));
+        assert!(write(&cache, "foo", "k3", b"cpu val=1"));
+    }
+}
@@ -0,0 +1,208 @@
+//! Closing of HTTP connections left idle.
+//!
+//! hyper keeps a connection open for as long as the client does, so clients
+//! that open connections and forget them hold on to connection slots. With an
+//! idle timeout, a connection on which no request is being handled, and no
+//! data was received or sent for the timeout, is closed as if the client had
+//! closed it.
+
+use std::future::Future;
+use std::io;
+use std::pin::Pin;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::task::{Context, Poll};
+use std::time::Duration;
+use tokio::io::{AsyncRead, AsyncWrite, ReadBuf};
+use tokio::time::{Instant, Sleep};
+
+/// A connection closed once idle for `timeout`, if any.
+#[derive(Debug)]
+pub(crate) struct IdleTimeout<S> {
+    inner: S,
+    timeout: Option<Duration>,
+    sleep: Option<Pin<Box<Sleep>>>,
+    requests: Arc<Requests>,
+}
+
+impl<S> IdleTimeout<S> {
+    pub(crate) fn new(inner: S, timeout: Option<Duration>) -> Self {
+        Self {
+            inner,
+            timeout,
+            sleep: None,
+            requests: Default::default(),
+        }
+    }
+
+    /// The requests being handled on the connection, which must be counted
+    /// for it not to be closed while a handler is still running.
+    pub(crate) fn requests(&self) -> Arc<Requests> {
+        Arc::clone(&self.requests)
+    }
+
+    /// Restart the timeout, on activity of the connection.
+    fn reset(&mut self) {
+        if let (Some(timeout), Some(sleep)) = (self.timeout, &mut self.sleep) {
+            sleep.as_mut().reset(Instant::now() + timeout);
+        }
+    }
+
+    /// Whether the connection has been idle for the timeout, registering to
+    /// be woken when it may be otherwise.
+    fn is_idle(&mut self, cx: &mut Context<'_>) -> bool {
+        let Some(timeout) = self.timeout else {
+            return false;
+        };
+        let sleep = self
+            .sleep
+            .get_or_insert_with(|| Box::pin(tokio::time::sleep(timeout)));
+        while sleep.as_mut().poll(cx).is_ready() {
+            if self.requests.in_flight.load(Ordering::SeqCst) == 0 {
+                return true;
+            }
+            // a handler is running without reading or writing, which the
+            // request timeouts are for
+            sleep.as_mut().reset(Instant::now() + timeout);
+        }
+        false
+    }
+}
+
+impl<S: AsyncRead + Unpin> AsyncRead for IdleTimeout<S> {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+        let filled = buf.filled().len();
+        match Pin::new(&mut this.inner).poll_read(cx, buf) {
+            Poll::Ready(result) => {
+                if buf.filled().len() > filled {
+                    this.reset();
+                }
+                Poll::Ready(result)
+            }
+            // reading nothing is the end of the connection to hyper
+            Poll::Pending if this.is_idle(cx) => Poll::Ready(Ok(())),
+            Poll::Pending => Poll::Pending,
+        }
+    }
+}
+
+impl<S: AsyncWrite + Unpin> AsyncWrite for IdleTimeout<S> {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = self.get_mut();
+        let result = Pin::new(&mut this.inner).poll_write(cx, buf);
+        if matches!(result, Poll::Ready(Ok(n)) if n > 0) {
+            this.reset();
+        }
+        result
+    }
+
+    fn poll_write_vectored(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        bufs: &[io::IoSlice<'_>],
+    ) -> Poll<io::Result<usize>> {
+        let this = self.get_mut();
+        let result = Pin::new(&mut this.inner).poll_write_vectored(cx, bufs);
+        if matches!(result, Poll::Ready(Ok(n)) if n > 0) {
+            this.reset();
+        }
+        result
+    }
+
+    fn is_write_vectored(&self) -> bool {
+        self.inner.is_write_vectored()
+    }
+
+    fn poll_flush(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.get_mut().inner).poll_flush(cx)
+    }
+
+    fn poll_shutdown(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.get_mut().inner).poll_shutdown(cx)
+    }
+}
+
+/// Counts the requests being handled on a connection.
+#[derive(Debug, Default)]
+pub(crate) struct Requests {
+    in_flight: AtomicUsize,
+}
+
+impl Requests {
+    /// Account for a request, until the returned guard is dropped.
+    pub(crate) fn start(self: &Arc<Self>) -> RequestGuard {
+        self.in_flight.fetch_add(1, Ordering::SeqCst);
+        RequestGuard(Arc::clone(self))
+    }
+}
+
+#[derive(Debug)]
+pub(crate) struct RequestGuard(Arc<Requests>);
+
+impl Drop for RequestGuard {
+    fn drop(&mut self) {
+        self.0.in_flight.fetch_sub(1, Ordering::SeqCst);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    const TIMEOUT: Duration = Duration::from_millis(50);
+
+    #[tokio::test]
+    async fn idle_connection_is_closed() {
+        let (mut client, server) = tokio::io::duplex(64);
+        let mut server = IdleTimeout::new(server, Some(TIMEOUT));
+
+        client.write_all(b"ping").await.unwrap();
+        let mut buf = [0; 4];
+        server.read_exact(&mut buf).await.unwrap();
+
+        // the client sends nothing more, so the connection ends
+        let start = Instant::now();
+        assert_eq!(server.read(&mut buf).await.unwrap(), 0);
+        assert!(start.elapsed() >= TIMEOUT);
+    }
+
+    #[tokio::test]
+    async fn connection_handling_a_request_is_not_closed() {
+        let (mut client, server) = tokio::io::duplex(64);
+        let mut server = IdleTimeout::new(server, Some(TIMEOUT));
+        let request = server.requests().start();
+
+        let read = tokio::spawn(async move {
+            let mut buf = [0; 4];
+            server.read_exact(&mut buf).await.map(|_| buf)
+        });
+        tokio::time::sleep(TIMEOUT * 4).await;
+        client.write_all(b"pong").await.unwrap();
+        assert_eq!(&read.await.unwrap().unwrap(), b"pong");
+        drop(request);
+    }
+
+    #[tokio::test]
+    async fn no_timeout() {
+        let (mut client, server) = tokio::io::duplex(64);
+        let mut server = IdleTimeout::new(server, None);
+
+        let read = tokio::spawn(async move {
+            let mut buf = [0; 4];
+            server.read_exact(&mut buf).await.map(|_| buf)
+        });
+        tokio::time::sleep(TIMEOUT * 4).await;
+        client.write_all(b"ping").await.unwrap();
+        assert_eq!(&read.await.unwrap().unwrap(), b"ping");
+    }
+}
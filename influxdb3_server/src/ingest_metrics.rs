@@ -0,0 +1,199 @@
+//! Ingest metrics by measurement.
+//!
+//! Counts the points and bytes written to each measurement of each database,
+//! and the points dropped from writes, so that operators can find the
+//! measurements using the most of the ingest capacity. Points are counted as
+//! received, before write rules and sampling are applied, from the
+//! [`WriteCounts`] gathered as the lines of a write are checked.
+//!
+//! A measurement is a label of the metrics, so the number of series is
+//! capped: the measurements that had the most points written recently, up to
+//! the configured limit, have their own series, and the others are counted
+//! together under `_other`. Dropped lines that cannot be parsed have no
+//! measurement and are counted under [`INVALID_MEASUREMENT`].
+
+use crate::capped_labels::{self, CappedLabels};
+use metric::{Attributes, Metric, U64Counter};
+use std::borrow::Cow;
+use std::collections::HashMap;
+
+/// The measurement dropped lines that cannot be parsed are counted under.
+pub const INVALID_MEASUREMENT: &str = "_invalid";
+
+/// The points of a write, by measurement.
+#[derive(Debug, Default)]
+pub(crate) struct WriteCounts {
+    /// The points and bytes of the lines accepted
+    written: HashMap<String, (u64, u64)>,
+    /// The points of the lines dropped
+    dropped: HashMap<String, u64>,
+}
+
+impl WriteCounts {
+    /// Count an accepted line of `bytes` bytes, newline included.
+    pub(crate) fn written(&mut self, measurement: &str, bytes: usize) {
+        match self.written.get_mut(measurement) {
+            Some((points, total)) => {
+                *points += 1;
+                *total += bytes as u64;
+            }
+            None => {
+                self.written
+                    .insert(measurement.to_string(), (1, bytes as u64));
+            }
+        }
+    }
+
+    /// Uncount an accepted line of `bytes` bytes, newline included, that was
+    /// not written after all.
+    pub(crate) fn unwritten(&mut self, measurement: &str, bytes: usize) {
+        if let Some((points, total)) = self.written.get_mut(measurement) {
+            *points -= 1;
+            *total -= bytes as u64;
+            if *points == 0 {
+                self.written.remove(measurement);
+            }
+        }
+    }
+
+    /// Count a dropped line, of no measurement if it cannot be parsed.
+    pub(crate) fn dropped(&mut self, measurement: Option<&str>) {
+        let measurement = measurement.unwrap_or(INVALID_MEASUREMENT);
+        match self.dropped.get_mut(measurement) {
+            Some(points) => *points += 1,
+            None => {
+                self.dropped.insert(measurement.to_string(), 1);
+            }
+        }
+    }
+}
+
+#[derive(Debug)]
+pub(crate) struct IngestMetrics {
+    points: Metric<U64Counter>,
+    bytes: Metric<U64Counter>,
+    dropped: Metric<U64Counter>,
+    /// The databases and measurements with series of their own, weighed by
+    /// their points
+    labels: CappedLabels<(String, String)>,
+}
+
+impl IngestMetrics {
+    pub(crate) fn new(max_measurements: usize, metrics: &metric::Registry) -> Self {
+        Self {
+            points: metrics.register_metric(
+                "influxdb3_ingest_points",
+                "Number of points written, by database and measurement",
+            ),
+            bytes: metrics.register_metric(
+                "influxdb3_ingest_bytes",
+                "Bytes of line protocol written, by database and measurement",
+            ),
+            dropped: metrics.register_metric(
+                "influxdb3_ingest_dropped_points",
+                "Number of points dropped from writes, by database and measurement",
+            ),
+            labels: CappedLabels::new(max_measurements, capped_labels::CHOOSE_INTERVAL),
+        }
+    }
+
+    /// Count the lines of a write buffered in `db`.
+    pub(crate) fn record_write(&self, db: &str, counts: &WriteCounts) {
+        let weighed: Vec<_> = counts
+            .written
+            .iter()
+            .map(|(measurement, (points, _))| ((db.to_string(), measurement.clone()), *points))
+            .collect();
+        let tracked = self.labels.record(&weighed);
+
+        let mut by_label: HashMap<&str, (u64, u64)> = HashMap::new();
+        for ((measurement, (points, bytes)), tracked) in counts.written.iter().zip(tracked) {
+            let label = if tracked {
+                measurement.as_str()
+            } else {
+                capped_labels::OTHER
+            };
+            let (p, b) = by_label.entry(label).or_default();
+            *p += points;
+            *b += bytes;
+        }
+        for (measurement, (points, bytes)) in by_label {
+            let attributes = attributes(db, measurement);
+            self.points.recorder(attributes.clone()).inc(points);
+            self.bytes.recorder(attributes).inc(bytes);
+        }
+    }
+
+    /// Count the lines dropped from a write to `db`.
+    pub(crate) fn record_dropped(&self, db: &str, counts: &WriteCounts) {
+        let mut by_label: HashMap<&str, u64> = HashMap::new();
+        for (measurement, points) in &counts.dropped {
+            let key = (db.to_string(), measurement.clone());
+            let label = if measurement == INVALID_MEASUREMENT || self.labels.is_tracked(&key) {
+                measurement.as_str()
+            } else {
+                capped_labels::OTHER
+            };
+            *by_label.entry(label).or_default() += points;
+        }
+        for (measurement, points) in by_label {
+            self.dropped
+                .recorder(attributes(db, measurement))
+                .inc(points);
+        }
+    }
+}
+
+fn attributes(db: &str, measurement: &str) -> Attributes {
+    Attributes::from([
+        ("db", Cow::Owned(db.to_string())),
+        ("measurement", Cow::Owned(measurement.to_string())),
+    ])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn value(metric: &Metric<U64Counter>, db: &str, measurement: &str) -> u64 {
+        metric
+            .get_observer(&attributes(db, measurement))
+            .map(|c| c.fetch())
+            .unwrap_or_default()
+    }
+
+    fn counts(lines: &[&str]) -> WriteCounts {
+        let mut counts = WriteCounts::default();
+        for line in lines {
+            let (measurement, _) = line.split_once(' ').unwrap();
+            counts.written(measurement, line.len() + 1);
+        }
+        counts
+    }
+
+    #[test]
+    fn measurements_beyond_the_limit_are_aggregated() {
+        let registry = metric::Registry::new();
+        let metrics = IngestMetrics::new(2, &registry);
+
+        metrics.record_write("db", &counts(&["cpu usage=1", "cpu usage=2", "mem free=1"]));
+        metrics.record_write(
+            "db",
+            &counts(&["disk used=1", "net bytes=1", "cpu usage=3"]),
+        );
+        assert_eq!(value(&metrics.points, "db", "cpu"), 3);
+        assert_eq!(value(&metrics.bytes, "db", "cpu"), 36);
+        assert_eq!(value(&metrics.points, "db", "mem"), 1);
+        assert_eq!(value(&metrics.points, "db", "disk"), 0);
+        assert_eq!(value(&metrics.points, "db", capped_labels::OTHER), 2);
+
+        let mut dropped = WriteCounts::default();
+        dropped.dropped(Some("mem"));
+        dropped.dropped(Some("disk"));
+        dropped.dropped(None);
+        metrics.record_dropped("db", &dropped);
+        assert_eq!(value(&metrics.dropped, "db", "mem"), 1);
+        assert_eq!(value(&metrics.dropped, "db", capped_labels::OTHER), 1);
+        assert_eq!(value(&metrics.dropped, "db", INVALID_MEASUREMENT), 1);
+    }
+}
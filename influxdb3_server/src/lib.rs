@@ -11,23 +11,69 @@ clippy::clone_on_ref_ptr,
 clippy::future_not_send
 )]
 
+mod capped_labels;
+pub mod compression;
+pub mod database_metrics;
+pub mod dead_letter;
+pub mod default_tags;
+pub mod export;
+pub mod gateway;
+pub mod health;
 mod http;
+pub mod idempotency;
+mod idle_timeout;
+pub mod ingest_metrics;
+pub mod listener;
+pub mod load_shedding;
+pub mod precision;
+mod profile_bundle;
+pub mod query_cursor;
 pub mod query_executor;
+pub mod read_only;
+pub mod rejection;
+pub mod reload;
+pub mod replication;
+pub mod resources;
+pub mod sampling;
+pub mod self_monitoring;
+pub mod signed_writes;
+pub mod time_bounds;
+pub mod udp;
+pub mod write_rules;
 
+use crate::compression::ResponseCompression;
+use crate::database_metrics::DatabaseMetricsConfig;
+use crate::dead_letter::DeadLetterDatabase;
+use crate::default_tags::DefaultTags;
+use crate::health::HealthThresholds;
 use crate::http::HttpApi;
+use crate::idempotency::IdempotencyCache;
+use crate::load_shedding::LoadSheddingConfig;
+use crate::read_only::ReadOnly;
+use crate::replication::Replicator;
+use crate::resources::Resources;
+use crate::sampling::SamplingRules;
+use crate::signed_writes::SigningKeys;
+use crate::time_bounds::TimeBounds;
+use crate::udp::UdpListener;
+use crate::write_rules::WriteRules;
 use async_trait::async_trait;
 use datafusion::execution::SendableRecordBatchStream;
 use influxdb3_write::{Persister, WriteBuffer};
 use observability_deps::tracing::info;
 use std::fmt::Debug;
 use std::net::SocketAddr;
+use std::num::NonZeroUsize;
+use std::path::PathBuf;
 use std::sync::Arc;
+use std::time::Duration;
 use thiserror::Error;
 use tokio_util::sync::CancellationToken;
 use trace::ctx::SpanContext;
 use trace::TraceCollector;
 use trace_http::ctx::RequestLogContext;
 use trace_http::ctx::TraceHeaderParser;
+use trogging::LogFilterHandle;
 
 #[derive(Debug, Error)]
 pub enum Error {
@@ -56,6 +102,7 @@ pub struct CommonServerState {
     trace_header_parser: TraceHeaderParser,
     http_addr: SocketAddr,
     bearer_token: Option<Vec<u8>>,
+    log_filter: Option<LogFilterHandle>,
 }
 
 impl CommonServerState {
@@ -72,9 +119,22 @@ impl CommonServerState {
             trace_header_parser,
             http_addr,
             bearer_token: bearer_token.map(hex::decode).transpose()?,
+            log_filter: None,
         })
     }
 
+    /// Allow the log filter of the process to be changed through the HTTP API.
+    pub fn with_log_filter(self, log_filter: LogFilterHandle) -> Self {
+        Self {
+            log_filter: Some(log_filter),
+            ..self
+        }
+    }
+
+    pub fn log_filter(&self) -> Option<&LogFilterHandle> {
+        self.log_filter.as_ref()
+    }
+
     pub fn trace_exporter(&self) -> Option<Arc<trace_exporters::export::AsyncExporter>> {
         self.trace_exporter.clone()
     }
@@ -98,17 +158,167 @@ impl CommonServerState {
     }
 }
 
+/// The default time in-flight requests have to complete on shutdown.
+pub const DEFAULT_SHUTDOWN_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Tuning for the HTTP server and the connections it accepts.
+#[derive(Debug, Clone)]
+pub struct HttpServerConfig {
+    /// Maximum size of a request body, in bytes.
+    pub max_request_bytes: usize,
+    /// Maximum number of connections served at once; further connections are
+    /// answered with `503 Service Unavailable` and closed.
+    pub max_connections: Option<usize>,
+    /// Time allowed for a client to send the request headers.
+    pub header_read_timeout: Option<Duration>,
+    /// Time after which a connection with no request being handled, and
+    /// nothing received or sent, is closed.
+    pub idle_timeout: Option<Duration>,
+    /// Time allowed for a request to be handled, unless overridden for the
+    /// endpoint.
+    pub request_timeout: Option<Duration>,
+    /// Time allowed for a request to `/api/v3/write_lp` to be handled.
+    pub write_timeout: Option<Duration>,
+    /// Time allowed for a request to `/api/v3/query_sql` to be handled.
+    pub query_timeout: Option<Duration>,
+    /// Whether HTTP/1 connections are kept alive between requests.
+    pub http1_keepalive: bool,
+    /// Interval of the TCP keepalive probes sent on idle connections.
+    pub tcp_keepalive: Option<Duration>,
+    /// Maximum size of the buffer holding the request headers, in bytes.
+    ///
+    /// Values below 8 KiB are raised to 8 KiB.
+    pub max_header_bytes: Option<usize>,
+    /// Whether clients may use HTTP/2.
+    pub http2: bool,
+    /// Path of a unix socket on which to serve the HTTP API in addition to the
+    /// TCP address.
+    pub unix_socket_path: Option<PathBuf>,
+    /// File permissions of the unix socket, which control the local users
+    /// able to connect to it.
+    pub unix_socket_permissions: u32,
+    /// Whether the TCP listener is bound with `SO_REUSEPORT`, so that a new
+    /// server process can bind it before this one exits.
+    pub reuse_port: bool,
+    /// Time the requests in flight when the server shuts down have to
+    /// complete before their connections are abandoned.
+    pub shutdown_timeout: Duration,
+    /// Thresholds beyond which `/ready` reports that the server is not ready.
+    pub health: HealthThresholds,
+    /// File of settings applied on `SIGHUP` or a call to
+    /// `/api/v3/config/reload`, see [`reload`].
+    pub reload_file: Option<PathBuf>,
+    /// Tags added to every point written to a database.
+    pub default_tags: DefaultTags,
+    /// How far from the present the timestamps of written lines may be.
+    pub time_bounds: TimeBounds,
+    /// Transformations applied to the lines written to a database.
+    pub write_rules: WriteRules,
+    /// Rules dropping some of the points written to a database.
+    pub sampling_rules: SamplingRules,
+    /// Secrets writes may be signed with instead of using the bearer token,
+    /// see [`signed_writes`].
+    pub signing_keys: SigningKeys,
+    /// How far the timestamp of a signed write may be from the time of the
+    /// server.
+    pub signed_write_max_skew: Duration,
+    /// SHA-256 of the token the replication peer authenticates with, without
+    /// which writes replicated from a peer are refused.
+    pub replication_peer_token: Option<Vec<u8>>,
+    /// Database the lines dropped from partially accepted writes are written
+    /// to.
+    pub dead_letter_database: Option<DeadLetterDatabase>,
+    /// Number of measurements with their own series in the ingest metrics by
+    /// measurement, which are not reported when unset.
+    pub ingest_metrics_max_measurements: Option<usize>,
+    /// Which databases have series of their own in the metrics of load by
+    /// database, which are not reported when unset.
+    pub database_metrics: Option<DatabaseMetricsConfig>,
+    /// Limits beyond which queries are refused, see [`load_shedding`], or
+    /// `None` if queries are never refused.
+    pub load_shedding: Option<LoadSheddingConfig>,
+    /// Whether writes are refused, see [`read_only`].
+    pub read_only: ReadOnly,
+    /// Resources detected at startup, reported on `/debug/resources`.
+    pub resources: Resources,
+    /// Total size of the rows of query results kept for their following
+    /// pages, see [`query_cursor`].
+    pub query_cursor_max_bytes: usize,
+    /// Time the rest of a paged query result is kept without being fetched.
+    pub query_cursor_ttl: Duration,
+}
+
+impl Default for HttpServerConfig {
+    fn default() -> Self {
+        Self {
+            max_request_bytes: 10 * 1024 * 1024,
+            max_connections: None,
+            header_read_timeout: None,
+            idle_timeout: None,
+            request_timeout: None,
+            write_timeout: None,
+            query_timeout: None,
+            http1_keepalive: true,
+            tcp_keepalive: None,
+            max_header_bytes: None,
+            http2: true,
+            unix_socket_path: None,
+            unix_socket_permissions: 0o660,
+            reuse_port: false,
+            shutdown_timeout: DEFAULT_SHUTDOWN_TIMEOUT,
+            health: HealthThresholds::default(),
+            reload_file: None,
+            default_tags: DefaultTags::default(),
+            time_bounds: TimeBounds::default(),
+            write_rules: WriteRules::default(),
+            sampling_rules: SamplingRules::default(),
+            signing_keys: SigningKeys::default(),
+            signed_write_max_skew: signed_writes::DEFAULT_MAX_SKEW,
+            replication_peer_token: None,
+            dead_letter_database: None,
+            ingest_metrics_max_measurements: None,
+            database_metrics: None,
+            load_shedding: None,
+            read_only: ReadOnly::default(),
+            resources: Resources::default(),
+            query_cursor_max_bytes: query_cursor::DEFAULT_MAX_BYTES,
+            query_cursor_ttl: query_cursor::DEFAULT_TTL,
+        }
+    }
+}
+
+impl HttpServerConfig {
+    /// The time allowed for handling a request to `path`.
+    pub(crate) fn request_timeout_for(&self, path: &str) -> Option<Duration> {
+        let endpoint_timeout = match path {
+            "/api/v3/write_lp" => self.write_timeout,
+            "/api/v3/query_sql" => self.query_timeout,
+            _ => None,
+        };
+        endpoint_timeout.or(self.request_timeout)
+    }
+}
+
 #[derive(Debug)]
 pub struct Server<W, Q> {
     http: Arc<HttpApi<W, Q>>,
+    metrics: Arc<metric::Registry>,
+    tcp_listener: Option<std::net::TcpListener>,
+    udp_listener: Option<UdpListener>,
 }
 
 #[async_trait]
 pub trait QueryExecutor: Debug + Send + Sync + 'static {
+    /// Run the SQL query `q` against `database`.
+    ///
+    /// `parallelism` is the number of partitions the query may be executed
+    /// in concurrently, capped by the executor's limit; if `None`, the limit
+    /// is used.
     async fn query(
         &self,
         database: &str,
         q: &str,
+        parallelism: Option<NonZeroUsize>,
         span_ctx: Option<SpanContext>,
         external_span_ctx: Option<RequestLogContext>,
     ) -> Result<SendableRecordBatchStream>;
@@ -120,16 +330,45 @@ impl<W, Q> Server<W, Q> {
         _persister: Arc<dyn Persister>,
         write_buffer: Arc<W>,
         query_executor: Arc<Q>,
-        max_http_request_size: usize,
+        http_config: HttpServerConfig,
+        idempotency_cache: IdempotencyCache,
+        response_compression: ResponseCompression,
+        replicator: Option<Replicator>,
     ) -> Self {
         let http = Arc::new(HttpApi::new(
             common_state.clone(),
             Arc::<W>::clone(&write_buffer),
             Arc::<Q>::clone(&query_executor),
-            max_http_request_size,
+            http_config,
+            idempotency_cache,
+            response_compression,
+            replicator,
         ));
 
-        Self { http }
+        Self {
+            http,
+            metrics: common_state.metric_registry(),
+            tcp_listener: None,
+            udp_listener: None,
+        }
+    }
+
+    /// Serve the HTTP API on `listener`, such as the socket passed by systemd,
+    /// instead of binding the configured address.
+    pub fn with_tcp_listener(self, listener: std::net::TcpListener) -> Self {
+        Self {
+            tcp_listener: Some(listener),
+            ..self
+        }
+    }
+
+    /// Also write the lines received by `listener`, through the same write
+    /// path as the HTTP API.
+    pub fn with_udp_listener(self, listener: UdpListener) -> Self {
+        Self {
+            udp_listener: Some(listener),
+            ..self
+        }
     }
 }
 
@@ -143,7 +382,22 @@ pub async fn serve<W: WriteBuffer, Q: QueryExecutor>(
     //  3. persist any segments from the buffer that are closed and haven't yet been persisted
     //  4. start serving
 
-    http::serve(Arc::clone(&server.http), shutdown).await?;
+    let udp_listener = server.udp_listener.map(|listener| {
+        tokio::spawn(listener.run(Arc::clone(&server.http), server.metrics, shutdown.clone()))
+    });
+
+    let result = http::serve(
+        Arc::clone(&server.http),
+        server.tcp_listener,
+        shutdown.clone(),
+    )
+    .await;
+    // the UDP listener writes the lines it has batched before it exits
+    shutdown.cancel();
+    if let Some(udp_listener) = udp_listener {
+        udp_listener.await.expect("UDP listener panicked");
+    }
+    result?;
 
     Ok(())
 }
@@ -171,12 +425,21 @@ pub async fn wait_for_signal() {
 
 #[cfg(test)]
 mod tests {
+    use crate::compression::ResponseCompression;
+    use crate::default_tags::DefaultTags;
+    use crate::idempotency::IdempotencyCache;
+    use crate::precision::Precision;
+    use crate::replication::Replicator;
     use crate::serve;
+    use crate::time_bounds::TimeBounds;
+    use crate::udp::{UdpConfig, UdpListener};
+    use crate::write_rules::WriteRules;
     use datafusion::parquet::data_type::AsBytes;
-    use hyper::{body, Body, Client, Request, Response};
+    use hyper::{body, Body, Client, Request, Response, StatusCode};
     use influxdb3_write::persister::PersisterImpl;
     use influxdb3_write::SegmentId;
     use iox_query::exec::{Executor, ExecutorConfig};
+    use iox_time::SystemProvider;
     use object_store::DynObjectStore;
     use parquet_file::storage::{ParquetStorage, StorageId};
     use std::collections::HashMap;
@@ -184,70 +447,14 @@ mod tests {
     use std::num::NonZeroUsize;
     use std::sync::atomic::{AtomicU16, Ordering};
     use std::sync::Arc;
+    use std::time::Duration;
     use tokio_util::sync::CancellationToken;
 
     static NEXT_PORT: AtomicU16 = AtomicU16::new(8090);
 
     #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
     async fn write_and_query() {
-        let addr = get_free_port();
-        let trace_header_parser = trace_http::ctx::TraceHeaderParser::new();
-        let metrics = Arc::new(metric::Registry::new());
-        let common_state = crate::CommonServerState::new(
-            Arc::clone(&metrics),
-            None,
-            trace_header_parser,
-            addr,
-            None,
-        )
-        .unwrap();
-        let catalog = Arc::new(influxdb3_write::catalog::Catalog::new());
-        let object_store: Arc<DynObjectStore> = Arc::new(object_store::memory::InMemory::new());
-        let parquet_store =
-            ParquetStorage::new(Arc::clone(&object_store), StorageId::from("influxdb3"));
-        let num_threads = NonZeroUsize::new(2).unwrap();
-        let exec = Arc::new(Executor::new_with_config(ExecutorConfig {
-            num_threads,
-            target_query_partitions: NonZeroUsize::new(1).unwrap(),
-            object_stores: [&parquet_store]
-                .into_iter()
-                .map(|store| (store.id(), Arc::clone(store.object_store())))
-                .collect(),
-            metric_registry: Arc::clone(&metrics),
-            mem_pool_size: usize::MAX,
-        }));
-
-        let write_buffer = Arc::new(
-            influxdb3_write::write_buffer::WriteBufferImpl::new(
-                Arc::clone(&catalog),
-                None::<Arc<influxdb3_write::wal::WalImpl>>,
-                SegmentId::new(0),
-            )
-            .unwrap(),
-        );
-        let query_executor = crate::query_executor::QueryExecutorImpl::new(
-            catalog,
-            Arc::clone(&write_buffer),
-            Arc::clone(&exec),
-            Arc::clone(&metrics),
-            Arc::new(HashMap::new()),
-            10,
-        );
-        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
-
-        let server = crate::Server::new(
-            common_state,
-            persister,
-            Arc::clone(&write_buffer),
-            Arc::new(query_executor),
-            usize::MAX,
-        );
-        let frontend_shutdown = CancellationToken::new();
-        let shutdown = frontend_shutdown.clone();
-
-        tokio::spawn(async move { serve(server, frontend_shutdown).await });
-
-        let server = format!("http://{}", addr);
+        let (server, shutdown) = setup_server().await;
         write_lp(&server, "foo", "cpu,host=a val=1i 123", None).await;
 
         // Test that we can query the output with a pretty output
@@ -319,6 +526,492 @@ mod tests {
         shutdown.cancel();
     }
 
+    #[test]
+    fn endpoint_timeouts_override_request_timeout() {
+        let config = crate::HttpServerConfig {
+            request_timeout: Some(Duration::from_secs(30)),
+            query_timeout: Some(Duration::from_secs(300)),
+            ..Default::default()
+        };
+
+        assert_eq!(
+            config.request_timeout_for("/api/v3/query_sql"),
+            Some(Duration::from_secs(300))
+        );
+        assert_eq!(
+            config.request_timeout_for("/api/v3/write_lp"),
+            Some(Duration::from_secs(30))
+        );
+        assert_eq!(
+            config.request_timeout_for("/health"),
+            Some(Duration::from_secs(30))
+        );
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn idempotent_write() {
+        let (server, shutdown) = setup_server().await;
+        let client = Client::new();
+        let write = |lp: &'static str| {
+            Request::builder()
+                .uri(format!("{}/api/v3/write_lp?db=foo", server))
+                .method("POST")
+                .header("Idempotency-Key", "batch-1")
+                .body(Body::from(lp))
+                .expect("failed to construct HTTP request")
+        };
+
+        // the retry of the same write is acknowledged but not applied again
+        for _ in 0..2 {
+            let res = client
+                .request(write("cpu,host=a val=1i 123"))
+                .await
+                .unwrap();
+            assert_eq!(res.status(), StatusCode::OK);
+        }
+        let res = query(&server, "foo", "select count(*) from cpu", "csv", None).await;
+        let body = body::to_bytes(res.into_body()).await.unwrap();
+        assert_eq!(
+            std::str::from_utf8(body.as_bytes()).unwrap(),
+            "COUNT(*)\n1\n"
+        );
+
+        // reusing the key for a different write is rejected
+        let res = client
+            .request(write("cpu,host=b val=2i 456"))
+            .await
+            .unwrap();
+        assert_eq!(res.status(), StatusCode::UNPROCESSABLE_ENTITY);
+
+        // the retry of a partial write is answered with the lines it rejected
+        for _ in 0..2 {
+            let request = Request::builder()
+                .uri(format!(
+                    "{server}/api/v3/write_lp?db=foo&accept_partial=true"
+                ))
+                .method("POST")
+                .header("Idempotency-Key", "batch-2")
+                .body(Body::from("cpu,host=c val=3i 789\ncpu,host=d val="))
+                .expect("failed to construct HTTP request");
+            let res = client.request(request).await.unwrap();
+            assert_eq!(res.status(), StatusCode::OK);
+            let body = body::to_bytes(res.into_body()).await.unwrap();
+            let rejected: serde_json::Value = serde_json::from_slice(&body).unwrap();
+            assert_eq!(rejected["rejected_count"], 1);
+            assert_eq!(rejected["rejected_lines"][0]["line_number"], 2);
+        }
+        let res = query(&server, "foo", "select count(*) from cpu", "csv", None).await;
+        let body = body::to_bytes(res.into_body()).await.unwrap();
+        assert_eq!(
+            std::str::from_utf8(body.as_bytes()).unwrap(),
+            "COUNT(*)\n2\n"
+        );
+
+        // the key of a write is only reused with the same parameters
+        let res = client
+            .request(
+                Request::builder()
+                    .uri(format!("{server}/api/v3/write_lp?db=foo&precision=s"))
+                    .method("POST")
+                    .header("Idempotency-Key", "batch-1")
+                    .body(Body::from("cpu,host=a val=1i 123"))
+                    .expect("failed to construct HTTP request"),
+            )
+            .await
+            .unwrap();
+        assert_eq!(res.status(), StatusCode::UNPROCESSABLE_ENTITY);
+
+        shutdown.cancel();
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn column_type_conflicts_are_rejected() {
+        let (server, shutdown) = setup_server().await;
+        let client = Client::new();
+        let write = |query: &str, lp: &'static str| {
+            Request::builder()
+                .uri(format!("{server}/api/v3/write_lp?db=foo{query}"))
+                .method("POST")
+                .header(hyper::header::ACCEPT, "application/json")
+                .body(Body::from(lp))
+                .expect("failed to construct HTTP request")
+        };
+
+        let res = client
+            .request(write("", "cpu,host=a val=1i 123"))
+            .await
+            .unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+
+        // without time bounds or ingest metrics, invalid line protocol is
+        // also rejected by the write buffer
+        let lp = "cpu,host=b val=2i 124\n\ncpu,host=c val=\"high\" 125\ncpu,host=d val=";
+        let res = client.request(write("", lp)).await.unwrap();
+        assert_eq!(res.status(), StatusCode::BAD_REQUEST);
+
+        let res = client
+            .request(write("&accept_partial=true", lp))
+            .await
+            .unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+        let body = body::to_bytes(res.into_body()).await.unwrap();
+        let rejected: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(rejected["rejected_count"], 2);
+        assert_eq!(rejected["rejected_lines"][0]["line_number"], 3);
+        assert_eq!(
+            rejected["rejected_lines"][0]["code"],
+            "column_type_conflict"
+        );
+        assert_eq!(
+            rejected["rejected_lines"][0]["line"],
+            "cpu,host=c val=\"high\" 125"
+        );
+        assert_eq!(rejected["rejected_lines"][1]["line_number"], 4);
+        assert_eq!(
+            rejected["rejected_lines"][1]["code"],
+            "invalid_line_protocol"
+        );
+
+        let res = query(&server, "foo", "select count(*) from cpu", "csv", None).await;
+        let body = body::to_bytes(res.into_body()).await.unwrap();
+        assert_eq!(
+            std::str::from_utf8(body.as_bytes()).unwrap(),
+            "COUNT(*)\n2\n"
+        );
+
+        shutdown.cancel();
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn column_type_conflicts_are_dead_lettered() {
+        let (server, shutdown) = setup_server_with_config(crate::HttpServerConfig {
+            max_request_bytes: usize::MAX,
+            dead_letter_database: Some("dead".parse().unwrap()),
+            ..Default::default()
+        })
+        .await;
+
+        let res = write_lp(&server, "foo", "cpu,host=a val=1i 123", None).await;
+        assert_eq!(res.status(), StatusCode::OK);
+
+        let request = Request::builder()
+            .uri(format!(
+                "{server}/api/v3/write_lp?db=foo&accept_partial=true"
+            ))
+            .method("POST")
+            .body(Body::from(
+                "cpu,host=b val=2i 124\ncpu,host=c val=\"high\" 125",
+            ))
+            .expect("failed to construct HTTP request");
+        let res = Client::new().request(request).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+
+        let res = query(
+            &server,
+            "dead",
+            "select db, code, line_number from rejected_lines",
+            "csv",
+            None,
+        )
+        .await;
+        let body = body::to_bytes(res.into_body()).await.unwrap();
+        assert_eq!(
+            std::str::from_utf8(body.as_bytes()).unwrap(),
+            "db,code,line_number\nfoo,column_type_conflict,2\n"
+        );
+
+        shutdown.cancel();
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn replicated_writes_are_only_accepted_from_the_peer() {
+        use sha2::Digest;
+
+        let dir = test_helpers::tmp_dir().unwrap();
+        let rules = dir.path().join("rules.json");
+        std::fs::write(
+            &rules,
+            r#"{"foo": [{"scale_field": {"field": "val", "multiply": 2}}]}"#,
+        )
+        .unwrap();
+        let (server, shutdown) = setup_server_with_config(crate::HttpServerConfig {
+            replication_peer_token: Some(sha2::Sha256::digest("peer-token").to_vec()),
+            write_rules: WriteRules::load(&rules).unwrap(),
+            default_tags: DefaultTags::new(["foo:site=factory-7".parse().unwrap()]),
+            ..Default::default()
+        })
+        .await;
+        let client = Client::new();
+        let write = |authorization: Option<&str>| {
+            let mut builder = Request::builder()
+                .uri(format!("{}/api/v3/write_lp?db=foo", server))
+                .method("POST")
+                .header(crate::replication::REPLICATED_HEADER, "true");
+            if let Some(authorization) = authorization {
+                builder = builder.header(hyper::header::AUTHORIZATION, authorization);
+            }
+            builder
+                .body(Body::from("cpu,host=a val=1i 123"))
+                .expect("failed to construct HTTP request")
+        };
+
+        for (authorization, status) in [
+            (None, StatusCode::FORBIDDEN),
+            (Some("Bearer other-token"), StatusCode::FORBIDDEN),
+            (Some("Bearer peer-token"), StatusCode::OK),
+        ] {
+            let res = client.request(write(authorization)).await.unwrap();
+            assert_eq!(res.status(), status, "{authorization:?}");
+        }
+
+        // the peer already applied its write rules and default tags
+        let res = query(&server, "foo", "select * from cpu", "csv", None).await;
+        let body = body::to_bytes(res.into_body()).await.unwrap();
+        assert_eq!(
+            std::str::from_utf8(&body).unwrap(),
+            "host,time,val\na,1970-01-01T00:00:00.000000123,1\n"
+        );
+
+        shutdown.cancel();
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn udp_writes_go_through_the_write_path() {
+        let dir = test_helpers::tmp_dir().unwrap();
+        let rules = dir.path().join("rules.json");
+        std::fs::write(&rules, r#"{"foo": [{"drop_field": "debug"}]}"#).unwrap();
+        let listener = UdpListener::bind(UdpConfig {
+            bind_addr: "127.0.0.1:0".parse().unwrap(),
+            db: "foo".to_string(),
+            precision: Precision::Nanosecond,
+            read_buffer_bytes: None,
+            batch_size: 2,
+            batch_timeout: Duration::from_secs(60),
+        })
+        .unwrap();
+        let udp_addr = listener.local_addr().unwrap();
+        let (server, shutdown) = setup_server_with_udp_listener(
+            crate::HttpServerConfig {
+                time_bounds: TimeBounds {
+                    max_future: Some(Duration::from_secs(3600)),
+                    max_past: None,
+                },
+                write_rules: WriteRules::load(&rules).unwrap(),
+                ..Default::default()
+            },
+            Some(listener),
+        )
+        .await;
+
+        // the second line is too far in the future
+        let socket = tokio::net::UdpSocket::bind("127.0.0.1:0").await.unwrap();
+        let future = iox_time::TimeProvider::now(&SystemProvider::new()).timestamp_nanos()
+            + 2 * 3_600_000_000_000;
+        socket
+            .send_to(
+                format!("cpu,host=a val=1i,debug=2i 123\ncpu,host=b val=2i {future}").as_bytes(),
+                udp_addr,
+            )
+            .await
+            .unwrap();
+
+        // the batch is full, so it is written at once
+        tokio::time::sleep(Duration::from_millis(500)).await;
+        let res = query(&server, "foo", "select * from cpu", "csv", None).await;
+        let body = body::to_bytes(res.into_body()).await.unwrap();
+        assert_eq!(
+            std::str::from_utf8(&body).unwrap(),
+            "host,time,val\na,1970-01-01T00:00:00.000000123,1\n"
+        );
+
+        shutdown.cancel();
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn health_and_ready() {
+        let (server, shutdown) = setup_server_with_config(crate::HttpServerConfig {
+            health: crate::health::HealthThresholds {
+                max_open_segment_rows: Some(1),
+                ..Default::default()
+            },
+            ..Default::default()
+        })
+        .await;
+        let client = Client::new();
+        let get = |path: &str| {
+            Request::builder()
+                .uri(format!("{server}{path}"))
+                .body(Body::empty())
+                .expect("failed to construct HTTP request")
+        };
+
+        let res = client.request(get("/ready")).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+
+        let res = write_lp(
+            &server,
+            "foo",
+            "cpu,host=a val=1i 1\ncpu,host=b val=2i 2",
+            None,
+        )
+        .await;
+        assert_eq!(res.status(), StatusCode::OK);
+
+        // the open segment is over its threshold, so the server is alive but
+        // not ready
+        let res = client.request(get("/ready")).await.unwrap();
+        assert_eq!(res.status(), StatusCode::SERVICE_UNAVAILABLE);
+
+        let res = client.request(get("/health")).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+        let body = body::to_bytes(res.into_body()).await.unwrap();
+        let report: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        assert_eq!(report["status"], "fail");
+        assert_eq!(report["checks"][0]["name"], "write_buffer");
+        assert_eq!(report["checks"][0]["details"]["open_segment_rows"], 2);
+
+        shutdown.cancel();
+    }
+
+    #[cfg(unix)]
+    #[tokio::test(flavor = "multi_thread", worker_threads = 2)]
+    async fn serve_unix_socket() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let dir = test_helpers::tmp_dir().unwrap();
+        let socket_path = dir.path().join("influxdb3.sock");
+        let (_, shutdown) = setup_server_with_config(crate::HttpServerConfig {
+            unix_socket_path: Some(socket_path.clone()),
+            unix_socket_permissions: 0o600,
+            ..Default::default()
+        })
+        .await;
+
+        // Wait for the server to bind the socket
+        let stream = loop {
+            match tokio::net::UnixStream::connect(&socket_path).await {
+                Ok(stream) => break stream,
+                Err(_) => tokio::time::sleep(Duration::from_millis(10)).await,
+            }
+        };
+        let mode = std::fs::metadata(&socket_path)
+            .unwrap()
+            .permissions()
+            .mode();
+        assert_eq!(mode & 0o777, 0o600);
+        // the directory the socket was bound in is removed
+        let entries: Vec<_> = std::fs::read_dir(dir.path())
+            .unwrap()
+            .map(|e| e.unwrap().file_name())
+            .collect();
+        assert_eq!(entries, ["influxdb3.sock"]);
+
+        let (mut sender, conn) = hyper::client::conn::handshake(stream).await.unwrap();
+        tokio::spawn(conn);
+        let request = Request::builder()
+            .uri("/health")
+            .body(Body::empty())
+            .unwrap();
+        let res = sender.send_request(request).await.unwrap();
+        assert_eq!(res.status(), StatusCode::OK);
+
+        shutdown.cancel();
+    }
+
+    /// Start a server with an in-memory object store and no WAL, returning its
+    /// base URL and a token to shut it down.
+    async fn setup_server() -> (String, CancellationToken) {
+        setup_server_with_config(crate::HttpServerConfig {
+            max_request_bytes: usize::MAX,
+            ..Default::default()
+        })
+        .await
+    }
+
+    async fn setup_server_with_config(
+        http_config: crate::HttpServerConfig,
+    ) -> (String, CancellationToken) {
+        setup_server_with_udp_listener(http_config, None).await
+    }
+
+    async fn setup_server_with_udp_listener(
+        http_config: crate::HttpServerConfig,
+        udp_listener: Option<UdpListener>,
+    ) -> (String, CancellationToken) {
+        let addr = get_free_port();
+        let trace_header_parser = trace_http::ctx::TraceHeaderParser::new();
+        let metrics = Arc::new(metric::Registry::new());
+        let common_state = crate::CommonServerState::new(
+            Arc::clone(&metrics),
+            None,
+            trace_header_parser,
+            addr,
+            None,
+        )
+        .unwrap();
+        let catalog = Arc::new(influxdb3_write::catalog::Catalog::new());
+        let object_store: Arc<DynObjectStore> = Arc::new(object_store::memory::InMemory::new());
+        let parquet_store =
+            ParquetStorage::new(Arc::clone(&object_store), StorageId::from("influxdb3"));
+        let num_threads = NonZeroUsize::new(2).unwrap();
+        let exec = Arc::new(Executor::new_with_config(ExecutorConfig {
+            num_threads,
+            target_query_partitions: NonZeroUsize::new(1).unwrap(),
+            object_stores: [&parquet_store]
+                .into_iter()
+                .map(|store| (store.id(), Arc::clone(store.object_store())))
+                .collect(),
+            metric_registry: Arc::clone(&metrics),
+            mem_pool_size: usize::MAX,
+        }));
+
+        let write_buffer = Arc::new(
+            influxdb3_write::write_buffer::WriteBufferImpl::new(
+                Arc::clone(&catalog),
+                None::<Arc<influxdb3_write::wal::WalImpl>>,
+                SegmentId::new(0),
+            )
+            .unwrap(),
+        );
+        let query_executor = crate::query_executor::QueryExecutorImpl::new(
+            catalog,
+            Arc::clone(&write_buffer),
+            Arc::clone(&exec),
+            Arc::clone(&metrics),
+            Arc::new(HashMap::new()),
+            10,
+            num_threads,
+        );
+        let persister = Arc::new(PersisterImpl::new(Arc::clone(&object_store)));
+        let idempotency_cache = IdempotencyCache::new(
+            Duration::from_secs(60),
+            100,
+            Arc::new(SystemProvider::new()),
+            &metrics,
+        );
+
+        let server = crate::Server::new(
+            common_state,
+            persister,
+            Arc::clone(&write_buffer),
+            Arc::new(query_executor),
+            http_config,
+            idempotency_cache,
+            ResponseCompression::new(usize::MAX, &metrics),
+            None,
+        );
+        let server = match udp_listener {
+            Some(listener) => server.with_udp_listener(listener),
+            None => server,
+        };
+        let frontend_shutdown = CancellationToken::new();
+        let shutdown = frontend_shutdown.clone();
+
+        tokio::spawn(async move { serve(server, frontend_shutdown).await });
+
+        (format!("http://{}", addr), shutdown)
+    }
+
     pub(crate) async fn write_lp(
         server: impl Into<String> + Send,
         database: impl Into<String> + Send,
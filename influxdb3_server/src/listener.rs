@@ -0,0 +1,130 @@
+//! The TCP listener of the HTTP API, and its handover between processes.
+//!
+//! Upgrading the server without a window in which requests fail requires the
+//! new process to accept connections before the old one stops. Either:
+//!
+//! - with systemd socket activation, the socket is opened by systemd and
+//!   passed to each process the unit starts, so it is never closed. The
+//!   socket is used instead of binding the configured address whenever the
+//!   server is started with one, see `sd_listen_fds(3)` and
+//!   [`take_systemd_listener`].
+//! - with `--http-reuse-port`, each process binds the address with
+//!   `SO_REUSEPORT`, and the kernel spreads new connections between the
+//!   processes until the old one exits.
+
+use observability_deps::tracing::info;
+use socket2::{Domain, Protocol, Socket, Type};
+use std::io;
+use std::net::{SocketAddr, TcpListener};
+
+/// The length of the queue of connections not yet accepted.
+const BACKLOG: i32 = 1024;
+
+/// The listener of the HTTP API: the socket `passed` by systemd if there is
+/// one, otherwise a socket bound to `addr`.
+pub(crate) fn bind(
+    addr: SocketAddr,
+    reuse_port: bool,
+    passed: Option<TcpListener>,
+) -> io::Result<TcpListener> {
+    if let Some(listener) = passed {
+        info!(
+            addr = ?listener.local_addr()?,
+            "using the HTTP listener passed by systemd"
+        );
+        listener.set_nonblocking(true)?;
+        return Ok(listener);
+    }
+
+    let socket = Socket::new(Domain::for_address(addr), Type::STREAM, Some(Protocol::TCP))?;
+    socket.set_reuse_address(true)?;
+    if reuse_port {
+        set_reuse_port(&socket)?;
+    }
+    socket.bind(&addr.into())?;
+    socket.listen(BACKLOG)?;
+    socket.set_nonblocking(true)?;
+    Ok(socket.into())
+}
+
+#[cfg(unix)]
+fn set_reuse_port(socket: &Socket) -> io::Result<()> {
+    socket.set_reuse_port(true)
+}
+
+#[cfg(not(unix))]
+fn set_reuse_port(_socket: &Socket) -> io::Result<()> {
+    observability_deps::tracing::warn!(
+        "SO_REUSEPORT is not supported on this platform, ignoring --http-reuse-port"
+    );
+    Ok(())
+}
+
+/// The first socket passed to this process by systemd socket activation, if
+/// any.
+///
+/// The `LISTEN_*` variables are removed from the environment, so that the
+/// sockets are not passed on to the processes this one starts. As changing
+/// the environment races with other threads reading it, this must be called
+/// before any other thread is started, and at most once.
+#[cfg(unix)]
+pub fn take_systemd_listener() -> Option<TcpListener> {
+    use std::os::unix::io::{FromRawFd, RawFd};
+
+    /// The first file descriptor passed by systemd.
+    const SD_LISTEN_FDS_START: RawFd = 3;
+
+    let var = |name| std::env::var(name).ok().and_then(|v| v.parse::<u32>().ok());
+    let for_this_process = var("LISTEN_PID") == Some(std::process::id());
+    let fds = var("LISTEN_FDS").unwrap_or_default();
+    // the sockets are not passed on to the processes this one starts
+    for name in ["LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"] {
+        std::env::remove_var(name);
+    }
+    if !for_this_process || fds == 0 {
+        return None;
+    }
+    if fds > 1 {
+        // logging is not set up yet
+        eprintln!("systemd passed {fds} sockets, using the first");
+    }
+
+    // SAFETY: when LISTEN_PID is the pid of this process, systemd passed it
+    // LISTEN_FDS open sockets from SD_LISTEN_FDS_START, which nothing else
+    // in the process owns
+    Some(unsafe { TcpListener::from_raw_fd(SD_LISTEN_FDS_START) })
+}
+
+/// The first socket passed to this process by systemd socket activation,
+/// which is not supported on this platform.
+#[cfg(not(unix))]
+pub fn take_systemd_listener() -> Option<TcpListener> {
+    None
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn reuse_port() {
+        let addr = "127.0.0.1:0".parse().unwrap();
+        let first = bind(addr, true, None).unwrap();
+        let addr = first.local_addr().unwrap();
+
+        // a second process binds the same address during an upgrade
+        let second = bind(addr, true, None).unwrap();
+        assert_eq!(second.local_addr().unwrap(), addr);
+        assert!(bind(addr, false, None).is_err());
+    }
+
+    #[test]
+    fn passed_listener() {
+        let passed = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = passed.local_addr().unwrap();
+
+        // the configured address is not bound when a socket is passed
+        let listener = bind("127.0.0.1:1".parse().unwrap(), false, Some(passed)).unwrap();
+        assert_eq!(listener.local_addr().unwrap(), addr);
+    }
+}
@@ -0,0 +1,337 @@
+//! Load shedding of queries, so that an overloaded server keeps serving the
+//! queries that matter rather than becoming unresponsive to all of them.
+//!
+//! The load of the server is the larger of its queries in flight and its
+//! resident memory, each relative to its configured limit. Queries are given a
+//! priority with the `priority` parameter of `/api/v3/query_sql`, `low`,
+//! `normal` (the default) or `high`:
+//!
+//! - from [`SHED_LOW`] of the limits, low priority queries are refused
+//! - from the limits, normal priority queries are refused as well
+//! - high priority queries are never refused
+//!
+//! Refused queries are answered with `503 Service Unavailable` and a
+//! `Retry-After` header. So that the server does not flap between admitting
+//! and refusing queries, it only stops refusing them once the load is
+//! [`HYSTERESIS`] below the load it started at.
+
+use metric::{Attributes, Metric, U64Counter, U64Gauge};
+use observability_deps::tracing::{info, warn};
+use parking_lot::Mutex;
+use serde::Deserialize;
+use std::borrow::Cow;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::Duration;
+
+/// The load, relative to the limits, from which low priority queries are
+/// refused.
+pub const SHED_LOW: f64 = 0.8;
+
+/// How far below the load it started at the load must fall for the server to
+/// stop refusing queries.
+pub const HYSTERESIS: f64 = 0.1;
+
+/// The default time clients are told to wait before retrying a refused query.
+pub const DEFAULT_RETRY_AFTER: Duration = Duration::from_secs(5);
+
+/// The limits beyond which queries are refused.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct LoadSheddingConfig {
+    /// Number of queries in flight, if limited
+    pub max_queries: Option<usize>,
+    /// Resident memory of the process, in bytes, if limited
+    pub max_memory_bytes: Option<usize>,
+    /// Time clients are told to wait before retrying a refused query
+    pub retry_after: Duration,
+}
+
+/// The priority of a query.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub(crate) enum Priority {
+    Low,
+    #[default]
+    Normal,
+    High,
+}
+
+impl Priority {
+    fn as_str(&self) -> &'static str {
+        match self {
+            Self::Low => "low",
+            Self::Normal => "normal",
+            Self::High => "high",
+        }
+    }
+}
+
+/// Which queries are admitted.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+enum Level {
+    /// All queries are admitted
+    Normal = 0,
+    /// Low priority queries are refused
+    ShedLow = 1,
+    /// Only high priority queries are admitted
+    ShedNormal = 2,
+}
+
+impl Level {
+    /// The load from which the server is at this level.
+    fn threshold(&self) -> f64 {
+        match self {
+            Self::Normal => 0.0,
+            Self::ShedLow => SHED_LOW,
+            Self::ShedNormal => 1.0,
+        }
+    }
+
+    fn admits(&self, priority: Priority) -> bool {
+        match self {
+            Self::Normal => true,
+            Self::ShedLow => priority >= Priority::Normal,
+            Self::ShedNormal => priority >= Priority::High,
+        }
+    }
+}
+
+/// A query refused because the server is overloaded.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) struct Overloaded {
+    pub(crate) retry_after: Duration,
+}
+
+#[derive(Debug)]
+pub(crate) struct LoadShedder {
+    config: LoadSheddingConfig,
+    in_flight: Arc<AtomicUsize>,
+    level: Mutex<Level>,
+    level_gauge: U64Gauge,
+    rejected: Metric<U64Counter>,
+}
+
+impl LoadShedder {
+    pub(crate) fn new(config: LoadSheddingConfig, metrics: &metric::Registry) -> Self {
+        let level_gauge = metrics
+            .register_metric::<U64Gauge>(
+                "influxdb3_load_shedding_level",
+                "Priorities of the queries refused: 0 for none, 1 for low, 2 for low and normal",
+            )
+            .recorder(&[]);
+        Self {
+            config,
+            in_flight: Arc::new(AtomicUsize::new(0)),
+            level: Mutex::new(Level::Normal),
+            level_gauge,
+            rejected: metrics.register_metric(
+                "influxdb3_load_shedding_rejected_queries",
+                "Number of queries refused because the server was overloaded, by priority",
+            ),
+        }
+    }
+
+    /// Admit a query of `priority`, which is in flight until the returned
+    /// permit is dropped, or refuse it if the server is overloaded.
+    pub(crate) fn admit(&self, priority: Priority) -> Result<QueryPermit, Overloaded> {
+        let memory = self
+            .config
+            .max_memory_bytes
+            .and_then(|_| resident_memory_bytes());
+        // the query is counted only if the number in flight it was admitted
+        // at has not changed, so that a burst does not exceed the limit
+        let mut in_flight = self.in_flight.load(Ordering::Relaxed);
+        loop {
+            let level = self.update(in_flight, memory);
+            if !level.admits(priority) {
+                self.rejected
+                    .recorder(Attributes::from([(
+                        "priority",
+                        Cow::Borrowed(priority.as_str()),
+                    )]))
+                    .inc(1);
+                return Err(Overloaded {
+                    retry_after: self.config.retry_after,
+                });
+            }
+            match self.in_flight.compare_exchange_weak(
+                in_flight,
+                in_flight + 1,
+                Ordering::Relaxed,
+                Ordering::Relaxed,
+            ) {
+                Ok(_) => return Ok(QueryPermit(Arc::clone(&self.in_flight))),
+                Err(actual) => in_flight = actual,
+            }
+        }
+    }
+
+    /// The load of the server, relative to the limits.
+    fn load(&self, in_flight: usize, memory_bytes: Option<usize>) -> f64 {
+        let ratio = |used: usize, max: usize| used as f64 / max.max(1) as f64;
+        let queries = self
+            .config
+            .max_queries
+            .map_or(0.0, |max| ratio(in_flight, max));
+        let memory = self
+            .config
+            .max_memory_bytes
+            .zip(memory_bytes)
+            .map_or(0.0, |(max, used)| ratio(used, max));
+        queries.max(memory)
+    }
+
+    /// Move to the level of the current load, and return it.
+    fn update(&self, in_flight: usize, memory_bytes: Option<usize>) -> Level {
+        let load = self.load(in_flight, memory_bytes);
+        let mut level = self.level.lock();
+        let next = [Level::ShedNormal, Level::ShedLow, Level::Normal]
+            .into_iter()
+            .find(|l| {
+                // the current level, and those below it, are kept until the
+                // load falls clearly below them
+                let threshold = if *l <= *level {
+                    l.threshold() - HYSTERESIS
+                } else {
+                    l.threshold()
+                };
+                load >= threshold
+            })
+            .unwrap_or(Level::Normal);
+        if next != *level {
+            if next > *level {
+                warn!(load, in_flight, ?memory_bytes, level = ?next, "shedding queries");
+            } else {
+                info!(load, in_flight, ?memory_bytes, level = ?next, "shedding fewer queries");
+            }
+            *level = next;
+            self.level_gauge.set(next as u64);
+        }
+        next
+    }
+}
+
+/// A query in flight.
+#[derive(Debug)]
+pub(crate) struct QueryPermit(Arc<AtomicUsize>);
+
+impl Drop for QueryPermit {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// The resident memory of the process, where the platform reports it.
+#[cfg(target_os = "linux")]
+fn resident_memory_bytes() -> Option<usize> {
+    let status = std::fs::read_to_string("/proc/self/status").ok()?;
+    let kib = status
+        .lines()
+        .find_map(|l| l.strip_prefix("VmRSS:"))?
+        .trim()
+        .strip_suffix("kB")?
+        .trim()
+        .parse::<usize>()
+        .ok()?;
+    Some(kib * 1024)
+}
+
+#[cfg(not(target_os = "linux"))]
+fn resident_memory_bytes() -> Option<usize> {
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn shedder(max_queries: usize) -> LoadShedder {
+        LoadShedder::new(
+            LoadSheddingConfig {
+                max_queries: Some(max_queries),
+                max_memory_bytes: None,
+                retry_after: DEFAULT_RETRY_AFTER,
+            },
+            &metric::Registry::new(),
+        )
+    }
+
+    #[test]
+    fn lowest_priorities_are_shed_first() {
+        let shedder = shedder(10);
+        let permits: Vec<_> = (0..8)
+            .map(|_| shedder.admit(Priority::Normal).unwrap())
+            .collect();
+        assert_eq!(
+            shedder.admit(Priority::Low).unwrap_err(),
+            Overloaded {
+                retry_after: DEFAULT_RETRY_AFTER
+            }
+        );
+        let more: Vec<_> = (0..2)
+            .map(|_| shedder.admit(Priority::Normal).unwrap())
+            .collect();
+        assert!(shedder.admit(Priority::Normal).is_err());
+        let _high = shedder.admit(Priority::High).unwrap();
+
+        drop(more);
+        drop(permits);
+        assert!(shedder.admit(Priority::Low).is_ok());
+        assert_eq!(
+            shedder
+                .rejected
+                .get_observer(&Attributes::from(&[("priority", "low")]))
+                .unwrap()
+                .fetch(),
+            1
+        );
+    }
+
+    #[test]
+    fn burst_does_not_exceed_limit() {
+        let shedder = Arc::new(shedder(10));
+        let threads: Vec<_> = (0..8)
+            .map(|_| {
+                let shedder = Arc::clone(&shedder);
+                std::thread::spawn(move || {
+                    (0..10)
+                        .filter_map(|_| shedder.admit(Priority::Normal).ok())
+                        .collect::<Vec<_>>()
+                })
+            })
+            .collect();
+        let permits: Vec<_> = threads
+            .into_iter()
+            .flat_map(|t| t.join().unwrap())
+            .collect();
+        assert_eq!(permits.len(), 10);
+    }
+
+    #[test]
+    fn hysteresis() {
+        let shedder = shedder(100);
+        assert_eq!(shedder.update(80, None), Level::ShedLow);
+        // not yet clearly below the threshold
+        assert_eq!(shedder.update(75, None), Level::ShedLow);
+        assert_eq!(shedder.update(65, None), Level::Normal);
+        assert_eq!(shedder.update(100, None), Level::ShedNormal);
+        assert_eq!(shedder.update(95, None), Level::ShedNormal);
+        assert_eq!(shedder.update(85, None), Level::ShedLow);
+        assert_eq!(shedder.update(10, None), Level::Normal);
+    }
+
+    #[test]
+    fn memory() {
+        let shedder = LoadShedder::new(
+            LoadSheddingConfig {
+                max_queries: None,
+                max_memory_bytes: Some(1000),
+                retry_after: DEFAULT_RETRY_AFTER,
+            },
+            &metric::Registry::new(),
+        );
+        assert_eq!(shedder.update(1_000_000, Some(500)), Level::Normal);
+        assert_eq!(shedder.update(0, Some(900)), Level::ShedLow);
+        assert_eq!(shedder.update(0, Some(1200)), Level::ShedNormal);
+    }
+}
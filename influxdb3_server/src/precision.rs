@@ -0,0 +1,190 @@
+//! Timestamp precision of written line protocol.
+//!
+//! Timestamps are buffered in nanoseconds. A write may give them in another
+//! precision with the `precision` parameter of `/api/v3/write_lp`, and may
+//! change the precision part way through its body with a directive line:
+//!
+//! ```text
+//! # precision=ms
+//! cpu,host=a usage=0.5 1700000000000
+//! # precision=s
+//! cpu,host=b usage=0.7 1700000000
+//! ```
+//!
+//! A directive applies to the lines that follow it, up to the next
+//! directive, so that devices with clocks of different precision can share a
+//! batch. Lines are rewritten with nanosecond timestamps before they are
+//! buffered. Directives are comments to the line protocol parser, and are
+//! kept so that the lines of the body keep their numbers.
+
+use serde::Deserialize;
+use std::borrow::Cow;
+use std::str::FromStr;
+use thiserror::Error;
+
+/// The prefix of a line that sets the precision of the lines following it.
+const DIRECTIVE: &str = "# precision=";
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("invalid precision '{0}', expected one of 'ns', 'us', 'ms' or 's'")]
+    InvalidPrecision(String),
+
+    #[error("invalid precision directive on line {line_number}: {source}")]
+    InvalidDirective {
+        line_number: usize,
+        #[source]
+        source: Box<Error>,
+    },
+
+    #[error("timestamp on line {line_number} is out of range")]
+    TimestampOutOfRange { line_number: usize },
+}
+
+/// The unit of the timestamps of written lines.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+#[serde(try_from = "String")]
+pub enum Precision {
+    #[default]
+    Nanosecond,
+    Microsecond,
+    Millisecond,
+    Second,
+}
+
+impl Precision {
+    /// The number of nanoseconds in a unit of this precision.
+    fn nanos(self) -> i64 {
+        match self {
+            Self::Nanosecond => 1,
+            Self::Microsecond => 1_000,
+            Self::Millisecond => 1_000_000,
+            Self::Second => 1_000_000_000,
+        }
+    }
+}
+
+impl FromStr for Precision {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "ns" | "n" | "nano" => Ok(Self::Nanosecond),
+            "us" | "u" | "µs" | "micro" => Ok(Self::Microsecond),
+            "ms" | "milli" => Ok(Self::Millisecond),
+            "s" | "second" => Ok(Self::Second),
+            _ => Err(Error::InvalidPrecision(s.to_string())),
+        }
+    }
+}
+
+impl TryFrom<String> for Precision {
+    type Error = Error;
+
+    fn try_from(s: String) -> Result<Self, Self::Error> {
+        s.parse()
+    }
+}
+
+/// Convert the timestamps of `lp`, given in `precision` unless a directive
+/// says otherwise, to nanoseconds.
+///
+/// Line protocol with nanosecond timestamps and no directives is returned
+/// unchanged.
+pub(crate) fn to_nanoseconds(lp: &str, precision: Precision) -> Result<Cow<'_, str>, Error> {
+    if precision == Precision::Nanosecond && !lp.contains(DIRECTIVE) {
+        return Ok(Cow::Borrowed(lp));
+    }
+
+    let mut precision = precision;
+    let mut converted = String::with_capacity(lp.len());
+    for (i, line) in lp.lines().enumerate() {
+        let line_number = i + 1;
+        if let Some(unit) = line.trim().strip_prefix(DIRECTIVE) {
+            precision = unit.trim().parse().map_err(|e| Error::InvalidDirective {
+                line_number,
+                source: Box::new(e),
+            })?;
+            converted.push_str(line);
+            converted.push('\n');
+            continue;
+        }
+        converted.push_str(&convert_line(line, precision, line_number)?);
+        converted.push('\n');
+    }
+    Ok(Cow::Owned(converted))
+}
+
+/// The timestamp of a line is its last element, after the fields.
+fn convert_line(
+    line: &str,
+    precision: Precision,
+    line_number: usize,
+) -> Result<Cow<'_, str>, Error> {
+    let trimmed = line.trim_end();
+    if precision == Precision::Nanosecond || trimmed.trim_start().starts_with('#') {
+        return Ok(Cow::Borrowed(line));
+    }
+    // a line whose last element is not a valid timestamp has none, or is
+    // invalid and left for the parser to reject
+    let Some((rest, timestamp)) = trimmed.rsplit_once([' ', '\t']) else {
+        return Ok(Cow::Borrowed(line));
+    };
+    let Ok(timestamp) = timestamp.parse::<i64>() else {
+        return Ok(Cow::Borrowed(line));
+    };
+    let timestamp = timestamp
+        .checked_mul(precision.nanos())
+        .ok_or(Error::TimestampOutOfRange { line_number })?;
+    Ok(Cow::Owned(format!("{rest} {timestamp}")))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn nanoseconds_are_unchanged() {
+        let lp = "cpu usage=1 123\n";
+        assert!(matches!(
+            to_nanoseconds(lp, Precision::Nanosecond).unwrap(),
+            Cow::Borrowed(_)
+        ));
+    }
+
+    #[test]
+    fn mixed_precision() {
+        let lp = "cpu,host=a usage=1 1700000000000\n\
+                  cpu,host=b usage=2\n\
+                  # precision=s\n\
+                  cpu,host=c usage=3,text=\"a 1\" 1700000000\n\
+                  # a comment 1\n\
+                  # precision=ns\n\
+                  cpu,host=d usage=4 1700000000000000000\n";
+        assert_eq!(
+            to_nanoseconds(lp, Precision::Millisecond).unwrap(),
+            "cpu,host=a usage=1 1700000000000000000\n\
+             cpu,host=b usage=2\n\
+             # precision=s\n\
+             cpu,host=c usage=3,text=\"a 1\" 1700000000000000000\n\
+             # a comment 1\n\
+             # precision=ns\n\
+             cpu,host=d usage=4 1700000000000000000\n"
+        );
+    }
+
+    #[test]
+    fn errors() {
+        assert!(matches!(
+            to_nanoseconds("# precision=h\ncpu usage=1 1", Precision::Nanosecond),
+            Err(Error::InvalidDirective { line_number: 1, .. })
+        ));
+        assert!(matches!(
+            to_nanoseconds(
+                "cpu usage=1 1\ncpu usage=1 9223372036854775",
+                Precision::Second
+            ),
+            Err(Error::TimestampOutOfRange { line_number: 2 })
+        ));
+    }
+}
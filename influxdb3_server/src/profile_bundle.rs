@@ -0,0 +1,133 @@
+//! Packaging of diagnostic data into a single archive for support cases.
+//!
+//! Rather than driving `go tool pprof` and scraping endpoints one at a time
+//! against a struggling server, an operator can request a bundle holding the
+//! profiles, metrics and health of the server captured over the same period.
+
+use flate2::write::GzEncoder;
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::io;
+
+/// The longest period, in seconds, profiles are captured over for a bundle,
+/// so that a request cannot keep the profilers running indefinitely.
+pub(crate) const MAX_SECONDS: u64 = 300;
+
+/// What happened when capturing one of the entries of a bundle.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub(crate) enum Capture {
+    /// The entry was captured and added to the bundle.
+    Captured,
+    /// The entry could not be captured; it is absent from the bundle.
+    Failed(String),
+}
+
+/// A gzipped tar archive of diagnostic files, with a `manifest.json`
+/// recording what was and was not captured.
+pub(crate) struct ProfileBundle {
+    tar: tar::Builder<GzEncoder<Vec<u8>>>,
+    mtime: u64,
+    manifest: BTreeMap<String, Capture>,
+}
+
+impl std::fmt::Debug for ProfileBundle {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ProfileBundle")
+            .field("mtime", &self.mtime)
+            .field("manifest", &self.manifest)
+            .finish_non_exhaustive()
+    }
+}
+
+impl ProfileBundle {
+    /// Create an empty bundle whose files are timestamped with `mtime`, in
+    /// seconds since the epoch.
+    pub(crate) fn new(mtime: u64) -> Self {
+        Self {
+            tar: tar::Builder::new(GzEncoder::new(Vec::new(), flate2::Compression::default())),
+            mtime,
+            manifest: BTreeMap::new(),
+        }
+    }
+
+    /// Add the file `name` to the bundle if it was captured, recording the
+    /// outcome in the manifest either way.
+    pub(crate) fn add<E: std::fmt::Display>(
+        &mut self,
+        name: &str,
+        contents: Result<Vec<u8>, E>,
+    ) -> io::Result<()> {
+        match contents {
+            Ok(contents) => self.add_captured(name, &contents),
+            Err(e) => {
+                self.manifest
+                    .insert(name.to_string(), Capture::Failed(e.to_string()));
+                Ok(())
+            }
+        }
+    }
+
+    /// Add the file `name`, which cannot fail to be captured, to the bundle.
+    pub(crate) fn add_captured(&mut self, name: &str, contents: &[u8]) -> io::Result<()> {
+        self.append(name, contents)?;
+        self.manifest.insert(name.to_string(), Capture::Captured);
+        Ok(())
+    }
+
+    /// Write the manifest and return the compressed archive.
+    pub(crate) fn finish(mut self) -> io::Result<Vec<u8>> {
+        let manifest = serde_json::to_vec_pretty(&self.manifest)?;
+        self.append("manifest.json", &manifest)?;
+        self.tar.into_inner()?.finish()
+    }
+
+    fn append(&mut self, name: &str, contents: &[u8]) -> io::Result<()> {
+        let mut header = tar::Header::new_gnu();
+        header.set_size(contents.len() as u64);
+        header.set_mode(0o644);
+        header.set_mtime(self.mtime);
+        self.tar.append_data(&mut header, name, contents)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use flate2::read::GzDecoder;
+    use std::io::Read;
+
+    #[test]
+    fn bundle_contains_captured_files_and_manifest() {
+        let mut bundle = ProfileBundle::new(1_700_000_000);
+        bundle
+            .add_captured("metrics.txt", b"http_requests 1\n")
+            .unwrap();
+        bundle
+            .add("cpu.pb", Err("pprof support is not compiled"))
+            .unwrap();
+        let archive = bundle.finish().unwrap();
+
+        let mut files = BTreeMap::new();
+        let mut archive = tar::Archive::new(GzDecoder::new(&archive[..]));
+        for entry in archive.entries().unwrap() {
+            let mut entry = entry.unwrap();
+            let name = entry.path().unwrap().to_string_lossy().to_string();
+            let mut contents = String::new();
+            entry.read_to_string(&mut contents).unwrap();
+            files.insert(name, contents);
+        }
+
+        assert_eq!(
+            files.keys().collect::<Vec<_>>(),
+            ["manifest.json", "metrics.txt"]
+        );
+        assert_eq!(files["metrics.txt"], "http_requests 1\n");
+        let manifest: serde_json::Value = serde_json::from_str(&files["manifest.json"]).unwrap();
+        assert_eq!(manifest["metrics.txt"], "captured");
+        assert_eq!(
+            manifest["cpu.pb"]["failed"],
+            "pprof support is not compiled"
+        );
+    }
+}
@@ -0,0 +1,395 @@
+//! Paging of large query results.
+//!
+//! A query made to `/api/v3/query_sql` with `page_size=<rows>` returns only
+//! the first rows of its result. The other rows are kept by the server, and
+//! the response has a [`CURSOR_HEADER`] header with a cursor, with which the
+//! next page is fetched from `/api/v3/query_sql/page?cursor=<cursor>`. The
+//! response to the last page has no cursor.
+//!
+//! Each cursor can be used once, and expires when it is not used within the
+//! configured TTL. The rows kept for all cursors are bounded in size, and are
+//! accounted for as the result is read: a query whose remaining rows do not
+//! fit fails as soon as they no longer do, rather than being paged. A cursor
+//! whose remaining rows do not fit after its page is taken is left as it was,
+//! so that the page can be fetched again.
+
+use arrow::record_batch::RecordBatch;
+use parking_lot::Mutex;
+use std::collections::{HashMap, VecDeque};
+use std::num::NonZeroUsize;
+use std::time::{Duration, Instant};
+use thiserror::Error;
+
+/// The response header with the cursor to the next page of a query result.
+pub const CURSOR_HEADER: &str = "x-influxdb3-cursor";
+
+/// The default total size of the rows kept for query cursors, in bytes.
+pub const DEFAULT_MAX_BYTES: usize = 1024 * 1024 * 1024;
+
+/// The default time a query cursor is kept without being used.
+pub const DEFAULT_TTL: Duration = Duration::from_secs(5 * 60);
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("query cursor '{0}' not found or expired")]
+    NotFound(String),
+
+    #[error(
+        "query result of at least {bytes} bytes does not fit in the {available} bytes left for \
+         query cursors"
+    )]
+    Full { bytes: usize, available: usize },
+}
+
+/// A page of a query result.
+#[derive(Debug)]
+pub(crate) struct Page {
+    pub(crate) batches: Vec<RecordBatch>,
+    /// The cursor to the next page, if there is one
+    pub(crate) cursor: Option<String>,
+}
+
+impl Page {
+    /// The whole of a query result, as a single page.
+    pub(crate) fn all(batches: Vec<RecordBatch>) -> Self {
+        Self {
+            batches,
+            cursor: None,
+        }
+    }
+}
+
+/// The rows of query results kept for the following pages.
+#[derive(Debug)]
+pub(crate) struct QueryCursors {
+    max_bytes: usize,
+    ttl: Duration,
+    state: Mutex<State>,
+}
+
+#[derive(Debug, Default)]
+struct State {
+    cursors: HashMap<String, Cursor>,
+    /// The total size of the rows of `cursors`
+    bytes: usize,
+}
+
+#[derive(Debug)]
+struct Cursor {
+    batches: VecDeque<RecordBatch>,
+    page_size: usize,
+    bytes: usize,
+    expires: Instant,
+}
+
+impl QueryCursors {
+    pub(crate) fn new(max_bytes: usize, ttl: Duration) -> Self {
+        Self {
+            max_bytes,
+            ttl,
+            state: Mutex::new(State::default()),
+        }
+    }
+
+    /// Page a query result of which the batches are then pushed to the
+    /// returned [`Pager`].
+    pub(crate) fn pager(&self, page_size: NonZeroUsize) -> Pager<'_> {
+        Pager {
+            cursors: self,
+            page_size: page_size.get(),
+            page: vec![],
+            page_rows: 0,
+            remaining: VecDeque::new(),
+            reserved: 0,
+        }
+    }
+
+    /// The page of a query result following `cursor`.
+    pub(crate) fn next_page(&self, cursor: &str) -> Result<Page, Error> {
+        let now = Instant::now();
+        let mut state = self.state.lock();
+        expire(&mut state, now);
+        let kept = state
+            .cursors
+            .get(cursor)
+            .ok_or_else(|| Error::NotFound(cursor.to_string()))?;
+
+        let mut remaining = kept.batches.clone();
+        let page = take_rows(&mut remaining, kept.page_size);
+        let page_size = kept.page_size;
+        let kept_bytes = kept.bytes;
+        let bytes = if remaining.iter().all(|b| b.num_rows() == 0) {
+            0
+        } else {
+            size(&remaining)
+        };
+        let available = self.max_bytes.saturating_sub(state.bytes - kept_bytes);
+        if bytes > available {
+            return Err(Error::Full { bytes, available });
+        }
+
+        state.cursors.remove(cursor);
+        state.bytes -= kept_bytes;
+        if bytes == 0 {
+            return Ok(Page::all(page));
+        }
+        state.bytes += bytes;
+        Ok(Page {
+            batches: page,
+            cursor: Some(self.insert(&mut state, remaining, page_size, bytes, now)),
+        })
+    }
+
+    /// Keep the `batches` of a cursor, of which the `bytes` are already
+    /// accounted for, returning the cursor.
+    fn insert(
+        &self,
+        state: &mut State,
+        batches: VecDeque<RecordBatch>,
+        page_size: usize,
+        bytes: usize,
+        now: Instant,
+    ) -> String {
+        let cursor = uuid::Uuid::new_v4().to_string();
+        state.cursors.insert(
+            cursor.clone(),
+            Cursor {
+                batches,
+                page_size,
+                bytes,
+                expires: now + self.ttl,
+            },
+        );
+        cursor
+    }
+}
+
+/// The first page of a query result being read, and the rows kept for the
+/// following pages, which are accounted for as they are pushed.
+#[derive(Debug)]
+pub(crate) struct Pager<'a> {
+    cursors: &'a QueryCursors,
+    page_size: usize,
+    page: Vec<RecordBatch>,
+    page_rows: usize,
+    remaining: VecDeque<RecordBatch>,
+    /// The bytes of `remaining` accounted for in the cursors
+    reserved: usize,
+}
+
+impl Pager<'_> {
+    /// Add the next batch of the result, failing if the rows beyond the first
+    /// page no longer fit.
+    pub(crate) fn push(&mut self, batch: RecordBatch) -> Result<(), Error> {
+        let mut batches = VecDeque::from([batch]);
+        let page = take_rows(&mut batches, self.page_size - self.page_rows);
+        self.page_rows += page.iter().map(|b| b.num_rows()).sum::<usize>();
+        self.page.extend(page);
+        if batches.iter().all(|b| b.num_rows() == 0) {
+            return Ok(());
+        }
+
+        let bytes = size(&batches);
+        let mut state = self.cursors.state.lock();
+        expire(&mut state, Instant::now());
+        let available = self.cursors.max_bytes.saturating_sub(state.bytes);
+        if bytes > available {
+            return Err(Error::Full {
+                bytes: self.reserved + bytes,
+                available: self.reserved + available,
+            });
+        }
+        state.bytes += bytes;
+        self.reserved += bytes;
+        self.remaining.extend(batches);
+        Ok(())
+    }
+
+    /// The first page of the result, with a cursor for the other rows if
+    /// there are any.
+    pub(crate) fn finish(mut self) -> Page {
+        let page = std::mem::take(&mut self.page);
+        if self.remaining.is_empty() {
+            return Page::all(page);
+        }
+
+        let mut state = self.cursors.state.lock();
+        let remaining = std::mem::take(&mut self.remaining);
+        let cursor = self.cursors.insert(
+            &mut state,
+            remaining,
+            self.page_size,
+            self.reserved,
+            Instant::now(),
+        );
+        // the reserved bytes are now those of the cursor
+        self.reserved = 0;
+        Page {
+            batches: page,
+            cursor: Some(cursor),
+        }
+    }
+}
+
+impl Drop for Pager<'_> {
+    fn drop(&mut self) {
+        if self.reserved > 0 {
+            self.cursors.state.lock().bytes -= self.reserved;
+        }
+    }
+}
+
+/// The size of the rows of `batches`.
+fn size(batches: &VecDeque<RecordBatch>) -> usize {
+    batches.iter().map(|b| b.get_array_memory_size()).sum()
+}
+
+/// Remove the cursors that expired before `now`.
+fn expire(state: &mut State, now: Instant) {
+    let mut freed = 0;
+    state.cursors.retain(|_, cursor| {
+        let keep = cursor.expires > now;
+        if !keep {
+            freed += cursor.bytes;
+        }
+        keep
+    });
+    state.bytes -= freed;
+}
+
+/// Remove the first `rows` rows of `batches`.
+fn take_rows(batches: &mut VecDeque<RecordBatch>, mut rows: usize) -> Vec<RecordBatch> {
+    let mut taken = vec![];
+    while rows > 0 {
+        let Some(batch) = batches.pop_front() else {
+            break;
+        };
+        if batch.num_rows() <= rows {
+            rows -= batch.num_rows();
+            taken.push(batch);
+        } else {
+            taken.push(batch.slice(0, rows));
+            batches.push_front(batch.slice(rows, batch.num_rows() - rows));
+            rows = 0;
+        }
+    }
+    taken
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use arrow::array::{ArrayRef, Int64Array};
+
+    fn batch(values: impl IntoIterator<Item = i64>) -> RecordBatch {
+        let array: ArrayRef = std::sync::Arc::new(Int64Array::from_iter_values(values));
+        RecordBatch::try_from_iter([("v", array)]).unwrap()
+    }
+
+    fn values(page: &Page) -> Vec<i64> {
+        page.batches
+            .iter()
+            .flat_map(|b| {
+                b.column(0)
+                    .as_any()
+                    .downcast_ref::<Int64Array>()
+                    .unwrap()
+                    .values()
+                    .to_vec()
+            })
+            .collect()
+    }
+
+    fn first_page(
+        cursors: &QueryCursors,
+        batches: Vec<RecordBatch>,
+        page_size: usize,
+    ) -> Result<Page, Error> {
+        let mut pager = cursors.pager(NonZeroUsize::new(page_size).unwrap());
+        for batch in batches {
+            pager.push(batch)?;
+        }
+        Ok(pager.finish())
+    }
+
+    #[test]
+    fn pages() {
+        let cursors = QueryCursors::new(DEFAULT_MAX_BYTES, DEFAULT_TTL);
+
+        let page = first_page(&cursors, vec![batch(0..2), batch(2..6), batch(6..7)], 3).unwrap();
+        assert_eq!(values(&page), [0, 1, 2]);
+
+        let cursor = page.cursor.unwrap();
+        let page = cursors.next_page(&cursor).unwrap();
+        assert_eq!(values(&page), [3, 4, 5]);
+        // a cursor is used once
+        assert!(matches!(
+            cursors.next_page(&cursor),
+            Err(Error::NotFound(_))
+        ));
+
+        let page = cursors.next_page(&page.cursor.unwrap()).unwrap();
+        assert_eq!(values(&page), [6]);
+        assert!(page.cursor.is_none());
+        assert_eq!(cursors.state.lock().bytes, 0);
+    }
+
+    #[test]
+    fn small_results_have_no_cursor() {
+        let cursors = QueryCursors::new(DEFAULT_MAX_BYTES, DEFAULT_TTL);
+        let page = first_page(&cursors, vec![batch(0..2), batch(2..3)], 3).unwrap();
+        assert_eq!(values(&page), [0, 1, 2]);
+        assert!(page.cursor.is_none());
+        assert_eq!(cursors.state.lock().bytes, 0);
+    }
+
+    #[test]
+    fn limits() {
+        let cursors = QueryCursors::new(0, DEFAULT_TTL);
+        assert!(matches!(
+            first_page(&cursors, vec![batch(0..2)], 1),
+            Err(Error::Full { .. })
+        ));
+
+        let cursors = QueryCursors::new(DEFAULT_MAX_BYTES, Duration::ZERO);
+        let page = first_page(&cursors, vec![batch(0..2)], 1).unwrap();
+        assert!(matches!(
+            cursors.next_page(&page.cursor.unwrap()),
+            Err(Error::NotFound(_))
+        ));
+    }
+
+    #[test]
+    fn result_fails_once_it_does_not_fit() {
+        let bytes = batch(0..4).get_array_memory_size();
+        let cursors = QueryCursors::new(bytes, DEFAULT_TTL);
+        let mut pager = cursors.pager(NonZeroUsize::new(1).unwrap());
+        pager.push(batch(0..1)).unwrap();
+        pager.push(batch(1..5)).unwrap();
+        assert_eq!(cursors.state.lock().bytes, bytes);
+        assert!(matches!(pager.push(batch(5..9)), Err(Error::Full { .. })));
+
+        // the rows read are no longer kept once the query fails
+        drop(pager);
+        assert_eq!(cursors.state.lock().bytes, 0);
+    }
+
+    #[test]
+    fn cursor_is_kept_when_the_rest_does_not_fit() {
+        let bytes = batch(1..5).get_array_memory_size();
+        let cursors = QueryCursors::new(bytes, DEFAULT_TTL);
+        let page = first_page(&cursors, vec![batch(0..1), batch(1..5)], 1).unwrap();
+        let cursor = page.cursor.unwrap();
+
+        // another query fills the space left
+        cursors.state.lock().bytes += 1;
+        assert!(matches!(
+            cursors.next_page(&cursor),
+            Err(Error::Full { .. })
+        ));
+
+        cursors.state.lock().bytes -= 1;
+        let page = cursors.next_page(&cursor).unwrap();
+        assert_eq!(values(&page), [1]);
+    }
+}
@@ -35,6 +35,7 @@ use schema::Schema;
 use std::any::Any;
 use std::collections::HashMap;
 use std::fmt::Debug;
+use std::num::NonZeroUsize;
 use std::sync::Arc;
 use trace::ctx::SpanContext;
 use trace::span::{Span, SpanExt, SpanRecorder};
@@ -50,9 +51,12 @@ pub struct QueryExecutorImpl<W> {
     exec: Arc<Executor>,
     datafusion_config: Arc<HashMap<String, String>>,
     query_execution_semaphore: Arc<InstrumentedAsyncSemaphore>,
+    max_parallelism: NonZeroUsize,
 }
 
 impl<W: WriteBuffer> QueryExecutorImpl<W> {
+    /// Create an executor running at most `concurrent_query_limit` queries at
+    /// once, each in at most `max_parallelism` partitions.
     pub fn new(
         catalog: Arc<Catalog>,
         write_buffer: Arc<W>,
@@ -60,6 +64,7 @@ impl<W: WriteBuffer> QueryExecutorImpl<W> {
         metrics: Arc<Registry>,
         datafusion_config: Arc<HashMap<String, String>>,
         concurrent_query_limit: usize,
+        max_parallelism: NonZeroUsize,
     ) -> Self {
         let semaphore_metrics = Arc::new(AsyncSemaphoreMetrics::new(
             &metrics,
@@ -73,8 +78,20 @@ impl<W: WriteBuffer> QueryExecutorImpl<W> {
             exec,
             datafusion_config,
             query_execution_semaphore,
+            max_parallelism,
         }
     }
+
+    fn query_database(&self, name: &str) -> Option<QueryDatabase<W>> {
+        let db_schema = self.catalog.db_schema(name)?;
+
+        Some(QueryDatabase::new(
+            db_schema,
+            Arc::clone(&self.write_buffer),
+            Arc::clone(&self.exec),
+            Arc::clone(&self.datafusion_config),
+        ))
+    }
 }
 
 #[async_trait]
@@ -83,16 +100,23 @@ impl<W: WriteBuffer> QueryExecutor for QueryExecutorImpl<W> {
         &self,
         database: &str,
         q: &str,
+        parallelism: Option<NonZeroUsize>,
         span_ctx: Option<SpanContext>,
         external_span_ctx: Option<RequestLogContext>,
     ) -> crate::Result<SendableRecordBatchStream> {
         info!("query in executor {}", database);
+        let span_recorder = SpanRecorder::new(span_ctx.child_span("get database"));
         let db = self
-            .db(database, span_ctx.child_span("get database"), false)
-            .await
+            .query_database(database)
             .ok_or_else(|| crate::Error::DatabaseNotFound {
                 db_name: database.to_string(),
             })?;
+        drop(span_recorder);
+
+        let max_parallelism = self.max_parallelism;
+        let db = db.with_target_partitions(
+            parallelism.map_or(max_parallelism, |p| p.min(max_parallelism)),
+        );
 
         let ctx = db.new_query_context(span_ctx);
 
@@ -138,14 +162,9 @@ impl<W: WriteBuffer> QueryNamespaceProvider for QueryExecutorImpl<W> {
     ) -> Option<Arc<dyn QueryNamespace>> {
         let _span_recorder = SpanRecorder::new(span);
 
-        let db_schema = self.catalog.db_schema(name)?;
-
-        Some(Arc::new(QueryDatabase::new(
-            db_schema,
-            Arc::clone(&self.write_buffer) as _,
-            Arc::clone(&self.exec),
-            Arc::clone(&self.datafusion_config),
-        )))
+        self.query_database(name).map(|db| {
+            Arc::new(db.with_target_partitions(self.max_parallelism)) as Arc<dyn QueryNamespace>
+        })
     }
 
     async fn acquire_semaphore(&self, span: Option<Span>) -> InstrumentedAsyncOwnedSemaphorePermit {
@@ -163,6 +182,7 @@ pub struct QueryDatabase<B> {
     exec: Arc<Executor>,
     datafusion_config: Arc<HashMap<String, String>>,
     query_log: Arc<QueryLog>,
+    target_partitions: Option<NonZeroUsize>,
 }
 
 impl<B: WriteBuffer> QueryDatabase<B> {
@@ -185,6 +205,16 @@ impl<B: WriteBuffer> QueryDatabase<B> {
             exec,
             datafusion_config,
             query_log,
+            target_partitions: None,
+        }
+    }
+
+    /// Execute the queries of this database in `target_partitions`
+    /// partitions.
+    pub fn with_target_partitions(self, target_partitions: NonZeroUsize) -> Self {
+        Self {
+            target_partitions: Some(target_partitions),
+            ..self
         }
     }
 }
@@ -240,6 +270,9 @@ impl<B: WriteBuffer> QueryNamespace for QueryDatabase<B> {
         for (k, v) in self.datafusion_config.as_ref() {
             cfg = cfg.with_config_option(k, v);
         }
+        if let Some(target_partitions) = self.target_partitions {
+            cfg = cfg.with_target_partitions(target_partitions);
+        }
 
         cfg.build()
     }
@@ -0,0 +1,106 @@
+//! Read-only mode, in which writes are refused while queries are served.
+//!
+//! For migrations, restores onto a replica, or containing an incident. The
+//! server is started read-only with `--read-only`, and switched at runtime
+//! with `PUT /api/v3/config/read_only`:
+//!
+//! ```json
+//! { "read_only": true, "reason": "restore from backup in progress" }
+//! ```
+//!
+//! While read-only, writes over HTTP are refused with `503 Service
+//! Unavailable` and the reason, lines received over UDP are dropped, and the
+//! server's own metrics are not written to its
+//! [monitoring database](crate::self_monitoring::MONITORING_DATABASE).
+
+use parking_lot::RwLock;
+use serde::{Deserialize, Serialize};
+use std::sync::Arc;
+
+/// The reason reported when read-only mode is enabled without one.
+const DEFAULT_REASON: &str = "the server is in read-only mode";
+
+/// Whether the server is read-only, shared by everything that writes.
+#[derive(Debug, Clone, Default)]
+pub struct ReadOnly(Arc<RwLock<Option<String>>>);
+
+impl ReadOnly {
+    /// The mode the server starts in, read-only if `read_only` is set.
+    pub fn new(read_only: bool) -> Self {
+        let mode = Self::default();
+        if read_only {
+            mode.set(Some("the server was started with --read-only".to_string()));
+        }
+        mode
+    }
+
+    /// Why writes are refused, if the server is read-only.
+    pub fn reason(&self) -> Option<String> {
+        self.0.read().clone()
+    }
+
+    /// Make the server read-only for `reason`, or writable if it is `None`.
+    pub fn set(&self, reason: Option<String>) {
+        *self.0.write() = reason;
+    }
+
+    pub(crate) fn state(&self) -> ReadOnlyState {
+        let reason = self.reason();
+        ReadOnlyState {
+            read_only: reason.is_some(),
+            reason,
+        }
+    }
+
+    pub(crate) fn set_state(&self, state: ReadOnlyState) {
+        self.set(state.read_only.then(|| {
+            state
+                .reason
+                .filter(|r| !r.is_empty())
+                .unwrap_or_else(|| DEFAULT_REASON.to_string())
+        }));
+    }
+}
+
+/// The body of the read-only mode endpoints.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize, Serialize)]
+pub(crate) struct ReadOnlyState {
+    pub(crate) read_only: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub(crate) reason: Option<String>,
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn state() {
+        let mode = ReadOnly::new(false);
+        assert_eq!(
+            mode.state(),
+            ReadOnlyState {
+                read_only: false,
+                reason: None
+            }
+        );
+
+        // clones share the mode
+        let shared = mode.clone();
+        mode.set_state(serde_json::from_str(r#"{"read_only": true}"#).unwrap());
+        assert_eq!(shared.reason().as_deref(), Some(DEFAULT_REASON));
+
+        mode.set_state(ReadOnlyState {
+            read_only: true,
+            reason: Some("restore".to_string()),
+        });
+        assert_eq!(shared.reason().as_deref(), Some("restore"));
+
+        mode.set_state(ReadOnlyState {
+            read_only: false,
+            reason: Some("ignored".to_string()),
+        });
+        assert_eq!(shared.reason(), None);
+        assert!(ReadOnly::new(true).reason().is_some());
+    }
+}
@@ -0,0 +1,300 @@
+//! Lines of a write rejected before it is buffered.
+//!
+//! Each line of a write is checked before any of it is buffered: lines that
+//! are not valid line protocol, or whose timestamps are outside the
+//! configured [`TimeBounds`], are rejected. The write buffer then rejects
+//! lines whose fields or tags have a different type than the columns of the
+//! table they are written to. The whole write then fails, or with
+//! `accept_partial=true` the other lines are written. Without time bounds
+//! or ingest metrics, lines are not checked before they are buffered, and
+//! invalid lines are rejected by the write buffer.
+//!
+//! Either way the response lists the rejected lines, with their line numbers,
+//! a machine-readable code, the reason and the start of the line, as
+//! [`RejectedLines`]. Responses list at most [`MAX_LISTED_LINES`] lines.
+
+use crate::ingest_metrics::WriteCounts;
+use crate::time_bounds::TimeBounds;
+use influxdb3_write::{WriteLineError, WriteLineErrorKind};
+use influxdb_line_protocol::parse_lines;
+use serde::Serialize;
+use std::borrow::Cow;
+use std::fmt;
+
+/// The most rejected lines listed in a response.
+pub const MAX_LISTED_LINES: usize = 100;
+
+/// The most bytes of a rejected line included in a response.
+pub const MAX_SNIPPET_BYTES: usize = 256;
+
+/// Why a line was rejected.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum RejectionCode {
+    InvalidLineProtocol,
+    TimestampTooFarInFuture,
+    TimestampTooFarInPast,
+    ColumnTypeConflict,
+}
+
+impl RejectionCode {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::InvalidLineProtocol => "invalid_line_protocol",
+            Self::TimestampTooFarInFuture => "timestamp_too_far_in_future",
+            Self::TimestampTooFarInPast => "timestamp_too_far_in_past",
+            Self::ColumnTypeConflict => "column_type_conflict",
+        }
+    }
+}
+
+impl fmt::Display for RejectionCode {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// A rejected line of a write.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct RejectedLine {
+    /// The number of the line in the body of the write, from 1
+    pub line_number: usize,
+    pub line: String,
+    pub code: RejectionCode,
+    pub reason: String,
+    /// The timestamp of the line, in nanoseconds, if it could be parsed
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub timestamp: Option<i64>,
+}
+
+/// The rejected lines of a write, as listed in a response.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct RejectedLines {
+    /// The number of rejected lines, including those not listed
+    pub rejected_count: usize,
+    /// The first rejected lines, truncated to [`MAX_SNIPPET_BYTES`]
+    pub rejected_lines: Vec<RejectedLine>,
+}
+
+impl RejectedLines {
+    pub fn new(rejected: &[RejectedLine]) -> Self {
+        Self {
+            rejected_count: rejected.len(),
+            rejected_lines: rejected
+                .iter()
+                .take(MAX_LISTED_LINES)
+                .map(|rejected| RejectedLine {
+                    line: snippet(&rejected.line).to_string(),
+                    ..rejected.clone()
+                })
+                .collect(),
+        }
+    }
+}
+
+impl fmt::Display for RejectedLines {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} lines were rejected", self.rejected_count)?;
+        for rejected in &self.rejected_lines {
+            write!(
+                f,
+                "\nline {}: {}: {}",
+                rejected.line_number, rejected.reason, rejected.line
+            )?;
+        }
+        Ok(())
+    }
+}
+
+/// The start of `line`, cut at a character boundary.
+fn snippet(line: &str) -> &str {
+    if line.len() <= MAX_SNIPPET_BYTES {
+        return line;
+    }
+    let mut end = MAX_SNIPPET_BYTES;
+    while !line.is_char_boundary(end) {
+        end -= 1;
+    }
+    &line[..end]
+}
+
+/// Split the lines of `lp`, with nanosecond timestamps, into those accepted
+/// and those rejected, for a write at time `now`, counting the points of each
+/// measurement as the lines are parsed. Rejected lines are left blank in the
+/// accepted lines, so that the lines keep their numbers.
+pub(crate) fn check<'a>(
+    lp: &'a str,
+    bounds: &TimeBounds,
+    now: i64,
+) -> (Cow<'a, str>, Vec<RejectedLine>, WriteCounts) {
+    let mut accepted = String::new();
+    let mut rejected = vec![];
+    let mut counts = WriteCounts::default();
+    for (i, line) in lp.lines().enumerate() {
+        let rejection = match parse_lines(line).next() {
+            // blank lines and comments
+            None => None,
+            Some(Err(e)) => {
+                counts.dropped(None);
+                Some((RejectionCode::InvalidLineProtocol, e.to_string(), None))
+            }
+            Some(Ok(parsed)) => {
+                let measurement = parsed.series.measurement.as_str();
+                let violation = parsed.timestamp.and_then(|timestamp| {
+                    bounds
+                        .violation(timestamp, now)
+                        .map(|(code, reason)| (code, reason, Some(timestamp)))
+                });
+                match violation {
+                    Some(_) => counts.dropped(Some(measurement)),
+                    None => counts.written(measurement, line.len() + 1),
+                }
+                violation
+            }
+        };
+        match rejection {
+            Some((code, reason, timestamp)) => rejected.push(RejectedLine {
+                line_number: i + 1,
+                line: line.to_string(),
+                code,
+                reason,
+                timestamp,
+            }),
+            None => accepted.push_str(line),
+        }
+        accepted.push('\n');
+    }
+
+    if rejected.is_empty() {
+        (Cow::Borrowed(lp), rejected, counts)
+    } else {
+        (Cow::Owned(accepted), rejected, counts)
+    }
+}
+
+/// The lines of `lp`, a write as checked, that the write buffer found
+/// invalid, reported as they were checked rather than as they were buffered.
+pub(crate) fn buffer_rejections(lp: &str, invalid_lines: &[WriteLineError]) -> Vec<RejectedLine> {
+    let lines: Vec<_> = lp.lines().collect();
+    invalid_lines
+        .iter()
+        .map(|invalid| {
+            let line = lines
+                .get(invalid.line_number - 1)
+                .copied()
+                .unwrap_or(&invalid.original_line);
+            let code = match invalid.kind {
+                WriteLineErrorKind::Parse => RejectionCode::InvalidLineProtocol,
+                WriteLineErrorKind::ColumnTypeConflict => RejectionCode::ColumnTypeConflict,
+            };
+            RejectedLine {
+                line_number: invalid.line_number,
+                line: line.to_string(),
+                code,
+                reason: invalid.error_message.clone(),
+                timestamp: parse_lines(line)
+                    .next()
+                    .and_then(Result::ok)
+                    .and_then(|parsed| parsed.timestamp),
+            }
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    const HOUR: i64 = 3_600_000_000_000;
+
+    #[test]
+    fn valid_lines_are_unchanged() {
+        let lp = "# comment\n\ncpu usage=1 0\n";
+        let (accepted, rejected, _) = check(lp, &TimeBounds::default(), 100 * HOUR);
+        assert!(matches!(accepted, Cow::Borrowed(_)));
+        assert!(rejected.is_empty());
+    }
+
+    #[test]
+    fn lines_are_rejected() {
+        let bounds = TimeBounds {
+            max_future: Some(Duration::from_secs(3600)),
+            max_past: None,
+        };
+        let now = 100 * HOUR;
+        let lp = format!(
+            "cpu,host=a usage=1 {now}\n\
+             cpu,host=b usage=\n\
+             cpu,host=c usage=3 {}\n\
+             cpu,host=d usage=4\n",
+            now + 2 * HOUR,
+        );
+
+        let (accepted, rejected, _) = check(&lp, &bounds, now);
+        assert_eq!(
+            accepted,
+            format!("cpu,host=a usage=1 {now}\n\n\ncpu,host=d usage=4\n")
+        );
+        assert_eq!(
+            rejected
+                .iter()
+                .map(|r| (r.line_number, r.code, r.timestamp))
+                .collect::<Vec<_>>(),
+            [
+                (2, RejectionCode::InvalidLineProtocol, None),
+                (
+                    3,
+                    RejectionCode::TimestampTooFarInFuture,
+                    Some(now + 2 * HOUR)
+                ),
+            ]
+        );
+
+        let json = serde_json::to_value(RejectedLines::new(&rejected)).unwrap();
+        assert_eq!(json["rejected_count"], 2);
+        assert_eq!(
+            json["rejected_lines"][1]["code"],
+            "timestamp_too_far_in_future"
+        );
+        assert!(json["rejected_lines"][0].get("timestamp").is_none());
+    }
+
+    #[test]
+    fn listed_lines_are_capped() {
+        let line = RejectedLine {
+            line_number: 1,
+            line: format!("a{}", "é".repeat(MAX_SNIPPET_BYTES)),
+            code: RejectionCode::InvalidLineProtocol,
+            reason: "invalid".to_string(),
+            timestamp: None,
+        };
+        let listed = RejectedLines::new(&vec![line; MAX_LISTED_LINES + 1]);
+        assert_eq!(listed.rejected_count, MAX_LISTED_LINES + 1);
+        assert_eq!(listed.rejected_lines.len(), MAX_LISTED_LINES);
+        assert_eq!(listed.rejected_lines[0].line.len(), MAX_SNIPPET_BYTES - 1);
+    }
+
+    #[test]
+    fn buffer_rejections_are_reported_as_checked() {
+        let lp = "cpu,host=a usage=1 10\n\ncpu,host=b usage=\"high\" 20\n";
+        let invalid = WriteLineError {
+            // the line as buffered, with a default tag
+            original_line: "cpu,host=b,site=x usage=\"high\" 20".to_string(),
+            line_number: 3,
+            error_message: "column type mismatch".to_string(),
+            kind: WriteLineErrorKind::ColumnTypeConflict,
+        };
+
+        assert_eq!(
+            buffer_rejections(lp, &[invalid]),
+            [RejectedLine {
+                line_number: 3,
+                line: "cpu,host=b usage=\"high\" 20".to_string(),
+                code: RejectionCode::ColumnTypeConflict,
+                reason: "column type mismatch".to_string(),
+                timestamp: Some(20),
+            }]
+        );
+    }
+}
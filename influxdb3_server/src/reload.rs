@@ -0,0 +1,288 @@
+//! Reloading of the settings of a running server without a restart.
+//!
+//! The log filter, request timeouts and health thresholds can be changed by
+//! editing the reload file given with `--config-reload-file` and either sending
+//! the process `SIGHUP` or calling `POST /api/v3/config/reload`. The file holds
+//! one `NAME=VALUE` setting per line, named after the environment variables of
+//! the corresponding flags:
+//!
+//! ```text
+//! # raise the level of the write buffer while investigating slow writes
+//! LOG_FILTER=info,influxdb3_write=debug
+//! INFLUXDB3_HTTP_QUERY_TIMEOUT=30s
+//! ```
+//!
+//! Settings absent from the file revert to the values the server was started
+//! with, so removing a line from the file undoes it on the next reload.
+
+use crate::HttpServerConfig;
+use observability_deps::tracing::{error, info};
+use parking_lot::RwLock;
+use serde_json::json;
+use std::io;
+use std::path::PathBuf;
+use std::sync::Arc;
+use std::time::Duration;
+use thiserror::Error;
+use tokio_util::sync::CancellationToken;
+use trogging::LogFilterHandle;
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("no config reload file is configured, see --config-reload-file")]
+    NoReloadFile,
+
+    #[error("cannot read config reload file {path}: {source}")]
+    Read { path: PathBuf, source: io::Error },
+
+    #[error("line {line}: expected NAME=VALUE")]
+    Syntax { line: usize },
+
+    #[error("line {line}: {name} cannot be reloaded")]
+    UnknownSetting { line: usize, name: String },
+
+    #[error("line {line}: invalid value '{value}' for {name}: {message}")]
+    InvalidSetting {
+        line: usize,
+        name: String,
+        value: String,
+        message: String,
+    },
+
+    #[error("cannot change log filter: {0}")]
+    LogFilter(#[from] trogging::Error),
+}
+
+pub type Result<T, E = Error> = std::result::Result<T, E>;
+
+/// Holds the settings currently in effect and replaces them on reload.
+#[derive(Debug)]
+pub(crate) struct ConfigReloader {
+    path: Option<PathBuf>,
+    startup: HttpServerConfig,
+    log_filter: Option<LogFilterHandle>,
+    startup_log_filter: Option<String>,
+    current: RwLock<Arc<HttpServerConfig>>,
+}
+
+impl ConfigReloader {
+    pub(crate) fn new(startup: HttpServerConfig, log_filter: Option<LogFilterHandle>) -> Self {
+        let startup_log_filter = log_filter.as_ref().and_then(|h| h.current().ok());
+        Self {
+            path: startup.reload_file.clone(),
+            current: RwLock::new(Arc::new(startup.clone())),
+            startup,
+            log_filter,
+            startup_log_filter,
+        }
+    }
+
+    /// The settings currently in effect.
+    pub(crate) fn current(&self) -> Arc<HttpServerConfig> {
+        Arc::clone(&self.current.read())
+    }
+
+    /// Apply the settings of the reload file over the startup settings.
+    ///
+    /// Nothing is changed if the file cannot be read or any of its settings
+    /// is invalid.
+    pub(crate) fn reload(&self) -> Result<Arc<HttpServerConfig>> {
+        let path = self.path.as_ref().ok_or(Error::NoReloadFile)?;
+        let contents = std::fs::read_to_string(path).map_err(|source| Error::Read {
+            path: path.clone(),
+            source,
+        })?;
+        let (config, log_filter) = self.parse(&contents)?;
+
+        let log_filter = log_filter.or_else(|| self.startup_log_filter.clone());
+        if let (Some(handle), Some(filter)) = (&self.log_filter, log_filter) {
+            handle.set(&filter)?;
+        }
+
+        let config = Arc::new(config);
+        *self.current.write() = Arc::clone(&config);
+        info!(path=%path.display(), "reloaded configuration");
+        Ok(config)
+    }
+
+    /// The settings currently in effect, as reported by the reload endpoint.
+    pub(crate) fn describe(&self) -> serde_json::Value {
+        let config = self.current();
+        let duration = |d: Option<Duration>| d.map(|d| humantime::format_duration(d).to_string());
+        json!({
+            "log_filter": self.log_filter.as_ref().and_then(|h| h.current().ok()),
+            "http_request_timeout": duration(config.request_timeout),
+            "http_write_timeout": duration(config.write_timeout),
+            "http_query_timeout": duration(config.query_timeout),
+            "health_write_queue_fail_ratio": config.health.write_queue_fail_ratio,
+            "health_open_segment_max_rows": config.health.max_open_segment_rows,
+        })
+    }
+
+    fn parse(&self, contents: &str) -> Result<(HttpServerConfig, Option<String>)> {
+        let mut config = self.startup.clone();
+        let mut log_filter = None;
+
+        for (i, line) in contents.lines().enumerate() {
+            let line_number = i + 1;
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let (name, value) = line
+                .split_once('=')
+                .ok_or(Error::Syntax { line: line_number })?;
+            let (name, value) = (name.trim(), value.trim());
+            let invalid = |message: String| Error::InvalidSetting {
+                line: line_number,
+                name: name.to_string(),
+                value: value.to_string(),
+                message,
+            };
+            let duration = || {
+                humantime::parse_duration(value)
+                    .map(Some)
+                    .map_err(|e| invalid(e.to_string()))
+            };
+
+            match name {
+                "LOG_FILTER" => log_filter = Some(value.to_string()),
+                "INFLUXDB3_HTTP_REQUEST_TIMEOUT" => config.request_timeout = duration()?,
+                "INFLUXDB3_HTTP_WRITE_TIMEOUT" => config.write_timeout = duration()?,
+                "INFLUXDB3_HTTP_QUERY_TIMEOUT" => config.query_timeout = duration()?,
+                "INFLUXDB3_HEALTH_WRITE_QUEUE_FAIL_RATIO" => {
+                    config.health.write_queue_fail_ratio = value
+                        .parse::<f64>()
+                        .ok()
+                        .filter(|r| (0.0..=1.0).contains(r))
+                        .ok_or_else(|| invalid("expected a number between 0 and 1".to_string()))?
+                }
+                "INFLUXDB3_HEALTH_OPEN_SEGMENT_MAX_ROWS" => {
+                    config.health.max_open_segment_rows =
+                        Some(value.parse().map_err(|e| invalid(format!("{e}")))?)
+                }
+                _ => {
+                    return Err(Error::UnknownSetting {
+                        line: line_number,
+                        name: name.to_string(),
+                    })
+                }
+            }
+        }
+
+        Ok((config, log_filter))
+    }
+}
+
+/// Reload the configuration each time the process receives `SIGHUP`, until
+/// `shutdown` is cancelled.
+#[cfg(unix)]
+pub(crate) async fn reload_on_sighup(reloader: Arc<ConfigReloader>, shutdown: CancellationToken) {
+    use tokio::signal::unix::{signal, SignalKind};
+    let mut hangup = signal(SignalKind::hangup()).expect("failed to register signal handler");
+
+    loop {
+        tokio::select! {
+            _ = hangup.recv() => {
+                info!("Received SIGHUP");
+                if let Err(e) = reloader.reload() {
+                    error!(%e, "failed to reload configuration");
+                }
+            }
+            _ = shutdown.cancelled() => return,
+        }
+    }
+}
+
+#[cfg(not(unix))]
+pub(crate) async fn reload_on_sighup(_reloader: Arc<ConfigReloader>, shutdown: CancellationToken) {
+    shutdown.cancelled().await
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::health::HealthThresholds;
+
+    fn reloader(contents: &str) -> (ConfigReloader, PathBuf) {
+        let path = test_helpers::tmp_dir()
+            .unwrap()
+            .into_path()
+            .join("influxdb3.reload");
+        std::fs::write(&path, contents).unwrap();
+        let startup = HttpServerConfig {
+            request_timeout: Some(Duration::from_secs(60)),
+            reload_file: Some(path.clone()),
+            ..Default::default()
+        };
+        (ConfigReloader::new(startup, None), path)
+    }
+
+    #[test]
+    fn reload_overlays_startup_settings() {
+        let (reloader, file) = reloader(
+            "# tighten queries\n\
+             INFLUXDB3_HTTP_QUERY_TIMEOUT = 30s\n\
+             \n\
+             INFLUXDB3_HEALTH_OPEN_SEGMENT_MAX_ROWS=1000\n",
+        );
+        assert_eq!(reloader.current().query_timeout, None);
+
+        let config = reloader.reload().unwrap();
+        assert_eq!(config.query_timeout, Some(Duration::from_secs(30)));
+        assert_eq!(config.request_timeout, Some(Duration::from_secs(60)));
+        assert_eq!(
+            config.health,
+            HealthThresholds {
+                max_open_segment_rows: Some(1000),
+                ..Default::default()
+            }
+        );
+        assert_eq!(reloader.current().query_timeout, config.query_timeout);
+
+        // removing a setting from the file reverts it on the next reload
+        std::fs::write(&file, "").unwrap();
+        let config = reloader.reload().unwrap();
+        assert_eq!(config.query_timeout, None);
+        assert_eq!(config.health.max_open_segment_rows, None);
+    }
+
+    #[test]
+    fn invalid_file_is_not_applied() {
+        let (reloader, file) = reloader("INFLUXDB3_HTTP_QUERY_TIMEOUT=30s\n");
+        reloader.reload().unwrap();
+
+        for (contents, expected) in [
+            (
+                "INFLUXDB3_HTTP_QUERY_TIMEOUT=1s\nINFLUXDB3_MAX_HTTP_REQUEST_SIZE=10",
+                "line 2: INFLUXDB3_MAX_HTTP_REQUEST_SIZE cannot be reloaded",
+            ),
+            (
+                "INFLUXDB3_HTTP_QUERY_TIMEOUT=soon",
+                "line 1: invalid value 'soon' for INFLUXDB3_HTTP_QUERY_TIMEOUT",
+            ),
+            (
+                "INFLUXDB3_HEALTH_WRITE_QUEUE_FAIL_RATIO=2",
+                "line 1: invalid value '2' for INFLUXDB3_HEALTH_WRITE_QUEUE_FAIL_RATIO",
+            ),
+            (
+                "INFLUXDB3_HTTP_QUERY_TIMEOUT",
+                "line 1: expected NAME=VALUE",
+            ),
+        ] {
+            std::fs::write(&file, contents).unwrap();
+            let err = reloader.reload().unwrap_err().to_string();
+            assert!(err.starts_with(expected), "{err}");
+            assert_eq!(
+                reloader.current().query_timeout,
+                Some(Duration::from_secs(30))
+            );
+        }
+    }
+
+    #[test]
+    fn reload_without_file() {
+        let reloader = ConfigReloader::new(HttpServerConfig::default(), None);
+        assert!(matches!(reloader.reload(), Err(Error::NoReloadFile)));
+    }
+}
@@ -0,0 +1,282 @@
+//! Mirroring of accepted writes to a peer server.
+//!
+//! Two servers that replicate to each other both hold every write, so that
+//! clients can write to either one and read from either one if the other is
+//! lost. Each write accepted through `/api/v3/write_lp` is sent on to the
+//! peer's `/api/v3/write_lp`, marked so that the peer does not send it back.
+//! As a write so marked is not replicated further, the peer only accepts it
+//! when it is authenticated with the token configured for its own peer.
+//!
+//! In [`ReplicationMode::Sync`] the write is only acknowledged once the peer
+//! has accepted it. In [`ReplicationMode::Async`] it is acknowledged at once
+//! and queued for the peer: the queue is retried, in order, for as long as the
+//! peer is unreachable, refuses the replication token or is rate limiting, and
+//! writes arriving while it is full are dropped. Only writes the peer rejects
+//! as invalid are dropped from the queue.
+//!
+//! Lines without a timestamp are given one by each server as it buffers them,
+//! so the two copies of such lines may differ slightly.
+
+use bytes::Bytes;
+use metric::{Metric, U64Counter};
+use observability_deps::tracing::{error, warn};
+use std::str::FromStr;
+use std::time::Duration;
+use thiserror::Error;
+use tokio::sync::mpsc;
+
+pub use influxdb3_client::REPLICATED_HEADER;
+
+/// The longest wait between two attempts to send a queued write.
+const MAX_RETRY_INTERVAL: Duration = Duration::from_secs(10);
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("invalid replication mode '{0}', expected 'sync' or 'async'")]
+    InvalidMode(String),
+
+    #[error("invalid replication peer: {0}")]
+    Peer(#[source] influxdb3_client::Error),
+
+    #[error("the write was applied but could not be replicated: {0}")]
+    Send(#[source] influxdb3_client::Error),
+}
+
+/// When a write is acknowledged, relative to it being accepted by the peer.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ReplicationMode {
+    /// Once the peer has accepted the write
+    Sync,
+    /// Before the write is sent to the peer
+    Async,
+}
+
+impl FromStr for ReplicationMode {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "sync" => Ok(Self::Sync),
+            "async" => Ok(Self::Async),
+            _ => Err(Error::InvalidMode(s.to_string())),
+        }
+    }
+}
+
+/// A write waiting to be sent to the peer.
+#[derive(Debug)]
+struct QueuedWrite {
+    db: String,
+    lp: Bytes,
+}
+
+/// Sends accepted writes to the peer.
+#[derive(Debug)]
+pub struct Replicator {
+    client: influxdb3_client::Client,
+    queue: Option<mpsc::Sender<QueuedWrite>>,
+    writes: Metric<U64Counter>,
+}
+
+impl Replicator {
+    /// Replicate to the server at `peer`, authenticating with `token` if
+    /// given.
+    ///
+    /// In async mode, this spawns the task sending queued writes, which stops
+    /// when the [`Replicator`] is dropped.
+    pub fn new(
+        peer: &str,
+        token: Option<&str>,
+        mode: ReplicationMode,
+        queue_size: usize,
+        metrics: &metric::Registry,
+    ) -> Result<Self, Error> {
+        let mut client = influxdb3_client::Client::new(peer).map_err(Error::Peer)?;
+        if let Some(token) = token {
+            client = client.with_auth_token(token);
+        }
+        let writes = metrics.register_metric::<U64Counter>(
+            "influxdb3_replication_writes",
+            "Number of writes sent to the replication peer, by result",
+        );
+
+        let queue = match mode {
+            ReplicationMode::Sync => None,
+            ReplicationMode::Async => {
+                let (tx, rx) = mpsc::channel(queue_size.max(1));
+                tokio::spawn(send_queued(client.clone(), rx, writes.clone()));
+                Some(tx)
+            }
+        };
+
+        Ok(Self {
+            client,
+            queue,
+            writes,
+        })
+    }
+
+    /// Replicate a write of `lp` to `db` that was accepted by this server.
+    ///
+    /// In sync mode this returns once the peer has accepted the write, or an
+    /// error if it did not. In async mode it returns at once.
+    pub(crate) async fn replicate(&self, db: &str, lp: Bytes) -> Result<(), Error> {
+        let Some(queue) = &self.queue else {
+            let result = send(&self.client, db, lp).await;
+            let outcome = if result.is_ok() { "ok" } else { "error" };
+            self.writes.recorder(&[("result", outcome)]).inc(1);
+            return result.map_err(Error::Send);
+        };
+
+        let write = QueuedWrite {
+            db: db.to_string(),
+            lp,
+        };
+        if let Err(e) = queue.try_send(write) {
+            let write = match e {
+                mpsc::error::TrySendError::Full(w) | mpsc::error::TrySendError::Closed(w) => w,
+            };
+            error!(
+                db = %write.db,
+                bytes = write.lp.len(),
+                "replication queue is full, the write will not be replicated"
+            );
+            self.writes.recorder(&[("result", "dropped")]).inc(1);
+        }
+        Ok(())
+    }
+}
+
+async fn send(
+    client: &influxdb3_client::Client,
+    db: &str,
+    lp: Bytes,
+) -> influxdb3_client::Result<()> {
+    client
+        .api_v3_write_lp(db)
+        .replicated(true)
+        .body(lp)
+        .send()
+        .await
+}
+
+/// Send the queued writes in order, retrying each until the peer accepts it.
+async fn send_queued(
+    client: influxdb3_client::Client,
+    mut queue: mpsc::Receiver<QueuedWrite>,
+    writes: Metric<U64Counter>,
+) {
+    while let Some(write) = queue.recv().await {
+        let mut retry_interval = Duration::from_millis(100);
+        loop {
+            match send(&client, &write.db, write.lp.clone()).await {
+                Ok(()) => {
+                    writes.recorder(&[("result", "ok")]).inc(1);
+                    break;
+                }
+                // a write the peer rejects as invalid will never succeed
+                Err(influxdb3_client::Error::ApiError { code, message })
+                    if is_invalid_write(code.as_u16()) =>
+                {
+                    error!(db = %write.db, %code, %message, "replication peer rejected write");
+                    writes.recorder(&[("result", "rejected")]).inc(1);
+                    break;
+                }
+                // the token is wrong until it is fixed, which needs an
+                // operator, but the write is kept for when it is
+                Err(influxdb3_client::Error::ApiError { code, message })
+                    if matches!(code.as_u16(), 401 | 403) =>
+                {
+                    error!(
+                        db = %write.db,
+                        %code,
+                        %message,
+                        ?retry_interval,
+                        "replication peer refused the replication token, check that it \
+                         matches the peer's --replication-peer-token; retrying"
+                    );
+                    writes.recorder(&[("result", "error")]).inc(1);
+                    tokio::time::sleep(retry_interval).await;
+                    retry_interval = (retry_interval * 2).min(MAX_RETRY_INTERVAL);
+                }
+                Err(e) => {
+                    warn!(
+                        db = %write.db,
+                        %e,
+                        ?retry_interval,
+                        "unable to replicate write, retrying"
+                    );
+                    writes.recorder(&[("result", "error")]).inc(1);
+                    tokio::time::sleep(retry_interval).await;
+                    retry_interval = (retry_interval * 2).min(MAX_RETRY_INTERVAL);
+                }
+            }
+        }
+    }
+}
+
+/// Whether a write the peer, or the upstream server of a gateway, answered
+/// with `status` is invalid, and would be rejected again if it were retried.
+pub(crate) fn is_invalid_write(status: u16) -> bool {
+    // bad line protocol, a body over the peer's size limit, and lines the
+    // peer rejected
+    matches!(status, 400 | 413 | 422)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_mode() {
+        assert_eq!(
+            "sync".parse::<ReplicationMode>().unwrap(),
+            ReplicationMode::Sync
+        );
+        assert_eq!(
+            "async".parse::<ReplicationMode>().unwrap(),
+            ReplicationMode::Async
+        );
+        assert!("both".parse::<ReplicationMode>().is_err());
+    }
+
+    #[test]
+    fn only_invalid_writes_are_dropped() {
+        for status in [400, 413, 422] {
+            assert!(is_invalid_write(status), "{status}");
+        }
+        // authentication, rate limiting and server errors are retried
+        for status in [401, 403, 408, 429, 500, 503] {
+            assert!(!is_invalid_write(status), "{status}");
+        }
+    }
+
+    #[tokio::test]
+    async fn full_queue_drops_writes() {
+        let metrics = metric::Registry::new();
+        // nothing listens on port 1, so the first write is retried while the
+        // second fills the queue
+        let replicator = Replicator::new(
+            "http://127.0.0.1:1",
+            None,
+            ReplicationMode::Async,
+            1,
+            &metrics,
+        )
+        .unwrap();
+        for _ in 0..3 {
+            replicator
+                .replicate("db", Bytes::from("cpu usage=1 1"))
+                .await
+                .unwrap();
+        }
+
+        let dropped = metrics
+            .get_instrument::<Metric<U64Counter>>("influxdb3_replication_writes")
+            .unwrap()
+            .get_observer(&metric::Attributes::from(&[("result", "dropped")]))
+            .map(|o| o.fetch())
+            .unwrap_or_default();
+        assert!(dropped >= 1);
+    }
+}
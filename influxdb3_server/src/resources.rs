@@ -0,0 +1,27 @@
+//! The resources the server detected at startup, and the settings derived
+//! from them, reported on `/debug/resources`.
+//!
+//! In a container, the CPUs and memory available to the server are those of
+//! its cgroup rather than those of the machine, and the defaults of the query
+//! settings are derived from them.
+
+use serde::Serialize;
+
+/// Resources detected at startup, and the settings derived from them.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize)]
+pub struct Resources {
+    /// CPUs available to the process, after any cgroup CPU quota
+    pub cpus: usize,
+    /// Memory of the machine, in bytes
+    pub system_memory_bytes: usize,
+    /// Memory limit of the cgroup of the process, in bytes
+    pub cgroup_memory_limit_bytes: Option<usize>,
+    /// Memory available to the process, in bytes
+    pub available_memory_bytes: usize,
+    /// Number of threads executing queries
+    pub num_query_threads: usize,
+    /// Maximum number of partitions a query is executed in concurrently
+    pub query_max_parallelism: usize,
+    /// Size of the memory pool of query execution, in bytes
+    pub exec_mem_pool_bytes: usize,
+}
@@ -0,0 +1,321 @@
+//! Sampling of the points written to a database.
+//!
+//! For emitters that write more points than are needed and cannot be changed,
+//! rules drop some of the points of a measurement before they are buffered.
+//! Rules are read from a JSON file mapping database names to the list of
+//! rules applied, in order, to each point written to the database:
+//!
+//! ```json
+//! {
+//!   "telegraf": [
+//!     { "keep_one_in": { "measurement": "cpu", "n": 10 } },
+//!     { "min_interval": { "measurement": "mem", "interval": "10s" } }
+//!   ]
+//! }
+//! ```
+//!
+//! - `keep_one_in` keeps the first of every `n` points of the measurement.
+//! - `min_interval` keeps a point of a series of the measurement only if its
+//!   timestamp is at least `interval` after that of the last point of the
+//!   series that was kept.
+//!
+//! A point dropped by a rule is not seen by the rules after it. The points
+//! dropped are counted in the `influxdb3_sampling_dropped_points` metric, by
+//! database and measurement.
+
+use influxdb_line_protocol::{parse_lines, ParsedLine};
+use metric::{Attributes, Metric, U64Counter};
+use parking_lot::Mutex;
+use serde::{Deserialize, Deserializer};
+use std::borrow::Cow;
+use std::collections::HashMap;
+use std::num::NonZeroU64;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+use thiserror::Error;
+
+/// The most series whose last kept point is tracked before those whose
+/// interval has passed are forgotten.
+const MAX_TRACKED_SERIES: usize = 1_000_000;
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("error reading sampling rules file {path}: {source}")]
+    Io {
+        path: PathBuf,
+        source: std::io::Error,
+    },
+
+    #[error("invalid sampling rules file {path}: {source}")]
+    Json {
+        path: PathBuf,
+        source: serde_json::Error,
+    },
+}
+
+/// A rule as written in the rules file.
+#[derive(Debug, Clone, Deserialize)]
+#[serde(rename_all = "snake_case", deny_unknown_fields)]
+enum Rule {
+    KeepOneIn {
+        measurement: String,
+        n: NonZeroU64,
+    },
+    MinInterval {
+        measurement: String,
+        #[serde(deserialize_with = "duration")]
+        interval: Duration,
+    },
+}
+
+fn duration<'de, D: Deserializer<'de>>(deserializer: D) -> Result<Duration, D::Error> {
+    let s = String::deserialize(deserializer)?;
+    humantime::parse_duration(&s).map_err(serde::de::Error::custom)
+}
+
+impl Rule {
+    fn measurement(&self) -> &str {
+        match self {
+            Self::KeepOneIn { measurement, .. } | Self::MinInterval { measurement, .. } => {
+                measurement
+            }
+        }
+    }
+}
+
+/// The sampling rules of each database.
+#[derive(Debug, Clone, Default)]
+pub struct SamplingRules {
+    by_db: HashMap<String, Vec<Rule>>,
+}
+
+impl SamplingRules {
+    /// Load the rules from the JSON file at `path`.
+    pub fn load(path: &Path) -> Result<Self, Error> {
+        let contents = std::fs::read_to_string(path).map_err(|source| Error::Io {
+            path: path.to_path_buf(),
+            source,
+        })?;
+        let by_db = serde_json::from_str(&contents).map_err(|source| Error::Json {
+            path: path.to_path_buf(),
+            source,
+        })?;
+        Ok(Self { by_db })
+    }
+}
+
+/// Applies the [`SamplingRules`], keeping the state of each rule.
+#[derive(Debug)]
+pub(crate) struct Sampler {
+    rules: SamplingRules,
+    dropped: Metric<U64Counter>,
+    state: Mutex<State>,
+}
+
+#[derive(Debug, Default)]
+struct State {
+    /// The points seen by each `keep_one_in` rule, by database and index of
+    /// the rule
+    seen: HashMap<(String, usize), u64>,
+    /// The time from which the next point of a series is kept by a
+    /// `min_interval` rule, by database, index of the rule and series
+    next_kept: HashMap<(String, usize, String), i64>,
+}
+
+impl Sampler {
+    pub(crate) fn new(rules: SamplingRules, metrics: &metric::Registry) -> Self {
+        Self {
+            rules,
+            dropped: metrics.register_metric(
+                "influxdb3_sampling_dropped_points",
+                "Number of points dropped by sampling rules, by database and measurement",
+            ),
+            state: Mutex::new(State::default()),
+        }
+    }
+
+    /// Drop the points of `lp`, written to `db` at `default_time`, that are
+    /// not kept by the rules of `db`.
+    ///
+    /// Lines that do not parse are left for the write buffer to reject.
+    pub(crate) fn apply<'a>(&self, db: &str, lp: &'a str, default_time: i64) -> Cow<'a, str> {
+        let Some(rules) = self.rules.by_db.get(db) else {
+            return Cow::Borrowed(lp);
+        };
+
+        let mut kept = String::with_capacity(lp.len());
+        let mut dropped: HashMap<String, u64> = HashMap::new();
+        let mut state = self.state.lock();
+        for line in lp.lines() {
+            if let Some(Ok(parsed)) = parse_lines(line).next() {
+                let measurement = parsed.series.measurement.as_str();
+                let keep = rules
+                    .iter()
+                    .enumerate()
+                    .filter(|(_, rule)| rule.measurement() == measurement)
+                    .all(|(i, rule)| state.keep(db, i, rule, &parsed, default_time));
+                // a dropped line is left blank, so that the lines after it
+                // keep their numbers
+                if !keep {
+                    *dropped.entry(measurement.to_string()).or_default() += 1;
+                    kept.push('\n');
+                    continue;
+                }
+            }
+            kept.push_str(line);
+            kept.push('\n');
+        }
+
+        if state.next_kept.len() > MAX_TRACKED_SERIES {
+            state.next_kept.retain(|_, next| *next > default_time);
+        }
+        drop(state);
+
+        if dropped.is_empty() {
+            return Cow::Borrowed(lp);
+        }
+        for (measurement, points) in dropped {
+            self.dropped
+                .recorder(Attributes::from([
+                    ("db", Cow::Owned(db.to_string())),
+                    ("measurement", Cow::Owned(measurement)),
+                ]))
+                .inc(points);
+        }
+        Cow::Owned(kept)
+    }
+}
+
+impl State {
+    /// Whether `rule`, the rule at `index` of the rules of `db`, keeps `line`.
+    fn keep(
+        &mut self,
+        db: &str,
+        index: usize,
+        rule: &Rule,
+        line: &ParsedLine<'_>,
+        default_time: i64,
+    ) -> bool {
+        match rule {
+            Rule::KeepOneIn { n, .. } => {
+                let seen = self.seen.entry((db.to_string(), index)).or_default();
+                let keep = *seen % n.get() == 0;
+                *seen += 1;
+                keep
+            }
+            Rule::MinInterval { interval, .. } => {
+                let timestamp = line.timestamp.unwrap_or(default_time);
+                let key = (db.to_string(), index, series_key(line));
+                match self.next_kept.get(&key) {
+                    Some(next) if timestamp < *next => false,
+                    _ => {
+                        let interval = i64::try_from(interval.as_nanos()).unwrap_or(i64::MAX);
+                        self.next_kept
+                            .insert(key, timestamp.saturating_add(interval));
+                        true
+                    }
+                }
+            }
+        }
+    }
+}
+
+/// The measurement and the tags, sorted by key, of `line`.
+fn series_key(line: &ParsedLine<'_>) -> String {
+    let mut tags: Vec<_> = line.series.tag_set.iter().flatten().collect();
+    tags.sort_by(|(a, _), (b, _)| a.as_str().cmp(b.as_str()));
+
+    let mut key = line.series.measurement.to_string();
+    for (k, v) in tags {
+        key.push(',');
+        key.push_str(k.as_str());
+        key.push('=');
+        key.push_str(v.as_str());
+    }
+    key
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const SECOND: i64 = 1_000_000_000;
+
+    fn sampler(json: &str) -> (Sampler, metric::Registry) {
+        let registry = metric::Registry::new();
+        let rules = SamplingRules {
+            by_db: serde_json::from_str(json).unwrap(),
+        };
+        (Sampler::new(rules, &registry), registry)
+    }
+
+    fn dropped(sampler: &Sampler, db: &str, measurement: &str) -> u64 {
+        sampler
+            .dropped
+            .get_observer(&Attributes::from([
+                ("db", Cow::Owned(db.to_string())),
+                ("measurement", Cow::Owned(measurement.to_string())),
+            ]))
+            .map(|c| c.fetch())
+            .unwrap_or_default()
+    }
+
+    #[test]
+    fn keep_one_in() {
+        let (sampler, _registry) =
+            sampler(r#"{"db": [{"keep_one_in": {"measurement": "cpu", "n": 3}}]}"#);
+
+        let lp = "cpu usage=1\ncpu usage=2\nmem free=1\ncpu usage=3\ncpu usage=4\ncpu usage=";
+        assert_eq!(
+            sampler.apply("db", lp, 0),
+            "cpu usage=1\n\nmem free=1\n\ncpu usage=4\ncpu usage=\n"
+        );
+        // the count carries over to the next write
+        assert_eq!(sampler.apply("db", "cpu usage=5\ncpu usage=6", 0), "\n\n");
+        assert_eq!(dropped(&sampler, "db", "cpu"), 4);
+
+        assert!(matches!(sampler.apply("other", lp, 0), Cow::Borrowed(_)));
+    }
+
+    #[test]
+    fn min_interval() {
+        let (sampler, _registry) =
+            sampler(r#"{"db": [{"min_interval": {"measurement": "cpu", "interval": "10s"}}]}"#);
+
+        let lp = format!(
+            "cpu,host=a,region=x usage=1 {}\n\
+             cpu,region=x,host=a usage=2 {}\n\
+             cpu,host=b usage=3 {}\n\
+             cpu,host=a,region=x usage=4 {}\n\
+             cpu,host=b usage=5\n",
+            0,
+            5 * SECOND,
+            5 * SECOND,
+            10 * SECOND,
+        );
+        assert_eq!(
+            sampler.apply("db", &lp, 12 * SECOND),
+            format!(
+                "cpu,host=a,region=x usage=1 0\n\
+                 \n\
+                 cpu,host=b usage=3 {}\n\
+                 cpu,host=a,region=x usage=4 {}\n\
+                 \n",
+                5 * SECOND,
+                10 * SECOND,
+            )
+        );
+        assert_eq!(dropped(&sampler, "db", "cpu"), 2);
+    }
+
+    #[test]
+    fn invalid_rules() {
+        for json in [
+            r#"{"db": [{"keep_one_in": {"measurement": "cpu", "n": 0}}]}"#,
+            r#"{"db": [{"min_interval": {"measurement": "cpu", "interval": "soon"}}]}"#,
+            r#"{"db": [{"keep_latest": {"measurement": "cpu"}}]}"#,
+        ] {
+            assert!(serde_json::from_str::<HashMap<String, Vec<Rule>>>(json).is_err());
+        }
+    }
+}
@@ -0,0 +1,130 @@
+//! Writes of the server's own metrics into one of its databases.
+//!
+//! On each interval, every metric of the registry served on `/metrics` is
+//! written to the [`MONITORING_DATABASE`] database, so that the server can be
+//! observed with queries against itself, without a separate scraper.
+//!
+//! Each metric is written to the table of the same name, with its attributes
+//! as tags. Counters and gauges have a `value` field, durations a `seconds`
+//! field, and histograms `count` and `sum` fields.
+//!
+//! Nothing is written while the server is [read-only](crate::read_only).
+
+use crate::read_only::ReadOnly;
+use data_types::NamespaceName;
+use influxdb3_write::WriteBuffer;
+use influxdb_line_protocol::builder::AfterMeasurement;
+use influxdb_line_protocol::LineProtocolBuilder;
+use iox_time::{SystemProvider, TimeProvider};
+use metric::{Attributes, Observation, RawReporter};
+use observability_deps::tracing::{debug, warn};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio_util::sync::CancellationToken;
+
+/// The database the server's metrics are written to.
+pub const MONITORING_DATABASE: &str = "_monitoring";
+
+/// Write the metrics of `registry` to the [`MONITORING_DATABASE`] database of
+/// `write_buffer` every `interval`, until `shutdown` is cancelled, skipping
+/// the intervals in which the server is `read_only`.
+pub async fn run<W: WriteBuffer>(
+    write_buffer: Arc<W>,
+    registry: Arc<metric::Registry>,
+    interval: Duration,
+    read_only: ReadOnly,
+    shutdown: CancellationToken,
+) {
+    let db = NamespaceName::new(MONITORING_DATABASE).expect("monitoring database name is valid");
+    let time_provider = SystemProvider::new();
+    let mut ticker = tokio::time::interval(interval);
+    ticker.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+    loop {
+        tokio::select! {
+            _ = ticker.tick() => {}
+            _ = shutdown.cancelled() => return,
+        }
+        if read_only.reason().is_some() {
+            continue;
+        }
+
+        let time = time_provider.now().timestamp_nanos();
+        let lp = line_protocol(&registry, time);
+        match write_buffer.write_lp(db.clone(), &lp, time, true).await {
+            Ok(result) => debug!(lines = result.line_count, "wrote self-monitoring metrics"),
+            Err(e) => warn!(%e, "unable to write self-monitoring metrics"),
+        }
+    }
+}
+
+/// The current observations of the metrics of `registry`, as line protocol
+/// with timestamp `time`.
+pub(crate) fn line_protocol(registry: &metric::Registry, time: i64) -> String {
+    let mut reporter = RawReporter::default();
+    registry.report(&mut reporter);
+
+    let mut builder = LineProtocolBuilder::new();
+    for metric in reporter.observations() {
+        for (attributes, observation) in &metric.observations {
+            let line = builder.measurement(metric.metric_name);
+            let line = tags(line, attributes);
+            let line = match observation {
+                Observation::U64Counter(v) | Observation::U64Gauge(v) => line.field("value", *v),
+                Observation::DurationCounter(v) | Observation::DurationGauge(v) => {
+                    line.field("seconds", v.as_secs_f64())
+                }
+                Observation::U64Histogram(h) => {
+                    line.field("count", h.sample_count()).field("sum", h.total)
+                }
+                Observation::DurationHistogram(h) => line
+                    .field("count", h.sample_count())
+                    .field("sum", h.total.as_secs_f64()),
+            };
+            builder = line.timestamp(time).close_line();
+        }
+    }
+    String::from_utf8(builder.build()).expect("line protocol is valid UTF-8")
+}
+
+fn tags(
+    mut line: LineProtocolBuilder<Vec<u8>, AfterMeasurement>,
+    attributes: &Attributes,
+) -> LineProtocolBuilder<Vec<u8>, AfterMeasurement> {
+    for (key, value) in attributes.iter() {
+        // empty tag values are not valid line protocol
+        if !value.is_empty() {
+            line = line.tag(key, value);
+        }
+    }
+    line
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use metric::{DurationHistogram, U64Counter, U64Gauge};
+
+    #[test]
+    fn metrics_as_line_protocol() {
+        let registry = metric::Registry::new();
+        registry
+            .register_metric::<U64Counter>("writes", "writes")
+            .recorder(&[("result", "ok"), ("db", "")])
+            .inc(3);
+        registry
+            .register_metric::<U64Gauge>("buffer_bytes", "bytes")
+            .recorder(&[])
+            .set(42);
+        registry
+            .register_metric::<DurationHistogram>("query_duration", "query time")
+            .recorder(&[])
+            .record(Duration::from_millis(500));
+
+        assert_eq!(
+            line_protocol(&registry, 123),
+            "buffer_bytes value=42u 123\n\
+             query_duration count=1u,sum=0.5 123\n\
+             writes,result=ok value=3u 123\n"
+        );
+    }
+}
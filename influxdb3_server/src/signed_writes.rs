@@ -0,0 +1,290 @@
+//! Writes authenticated by an HMAC signature instead of the bearer token.
+//!
+//! Devices that cannot keep a token from being intercepted, such as
+//! constrained IoT devices, share a secret with the server instead and sign
+//! each write with it, so that the secret never traverses the wire. The
+//! secrets are read from a JSON file mapping the id of each key to its
+//! secret:
+//!
+//! ```json
+//! { "sensor-17": "4c1f0e2a9b...", "sensor-18": "d07e5b13c6..." }
+//! ```
+//!
+//! A signed write to `/api/v3/write_lp` has the header
+//!
+//! ```text
+//! Authorization: HMAC-SHA256 <key id>:<timestamp>:<signature>
+//! ```
+//!
+//! where the timestamp is in seconds since the epoch, and the signature is the
+//! hex encoded HMAC-SHA256, with the secret of the key, of
+//!
+//! ```text
+//! <timestamp>\n<method>\n<path and query>\n<body>
+//! ```
+//!
+//! The body is the line protocol, before any `Content-Encoding` is applied.
+//! A write is refused if its timestamp is further than the maximum skew from
+//! the time of the server, or if a write with the same signature was accepted
+//! in that time, so that a captured write cannot be sent again.
+
+use hmac::{Hmac, Mac};
+use parking_lot::Mutex;
+use serde::Deserialize;
+use sha2::Sha256;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+use thiserror::Error;
+
+/// The scheme of the `Authorization` header of signed writes.
+pub const SCHEME: &str = "HMAC-SHA256";
+
+/// The default of how far the timestamp of a signed write may be from the
+/// time of the server.
+pub const DEFAULT_MAX_SKEW: Duration = Duration::from_secs(300);
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("error reading signing keys file {path}: {source}")]
+    Io {
+        path: PathBuf,
+        source: std::io::Error,
+    },
+
+    #[error("invalid signing keys file {path}: {source}")]
+    Json {
+        path: PathBuf,
+        source: serde_json::Error,
+    },
+}
+
+/// Why a signed write was refused.
+#[derive(Debug, Error, PartialEq, Eq)]
+pub enum SignatureError {
+    #[error("unknown signing key '{0}'")]
+    UnknownKey(String),
+
+    #[error("signature timestamp {0} is too far from the time of the server")]
+    Expired(i64),
+
+    #[error("invalid signature")]
+    Invalid,
+
+    #[error("signature was already used")]
+    Replayed,
+}
+
+/// The secrets writes may be signed with, by key id.
+#[derive(Clone, Default, Deserialize)]
+#[serde(transparent)]
+pub struct SigningKeys(HashMap<String, String>);
+
+impl SigningKeys {
+    /// Load the keys from the JSON file at `path`.
+    pub fn load(path: &Path) -> Result<Self, Error> {
+        let contents = std::fs::read_to_string(path).map_err(|source| Error::Io {
+            path: path.to_path_buf(),
+            source,
+        })?;
+        serde_json::from_str(&contents).map_err(|source| Error::Json {
+            path: path.to_path_buf(),
+            source,
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+}
+
+impl std::fmt::Debug for SigningKeys {
+    // the secrets are not logged
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_set().entries(self.0.keys()).finish()
+    }
+}
+
+/// The signature of a write, from its `Authorization` header.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct Signature {
+    key_id: String,
+    timestamp: i64,
+    signature: Vec<u8>,
+}
+
+impl Signature {
+    /// Parse the credentials following the scheme in the header,
+    /// `<key id>:<timestamp>:<signature>`.
+    pub(crate) fn parse(credentials: &str) -> Option<Self> {
+        // key ids may contain ':', the timestamp and signature may not
+        let mut parts = credentials.rsplitn(3, ':');
+        let signature = hex::decode(parts.next()?).ok()?;
+        let timestamp = parts.next()?.parse().ok()?;
+        let key_id = parts.next().filter(|k| !k.is_empty())?.to_string();
+        Some(Self {
+            key_id,
+            timestamp,
+            signature,
+        })
+    }
+}
+
+/// Verifies the signatures of writes, and remembers those accepted until
+/// their timestamp expires.
+#[derive(Debug)]
+pub(crate) struct SignatureVerifier {
+    keys: SigningKeys,
+    max_skew: u64,
+    seen: Mutex<Seen>,
+}
+
+#[derive(Debug, Default)]
+struct Seen {
+    /// The timestamps of the signatures accepted, by signature
+    signatures: HashMap<Vec<u8>, i64>,
+    /// When the expired signatures were last forgotten
+    pruned_at: i64,
+}
+
+impl SignatureVerifier {
+    pub(crate) fn new(keys: SigningKeys, max_skew: Duration) -> Self {
+        Self {
+            keys,
+            max_skew: max_skew.as_secs(),
+            seen: Default::default(),
+        }
+    }
+
+    /// Whether any key is configured, without which signed writes are not
+    /// accepted.
+    pub(crate) fn is_enabled(&self) -> bool {
+        !self.keys.is_empty()
+    }
+
+    /// Verify the signature of a write, `now` being the time of the server
+    /// in seconds since the epoch.
+    pub(crate) fn verify(
+        &self,
+        signature: &Signature,
+        method: &str,
+        path_and_query: &str,
+        body: &[u8],
+        now: i64,
+    ) -> Result<(), SignatureError> {
+        let secret = self
+            .keys
+            .0
+            .get(&signature.key_id)
+            .ok_or_else(|| SignatureError::UnknownKey(signature.key_id.clone()))?;
+        if now.abs_diff(signature.timestamp) > self.max_skew {
+            return Err(SignatureError::Expired(signature.timestamp));
+        }
+
+        let mut mac = Hmac::<Sha256>::new_from_slice(secret.as_bytes())
+            .expect("HMAC accepts keys of any size");
+        mac.update(format!("{}\n{method}\n{path_and_query}\n", signature.timestamp).as_bytes());
+        mac.update(body);
+        mac.verify_slice(&signature.signature)
+            .map_err(|_| SignatureError::Invalid)?;
+
+        let mut seen = self.seen.lock();
+        if now.abs_diff(seen.pruned_at) > self.max_skew {
+            let max_skew = self.max_skew;
+            seen.signatures
+                .retain(|_, timestamp| now.abs_diff(*timestamp) <= max_skew);
+            seen.pruned_at = now;
+        }
+        if seen
+            .signatures
+            .insert(signature.signature.clone(), signature.timestamp)
+            .is_some()
+        {
+            return Err(SignatureError::Replayed);
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PATH: &str = "/api/v3/write_lp?db=sensors";
+    const BODY: &[u8] = b"temp,room=a value=21.5";
+
+    fn sign(secret: &str, timestamp: i64, path_and_query: &str, body: &[u8]) -> String {
+        let mut mac = Hmac::<Sha256>::new_from_slice(secret.as_bytes()).unwrap();
+        mac.update(format!("{timestamp}\nPOST\n{path_and_query}\n").as_bytes());
+        mac.update(body);
+        hex::encode(mac.finalize().into_bytes())
+    }
+
+    fn verifier() -> SignatureVerifier {
+        let keys = serde_json::from_str(r#"{"sensor:17": "secret"}"#).unwrap();
+        SignatureVerifier::new(keys, Duration::from_secs(60))
+    }
+
+    #[test]
+    fn parse() {
+        assert_eq!(
+            Signature::parse("sensor:17:1700000000:00ff"),
+            Some(Signature {
+                key_id: "sensor:17".to_string(),
+                timestamp: 1_700_000_000,
+                signature: vec![0, 255],
+            })
+        );
+        assert_eq!(Signature::parse(":1700000000:00ff"), None);
+        assert_eq!(Signature::parse("sensor:now:00ff"), None);
+        assert_eq!(Signature::parse("sensor:1700000000:xyz"), None);
+        assert_eq!(Signature::parse("00ff"), None);
+    }
+
+    #[test]
+    fn verify() {
+        let verifier = verifier();
+        let now = 1_700_000_000;
+        let signed = |timestamp, path, body| {
+            let signature = sign("secret", timestamp, path, body);
+            Signature::parse(&format!("sensor:17:{timestamp}:{signature}")).unwrap()
+        };
+
+        let signature = signed(now - 30, PATH, BODY);
+        assert_eq!(verifier.verify(&signature, "POST", PATH, BODY, now), Ok(()));
+        assert_eq!(
+            verifier.verify(&signature, "POST", PATH, BODY, now),
+            Err(SignatureError::Replayed)
+        );
+
+        // the signature covers the database and the body
+        let signature = signed(now, PATH, BODY);
+        assert_eq!(
+            verifier.verify(&signature, "POST", "/api/v3/write_lp?db=other", BODY, now),
+            Err(SignatureError::Invalid)
+        );
+        assert_eq!(
+            verifier.verify(&signature, "POST", PATH, b"temp,room=a value=0", now),
+            Err(SignatureError::Invalid)
+        );
+
+        let signature = signed(now - 61, PATH, BODY);
+        assert_eq!(
+            verifier.verify(&signature, "POST", PATH, BODY, now),
+            Err(SignatureError::Expired(now - 61))
+        );
+
+        let mut signature = signed(now, PATH, BODY);
+        signature.key_id = "sensor:18".to_string();
+        assert_eq!(
+            verifier.verify(&signature, "POST", PATH, BODY, now),
+            Err(SignatureError::UnknownKey("sensor:18".to_string()))
+        );
+    }
+
+    #[test]
+    fn secrets_are_not_logged() {
+        let keys: SigningKeys = serde_json::from_str(r#"{"sensor": "secret"}"#).unwrap();
+        assert_eq!(format!("{keys:?}"), r#"{"sensor"}"#);
+    }
+}
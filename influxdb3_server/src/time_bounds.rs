@@ -0,0 +1,90 @@
+//! Rejection of written points with timestamps too far from the present.
+//!
+//! A client with a wrong clock can write points years in the past or future,
+//! which are rarely meant and spread the data over many partitions. With
+//! [`TimeBounds`] configured, such lines are rejected along with invalid
+//! lines, see [`rejection`](crate::rejection).
+
+use crate::rejection::RejectionCode;
+use std::time::Duration;
+
+/// How far from the time of a write the timestamps of its lines may be.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct TimeBounds {
+    /// How far in the future a timestamp may be
+    pub max_future: Option<Duration>,
+    /// How far in the past a timestamp may be
+    pub max_past: Option<Duration>,
+}
+
+impl TimeBounds {
+    /// Whether no timestamp is outside the bounds.
+    pub(crate) fn is_unbounded(&self) -> bool {
+        self.max_future.is_none() && self.max_past.is_none()
+    }
+
+    /// The code and reason for rejecting a line with nanosecond `timestamp`
+    /// written at time `now`, if it is outside the bounds.
+    pub(crate) fn violation(&self, timestamp: i64, now: i64) -> Option<(RejectionCode, String)> {
+        let nanos = |d: Duration| i64::try_from(d.as_nanos()).unwrap_or(i64::MAX);
+        if let Some(max_future) = self.max_future {
+            if timestamp > now.saturating_add(nanos(max_future)) {
+                return Some((
+                    RejectionCode::TimestampTooFarInFuture,
+                    format!(
+                        "timestamp is more than {} in the future",
+                        humantime::format_duration(max_future)
+                    ),
+                ));
+            }
+        }
+        if let Some(max_past) = self.max_past {
+            if timestamp < now.saturating_sub(nanos(max_past)) {
+                return Some((
+                    RejectionCode::TimestampTooFarInPast,
+                    format!(
+                        "timestamp is more than {} in the past",
+                        humantime::format_duration(max_past)
+                    ),
+                ));
+            }
+        }
+        None
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const HOUR: i64 = 3_600_000_000_000;
+
+    #[test]
+    fn unbounded() {
+        assert_eq!(TimeBounds::default().violation(0, 100 * HOUR), None);
+    }
+
+    #[test]
+    fn timestamps_outside_bounds() {
+        let bounds = TimeBounds {
+            max_future: Some(Duration::from_secs(3600)),
+            max_past: Some(Duration::from_secs(24 * 3600)),
+        };
+        let now = 100 * HOUR;
+        assert_eq!(bounds.violation(now - 23 * HOUR, now), None);
+        assert_eq!(
+            bounds.violation(now + 2 * HOUR, now),
+            Some((
+                RejectionCode::TimestampTooFarInFuture,
+                "timestamp is more than 1h in the future".to_string()
+            ))
+        );
+        assert_eq!(
+            bounds.violation(now - 25 * HOUR, now),
+            Some((
+                RejectionCode::TimestampTooFarInPast,
+                "timestamp is more than 1day in the past".to_string()
+            ))
+        );
+    }
+}
@@ -0,0 +1,263 @@
+//! Line protocol writes received over UDP.
+//!
+//! Compatible with the `[[udp]]` service of InfluxDB 1.x, for emitters that
+//! cannot wait for the response to an HTTP request. Each datagram holds one or
+//! more lines, all written to the configured database. Lines are batched, and
+//! a batch is written once it has `batch_size` lines, or `batch_timeout` after
+//! its first line was received.
+//!
+//! Batches go through the same write path as writes made to
+//! `/api/v3/write_lp` with `accept_partial=true`, so that time bounds, write
+//! rules, default tags, sampling, replication and dead letters apply to them
+//! alike.
+//!
+//! Datagrams are not acknowledged: lines that are invalid, that cannot be
+//! written, or that are received while the server is read-only, are dropped,
+//! logged and counted in the `influxdb3_udp_lines` metric.
+
+use crate::http::{self, HttpApi, LineWrite};
+use crate::precision::Precision;
+use crate::QueryExecutor;
+use data_types::{NamespaceName, NamespaceNameError};
+use influxdb3_write::WriteBuffer;
+use metric::{Metric, U64Counter};
+use observability_deps::tracing::{debug, info, warn};
+use socket2::{Domain, Protocol, Socket, Type};
+use std::net::SocketAddr;
+use std::sync::Arc;
+use std::time::Duration;
+use thiserror::Error;
+use tokio::net::UdpSocket;
+use tokio::time::Instant;
+use tokio_util::sync::CancellationToken;
+
+/// The largest datagram received; larger ones are truncated.
+const MAX_DATAGRAM_BYTES: usize = 64 * 1024;
+
+/// The default number of lines written in a batch.
+pub const DEFAULT_BATCH_SIZE: usize = 5000;
+
+/// The default time after which a batch is written, even if it is not full.
+pub const DEFAULT_BATCH_TIMEOUT: Duration = Duration::from_secs(1);
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("invalid UDP database: {0}")]
+    InvalidDatabase(#[from] NamespaceNameError),
+
+    #[error("cannot bind UDP listener to {addr}: {source}")]
+    Bind {
+        addr: SocketAddr,
+        source: std::io::Error,
+    },
+}
+
+/// Configuration of the UDP listener.
+#[derive(Debug, Clone)]
+pub struct UdpConfig {
+    pub bind_addr: SocketAddr,
+    /// The database the lines are written to
+    pub db: String,
+    /// The precision of the timestamps of the lines
+    pub precision: Precision,
+    /// Size of the receive buffer of the socket, or the system default
+    pub read_buffer_bytes: Option<usize>,
+    pub batch_size: usize,
+    pub batch_timeout: Duration,
+}
+
+/// A bound UDP listener, see [`UdpListener::run`].
+#[derive(Debug)]
+pub struct UdpListener {
+    socket: UdpSocket,
+    db: NamespaceName<'static>,
+    config: UdpConfig,
+}
+
+impl UdpListener {
+    pub fn bind(config: UdpConfig) -> Result<Self, Error> {
+        let db = NamespaceName::new(config.db.clone())?;
+        let addr = config.bind_addr;
+        let bind = || -> std::io::Result<UdpSocket> {
+            let socket = Socket::new(Domain::for_address(addr), Type::DGRAM, Some(Protocol::UDP))?;
+            if let Some(bytes) = config.read_buffer_bytes {
+                socket.set_recv_buffer_size(bytes)?;
+            }
+            socket.set_nonblocking(true)?;
+            socket.bind(&addr.into())?;
+            UdpSocket::from_std(socket.into())
+        };
+        let socket = bind().map_err(|source| Error::Bind { addr, source })?;
+        Ok(Self { socket, db, config })
+    }
+
+    /// The address the listener is bound to.
+    pub fn local_addr(&self) -> std::io::Result<SocketAddr> {
+        self.socket.local_addr()
+    }
+
+    /// Receive lines and write them through `http`, until `shutdown` is
+    /// cancelled.
+    pub(crate) async fn run<W: WriteBuffer, Q: QueryExecutor>(
+        self,
+        http: Arc<HttpApi<W, Q>>,
+        metrics: Arc<metric::Registry>,
+        shutdown: CancellationToken,
+    ) {
+        let lines_metric: Metric<U64Counter> = metrics.register_metric(
+            "influxdb3_udp_lines",
+            "Number of lines received over UDP, by result",
+        );
+        info!(addr = %self.config.bind_addr, db = %self.db, "UDP listener started");
+
+        let mut buf = vec![0; MAX_DATAGRAM_BYTES];
+        let mut batch = Batch::default();
+        loop {
+            let deadline = batch.deadline;
+            let timeout = async move {
+                match deadline {
+                    Some(deadline) => tokio::time::sleep_until(deadline).await,
+                    None => std::future::pending().await,
+                }
+            };
+
+            tokio::select! {
+                _ = shutdown.cancelled() => {
+                    self.write(&http, &lines_metric, batch.take()).await;
+                    return;
+                }
+                _ = timeout => self.write(&http, &lines_metric, batch.take()).await,
+                received = self.socket.recv_from(&mut buf) => {
+                    let n = match received {
+                        Ok((n, _)) => n,
+                        Err(e) => {
+                            warn!(%e, "error receiving UDP datagram");
+                            continue;
+                        }
+                    };
+                    let Ok(lines) = std::str::from_utf8(&buf[..n]) else {
+                        debug!(bytes = n, "dropped UDP datagram that is not UTF-8");
+                        lines_metric.recorder(&[("result", "dropped")]).inc(1);
+                        continue;
+                    };
+                    batch.push(lines, self.config.batch_timeout);
+                    if batch.lines >= self.config.batch_size {
+                        self.write(&http, &lines_metric, batch.take()).await;
+                    }
+                }
+            }
+        }
+    }
+
+    async fn write<W: WriteBuffer, Q: QueryExecutor>(
+        &self,
+        http: &HttpApi<W, Q>,
+        lines_metric: &Metric<U64Counter>,
+        lp: String,
+    ) {
+        if lp.is_empty() {
+            return;
+        }
+        let lines = lp.lines().count() as u64;
+        if let Some(reason) = http.read_only_reason() {
+            debug!(lines, %reason, "dropped lines received over UDP while read-only");
+            lines_metric.recorder(&[("result", "dropped")]).inc(lines);
+            return;
+        }
+
+        let write = LineWrite {
+            db: self.db.to_string(),
+            lp: lp.as_bytes(),
+            precision: self.config.precision,
+            accept_partial: true,
+            replicate: true,
+            idempotency_key: None,
+            json_errors: false,
+            span_ctx: None,
+        };
+        match http.write_lines(write).await {
+            Ok(rejected) => {
+                let dropped = rejected.len() as u64;
+                if dropped > 0 {
+                    debug!(lines = dropped, "dropped invalid lines received over UDP");
+                    lines_metric.recorder(&[("result", "dropped")]).inc(dropped);
+                }
+                lines_metric
+                    .recorder(&[("result", "written")])
+                    .inc(lines - dropped);
+            }
+            // the timestamps of the batch cannot be converted
+            Err(e @ http::Error::Precision(_)) => {
+                warn!(%e, lines, "dropped batch of lines received over UDP");
+                lines_metric.recorder(&[("result", "dropped")]).inc(lines);
+            }
+            Err(e) => {
+                warn!(%e, db = %self.db, "unable to write lines received over UDP");
+                lines_metric.recorder(&[("result", "error")]).inc(lines);
+            }
+        }
+    }
+}
+
+/// The lines received since the last write.
+#[derive(Debug, Default)]
+struct Batch {
+    lp: String,
+    lines: usize,
+    /// When the batch is written if it does not fill up first
+    deadline: Option<Instant>,
+}
+
+impl Batch {
+    fn push(&mut self, lines: &str, timeout: Duration) {
+        for line in lines.lines().filter(|l| !l.trim().is_empty()) {
+            self.lp.push_str(line);
+            self.lp.push('\n');
+            self.lines += 1;
+        }
+        if self.lines > 0 && self.deadline.is_none() {
+            self.deadline = Some(Instant::now() + timeout);
+        }
+    }
+
+    fn take(&mut self) -> String {
+        std::mem::take(self).lp
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn batch() {
+        let mut batch = Batch::default();
+        batch.push("\n", DEFAULT_BATCH_TIMEOUT);
+        assert!(batch.deadline.is_none());
+
+        batch.push("cpu usage=1\n\ncpu usage=2", DEFAULT_BATCH_TIMEOUT);
+        batch.push("cpu usage=3\n", DEFAULT_BATCH_TIMEOUT);
+        assert_eq!(batch.lines, 3);
+        assert!(batch.deadline.is_some());
+
+        assert_eq!(batch.take(), "cpu usage=1\ncpu usage=2\ncpu usage=3\n");
+        assert_eq!(batch.lines, 0);
+        assert!(batch.deadline.is_none());
+    }
+
+    #[test]
+    fn invalid_database() {
+        let config = UdpConfig {
+            bind_addr: "127.0.0.1:0".parse().unwrap(),
+            db: String::new(),
+            precision: Precision::Nanosecond,
+            read_buffer_bytes: None,
+            batch_size: DEFAULT_BATCH_SIZE,
+            batch_timeout: DEFAULT_BATCH_TIMEOUT,
+        };
+        assert!(matches!(
+            UdpListener::bind(config),
+            Err(Error::InvalidDatabase(_))
+        ));
+    }
+}
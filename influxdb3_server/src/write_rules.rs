@@ -0,0 +1,418 @@
+//! Transformations applied to the lines written to a database.
+//!
+//! Rules are read from a JSON file mapping database names to the list of
+//! rules applied, in order, to each line written to the database:
+//!
+//! ```json
+//! {
+//!   "sensors": [
+//!     { "rename_tag": { "from": "loc", "to": "location" } },
+//!     { "drop_field": "debug" },
+//!     { "scale_field": { "field": "temp", "multiply": 0.5556, "add": -17.78 } },
+//!     { "extract_tag": { "field": "message", "pattern": "device=(\\w+)", "tag": "device" } }
+//!   ]
+//! }
+//! ```
+//!
+//! - `rename_tag` renames a tag, replacing any tag of the new name.
+//! - `drop_field` removes a field. A line left without fields is dropped.
+//! - `scale_field` multiplies a numeric field and adds to it, writing the
+//!   result as a float.
+//! - `extract_tag` matches `pattern` against a string field, and sets `tag`
+//!   to its first capture group, or to the whole match if it has none. Lines
+//!   that do not match are left as they are.
+//!
+//! Writes replicated from the peer were transformed by it, and are buffered as
+//! they are.
+
+use influxdb_line_protocol::builder::{AfterField, AfterMeasurement};
+use influxdb_line_protocol::{
+    parse_lines, split_lines, FieldValue, LineProtocolBuilder, ParsedLine,
+};
+use regex::Regex;
+use serde::Deserialize;
+use std::borrow::Cow;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("error reading write rules file {path}: {source}")]
+    Io {
+        path: PathBuf,
+        source: std::io::Error,
+    },
+
+    #[error("invalid write rules file {path}: {source}")]
+    Json {
+        path: PathBuf,
+        source: serde_json::Error,
+    },
+
+    #[error("invalid pattern for database '{db}': {source}")]
+    Pattern { db: String, source: regex::Error },
+}
+
+/// A rule as written in the rules file.
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "snake_case", deny_unknown_fields)]
+enum RuleSpec {
+    RenameTag {
+        from: String,
+        to: String,
+    },
+    DropField(String),
+    ScaleField {
+        field: String,
+        #[serde(default = "one")]
+        multiply: f64,
+        #[serde(default)]
+        add: f64,
+    },
+    ExtractTag {
+        field: String,
+        pattern: String,
+        tag: String,
+    },
+}
+
+fn one() -> f64 {
+    1.0
+}
+
+/// A transformation of a line.
+#[derive(Debug, Clone)]
+enum Rule {
+    RenameTag {
+        from: String,
+        to: String,
+    },
+    DropField(String),
+    ScaleField {
+        field: String,
+        multiply: f64,
+        add: f64,
+    },
+    ExtractTag {
+        field: String,
+        pattern: Regex,
+        tag: String,
+    },
+}
+
+/// The write rules of each database.
+#[derive(Debug, Clone, Default)]
+pub struct WriteRules {
+    by_db: HashMap<String, Vec<Rule>>,
+}
+
+impl WriteRules {
+    /// Load the rules from the JSON file at `path`.
+    pub fn load(path: &Path) -> Result<Self, Error> {
+        let contents = std::fs::read_to_string(path).map_err(|source| Error::Io {
+            path: path.to_path_buf(),
+            source,
+        })?;
+        let specs = serde_json::from_str(&contents).map_err(|source| Error::Json {
+            path: path.to_path_buf(),
+            source,
+        })?;
+        Self::compile(specs)
+    }
+
+    fn compile(specs: HashMap<String, Vec<RuleSpec>>) -> Result<Self, Error> {
+        let mut by_db = HashMap::with_capacity(specs.len());
+        for (db, specs) in specs {
+            let rules = specs
+                .into_iter()
+                .map(|spec| {
+                    Ok(match spec {
+                        RuleSpec::RenameTag { from, to } => Rule::RenameTag { from, to },
+                        RuleSpec::DropField(field) => Rule::DropField(field),
+                        RuleSpec::ScaleField {
+                            field,
+                            multiply,
+                            add,
+                        } => Rule::ScaleField {
+                            field,
+                            multiply,
+                            add,
+                        },
+                        RuleSpec::ExtractTag {
+                            field,
+                            pattern,
+                            tag,
+                        } => Rule::ExtractTag {
+                            field,
+                            pattern: Regex::new(&pattern).map_err(|source| Error::Pattern {
+                                db: db.clone(),
+                                source,
+                            })?,
+                            tag,
+                        },
+                    })
+                })
+                .collect::<Result<_, Error>>()?;
+            by_db.insert(db, rules);
+        }
+        Ok(Self { by_db })
+    }
+
+    /// Apply the rules of `db` to the lines of `lp`.
+    ///
+    /// Lines that do not parse are left unchanged, for the write buffer to
+    /// reject.
+    pub(crate) fn apply<'a>(&self, db: &str, lp: &'a str) -> Cow<'a, str> {
+        let Some(rules) = self.by_db.get(db) else {
+            return Cow::Borrowed(lp);
+        };
+
+        let mut transformed = String::with_capacity(lp.len());
+        for original in split_lines(lp) {
+            let parsed = match parse_lines(original).next() {
+                // blank lines and comments, and invalid lines, which are left
+                // to be rejected by the write buffer
+                None | Some(Err(_)) => {
+                    push_line(&mut transformed, original, original);
+                    continue;
+                }
+                Some(Ok(parsed)) => parsed,
+            };
+            let mut line = Line::from(&parsed);
+            for rule in rules {
+                line.apply(rule);
+            }
+            let built = line.build(LineProtocolBuilder::new()).build();
+            let built = String::from_utf8(built).expect("line protocol is valid UTF-8");
+            push_line(&mut transformed, original, &built);
+        }
+        Cow::Owned(transformed)
+    }
+}
+
+/// Append `line`, transformed from the `original` line of a write, to `lp`,
+/// followed by blank lines for any it no longer spans, so that the lines after
+/// it keep their numbers.
+pub(crate) fn push_line(lp: &mut String, original: &str, line: &str) {
+    let line = line.strip_suffix('\n').unwrap_or(line);
+    lp.push_str(line);
+    let newlines = original.matches('\n').count() + 1;
+    for _ in line.matches('\n').count()..newlines {
+        lp.push('\n');
+    }
+}
+
+/// A line being transformed.
+#[derive(Debug)]
+struct Line {
+    measurement: String,
+    tags: Vec<(String, String)>,
+    fields: Vec<(String, Value)>,
+    timestamp: Option<i64>,
+}
+
+/// A field value, which can be written to a [`LineProtocolBuilder`].
+#[derive(Debug, Clone)]
+pub(crate) enum Value {
+    I64(i64),
+    U64(u64),
+    F64(f64),
+    String(String),
+    Boolean(bool),
+}
+
+impl From<&ParsedLine<'_>> for Line {
+    fn from(line: &ParsedLine<'_>) -> Self {
+        Self {
+            measurement: line.series.measurement.to_string(),
+            tags: line
+                .series
+                .tag_set
+                .iter()
+                .flatten()
+                .map(|(k, v)| (k.to_string(), v.to_string()))
+                .collect(),
+            fields: line
+                .field_set
+                .iter()
+                .map(|(k, v)| (k.to_string(), Value::from(v)))
+                .collect(),
+            timestamp: line.timestamp,
+        }
+    }
+}
+
+impl Line {
+    fn field(&self, name: &str) -> Option<&Value> {
+        self.fields.iter().find(|(k, _)| k == name).map(|(_, v)| v)
+    }
+
+    fn set_tag(&mut self, key: &str, value: String) {
+        match self.tags.iter_mut().find(|(k, _)| k == key) {
+            Some((_, v)) => *v = value,
+            None => self.tags.push((key.to_string(), value)),
+        }
+    }
+
+    fn apply(&mut self, rule: &Rule) {
+        match rule {
+            Rule::RenameTag { from, to } => {
+                if let Some(i) = self.tags.iter().position(|(k, _)| k == from) {
+                    let (_, value) = self.tags.remove(i);
+                    self.set_tag(to, value);
+                }
+            }
+            Rule::DropField(field) => self.fields.retain(|(k, _)| k != field),
+            Rule::ScaleField {
+                field,
+                multiply,
+                add,
+            } => {
+                for (_, value) in self.fields.iter_mut().filter(|(k, _)| k == field) {
+                    let v = match value {
+                        Value::I64(v) => *v as f64,
+                        Value::U64(v) => *v as f64,
+                        Value::F64(v) => *v,
+                        Value::String(_) | Value::Boolean(_) => continue,
+                    };
+                    *value = Value::F64(v * multiply + add);
+                }
+            }
+            Rule::ExtractTag {
+                field,
+                pattern,
+                tag,
+            } => {
+                let Some(Value::String(s)) = self.field(field) else {
+                    return;
+                };
+                let Some(captures) = pattern.captures(s) else {
+                    return;
+                };
+                let value = captures
+                    .get(1)
+                    .or_else(|| captures.get(0))
+                    .map(|m| m.as_str().to_string())
+                    .filter(|v| !v.is_empty());
+                if let Some(value) = value {
+                    self.set_tag(tag, value);
+                }
+            }
+        }
+    }
+
+    /// Append the line to `builder`, unless it has no fields left.
+    fn build(self, builder: LineProtocolBuilder<Vec<u8>>) -> LineProtocolBuilder<Vec<u8>> {
+        let mut fields = self.fields.iter();
+        let Some((key, value)) = fields.next() else {
+            return builder;
+        };
+
+        let mut line = builder.measurement(&self.measurement);
+        for (key, value) in &self.tags {
+            line = line.tag(key, value);
+        }
+        let mut line = value.first(line, key);
+        for (key, value) in fields {
+            line = value.next(line, key);
+        }
+        match self.timestamp {
+            Some(timestamp) => line.timestamp(timestamp).close_line(),
+            None => line.close_line(),
+        }
+    }
+}
+
+impl From<&FieldValue<'_>> for Value {
+    fn from(value: &FieldValue<'_>) -> Self {
+        match value {
+            FieldValue::I64(v) => Self::I64(*v),
+            FieldValue::U64(v) => Self::U64(*v),
+            FieldValue::F64(v) => Self::F64(*v),
+            FieldValue::String(v) => Self::String(v.to_string()),
+            FieldValue::Boolean(v) => Self::Boolean(*v),
+        }
+    }
+}
+
+impl Value {
+    /// Write the value as the first field of a line.
+    pub(crate) fn first(
+        &self,
+        line: LineProtocolBuilder<Vec<u8>, AfterMeasurement>,
+        name: &str,
+    ) -> LineProtocolBuilder<Vec<u8>, AfterField> {
+        match self {
+            Self::I64(v) => line.field(name, *v),
+            Self::U64(v) => line.field(name, *v),
+            Self::F64(v) => line.field(name, *v),
+            Self::String(v) => line.field(name, v.as_str()),
+            Self::Boolean(v) => line.field(name, *v),
+        }
+    }
+
+    /// Write the value as a field following others.
+    pub(crate) fn next(
+        &self,
+        line: LineProtocolBuilder<Vec<u8>, AfterField>,
+        name: &str,
+    ) -> LineProtocolBuilder<Vec<u8>, AfterField> {
+        match self {
+            Self::I64(v) => line.field(name, *v),
+            Self::U64(v) => line.field(name, *v),
+            Self::F64(v) => line.field(name, *v),
+            Self::String(v) => line.field(name, v.as_str()),
+            Self::Boolean(v) => line.field(name, *v),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const RULES: &str = r#"{
+        "sensors": [
+            { "rename_tag": { "from": "loc", "to": "location" } },
+            { "drop_field": "debug" },
+            { "scale_field": { "field": "temp", "multiply": 2, "add": 1 } },
+            { "extract_tag": { "field": "message", "pattern": "device=(\\w+)", "tag": "device" } }
+        ]
+    }"#;
+
+    fn parse(json: &str) -> Result<WriteRules, Error> {
+        WriteRules::compile(serde_json::from_str(json).map_err(|source| Error::Json {
+            path: PathBuf::from("rules.json"),
+            source,
+        })?)
+    }
+
+    #[test]
+    fn rules_are_applied_in_order() {
+        let rules = parse(RULES).unwrap();
+        let lp = "env,loc=a,location=b temp=20i,debug=true,message=\"device=x1 ok\" 1\n\
+                  env,loc=c debug=true 2\n\
+                  env message=\"no device\" 3";
+        assert_eq!(
+            rules.apply("sensors", lp),
+            "env,location=a,device=x1 temp=41,message=\"device=x1 ok\" 1\n\
+             \n\
+             env message=\"no device\" 3\n",
+            "a dropped line is left blank, so the lines keep their numbers"
+        );
+        assert!(matches!(rules.apply("other", lp), Cow::Borrowed(_)));
+    }
+
+    #[test]
+    fn invalid_rules() {
+        assert!(matches!(
+            parse(r#"{"db": [{"drop_tag": "a"}]}"#),
+            Err(Error::Json { .. })
+        ));
+        assert!(matches!(
+            parse(r#"{"db": [{"extract_tag": {"field": "a", "pattern": "(", "tag": "b"}}]}"#),
+            Err(Error::Pattern { .. })
+        ));
+    }
+}
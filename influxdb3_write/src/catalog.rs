@@ -239,6 +239,12 @@ impl TableDefinition {
         self.columns.contains_key(column)
     }
 
+    pub(crate) fn column_type(&self, column: &str) -> Option<ColumnType> {
+        self.columns
+            .get(column)
+            .map(|column_type| ColumnType::try_from(*column_type).unwrap())
+    }
+
     pub(crate) fn add_columns(&mut self, mut columns: Vec<(String, i16)>) {
         let mut schema_builder = SchemaBuilder::with_capacity(columns.len());
         columns.sort_by(|(a, _), (b, _)| a.cmp(b));
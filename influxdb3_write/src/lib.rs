@@ -78,11 +78,16 @@ pub trait Bufferer: Debug + Send + Sync + 'static {
     /// and returns the result with any lines that had errors and summary statistics. This writes into the currently
     /// open segment or it will open one. The open segment id and the memory usage of the currently open segment are
     /// returned.
+    ///
+    /// Lines that cannot be parsed or that conflict with the schema are returned as the invalid lines of the
+    /// result if `accept_partial` is set, and the other lines are written. Otherwise nothing is written and the
+    /// invalid lines are returned as a [`write_buffer::Error::InvalidLines`] error.
     async fn write_lp(
         &self,
         database: NamespaceName<'static>,
         lp: &str,
         default_time: i64,
+        accept_partial: bool,
     ) -> write_buffer::Result<BufferedWriteRequest>;
 
     /// Closes the open segment and returns it so that it can be persisted or thrown away. A new segment will be opened
@@ -100,6 +105,25 @@ pub trait Bufferer: Debug + Send + Sync + 'static {
 
     /// Returns the configured WAL, if there is one.
     fn wal(&self) -> Option<Arc<impl Wal>>;
+
+    /// Returns a summary of the state of the buffer, used to report on its health.
+    fn status(&self) -> BufferStatus;
+
+    /// Returns the catalog of the databases and tables written to the buffer.
+    fn catalog(&self) -> Arc<Catalog>;
+}
+
+/// A point in time summary of the state of a [`Bufferer`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct BufferStatus {
+    /// The id of the segment currently receiving writes.
+    pub open_segment_id: SegmentId,
+    /// The number of rows buffered in the open segment.
+    pub open_segment_rows: usize,
+    /// The number of validated writes waiting to be flushed to the WAL.
+    pub queued_writes: usize,
+    /// The number of writes that can be queued before writers are made to wait.
+    pub queue_capacity: usize,
 }
 
 /// A segment in the buffer that corresponds to a single WAL segment file. It contains a catalog with any updates
@@ -214,6 +238,11 @@ pub trait Wal: Debug + Send + Sync + 'static {
 
     /// Deletes the WAL segment file from disk.
     fn delete_wal_segment(&self, segment_id: SegmentId) -> wal::Result<()>;
+
+    /// What the recovery pass run when the WAL was opened found, if it ran.
+    fn recovery_report(&self) -> Option<&wal::RecoveryReport> {
+        None
+    }
 }
 
 #[derive(Debug)]
@@ -267,11 +296,23 @@ pub struct LpWriteOp {
 
 /// A single write request can have many lines in it. A writer can request to accept all lines that are valid, while
 /// returning an error for any invalid lines. This is the error information for a single invalid line.
-#[derive(Debug, Serialize)]
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
 pub struct WriteLineError {
     pub original_line: String,
+    /// The number of the line in the line protocol of the write, from 1, counting blank lines and comments
     pub line_number: usize,
     pub error_message: String,
+    pub kind: WriteLineErrorKind,
+}
+
+/// Why a line of a write is invalid.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum WriteLineErrorKind {
+    /// The line is not valid line protocol.
+    Parse,
+    /// A tag or field of the line has a different type than the column of the same name in the table.
+    ColumnTypeConflict,
 }
 
 /// A write that has been validated against the catalog schema, written to the WAL (if configured), and buffered in
@@ -11,13 +11,14 @@ use byteorder::{BigEndian, ReadBytesExt, WriteBytesExt};
 use crc32fast::Hasher;
 use datafusion::parquet::file::reader::Length;
 use observability_deps::tracing::{info, warn};
+use serde::Serialize;
 use snap::read::FrameDecoder;
 use std::fmt::Debug;
 use std::{
     fs::{File, OpenOptions},
     io::{self, BufReader, Cursor, Read, Write},
     mem,
-    path::PathBuf,
+    path::{Path, PathBuf},
 };
 use thiserror::Error;
 
@@ -25,6 +26,13 @@ use thiserror::Error;
 type FileTypeIdentifier = [u8; 8];
 const FILE_TYPE_IDENTIFIER: &[u8] = b"idb3.001";
 
+/// The start of the file type identifier of segment files of every version.
+const FILE_TYPE_PREFIX: &[u8] = b"idb3.";
+
+/// The directory, under the WAL directory, that damaged segment files are
+/// moved or copied to by the startup recovery pass.
+pub const QUARANTINE_DIR: &str = "quarantine";
+
 #[derive(Debug, Error)]
 pub enum Error {
     #[error("io error: {source}")]
@@ -71,6 +79,19 @@ pub enum Error {
         actual: u32,
     },
 
+    #[error(
+        "segment file {path:?} has format version {found:?}, but this version of influxdb3 \
+         supports only {supported:?}; it was likely written by a newer version of influxdb3. \
+         Upgrade back to the version of influxdb3 that wrote the WAL, or move the \
+         segment files out of the WAL directory to start with an empty WAL, losing the \
+         writes in them that were not persisted"
+    )]
+    UnsupportedSegmentVersion {
+        path: PathBuf,
+        found: String,
+        supported: String,
+    },
+
     #[error("invalid segment file name {0:?}")]
     InvalidSegmentFileName(String),
 
@@ -86,9 +107,54 @@ pub type Result<T, E = Error> = std::result::Result<T, E>;
 #[derive(Debug)]
 pub struct WalImpl {
     root: PathBuf,
+    recovery: RecoveryReport,
+}
+
+/// What the startup recovery pass found in the WAL directory.
+#[derive(Debug, Default, Clone, Serialize)]
+pub struct RecoveryReport {
+    /// Number of segment files that were checked
+    pub segments_checked: usize,
+    /// Segments that were truncated to their last intact batch
+    pub repaired: Vec<DamagedSegment>,
+    /// Segments that were unreadable and moved out of the WAL directory
+    pub quarantined: Vec<DamagedSegment>,
+}
+
+impl RecoveryReport {
+    /// Whether no damaged segment was found.
+    pub fn is_clean(&self) -> bool {
+        self.repaired.is_empty() && self.quarantined.is_empty()
+    }
+}
+
+/// A segment file that the recovery pass found to be damaged.
+#[derive(Debug, Clone, Serialize)]
+pub struct DamagedSegment {
+    pub segment_id: SegmentId,
+    /// Where the original file was kept, in the quarantine directory
+    pub quarantine_path: PathBuf,
+    /// Number of intact batches at the start of the file, which were kept
+    pub intact_batches: usize,
+    /// Number of bytes of the file that were dropped
+    pub discarded_bytes: u64,
+    /// Why the file could not be read past its intact batches
+    pub reason: String,
 }
 
 impl WalImpl {
+    /// Open the WAL in the directory at `path`, creating it if needed.
+    ///
+    /// Existing segment files are checked first. A file whose tail is torn or
+    /// corrupt, such as after a crash while it was written, is truncated to
+    /// its last intact batch, and a file whose header is unreadable is set
+    /// aside, so that the server can start. Originals are kept in the
+    /// [`QUARANTINE_DIR`] and the findings are available from
+    /// [`Wal::recovery_report`].
+    ///
+    /// Segment files in a format version other than that of this binary, such
+    /// as those written by a newer version, are not touched: the WAL fails to
+    /// open with [`Error::UnsupportedSegmentVersion`] instead.
     pub fn new(path: impl Into<PathBuf>) -> Result<Self> {
         let root = path.into();
         info!(wal_dir=?root, "Ensuring WAL directory exists");
@@ -101,7 +167,87 @@ impl WalImpl {
             .sync_all()
             .expect("fsync failure");
 
-        Ok(Self { root })
+        let mut wal = Self {
+            root,
+            recovery: RecoveryReport::default(),
+        };
+        wal.recovery = wal.recover()?;
+        Ok(wal)
+    }
+
+    fn recover(&self) -> Result<RecoveryReport> {
+        let mut report = RecoveryReport::default();
+
+        let files = self.segment_files()?;
+        for file in &files {
+            check_segment_version(&file.path)?;
+        }
+
+        for file in files {
+            report.segments_checked += 1;
+            let scan = match WalSegmentReaderImpl::new(self.root.clone(), file.segment_id) {
+                Ok(reader) => reader.scan(),
+                Err(e) => SegmentScan {
+                    intact_len: 0,
+                    intact_batches: 0,
+                    error: Some(e),
+                },
+            };
+            let file_len = file.path.metadata()?.len();
+            let reason = match scan.error {
+                Some(e) => e.to_string(),
+                None if file_len > scan.intact_len => format!(
+                    "{} trailing bytes after the last batch",
+                    file_len - scan.intact_len
+                ),
+                None => continue,
+            };
+
+            let quarantine_dir = self.root.join(QUARANTINE_DIR);
+            std::fs::create_dir_all(&quarantine_dir)?;
+            // the header is intact, so keep the batches before the damage
+            let truncate = scan.intact_len > 0;
+            let quarantine_path = quarantine(&file.path, &quarantine_dir, truncate)?;
+            let damaged = DamagedSegment {
+                segment_id: file.segment_id,
+                quarantine_path: quarantine_path.clone(),
+                intact_batches: scan.intact_batches,
+                discarded_bytes: file_len - scan.intact_len,
+                reason,
+            };
+
+            if truncate {
+                let f = OpenOptions::new().write(true).open(&file.path)?;
+                f.set_len(scan.intact_len)?;
+                f.sync_all()?;
+                warn!(
+                    segment_id = ?file.segment_id,
+                    intact_batches = damaged.intact_batches,
+                    discarded_bytes = damaged.discarded_bytes,
+                    reason = %damaged.reason,
+                    quarantine_path = ?quarantine_path,
+                    "Truncated damaged wal segment file to its last intact batch"
+                );
+                report.repaired.push(damaged);
+            } else {
+                std::fs::remove_file(&file.path)?;
+                warn!(
+                    segment_id = ?file.segment_id,
+                    reason = %damaged.reason,
+                    quarantine_path = ?quarantine_path,
+                    "Quarantined unreadable wal segment file"
+                );
+                report.quarantined.push(damaged);
+            }
+        }
+
+        if report.is_clean() {
+            info!(
+                segments_checked = report.segments_checked,
+                "WAL recovery found no damaged segment files"
+            );
+        }
+        Ok(report)
     }
 
     fn open_segment_writer(&self, segment_id: SegmentId) -> Result<Box<dyn WalSegmentWriter>> {
@@ -181,6 +327,10 @@ impl Wal for WalImpl {
     fn delete_wal_segment(&self, _segment_id: SegmentId) -> Result<()> {
         self.delete_wal_segment(_segment_id)
     }
+
+    fn recovery_report(&self) -> Option<&RecoveryReport> {
+        Some(&self.recovery)
+    }
 }
 
 #[derive(Debug)]
@@ -377,6 +527,19 @@ impl WalSegmentWriter for WalSegmentWriterNoopImpl {
 pub struct WalSegmentReaderImpl {
     f: BufReader<File>,
     segment_id: SegmentId,
+    /// Number of bytes of the file read by successful reads
+    bytes_read: u64,
+}
+
+/// The result of reading a whole segment file.
+#[derive(Debug)]
+struct SegmentScan {
+    /// Length of the part of the file that could be read
+    intact_len: u64,
+    /// Number of batches in the part of the file that could be read
+    intact_batches: usize,
+    /// Why the rest of the file could not be read, if it could not
+    error: Option<Error>,
 }
 
 impl WalSegmentReaderImpl {
@@ -384,7 +547,11 @@ impl WalSegmentReaderImpl {
         let path = SegmentWalFilePath::new(root, segment_id);
         let f = BufReader::new(File::open(path.clone())?);
 
-        let mut reader = Self { f, segment_id };
+        let mut reader = Self {
+            f,
+            segment_id,
+            bytes_read: 0,
+        };
 
         let (file_type, id) = reader.read_header()?;
 
@@ -429,6 +596,7 @@ impl WalSegmentReaderImpl {
         let mut reader = Self {
             f: BufReader::new(f),
             segment_id,
+            bytes_read: 0,
         };
 
         let (file_type, _id) = reader.read_header()?;
@@ -458,7 +626,36 @@ impl WalSegmentReaderImpl {
                 bytes_written,
             }))
         } else {
-            Ok(None)
+            // a segment that was opened but never written to
+            Ok(Some(ExistingSegmentFileInfo {
+                last_sequence_number: SequenceNumber::new(0),
+                bytes_written,
+            }))
+        }
+    }
+
+    /// Read the rest of the file, to find how much of it is intact.
+    fn scan(mut self) -> SegmentScan {
+        let mut intact_batches = 0;
+        loop {
+            let intact_len = self.bytes_read;
+            match self.next_batch() {
+                Ok(Some(_)) => intact_batches += 1,
+                Ok(None) => {
+                    return SegmentScan {
+                        intact_len,
+                        intact_batches,
+                        error: None,
+                    }
+                }
+                Err(e) => {
+                    return SegmentScan {
+                        intact_len,
+                        intact_batches,
+                        error: Some(e),
+                    }
+                }
+            }
         }
     }
 
@@ -507,12 +704,14 @@ impl WalSegmentReaderImpl {
             });
         }
 
+        self.bytes_read += (2 * mem::size_of::<u32>()) as u64 + u64::from(expected_len);
         Ok(Some(data))
     }
 
     fn read_array<const N: usize>(&mut self) -> Result<[u8; N]> {
         let mut data = [0u8; N];
         self.f.read_exact(&mut data)?;
+        self.bytes_read += N as u64;
         Ok(data)
     }
 
@@ -521,6 +720,69 @@ impl WalSegmentReaderImpl {
     }
 }
 
+/// Keep the damaged segment file at `path` in `dir`, as a copy if `copy` or
+/// else as a hard link to be left once the file is removed from the WAL
+/// directory, returning the path it is kept at.
+///
+/// Segment ids are reused once their files are deleted, so a segment may be
+/// damaged again with the same name. The name is suffixed with the time and,
+/// if needed, a counter, and an existing file is never replaced.
+fn quarantine(path: &Path, dir: &Path, copy: bool) -> Result<PathBuf> {
+    let file_name = path.file_name().expect("segment files have a name");
+    let time = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or_default();
+    for n in 0.. {
+        let mut name = file_name.to_os_string();
+        name.push(format!(".{time}"));
+        if n > 0 {
+            name.push(format!(".{n}"));
+        }
+        let quarantine_path = dir.join(name);
+        let kept = if copy {
+            OpenOptions::new()
+                .write(true)
+                .create_new(true)
+                .open(&quarantine_path)
+                .and_then(|mut to| {
+                    io::copy(&mut File::open(path)?, &mut to)?;
+                    to.sync_all()
+                })
+        } else {
+            std::fs::hard_link(path, &quarantine_path)
+        };
+        match kept {
+            Ok(()) => return Ok(quarantine_path),
+            Err(e) if e.kind() == io::ErrorKind::AlreadyExists => continue,
+            Err(e) => return Err(e.into()),
+        }
+    }
+    unreachable!("a free quarantine path is found")
+}
+
+/// Check that the segment file at `path`, if it has the identifier of a
+/// segment file, is in the format version of this binary. Files that are not
+/// recognised are left to the recovery pass.
+fn check_segment_version(path: &Path) -> Result<()> {
+    let mut file_type = FileTypeIdentifier::default();
+    let mut f = File::open(path)?;
+    match f.read_exact(&mut file_type) {
+        Ok(()) => {}
+        Err(e) if e.kind() == io::ErrorKind::UnexpectedEof => return Ok(()),
+        Err(e) => return Err(e.into()),
+    }
+
+    if file_type.starts_with(FILE_TYPE_PREFIX) && file_type != FILE_TYPE_IDENTIFIER {
+        return Err(Error::UnsupportedSegmentVersion {
+            path: path.to_path_buf(),
+            found: String::from_utf8_lossy(&file_type).into_owned(),
+            supported: String::from_utf8_lossy(FILE_TYPE_IDENTIFIER).into_owned(),
+        });
+    }
+    Ok(())
+}
+
 struct ExistingSegmentFileInfo {
     last_sequence_number: SequenceNumber,
     bytes_written: u32,
@@ -701,4 +963,121 @@ mod tests {
         assert_eq!(batch.ops, vec![wal_op.clone()]);
         assert_eq!(batch.sequence_number, SequenceNumber::new(1));
     }
+
+    #[test]
+    fn wal_recovery_truncates_torn_segment() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let wal_op = WalOp::LpWrite(LpWriteOp {
+            db_name: "foo".to_string(),
+            lp: "cpu host=a val=10i 10".to_string(),
+            default_time: 1,
+        });
+
+        {
+            let mut writer =
+                WalSegmentWriterImpl::new_or_open(dir.clone(), SegmentId::new(0)).unwrap();
+            writer.write_batch(vec![wal_op.clone()]).unwrap();
+            writer.write_batch(vec![wal_op.clone()]).unwrap();
+        }
+        // a batch that was only partly written when the process died
+        let path = SegmentWalFilePath::new(dir.clone(), SegmentId::new(0));
+        let intact_len = path.metadata().unwrap().len();
+        let mut f = OpenOptions::new().append(true).open(&path).unwrap();
+        f.write_all(&[0, 0, 0, 1, 0, 0, 0, 100, 1, 2, 3]).unwrap();
+
+        let wal = WalImpl::new(dir.clone()).unwrap();
+        let report = wal.recovery_report().unwrap();
+        assert_eq!(report.segments_checked, 1);
+        assert_eq!(report.repaired.len(), 1);
+        assert_eq!(report.repaired[0].intact_batches, 2);
+        assert_eq!(report.repaired[0].discarded_bytes, 11);
+        assert!(report.repaired[0].quarantine_path.exists());
+        assert_eq!(path.metadata().unwrap().len(), intact_len);
+
+        // writes continue after the intact batches
+        let mut writer = wal.open_segment_writer(SegmentId::new(0)).unwrap();
+        assert_eq!(
+            writer.write_batch(vec![wal_op]).unwrap(),
+            SequenceNumber::new(3)
+        );
+        let mut reader = wal.open_segment_reader(SegmentId::new(0)).unwrap();
+        let mut batches = 0;
+        while reader.next_batch().unwrap().is_some() {
+            batches += 1;
+        }
+        assert_eq!(batches, 3);
+    }
+
+    #[test]
+    fn wal_recovery_quarantines_unreadable_segment() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let path = SegmentWalFilePath::new(dir.clone(), SegmentId::new(4));
+        std::fs::write(&path, b"not a wal file").unwrap();
+
+        let wal = WalImpl::new(dir.clone()).unwrap();
+        let report = wal.recovery_report().unwrap();
+        assert_eq!(report.quarantined.len(), 1);
+        assert_eq!(report.quarantined[0].segment_id, SegmentId::new(4));
+        assert!(!path.exists());
+        let quarantine_path = &report.quarantined[0].quarantine_path;
+        assert_eq!(quarantine_path.parent(), Some(&*dir.join(QUARANTINE_DIR)));
+        assert!(quarantine_path
+            .file_name()
+            .unwrap()
+            .to_string_lossy()
+            .starts_with("0000000004.wal."));
+        assert_eq!(std::fs::read(quarantine_path).unwrap(), b"not a wal file");
+        assert!(wal.segment_files().unwrap().is_empty());
+    }
+
+    #[test]
+    fn wal_recovery_keeps_earlier_quarantined_copies() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let path = SegmentWalFilePath::new(dir.clone(), SegmentId::new(4));
+
+        let mut quarantine_paths = vec![];
+        for contents in [&b"first"[..], b"second", b"third"] {
+            std::fs::write(&path, contents).unwrap();
+            let wal = WalImpl::new(dir.clone()).unwrap();
+            let report = wal.recovery_report().unwrap();
+            quarantine_paths.push(report.quarantined[0].quarantine_path.clone());
+        }
+
+        let contents: Vec<_> = quarantine_paths
+            .iter()
+            .map(|path| std::fs::read(path).unwrap())
+            .collect();
+        assert_eq!(contents, [&b"first"[..], b"second", b"third"]);
+    }
+
+    #[test]
+    fn wal_refuses_segments_of_other_versions() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        let path = SegmentWalFilePath::new(dir.clone(), SegmentId::new(2));
+        std::fs::write(&path, b"idb3.002\0\0\0\0").unwrap();
+
+        let err = WalImpl::new(dir.clone()).unwrap_err();
+        assert!(matches!(
+            err,
+            Error::UnsupportedSegmentVersion { ref found, .. } if found == "idb3.002"
+        ));
+        // the segment is not quarantined
+        assert!(path.exists());
+        assert!(!dir.join(QUARANTINE_DIR).exists());
+    }
+
+    #[test]
+    fn wal_recovery_leaves_intact_segments() {
+        let dir = test_helpers::tmp_dir().unwrap().into_path();
+        {
+            WalSegmentWriterImpl::new_or_open(dir.clone(), SegmentId::new(0)).unwrap();
+        }
+
+        let wal = WalImpl::new(dir).unwrap();
+        let report = wal.recovery_report().unwrap();
+        assert_eq!(report.segments_checked, 1);
+        assert!(report.is_clean());
+        // a segment with no batches can be opened again
+        wal.open_segment_writer(SegmentId::new(0)).unwrap();
+    }
 }
@@ -53,6 +53,12 @@ impl OpenBufferSegment {
     pub fn segment_id(&self) -> SegmentId {
         self.segment_id
     }
+
+    /// The number of rows buffered in the segment.
+    pub fn segment_size(&self) -> usize {
+        self.segment_size
+    }
+
     pub fn write_batch(&mut self, write_batch: Vec<WalOp>) -> wal::Result<SequenceNumber> {
         self.segment_writer.write_batch(write_batch)
     }
@@ -644,7 +650,7 @@ mod tests {
         let mut write_batch = WriteBatch::default();
         let (seq, db) = catalog.db_or_create(db_name);
         let partitioner = Partitioner::new_per_day_partitioner();
-        let result = parse_validate_and_update_schema(lp, &db, &partitioner, 0).unwrap();
+        let result = parse_validate_and_update_schema(lp, &db, &partitioner, 0, false).unwrap();
         if let Some(db) = result.schema {
             catalog.replace_database(seq, Arc::new(db)).unwrap();
         }
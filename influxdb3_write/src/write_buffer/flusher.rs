@@ -102,6 +102,17 @@ impl WriteBufferFlusher {
             BufferedWriteResult::Error(e) => Err(Error::BufferSegmentError(e)),
         }
     }
+
+    /// The number of writes waiting to be flushed to the wal.
+    pub fn queued_writes(&self) -> usize {
+        BUFFER_CHANNEL_LIMIT - self.buffer_tx.capacity()
+    }
+
+    /// The maximum number of writes that can wait to be flushed before writers
+    /// are made to wait.
+    pub fn queue_capacity(&self) -> usize {
+        BUFFER_CHANNEL_LIMIT
+    }
 }
 
 async fn run_wal_op_buffer(
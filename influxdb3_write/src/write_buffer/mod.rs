@@ -8,8 +8,8 @@ use crate::wal::WalSegmentWriterNoopImpl;
 use crate::write_buffer::buffer_segment::{ClosedBufferSegment, OpenBufferSegment, TableBuffer};
 use crate::write_buffer::flusher::WriteBufferFlusher;
 use crate::{
-    BufferSegment, BufferedWriteRequest, Bufferer, ChunkContainer, LpWriteOp, SegmentId, Wal,
-    WalOp, WriteBuffer,
+    BufferSegment, BufferStatus, BufferedWriteRequest, Bufferer, ChunkContainer, LpWriteOp,
+    SegmentId, Wal, WalOp, WriteBuffer, WriteLineError, WriteLineErrorKind,
 };
 use arrow::record_batch::RecordBatch;
 use async_trait::async_trait;
@@ -21,7 +21,7 @@ use data_types::{
 use datafusion::common::{DataFusionError, Statistics};
 use datafusion::execution::context::SessionState;
 use datafusion::logical_expr::Expr;
-use influxdb_line_protocol::{parse_lines, FieldValue, ParsedLine};
+use influxdb_line_protocol::{parse_lines, split_lines, FieldValue, ParsedLine};
 use iox_query::chunk_statistics::create_chunk_statistics;
 use iox_query::{QueryChunk, QueryChunkData};
 use observability_deps::tracing::{debug, info};
@@ -36,9 +36,6 @@ use thiserror::Error;
 
 #[derive(Debug, Error)]
 pub enum Error {
-    #[error("error parsing line {line_number}: {message}")]
-    ParseError { line_number: usize, message: String },
-
     #[error("column type mismatch for column {name}: existing: {existing:?}, new: {new:?}")]
     ColumnTypeMismatch {
         name: String,
@@ -54,6 +51,9 @@ pub enum Error {
 
     #[error("error from buffer segment: {0}")]
     BufferSegmentError(String),
+
+    #[error("{} lines of the write are invalid, the first on line {}: {}", .0.len(), .0[0].line_number, .0[0].error_message)]
+    InvalidLines(Vec<WriteLineError>),
 }
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
@@ -121,14 +121,22 @@ impl<W: Wal> WriteBufferImpl<W> {
         db_name: NamespaceName<'static>,
         lp: &str,
         default_time: i64,
+        accept_partial: bool,
     ) -> Result<BufferedWriteRequest> {
         debug!("write_lp to {} in writebuffer", db_name);
 
-        let result = self.parse_validate_and_update_schema(db_name.clone(), lp, default_time)?;
+        let mut result = self.parse_validate_and_update_schema(
+            db_name.clone(),
+            lp,
+            default_time,
+            accept_partial,
+        )?;
 
+        // the invalid lines are left out of the WAL, which holds only the
+        // lines buffered
         let wal_op = WalOp::LpWrite(LpWriteOp {
             db_name: db_name.to_string(),
-            lp: lp.to_string(),
+            lp: result.valid_lp.take().unwrap_or_else(|| lp.to_string()),
             default_time,
         });
 
@@ -139,7 +147,7 @@ impl<W: Wal> WriteBufferImpl<W> {
 
         Ok(BufferedWriteRequest {
             db_name,
-            invalid_lines: vec![],
+            invalid_lines: result.invalid_lines,
             line_count: result.line_count,
             field_count: result.field_count,
             tag_count: result.tag_count,
@@ -154,6 +162,7 @@ impl<W: Wal> WriteBufferImpl<W> {
         db_name: NamespaceName<'static>,
         lp: &str,
         default_time: i64,
+        accept_partial: bool,
     ) -> Result<ValidationResult> {
         let (sequence, db) = self.catalog.db_or_create(db_name.as_str());
         let mut result = parse_validate_and_update_schema(
@@ -161,6 +170,7 @@ impl<W: Wal> WriteBufferImpl<W> {
             &db,
             &Partitioner::new_per_day_partitioner(),
             default_time,
+            accept_partial,
         )?;
 
         if let Some(schema) = result.schema.take() {
@@ -253,8 +263,10 @@ impl<W: Wal> Bufferer for WriteBufferImpl<W> {
         database: NamespaceName<'static>,
         lp: &str,
         default_time: i64,
+        accept_partial: bool,
     ) -> Result<BufferedWriteRequest> {
-        self.write_lp(database, lp, default_time).await
+        self.write_lp(database, lp, default_time, accept_partial)
+            .await
     }
 
     async fn close_open_segment(&self) -> crate::Result<Arc<dyn BufferSegment>> {
@@ -272,6 +284,20 @@ impl<W: Wal> Bufferer for WriteBufferImpl<W> {
     fn wal(&self) -> Option<Arc<impl Wal>> {
         self.wal.clone()
     }
+
+    fn status(&self) -> BufferStatus {
+        let state = self.segment_state.read();
+        BufferStatus {
+            open_segment_id: state.open_segment.segment_id(),
+            open_segment_rows: state.open_segment.segment_size(),
+            queued_writes: self.write_buffer_flusher.queued_writes(),
+            queue_capacity: self.write_buffer_flusher.queue_capacity(),
+        }
+    }
+
+    fn catalog(&self) -> Arc<Catalog> {
+        Arc::clone(&self.catalog)
+    }
 }
 
 impl<W: Wal> ChunkContainer for WriteBufferImpl<W> {
@@ -352,56 +378,101 @@ impl QueryChunk for BufferChunk {
 const YEAR_MONTH_DAY_TIME_FORMAT: &str = "%Y-%m-%d";
 
 /// Takes &str of line protocol, parses lines, validates the schema, and inserts new columns
-/// and partitions if present. Assigns the default time to any lines that do not include a time
+/// and partitions if present. Assigns the default time to any lines that do not include a time.
+///
+/// Lines that cannot be parsed or that conflict with the schema are returned as the invalid lines
+/// of the result if `accept_partial` is set, or as an [`Error::InvalidLines`] error otherwise.
 pub(crate) fn parse_validate_and_update_schema(
     lp: &str,
     schema: &DatabaseSchema,
     partitioner: &Partitioner,
     default_time: i64,
+    accept_partial: bool,
 ) -> Result<ValidationResult> {
     let mut lines = vec![];
-    for (line_idx, maybe_line) in parse_lines(lp).enumerate() {
-        let line = maybe_line.map_err(|e| Error::ParseError {
-            line_number: line_idx + 1,
-            message: e.to_string(),
-        })?;
-        lines.push(line);
+    let mut invalid_lines = vec![];
+    // lines are split as by the parser, but numbered by their position in the write, counting
+    // blank lines, comments and newlines in quoted strings
+    let mut line_number = 1;
+    for text in split_lines(lp) {
+        match parse_lines(text).next() {
+            // blank lines and comments
+            None => {}
+            Some(Ok(line)) => lines.push((line_number, text, line)),
+            Some(Err(e)) => invalid_lines.push(WriteLineError {
+                original_line: text.to_string(),
+                line_number,
+                error_message: e.to_string(),
+                kind: WriteLineErrorKind::Parse,
+            }),
+        }
+        line_number += 1 + text.matches('\n').count();
     }
 
-    validate_or_insert_schema_and_partitions(lines, schema, partitioner, default_time)
+    let mut result =
+        validate_or_insert_schema_and_partitions(lines, schema, partitioner, default_time);
+    invalid_lines.append(&mut result.invalid_lines);
+    if invalid_lines.is_empty() {
+        // the write is buffered as it was made
+        result.valid_lp = None;
+        return Ok(result);
+    }
+    invalid_lines.sort_by_key(|line| line.line_number);
+    if !accept_partial {
+        return Err(Error::InvalidLines(invalid_lines));
+    }
+    result.invalid_lines = invalid_lines;
+    Ok(result)
 }
 
-/// Takes parsed lines, validates their schema. If new tables or columns are defined, they
-/// are passed back as a new DatabaseSchema as part of the ValidationResult. Lines are split
-/// into partitions and the validation result contains the data that can then be serialized
-/// into the WAL.
+/// Takes parsed lines, with their number and text, and validates their schema. If new tables
+/// or columns are defined, they are passed back as a new DatabaseSchema as part of the
+/// ValidationResult. Lines are split into partitions and the validation result contains the
+/// data that can then be serialized into the WAL. Lines that conflict with the schema are
+/// returned as invalid lines, and the text of the others as the valid line protocol.
 pub(crate) fn validate_or_insert_schema_and_partitions(
-    lines: Vec<ParsedLine<'_>>,
+    lines: Vec<(usize, &str, ParsedLine<'_>)>,
     schema: &DatabaseSchema,
     partitioner: &Partitioner,
     default_time: i64,
-) -> Result<ValidationResult> {
+) -> ValidationResult {
     // The (potentially updated) DatabaseSchema to return to the caller.
     let mut schema = Cow::Borrowed(schema);
 
     // The parsed and validated table_batches
     let mut table_batches: HashMap<String, TableBatch> = HashMap::new();
 
-    let line_count = lines.len();
+    let mut line_count = 0;
     let mut field_count = 0;
     let mut tag_count = 0;
+    let mut valid_lp = String::new();
+    let mut invalid_lines = vec![];
 
-    for line in lines.into_iter() {
-        field_count += line.field_set.len();
-        tag_count += line.series.tag_set.as_ref().map(|t| t.len()).unwrap_or(0);
+    for (line_number, text, line) in lines.into_iter() {
+        let fields = line.field_set.len();
+        let tags = line.series.tag_set.as_ref().map(|t| t.len()).unwrap_or(0);
 
-        validate_and_convert_parsed_line(
+        match validate_and_convert_parsed_line(
             line,
             &mut table_batches,
             &mut schema,
             partitioner,
             default_time,
-        )?;
+        ) {
+            Ok(()) => {
+                line_count += 1;
+                field_count += fields;
+                tag_count += tags;
+                valid_lp.push_str(text);
+                valid_lp.push('\n');
+            }
+            Err(e) => invalid_lines.push(WriteLineError {
+                original_line: text.to_string(),
+                line_number,
+                error_message: e.to_string(),
+                kind: WriteLineErrorKind::ColumnTypeConflict,
+            }),
+        }
     }
 
     let schema = match schema {
@@ -409,13 +480,15 @@ pub(crate) fn validate_or_insert_schema_and_partitions(
         Cow::Borrowed(_) => None,
     };
 
-    Ok(ValidationResult {
+    ValidationResult {
         schema,
         table_batches,
         line_count,
         field_count,
         tag_count,
-    })
+        valid_lp: Some(valid_lp),
+        invalid_lines,
+    }
 }
 
 // &mut Cow is used to avoid a copy, so allow it
@@ -436,17 +509,24 @@ fn validate_and_convert_parsed_line(
     match schema.tables.get(table_name) {
         Some(t) => {
             // Collect new column definitions
+            // and check the types of the existing ones, before the schema is changed
             let mut new_cols = Vec::with_capacity(line.column_count() + 1);
-            if let Some(tagset) = &line.series.tag_set {
-                for (tag_key, _) in tagset {
-                    if !t.column_exists(tag_key.as_str()) {
-                        new_cols.push((tag_key.to_string(), ColumnType::Tag as i16));
+            let tags = line.series.tag_set.iter().flatten();
+            let tags = tags.map(|(tag_key, _)| (tag_key, ColumnType::Tag));
+            let fields = line.field_set.iter();
+            let fields =
+                fields.map(|(field_name, value)| (field_name, column_type_from_field(value)));
+            for (name, new) in tags.chain(fields) {
+                match t.column_type(name.as_str()) {
+                    Some(existing) if existing != new => {
+                        return Err(Error::ColumnTypeMismatch {
+                            name: name.to_string(),
+                            existing,
+                            new,
+                        });
                     }
-                }
-            }
-            for (field_name, value) in &line.field_set {
-                if !t.column_exists(field_name.as_str()) {
-                    new_cols.push((field_name.to_string(), column_type_from_field(value) as i16));
+                    Some(_) => {}
+                    None => new_cols.push((name.to_string(), new as i16)),
                 }
             }
 
@@ -585,6 +665,10 @@ pub(crate) struct ValidationResult {
     pub(crate) field_count: usize,
     /// Number of tags passed in
     pub(crate) tag_count: usize,
+    /// The line protocol of the valid lines, if any of the lines were invalid
+    pub(crate) valid_lp: Option<String>,
+    /// The lines that could not be parsed or conflict with the schema
+    pub(crate) invalid_lines: Vec<WriteLineError>,
 }
 
 /// Generates the partition key for a given line or row
@@ -628,7 +712,7 @@ mod tests {
         let db = Arc::new(DatabaseSchema::new("foo"));
         let partitioner = Partitioner::new_per_day_partitioner();
         let lp = "cpu,region=west user=23.2 100\nfoo f1=1i";
-        let result = parse_validate_and_update_schema(lp, &db, &partitioner, 0).unwrap();
+        let result = parse_validate_and_update_schema(lp, &db, &partitioner, 0, false).unwrap();
 
         println!("result: {:#?}", result);
         let db = result.schema.unwrap();
@@ -638,6 +722,49 @@ mod tests {
         assert_eq!(db.tables.get("foo").unwrap().columns().len(), 2);
     }
 
+    #[test]
+    fn parse_lp_reports_invalid_lines() {
+        let db = Arc::new(DatabaseSchema::new("foo"));
+        let partitioner = Partitioner::new_per_day_partitioner();
+        let lp =
+            "cpu,region=west user=23.2 100\n\n# comment\ncpu user=1i 100\nnot lp\ncpu user=2.5 100";
+
+        let result = parse_validate_and_update_schema(lp, &db, &partitioner, 0, true).unwrap();
+        assert_eq!(result.line_count, 2);
+        assert_eq!(
+            result.valid_lp.as_deref(),
+            Some("cpu,region=west user=23.2 100\ncpu user=2.5 100\n")
+        );
+        let invalid: Vec<_> = result
+            .invalid_lines
+            .iter()
+            .map(|line| (line.line_number, line.original_line.as_str(), line.kind))
+            .collect();
+        assert_eq!(
+            invalid,
+            vec![
+                (4, "cpu user=1i 100", WriteLineErrorKind::ColumnTypeConflict),
+                (5, "not lp", WriteLineErrorKind::Parse),
+            ]
+        );
+        assert_eq!(
+            result.invalid_lines[0].error_message,
+            "column type mismatch for column user: existing: F64, new: I64"
+        );
+        // the conflicting line does not change the schema
+        let db = result.schema.unwrap();
+        assert_eq!(
+            db.tables.get("cpu").unwrap().column_type("user"),
+            Some(ColumnType::F64)
+        );
+
+        let err = parse_validate_and_update_schema(lp, &db, &partitioner, 0, false).unwrap_err();
+        let Error::InvalidLines(lines) = err else {
+            panic!("unexpected error: {err}");
+        };
+        assert_eq!(lines.len(), 2);
+    }
+
     #[tokio::test]
     async fn buffers_and_persists_to_wal() {
         let dir = test_helpers::tmp_dir().unwrap().into_path();
@@ -647,7 +774,12 @@ mod tests {
             WriteBufferImpl::new(catalog, Some(Arc::new(wal)), SegmentId::new(0)).unwrap();
 
         let summary = write_buffer
-            .write_lp(NamespaceName::new("foo").unwrap(), "cpu bar=1 10", 123)
+            .write_lp(
+                NamespaceName::new("foo").unwrap(),
+                "cpu bar=1 10",
+                123,
+                false,
+            )
             .await
             .unwrap();
         assert_eq!(summary.line_count, 1);
@@ -686,7 +818,8 @@ mod tests {
     pub(crate) fn lp_to_table_batches(lp: &str, default_time: i64) -> HashMap<String, TableBatch> {
         let db = Arc::new(DatabaseSchema::new("foo"));
         let partitioner = Partitioner::new_per_day_partitioner();
-        let result = parse_validate_and_update_schema(lp, &db, &partitioner, default_time).unwrap();
+        let result =
+            parse_validate_and_update_schema(lp, &db, &partitioner, default_time, false).unwrap();
 
         result.table_batches
     }
@@ -17,6 +17,7 @@ use workspace_hack as _;
 
 use crate::export::AsyncExporter;
 use crate::jaeger::JaegerAgentExporter;
+use crate::otlp::OtlpHttpExporter;
 use iox_time::SystemProvider;
 use jaeger::JaegerTag;
 use snafu::Snafu;
@@ -26,6 +27,7 @@ use std::sync::Arc;
 pub mod export;
 
 mod jaeger;
+mod otlp;
 mod rate_limiter;
 
 /// Auto-generated thrift code
@@ -49,6 +51,9 @@ mod thrift {
 /// Default header name used to export traces
 pub const DEFAULT_JAEGER_TRACE_CONTEXT_HEADER_NAME: &str = "uber-trace-id";
 
+/// Default OTLP/HTTP endpoint of a local OpenTelemetry collector
+pub const DEFAULT_OTLP_ENDPOINT: &str = "http://localhost:4318/v1/traces";
+
 /// Default header name for Influx Cloud
 pub const DEFAULT_INFLUX_TRACE_CONTEXT_HEADER_NAME: &str = "influx-trace-id";
 
@@ -57,7 +62,7 @@ pub const DEFAULT_INFLUX_TRACE_CONTEXT_HEADER_NAME: &str = "influx-trace-id";
 pub struct TracingConfig {
     /// Tracing: exporter type
     ///
-    /// Can be one of: none, jaeger
+    /// Can be one of: none, jaeger, otlp
     #[clap(
         long = "traces-exporter",
         env = "TRACES_EXPORTER",
@@ -148,6 +153,49 @@ pub struct TracingConfig {
         action
     )]
     pub traces_jaeger_max_msgs_per_second: NonZeroU64,
+
+    /// Tracing: OTLP/HTTP endpoint that spans are posted to, using the JSON
+    /// encoding.
+    ///
+    /// Only used if `--traces-exporter` is "otlp".
+    #[clap(
+        long = "traces-exporter-otlp-endpoint",
+        env = "TRACES_EXPORTER_OTLP_ENDPOINT",
+        default_value = DEFAULT_OTLP_ENDPOINT,
+        action
+    )]
+    pub traces_exporter_otlp_endpoint: String,
+
+    /// Tracing: OTLP service name.
+    ///
+    /// Only used if `--traces-exporter` is "otlp".
+    #[clap(
+        long = "traces-exporter-otlp-service-name",
+        env = "TRACES_EXPORTER_OTLP_SERVICE_NAME",
+        default_value = "influxdb3",
+        action
+    )]
+    pub traces_exporter_otlp_service_name: String,
+
+    /// Tracing: fraction of requests, between 0 and 1, that start a new trace
+    /// when they do not carry a trace context of their own.
+    ///
+    /// Requests that carry a trace context always follow its sampling decision.
+    #[clap(
+        long = "traces-sampling-ratio",
+        env = "TRACES_SAMPLING_RATIO",
+        default_value = "0",
+        value_parser = parse_sampling_ratio,
+        action
+    )]
+    pub traces_sampling_ratio: f64,
+}
+
+fn parse_sampling_ratio(s: &str) -> Result<f64, String> {
+    s.parse::<f64>()
+        .ok()
+        .filter(|r| (0.0..=1.0).contains(r))
+        .ok_or_else(|| format!("invalid sampling ratio '{s}', expected a number between 0 and 1"))
 }
 
 impl TracingConfig {
@@ -155,6 +203,7 @@ impl TracingConfig {
         match self.traces_exporter {
             TracesExporter::None => Ok(None),
             TracesExporter::Jaeger => Ok(Some(jaeger_exporter(self)?)),
+            TracesExporter::Otlp => Ok(Some(otlp_exporter(self)?)),
         }
     }
 }
@@ -163,6 +212,7 @@ impl TracingConfig {
 pub enum TracesExporter {
     None,
     Jaeger,
+    Otlp,
 }
 
 impl std::str::FromStr for TracesExporter {
@@ -172,8 +222,9 @@ impl std::str::FromStr for TracesExporter {
         match s.to_ascii_lowercase().as_str() {
             "none" => Ok(Self::None),
             "jaeger" => Ok(Self::Jaeger),
+            "otlp" => Ok(Self::Otlp),
             _ => Err(format!(
-                "Invalid traces exporter '{s}'. Valid options: none, jaeger"
+                "Invalid traces exporter '{s}'. Valid options: none, jaeger, otlp"
             )),
         }
     }
@@ -186,6 +237,9 @@ pub enum Error {
 
     #[snafu(context(false))]
     IOError { source: std::io::Error },
+
+    #[snafu(display("Failed to create OTLP client: {}", message))]
+    OtlpClient { message: String },
 }
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
@@ -227,3 +281,16 @@ fn jaeger_exporter(config: &TracingConfig) -> Result<Arc<AsyncExporter>> {
 
     Ok(Arc::new(AsyncExporter::new(jaeger)))
 }
+
+fn otlp_exporter(config: &TracingConfig) -> Result<Arc<AsyncExporter>> {
+    let mut otlp = OtlpHttpExporter::new(
+        config.traces_exporter_otlp_endpoint.trim().to_string(),
+        config.traces_exporter_otlp_service_name.clone(),
+    )?;
+
+    if let Ok(hostname) = std::env::var("HOSTNAME") {
+        otlp = otlp.with_resource_attributes([("host.name", hostname.as_str())]);
+    }
+
+    Ok(Arc::new(AsyncExporter::new(otlp)))
+}
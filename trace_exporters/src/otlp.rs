@@ -0,0 +1,227 @@
+//! Export of spans to an OpenTelemetry collector using OTLP over HTTP, with
+//! the JSON encoding.
+//!
+//! See <https://opentelemetry.io/docs/specs/otlp/#otlphttp>.
+
+use std::time::Duration;
+
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use serde_json::{json, Value};
+
+use observability_deps::tracing::*;
+use trace::ctx::{SpanId, TraceId};
+use trace::span::{MetaValue, Span, SpanEvent, SpanStatus};
+
+use crate::export::AsyncExport;
+
+/// Time allowed for the collector to accept a batch of spans.
+const EXPORT_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// `OtlpHttpExporter` receives span data and posts it to an OTLP/HTTP
+/// endpoint, such as an OpenTelemetry collector.
+///
+/// Spans that cannot be delivered are dropped and an error is logged.
+#[derive(Debug)]
+pub struct OtlpHttpExporter {
+    /// The URL spans are posted to, e.g. `http://localhost:4318/v1/traces`
+    endpoint: String,
+
+    /// Attributes describing this process, attached to every batch
+    resource: Vec<Value>,
+
+    client: reqwest::Client,
+}
+
+impl OtlpHttpExporter {
+    pub fn new(endpoint: String, service_name: String) -> super::Result<Self> {
+        info!(%endpoint, %service_name, "Creating OTLP tracing exporter");
+        let client = reqwest::Client::builder()
+            .timeout(EXPORT_TIMEOUT)
+            .build()
+            .map_err(|e| super::Error::OtlpClient {
+                message: e.to_string(),
+            })?;
+
+        Ok(Self {
+            endpoint,
+            resource: vec![attribute("service.name", &MetaValue::from(service_name))],
+            client,
+        })
+    }
+
+    /// Annotate all spans emitted by this exporter with the specified static
+    /// resource attributes.
+    pub fn with_resource_attributes<'a>(
+        mut self,
+        attributes: impl IntoIterator<Item = (&'a str, &'a str)>,
+    ) -> Self {
+        for (key, value) in attributes {
+            self.resource
+                .push(attribute(key, &MetaValue::from(value.to_string())));
+        }
+        self
+    }
+
+    fn make_request(&self, spans: Vec<Span>) -> Value {
+        json!({
+            "resourceSpans": [{
+                "resource": { "attributes": self.resource },
+                "scopeSpans": [{
+                    "scope": { "name": "influxdb" },
+                    "spans": spans.into_iter().map(encode_span).collect::<Vec<_>>(),
+                }],
+            }],
+        })
+    }
+}
+
+#[async_trait]
+impl AsyncExport for OtlpHttpExporter {
+    async fn export(&mut self, spans: Vec<Span>) {
+        let count = spans.len();
+        let body = self.make_request(spans);
+
+        let result = self
+            .client
+            .post(&self.endpoint)
+            .json(&body)
+            .send()
+            .await
+            .and_then(|response| response.error_for_status());
+        if let Err(e) = result {
+            error!(%e, endpoint=%self.endpoint, count, "error exporting spans to OTLP endpoint");
+        }
+    }
+}
+
+fn encode_span(s: Span) -> Value {
+    let mut span = json!({
+        "traceId": trace_id(s.ctx.trace_id),
+        "spanId": span_id(s.ctx.span_id),
+        "name": s.name,
+        "kind": SPAN_KIND_INTERNAL,
+        "startTimeUnixNano": nanos(s.start),
+        "endTimeUnixNano": nanos(s.end.or(s.start)),
+        "attributes": s
+            .metadata
+            .iter()
+            .map(|(k, v)| attribute(k, v))
+            .collect::<Vec<_>>(),
+        "events": s.events.iter().map(encode_event).collect::<Vec<_>>(),
+        "links": s
+            .ctx
+            .links
+            .iter()
+            .map(|(t, s)| json!({ "traceId": trace_id(*t), "spanId": span_id(*s) }))
+            .collect::<Vec<_>>(),
+        "status": { "code": status_code(s.status) },
+    });
+    if let Some(parent) = s.ctx.parent_span_id {
+        span["parentSpanId"] = span_id(parent).into();
+    }
+    span
+}
+
+fn encode_event(e: &SpanEvent) -> Value {
+    json!({
+        "timeUnixNano": nanos(Some(e.time)),
+        "name": e.msg,
+        "attributes": e
+            .metadata
+            .iter()
+            .map(|(k, v)| attribute(k, v))
+            .collect::<Vec<_>>(),
+    })
+}
+
+/// The kind of span is not tracked, so all spans are reported as internal.
+const SPAN_KIND_INTERNAL: u8 = 1;
+
+fn status_code(status: SpanStatus) -> u8 {
+    match status {
+        SpanStatus::Unknown => 0,
+        SpanStatus::Ok => 1,
+        SpanStatus::Err => 2,
+    }
+}
+
+fn attribute(key: &str, value: &MetaValue) -> Value {
+    // 64 bit integers are encoded as strings in OTLP/JSON
+    let value = match value {
+        MetaValue::String(v) => json!({ "stringValue": v }),
+        MetaValue::Float(v) => json!({ "doubleValue": v }),
+        MetaValue::Int(v) => json!({ "intValue": v.to_string() }),
+        MetaValue::Bool(v) => json!({ "boolValue": v }),
+    };
+    json!({ "key": key, "value": value })
+}
+
+fn trace_id(id: TraceId) -> String {
+    format!("{:032x}", id.get())
+}
+
+fn span_id(id: SpanId) -> String {
+    format!("{:016x}", id.get())
+}
+
+fn nanos(time: Option<DateTime<Utc>>) -> String {
+    time.and_then(|t| t.timestamp_nanos_opt())
+        .unwrap_or_default()
+        .to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use chrono::TimeZone;
+    use std::sync::Arc;
+    use trace::ctx::SpanContext;
+    use trace::RingBufferTraceCollector;
+
+    #[test]
+    fn encode() {
+        let collector = Arc::new(RingBufferTraceCollector::new(5));
+        let ctx = SpanContext::new(collector);
+        let mut root = ctx.child("IOx http_api");
+        root.start = Some(Utc.timestamp_opt(1, 500).unwrap());
+        root.end = Some(Utc.timestamp_opt(2, 0).unwrap());
+        root.ok("done");
+
+        let mut child = root.child("write_lp");
+        child.metadata.insert("lines".into(), MetaValue::Int(3));
+        child.error("parse failed");
+
+        let exporter = OtlpHttpExporter::new(
+            "http://localhost:4318/v1/traces".to_string(),
+            "influxdb3".to_string(),
+        )
+        .unwrap()
+        .with_resource_attributes([("hostname", "node-1")]);
+        let request = exporter.make_request(vec![root.clone(), child.clone()]);
+
+        let resource = &request["resourceSpans"][0]["resource"]["attributes"];
+        assert_eq!(resource[0]["key"], "service.name");
+        assert_eq!(resource[0]["value"]["stringValue"], "influxdb3");
+        assert_eq!(resource[1]["value"]["stringValue"], "node-1");
+
+        let spans = &request["resourceSpans"][0]["scopeSpans"][0]["spans"];
+        assert_eq!(
+            spans[0]["traceId"],
+            format!("{:032x}", root.ctx.trace_id.get())
+        );
+        assert_eq!(spans[0]["kind"], SPAN_KIND_INTERNAL);
+        assert_eq!(spans[0]["startTimeUnixNano"], "1000000500");
+        assert_eq!(spans[0]["endTimeUnixNano"], "2000000000");
+        assert_eq!(spans[0]["status"]["code"], 1);
+        assert_eq!(spans[0]["events"][0]["name"], "done");
+
+        assert_eq!(
+            spans[1]["parentSpanId"],
+            format!("{:016x}", root.ctx.span_id.get())
+        );
+        assert_eq!(spans[1]["attributes"][0]["key"], "lines");
+        assert_eq!(spans[1]["attributes"][0]["value"]["intValue"], "3");
+        assert_eq!(spans[1]["status"]["code"], 2);
+    }
+}
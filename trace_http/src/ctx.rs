@@ -4,6 +4,7 @@ use std::sync::Arc;
 
 use http::HeaderMap;
 use observability_deps::tracing::*;
+use rand::Rng;
 use snafu::Snafu;
 
 use trace::ctx::{SpanContext, SpanId, TraceId};
@@ -71,6 +72,8 @@ pub struct TraceHeaderParser {
     jaeger_trace_context_header_name: Option<Arc<str>>,
     /// header that forces sampling
     jaeger_debug_name: Option<Arc<str>>,
+    /// fraction of requests without a trace context that start a new trace
+    sampling_ratio: f64,
 }
 
 impl TraceHeaderParser {
@@ -96,6 +99,13 @@ impl TraceHeaderParser {
         self
     }
 
+    /// specify the fraction of requests, between 0 and 1, that start a new
+    /// trace when they do not carry a trace context
+    pub fn with_sampling_ratio(mut self, ratio: f64) -> Self {
+        self.sampling_ratio = ratio;
+        self
+    }
+
     /// Create a SpanContext for the trace described in the request's
     /// headers, if any
     ///
@@ -130,6 +140,12 @@ impl TraceHeaderParser {
             }
         }
 
+        if self.sampling_ratio > 0.0 && rand::thread_rng().gen_bool(self.sampling_ratio.min(1.0)) {
+            return Ok(Some(SpanContext::new_with_optional_collector(
+                collector.cloned(),
+            )));
+        }
+
         Ok(None)
     }
 }
@@ -583,4 +599,26 @@ mod tests {
             sampled: false,
         });
     }
+
+    #[test]
+    fn test_sampling_ratio() {
+        let collector: Arc<dyn TraceCollector> = Arc::new(trace::LogTraceCollector::new());
+        let headers = HeaderMap::new();
+
+        let parser = TraceHeaderParser::new();
+        assert!(parser.parse(Some(&collector), &headers).unwrap().is_none());
+
+        let parser = TraceHeaderParser::new().with_sampling_ratio(1.0);
+        let span = parser.parse(Some(&collector), &headers).unwrap().unwrap();
+        assert!(span.sampled);
+        assert!(span.parent_span_id.is_none());
+
+        // an incoming trace context takes precedence
+        let mut headers = HeaderMap::new();
+        headers.insert(B3_TRACE_ID_HEADER, HeaderValue::from_static("ee25f"));
+        headers.insert(B3_SPAN_ID_HEADER, HeaderValue::from_static("34e"));
+        let span = parser.parse(Some(&collector), &headers).unwrap().unwrap();
+        assert_eq!(span.trace_id.get(), 0xee25f);
+        assert!(!span.sampled);
+    }
 }
@@ -1,5 +1,7 @@
 //! Common CLI flags for logging and tracing
-use crate::{config::*, Builder};
+use crate::{config::*, Builder, Rotation, Sampling};
+use std::path::PathBuf;
+use std::time::Duration;
 use tracing_subscriber::fmt::{writer::BoxMakeWriter, MakeWriter};
 
 /// CLI config for the logging related subset of options.
@@ -14,7 +16,8 @@ pub struct LoggingConfig {
     /// Levels for different modules can be specified. For example
     /// `debug,hyper::proto::h1=info` specifies debug logging for all modules
     /// except for the `hyper::proto::h1' module which will only display info
-    /// level logging.
+    /// level logging, and `info,influxdb3_write=debug` enables debug logging
+    /// for the write buffer only.
     ///
     /// Extended syntax provided by `tracing-subscriber` includes span/field
     /// filters. See <https://docs.rs/tracing-subscriber/0.2.17/tracing_subscriber/filter/struct.EnvFilter.html> for more details.
@@ -46,8 +49,8 @@ pub struct LoggingConfig {
     /// Logs: destination
     ///
     /// Can be one of: stdout, stderr
-    //
-    // TODO(jacobmarble): consider adding file path, file rotation, syslog, ?
+    ///
+    /// Ignored if `--log-file` is set.
     #[clap(
         long = "log-destination",
         env = "LOG_DESTINATION",
@@ -57,6 +60,57 @@ pub struct LoggingConfig {
     )]
     pub log_destination: LogDestination,
 
+    /// Logs: file to write logs to, instead of `--log-destination`
+    #[clap(long = "log-file", env = "LOG_FILE", action)]
+    pub log_file: Option<PathBuf>,
+
+    /// Logs: size in bytes the log file may grow to before it is rotated
+    ///
+    /// Only used if `--log-file` is set.
+    #[clap(long = "log-file-max-size", env = "LOG_FILE_MAX_SIZE", action)]
+    pub log_file_max_size: Option<u64>,
+
+    /// Logs: age the log file may reach before it is rotated, e.g. `24h`
+    ///
+    /// Only used if `--log-file` is set.
+    #[clap(
+        long = "log-file-max-age",
+        env = "LOG_FILE_MAX_AGE",
+        value_parser = humantime::parse_duration,
+        action
+    )]
+    pub log_file_max_age: Option<Duration>,
+
+    /// Logs: number of rotated log files to keep
+    ///
+    /// Only used if `--log-file` is set.
+    #[clap(
+        long = "log-file-max-backups",
+        env = "LOG_FILE_MAX_BACKUPS",
+        default_value = "5",
+        action
+    )]
+    pub log_file_max_backups: usize,
+
+    /// Logs: number of events per second each log statement emits before
+    /// sampling starts
+    ///
+    /// Warnings and errors are never sampled. Sampling is disabled if unset.
+    #[clap(long = "log-sampling-initial", env = "LOG_SAMPLING_INITIAL", action)]
+    pub log_sampling_initial: Option<u64>,
+
+    /// Logs: once sampling starts, emit only every Nth event of a log
+    /// statement for the rest of the second
+    ///
+    /// Only used if `--log-sampling-initial` is set.
+    #[clap(
+        long = "log-sampling-thereafter",
+        env = "LOG_SAMPLING_THEREAFTER",
+        default_value = "100",
+        action
+    )]
+    pub log_sampling_thereafter: u64,
+
     #[rustfmt::skip]
     /// Logs: message format
     ///
@@ -111,13 +165,29 @@ impl LoggingConfig {
     where
         W: for<'writer> MakeWriter<'writer> + Send + Sync + Clone + 'static,
     {
-        builder
+        let builder = builder
             .with_log_filter(&self.log_filter)
             // with_verbose_count goes after with_log_filter because our CLI flag state
             // that --v overrides --log-filter.
             .with_log_verbose_count(self.log_verbose_count)
             .with_log_destination(self.log_destination)
             .with_log_format(self.log_format)
+            .with_log_sampling(self.log_sampling_initial.map(|initial| Sampling {
+                initial,
+                thereafter: self.log_sampling_thereafter,
+            }));
+
+        match &self.log_file {
+            Some(path) => builder.with_log_file(
+                path,
+                Rotation {
+                    max_size: self.log_file_max_size,
+                    max_age: self.log_file_max_age,
+                    max_backups: self.log_file_max_backups,
+                },
+            ),
+            None => builder,
+        }
     }
 }
 
@@ -17,23 +17,31 @@
 #[cfg(feature = "clap")]
 pub mod cli;
 pub mod config;
+mod rotation;
+mod sampling;
 
 pub use config::*;
+pub use rotation::Rotation;
+pub use sampling::Sampling;
 
 // Re-export tracing_subscriber
 pub use tracing_subscriber;
 
 use observability_deps::tracing::{self, Subscriber};
+use rotation::RotatingFile;
+use sampling::SamplingLayer;
 use std::{
     cmp::min,
     io::{self, IsTerminal, Write},
+    path::PathBuf,
+    sync::Arc,
 };
 use thiserror::Error;
 use tracing_subscriber::{
     fmt::{self, writer::BoxMakeWriter, MakeWriter},
     layer::SubscriberExt,
     registry::LookupSpan,
-    EnvFilter, Layer,
+    reload, EnvFilter, Layer,
 };
 
 /// Maximum length of a log line.
@@ -53,6 +61,15 @@ pub enum Error {
 
     #[error("Cannot set global log subscriber")]
     SetLoggerError(#[from] tracing_log::log_tracer::SetLoggerError),
+
+    #[error("Cannot open log file {path}: {source}")]
+    LogFile { path: PathBuf, source: io::Error },
+
+    #[error("Invalid log filter: {0}")]
+    InvalidLogFilter(#[from] tracing_subscriber::filter::ParseError),
+
+    #[error("Cannot change log filter: {0}")]
+    ReloadLogFilter(#[from] reload::Error),
 }
 
 pub type Result<T, E = Error> = std::result::Result<T, E>;
@@ -65,6 +82,9 @@ pub struct Builder<W = fn() -> io::Stdout> {
     // used when log_filter is none.
     default_log_filter: EnvFilter,
     make_writer: W,
+    // when set, logs are written to this file rather than `make_writer`.
+    log_file: Option<(PathBuf, Rotation)>,
+    log_sampling: Option<Sampling>,
     with_target: bool,
     with_ansi: bool,
 }
@@ -76,6 +96,8 @@ impl Default for Builder {
             log_filter: None,
             default_log_filter: EnvFilter::try_new(Self::DEFAULT_LOG_FILTER).unwrap(),
             make_writer: io::stdout,
+            log_file: None,
+            log_sampling: None,
             with_target: true,
             // use ansi control codes for color if connected to a TTY
             with_ansi: std::io::stdout().is_terminal(),
@@ -101,6 +123,8 @@ impl<W> Builder<W> {
             log_format: self.log_format,
             log_filter: self.log_filter,
             default_log_filter: self.default_log_filter,
+            log_file: self.log_file,
+            log_sampling: self.log_sampling,
             with_target: self.with_target,
             with_ansi: self.with_ansi,
         }
@@ -174,11 +198,30 @@ where
             log_format: self.log_format,
             log_filter: self.log_filter,
             default_log_filter: self.default_log_filter,
+            log_file: self.log_file,
+            log_sampling: self.log_sampling,
             with_target: self.with_target,
             with_ansi: self.with_ansi,
         }
     }
 
+    /// Write logs to the file at `path`, rotating it according to `rotation`,
+    /// instead of the configured writer or destination.
+    pub fn with_log_file(self, path: impl Into<PathBuf>, rotation: Rotation) -> Self {
+        Self {
+            log_file: Some((path.into(), rotation)),
+            ..self
+        }
+    }
+
+    /// Sample high volume log events, see [`Sampling`].
+    pub fn with_log_sampling(self, log_sampling: Option<Sampling>) -> Self {
+        Self {
+            log_sampling,
+            ..self
+        }
+    }
+
     /// Sets whether or not an event’s target and location are displayed.
     ///
     /// Defaults to true. See [tracing_subscriber::fmt::Layer::with_target]
@@ -204,46 +247,51 @@ where
         S: Subscriber,
         for<'a> S: LookupSpan<'a>,
     {
-        let log_writer = self.make_writer;
+        self.build_reloadable().map(|(layer, _)| layer)
+    }
+
+    /// Like [`Self::build`], also returning a [`LogFilterHandle`] that changes
+    /// the log filter of the returned layer while it is in use.
+    pub fn build_reloadable<S>(self) -> Result<(impl Layer<S> + 'static, LogFilterHandle)>
+    where
+        S: Subscriber,
+        for<'a> S: LookupSpan<'a>,
+    {
         let log_format = self.log_format;
         let with_target = self.with_target;
         let with_ansi = self.with_ansi;
 
-        let log_filter = self.log_filter.unwrap_or(self.default_log_filter);
-
-        let res: Box<dyn Layer<S> + Send + Sync> = match log_format {
-            LogFormat::Full => Box::new(
-                log_filter.and_then(
-                    fmt::layer()
-                        .with_writer(log_writer)
-                        .with_target(with_target)
-                        .with_ansi(with_ansi),
-                ),
-            ),
-            LogFormat::Pretty => Box::new(
-                log_filter.and_then(
-                    fmt::layer()
-                        .pretty()
-                        .with_writer(log_writer)
-                        .with_target(with_target)
-                        .with_ansi(with_ansi),
-                ),
-            ),
-            LogFormat::Json => Box::new(
-                log_filter.and_then(
-                    fmt::layer()
-                        .json()
-                        .with_writer(log_writer)
-                        .with_target(with_target)
-                        .with_ansi(with_ansi),
-                ),
-            ),
-            LogFormat::Logfmt => Box::new(
-                log_filter.and_then(logfmt::LogFmtLayer::new(log_writer).with_target(with_target)),
+        let (log_filter, handle) =
+            reload::Layer::new(self.log_filter.unwrap_or(self.default_log_filter));
+        let handle = LogFilterHandle::new(handle);
+
+        let res = match self.log_file {
+            Some((path, rotation)) => {
+                let file = RotatingFile::open(&path, rotation)
+                    .map_err(|source| Error::LogFile { path, source })?;
+                format_layer(
+                    log_format,
+                    log_filter,
+                    make_writer(file),
+                    with_target,
+                    with_ansi,
+                )
+            }
+            None => format_layer(
+                log_format,
+                log_filter,
+                self.make_writer,
+                with_target,
+                with_ansi,
             ),
         };
 
-        Ok(res)
+        let res: Box<dyn Layer<S> + Send + Sync> = match self.log_sampling {
+            Some(sampling) => Box::new(SamplingLayer::new(sampling).and_then(res)),
+            None => res,
+        };
+
+        Ok((res, handle))
     }
 
     /// Build a tracing subscriber and install it as a global default subscriber
@@ -257,6 +305,90 @@ where
     }
 }
 
+/// Changes the log filter of a running process, e.g. to enable debug logging
+/// of a single component while investigating a problem.
+#[derive(Clone)]
+pub struct LogFilterHandle {
+    set: Arc<dyn Fn(EnvFilter) -> Result<(), reload::Error> + Send + Sync>,
+    get: Arc<dyn Fn() -> Result<String, reload::Error> + Send + Sync>,
+}
+
+impl std::fmt::Debug for LogFilterHandle {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("LogFilterHandle").finish_non_exhaustive()
+    }
+}
+
+impl LogFilterHandle {
+    fn new<S: 'static>(handle: reload::Handle<EnvFilter, S>) -> Self {
+        let get_handle = handle.clone();
+        Self {
+            set: Arc::new(move |filter| handle.reload(filter)),
+            get: Arc::new(move || get_handle.with_current(ToString::to_string)),
+        }
+    }
+
+    /// The filter directives currently in effect.
+    pub fn current(&self) -> Result<String> {
+        Ok((self.get)()?)
+    }
+
+    /// Replace the log filter with `directives`, which use the same syntax
+    /// as `--log-filter`, e.g. `info,influxdb3_write=debug`.
+    pub fn set(&self, directives: &str) -> Result<()> {
+        let filter = EnvFilter::try_new(directives)?;
+        Ok((self.set)(filter)?)
+    }
+}
+
+/// Returns a [`Layer`] that formats events passing `log_filter` as
+/// `log_format`, writing them to `log_writer`.
+fn format_layer<S, F, W>(
+    log_format: LogFormat,
+    log_filter: F,
+    log_writer: W,
+    with_target: bool,
+    with_ansi: bool,
+) -> Box<dyn Layer<S> + Send + Sync>
+where
+    S: Subscriber,
+    for<'a> S: LookupSpan<'a>,
+    F: Layer<S> + Send + Sync + 'static,
+    W: for<'writer> MakeWriter<'writer> + Send + Sync + 'static,
+{
+    match log_format {
+        LogFormat::Full => Box::new(
+            log_filter.and_then(
+                fmt::layer()
+                    .with_writer(log_writer)
+                    .with_target(with_target)
+                    .with_ansi(with_ansi),
+            ),
+        ),
+        LogFormat::Pretty => Box::new(
+            log_filter.and_then(
+                fmt::layer()
+                    .pretty()
+                    .with_writer(log_writer)
+                    .with_target(with_target)
+                    .with_ansi(with_ansi),
+            ),
+        ),
+        LogFormat::Json => Box::new(
+            log_filter.and_then(
+                fmt::layer()
+                    .json()
+                    .with_writer(log_writer)
+                    .with_target(with_target)
+                    .with_ansi(with_ansi),
+            ),
+        ),
+        LogFormat::Logfmt => Box::new(
+            log_filter.and_then(logfmt::LogFmtLayer::new(log_writer).with_target(with_target)),
+        ),
+    }
+}
+
 /// Install a global tracing/logging subscriber.
 ///
 /// Call this function when installing a subscriber instead of calling
@@ -440,7 +572,7 @@ mod tests {
     use super::*;
 
     use crate::test_util::*;
-    use observability_deps::tracing::{debug, error};
+    use observability_deps::tracing::{debug, error, info, warn};
     use std::sync::atomic::{AtomicBool, Ordering};
     use std::sync::Arc;
 
@@ -546,6 +678,58 @@ INFO bar
         );
     }
 
+    #[test]
+    fn log_sampling() {
+        let captured = log_test(
+            Builder::new()
+                .with_log_filter(&Some("info".to_string()))
+                .with_log_sampling(Some(Sampling {
+                    initial: 2,
+                    thereafter: 3,
+                })),
+            || {
+                for i in 0..10 {
+                    info!(i, "sampled");
+                }
+                for _ in 0..2 {
+                    warn!("kept");
+                }
+            },
+        )
+        .to_string();
+
+        let sampled = captured
+            .lines()
+            .filter(|l| l.contains("sampled"))
+            .map(|l| l.rsplit_once("i=").unwrap().1)
+            .collect::<Vec<_>>();
+        assert_eq!(sampled, ["0", "1", "4", "7"]);
+        assert_eq!(captured.matches("kept").count(), 2);
+    }
+
+    #[test]
+    fn reload_log_filter() {
+        let (writer, captured) = TestWriter::new();
+        let (layer, handle) = Builder::new()
+            .with_writer(make_writer(writer))
+            .with_target(false)
+            .with_ansi(false)
+            .with_log_filter(&Some("warn".to_string()))
+            .build_reloadable()
+            .unwrap();
+        let subscriber = tracing_subscriber::Registry::default().with(layer);
+
+        tracing::subscriber::with_default(subscriber, || {
+            info!("before");
+            handle.set("info").unwrap();
+            info!("after");
+        });
+
+        assert_eq!(handle.current().unwrap(), "info");
+        assert!(handle.set("info,foo=loud").is_err());
+        assert_eq!(captured.without_timestamps(), "INFO after\n");
+    }
+
     #[test]
     fn test_side_effects() {
         let called = Arc::new(AtomicBool::new(false));
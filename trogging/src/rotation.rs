@@ -0,0 +1,241 @@
+//! A log file that is rotated when it grows too large or too old.
+
+use std::ffi::OsString;
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+use tracing_subscriber::fmt::MakeWriter;
+
+/// When a log file is rotated, and how many rotated files are kept.
+///
+/// Rotated files are renamed with a numeric suffix, `<path>.1` being the most
+/// recent; the oldest file is removed once there are more than
+/// `max_backups` of them.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Rotation {
+    /// Rotate the file before it grows beyond this many bytes.
+    pub max_size: Option<u64>,
+    /// Rotate the file once it has been written to for this long.
+    pub max_age: Option<Duration>,
+    /// Number of rotated files to keep.
+    pub max_backups: usize,
+}
+
+impl Default for Rotation {
+    fn default() -> Self {
+        Self {
+            max_size: None,
+            max_age: None,
+            max_backups: 5,
+        }
+    }
+}
+
+/// How long after a failed rotation it is retried.
+const RETRY_INTERVAL: Duration = Duration::from_secs(10);
+
+#[derive(Debug)]
+struct State {
+    file: File,
+    size: u64,
+    opened_at: Instant,
+    /// When rotating last failed, if it has failed since the last rotation
+    rotation_failed_at: Option<Instant>,
+}
+
+/// A log file that is rotated according to a [`Rotation`] policy.
+#[derive(Debug)]
+pub(crate) struct RotatingFile {
+    path: PathBuf,
+    rotation: Rotation,
+    state: Mutex<State>,
+}
+
+impl RotatingFile {
+    /// Open the log file at `path` for appending, creating it if necessary.
+    pub(crate) fn open(path: impl Into<PathBuf>, rotation: Rotation) -> io::Result<Self> {
+        let path = path.into();
+        let state = Mutex::new(open(&path)?);
+        Ok(Self {
+            path,
+            rotation,
+            state,
+        })
+    }
+
+    fn backup_path(&self, n: usize) -> PathBuf {
+        let mut name = OsString::from(self.path.as_os_str());
+        name.push(format!(".{n}"));
+        name.into()
+    }
+
+    fn should_rotate(&self, state: &State, len: usize) -> bool {
+        if state.size == 0
+            || state
+                .rotation_failed_at
+                .is_some_and(|at| at.elapsed() < RETRY_INTERVAL)
+        {
+            return false;
+        }
+        let too_large = self
+            .rotation
+            .max_size
+            .is_some_and(|max| state.size + len as u64 > max);
+        let too_old = self
+            .rotation
+            .max_age
+            .is_some_and(|max| state.opened_at.elapsed() >= max);
+        too_large || too_old
+    }
+
+    fn rotate(&self, state: &mut State) -> io::Result<()> {
+        state.file.flush()?;
+        if self.rotation.max_backups == 0 {
+            fs::remove_file(&self.path)?;
+        } else {
+            for n in (1..self.rotation.max_backups).rev() {
+                let from = self.backup_path(n);
+                if from.exists() {
+                    fs::rename(from, self.backup_path(n + 1))?;
+                }
+            }
+            fs::rename(&self.path, self.backup_path(1))?;
+        }
+        *state = open(&self.path)?;
+        Ok(())
+    }
+}
+
+fn open(path: &Path) -> io::Result<State> {
+    let file = OpenOptions::new().create(true).append(true).open(path)?;
+    let size = file.metadata()?.len();
+    Ok(State {
+        file,
+        size,
+        opened_at: Instant::now(),
+        rotation_failed_at: None,
+    })
+}
+
+impl Write for &RotatingFile {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let mut state = self.state.lock().expect("log file mutex poisoned");
+        if self.should_rotate(&state, buf.len()) {
+            // Keep logging to the current file rather than losing the line,
+            // reporting the failure once until rotating succeeds again.
+            if let Err(e) = self.rotate(&mut state) {
+                if state.rotation_failed_at.is_none() {
+                    eprintln!(
+                        "failed to rotate log file {}, retrying every {RETRY_INTERVAL:?}: {e}",
+                        self.path.display()
+                    );
+                }
+                state.rotation_failed_at = Some(Instant::now());
+            }
+        }
+        state.file.write_all(buf)?;
+        state.size += buf.len() as u64;
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.state
+            .lock()
+            .expect("log file mutex poisoned")
+            .file
+            .flush()
+    }
+}
+
+impl<'a> MakeWriter<'a> for RotatingFile {
+    type Writer = &'a Self;
+
+    fn make_writer(&'a self) -> Self::Writer {
+        self
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn read(path: impl AsRef<Path>) -> String {
+        fs::read_to_string(path).unwrap()
+    }
+
+    #[test]
+    fn rotates_by_size() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("influxdb3.log");
+        let file = RotatingFile::open(
+            &path,
+            Rotation {
+                max_size: Some(10),
+                max_age: None,
+                max_backups: 2,
+            },
+        )
+        .unwrap();
+
+        for line in ["one\n", "two\n", "three\n", "four\n", "five\n"] {
+            (&file).write_all(line.as_bytes()).unwrap();
+        }
+
+        assert_eq!(read(&path), "four\nfive\n");
+        assert_eq!(read(file.backup_path(1)), "three\n");
+        assert_eq!(read(file.backup_path(2)), "one\ntwo\n");
+        assert!(!file.backup_path(3).exists());
+    }
+
+    #[test]
+    fn rotates_by_age() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("influxdb3.log");
+        let file = RotatingFile::open(
+            &path,
+            Rotation {
+                max_size: None,
+                max_age: Some(Duration::ZERO),
+                max_backups: 0,
+            },
+        )
+        .unwrap();
+
+        (&file).write_all(b"one\n").unwrap();
+        (&file).write_all(b"two\n").unwrap();
+
+        // without backups, the rotated file is discarded
+        assert_eq!(read(&path), "two\n");
+        assert!(!file.backup_path(1).exists());
+    }
+
+    #[test]
+    fn failed_rotation_is_not_retried_on_every_write() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("influxdb3.log");
+        let file = RotatingFile::open(
+            &path,
+            Rotation {
+                max_size: Some(1),
+                max_age: None,
+                max_backups: 1,
+            },
+        )
+        .unwrap();
+        // the file cannot be renamed over a directory that is not empty
+        fs::create_dir_all(file.backup_path(1).join("blocked")).unwrap();
+
+        (&file).write_all(b"one\n").unwrap();
+        (&file).write_all(b"two\n").unwrap();
+        let failed_at = file.state.lock().unwrap().rotation_failed_at.unwrap();
+        (&file).write_all(b"three\n").unwrap();
+
+        assert_eq!(read(&path), "one\ntwo\nthree\n");
+        assert_eq!(
+            file.state.lock().unwrap().rotation_failed_at,
+            Some(failed_at)
+        );
+    }
+}
@@ -0,0 +1,61 @@
+//! Sampling of high volume log events.
+
+use observability_deps::tracing::{callsite::Identifier, Event, Level, Subscriber};
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::time::Instant;
+use tracing_subscriber::layer::{Context, Layer};
+
+/// Limits the rate at which a single log statement emits events.
+///
+/// Within each second, the first `initial` events from a log statement are
+/// emitted, then only every `thereafter`th. Warnings and errors are never
+/// dropped.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Sampling {
+    pub initial: u64,
+    pub thereafter: u64,
+}
+
+/// A [`Layer`] that drops events according to a [`Sampling`] policy.
+#[derive(Debug)]
+pub(crate) struct SamplingLayer {
+    sampling: Sampling,
+    start: Instant,
+    /// The current second and the number of events seen in it, per callsite.
+    counters: Mutex<HashMap<Identifier, (u64, u64)>>,
+}
+
+impl SamplingLayer {
+    pub(crate) fn new(sampling: Sampling) -> Self {
+        Self {
+            sampling,
+            start: Instant::now(),
+            counters: Default::default(),
+        }
+    }
+}
+
+impl<S: Subscriber> Layer<S> for SamplingLayer {
+    fn event_enabled(&self, event: &Event<'_>, _ctx: Context<'_, S>) -> bool {
+        let metadata = event.metadata();
+        if *metadata.level() <= Level::WARN {
+            return true;
+        }
+
+        let tick = self.start.elapsed().as_secs();
+        let mut counters = self.counters.lock().expect("sampling mutex poisoned");
+        let (counter_tick, count) = counters.entry(metadata.callsite()).or_insert((tick, 0));
+        if *counter_tick != tick {
+            *counter_tick = tick;
+            *count = 0;
+        }
+        *count += 1;
+
+        let Sampling {
+            initial,
+            thereafter,
+        } = self.sampling;
+        *count <= initial || (thereafter > 0 && (*count - initial) % thereafter == 0)
+    }
+}